@@ -0,0 +1,566 @@
+/*
+This file contains access control lists. Every connection is authenticated as a
+user, and every user has a set of rules saying which commands it may run, which
+keys it may access and which pub/sub channels it may use. The rules are the ones
+Redis uses, such as +@read, -debug, ~cache:* or &news.*, and are checked before
+every command runs. Connections start out as the default user, which may run
+everything and, unless requirepass is set, needs no password. For a detailed
+description of ACLs, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/security/acl/
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// User is an ACL user.
+type User struct {
+	name      string
+	enabled   bool
+	nopass    bool                // Any password is accepted
+	passwords map[string]struct{} // SHA256 digests in hex
+
+	commandRules []string // Command rules in the order they were applied
+
+	keyPatterns     []string
+	channelPatterns []string
+}
+
+// users maps the name of every user to its definition.
+var users = map[string]*User{"default": newDefaultUser()}
+
+// newUser creates a user that is disabled and can't do anything.
+func newUser(name string) *User {
+	return &User{
+		name:      name,
+		passwords: map[string]struct{}{},
+	}
+}
+
+// newDefaultUser creates the default user, which may do everything without a
+// password.
+func newDefaultUser() *User {
+	u := newUser("default")
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+// defaultUser returns the user new connections are authenticated as.
+func defaultUser() *User {
+	return users["default"]
+}
+
+// hashPassword returns the digest under which password is stored.
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword reports whether password is one of the user's passwords. The
+// digests are compared in constant time, so timing doesn't reveal how much of
+// a password was right.
+func (u *User) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+
+	given := hashPassword(password)
+	match := false
+	for digest := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(digest)) == 1 {
+			match = true
+		}
+	}
+	return match
+}
+
+// applyRule applies a single ACL rule to the user.
+func (u *User) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = map[string]struct{}{}
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = map[string]struct{}{}
+	case strings.HasPrefix(rule, ">"):
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+		u.nopass = false
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		digest := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != 2*sha256.Size {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.passwords[digest] = struct{}{}
+		u.nopass = false
+	case strings.HasPrefix(rule, "!"):
+		delete(u.passwords, strings.ToLower(rule[1:]))
+
+	case lower == "allkeys":
+		u.keyPatterns = []string{"*"}
+	case lower == "resetkeys":
+		u.keyPatterns = nil
+	case strings.HasPrefix(rule, "~"):
+		u.keyPatterns = append(u.keyPatterns, rule[1:])
+	case lower == "allchannels":
+		u.channelPatterns = []string{"*"}
+	case lower == "resetchannels":
+		u.channelPatterns = nil
+	case strings.HasPrefix(rule, "&"):
+		u.channelPatterns = append(u.channelPatterns, rule[1:])
+
+	case lower == "allcommands":
+		return u.applyRule("+@all")
+	case lower == "nocommands":
+		return u.applyRule("-@all")
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		return u.applyCommandRule(lower)
+
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.applyRule(r)
+		}
+
+	default:
+		return fmt.Errorf("Syntax error")
+	}
+
+	return nil
+}
+
+// applyCommandRule applies a rule allowing or denying a command or a category,
+// such as +get or -@dangerous.
+func (u *User) applyCommandRule(rule string) error {
+	name := rule[1:]
+
+	if strings.HasPrefix(name, "@") {
+		if name != "@all" && commandsInCategory(name[1:]) == nil {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+	} else if _, ok := originalCommands[strings.ToUpper(name)]; !ok {
+		return fmt.Errorf("Unknown command or category name in ACL")
+	}
+
+	// Allowing or denying everything makes the earlier rules irrelevant
+	if name == "@all" {
+		u.commandRules = nil
+	}
+	u.commandRules = append(u.commandRules, rule)
+
+	return nil
+}
+
+// mayRun reports whether the user may run cmd. The rules are evaluated in the
+// order they were applied, the last one matching the command wins.
+func (u *User) mayRun(cmd *Command) bool {
+	allowed := false
+	for _, rule := range u.commandRules {
+		name := rule[1:]
+
+		matches := name == cmd.name || name == "@all"
+		if !matches && strings.HasPrefix(name, "@") {
+			for _, category := range cmd.aclCategories() {
+				if category == name {
+					matches = true
+					break
+				}
+			}
+		}
+
+		if matches {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// commandsInCategory returns the names of the commands in category, or nil if
+// the category doesn't exist.
+func commandsInCategory(category string) []string {
+	names := []string{}
+	found := category == "all"
+
+	for _, cmd := range originalCommands {
+		if category == "all" {
+			names = append(names, cmd.name)
+			continue
+		}
+		for _, c := range cmd.aclCategories() {
+			if c == "@"+category {
+				names = append(names, cmd.name)
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	sort.Strings(names)
+	return names
+}
+
+// aclCategoryNames returns the names of every category, without the @.
+func aclCategoryNames() []string {
+	seen := map[string]bool{}
+	for _, cmd := range originalCommands {
+		for _, c := range cmd.aclCategories() {
+			seen[strings.TrimPrefix(c, "@")] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describeCommands returns the command rules of the user.
+func (u *User) describeCommands() string {
+	// Everything not allowed by a rule is denied
+	rules := u.commandRules
+	if len(rules) == 0 || rules[0][1:] != "@all" {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(rules, " ")
+}
+
+// describeKeys returns the key patterns of the user as rules.
+func (u *User) describeKeys() string {
+	rules := make([]string, 0, len(u.keyPatterns))
+	for _, pattern := range u.keyPatterns {
+		rules = append(rules, "~"+pattern)
+	}
+	return strings.Join(rules, " ")
+}
+
+// describeChannels returns the channel patterns of the user as rules.
+func (u *User) describeChannels() string {
+	if len(u.channelPatterns) == 0 {
+		return "resetchannels"
+	}
+
+	rules := make([]string, 0, len(u.channelPatterns))
+	for _, pattern := range u.channelPatterns {
+		rules = append(rules, "&"+pattern)
+	}
+	return strings.Join(rules, " ")
+}
+
+// describe returns the rules that recreate the user, as listed by ACL LIST.
+func (u *User) describe() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, digest := range u.sortedPasswords() {
+		parts = append(parts, "#"+digest)
+	}
+	if keys := u.describeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	parts = append(parts, u.describeChannels(), u.describeCommands())
+
+	return strings.Join(parts, " ")
+}
+
+// sortedPasswords returns the password digests of the user in order.
+func (u *User) sortedPasswords() []string {
+	digests := make([]string, 0, len(u.passwords))
+	for digest := range u.passwords {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+// matchesAny reports whether s matches one of the glob-style patterns.
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if stringMatch(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclCheck checks whether the client may run the command in argv. It returns
+// the NOPERM error to reply with, or nil if the command is allowed, logging
+// the denial in the ACL log. Fake
+// clients, like the one replaying the AOF, have no user and may run anything.
+// The caller must hold execMu.
+func aclCheck(c *Client, cmd *Command, argv []Value) *Value {
+	u := c.user
+	if u == nil {
+		return nil
+	}
+
+	if !u.mayRun(cmd) {
+		aclLogDenial(c, "command", cmd.name, u.name)
+		return &Value{typ: ValueTypSimpleError, str: fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", u.name, cmd.name)}
+	}
+
+	for _, pos := range cmd.keyPositions(argv) {
+		if !matchesAny(u.keyPatterns, argv[pos].bulk) {
+			aclLogDenial(c, "key", argv[pos].bulk, u.name)
+			return &Value{typ: ValueTypSimpleError, str: "NOPERM No permissions to access a key"}
+		}
+	}
+
+	for _, channel := range commandChannels(cmd, argv) {
+		if !u.mayUseChannel(cmd, channel) {
+			aclLogDenial(c, "channel", channel, u.name)
+			return &Value{typ: ValueTypSimpleError, str: "NOPERM No permissions to access a channel"}
+		}
+	}
+
+	return nil
+}
+
+// hasAllKeys reports whether the user may access every key, which commands
+// reading keys named by patterns rather than arguments, like SORT BY, require.
+// Fake clients have no user and may.
+func (u *User) hasAllKeys() bool {
+	return u == nil || slices.Contains(u.keyPatterns, "*")
+}
+
+// mayUseChannel reports whether the user may use channel with cmd. A pattern
+// subscription is only allowed if the pattern is literally one of the user's,
+// since it could match channels the user has no access to otherwise.
+func (u *User) mayUseChannel(cmd *Command, channel string) bool {
+	if cmd.name == "psubscribe" {
+		for _, pattern := range u.channelPatterns {
+			if pattern == "*" || pattern == channel {
+				return true
+			}
+		}
+		return false
+	}
+	return matchesAny(u.channelPatterns, channel)
+}
+
+// commandChannels returns the pub/sub channels or patterns used by argv.
+func commandChannels(cmd *Command, argv []Value) []string {
+	channels := []string{}
+	switch cmd.name {
+	case "subscribe", "psubscribe", "ssubscribe":
+		for _, arg := range argv[1:] {
+			channels = append(channels, arg.bulk)
+		}
+	case "publish", "spublish":
+		channels = append(channels, argv[1].bulk)
+	}
+	return channels
+}
+
+// aclCommand handles the ACL command.
+func aclCommand(c *Client, args []Value) Value {
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "SETUSER":
+		if len(args) < 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|setuser' command"}
+		}
+		return aclSetUser(args[1].bulk, args[2:])
+
+	case "GETUSER":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|getuser' command"}
+		}
+		u, ok := users[args[1].bulk]
+		if !ok {
+			return Value{typ: ValueTypNullArray}
+		}
+		return u.value()
+
+	case "DELUSER":
+		if len(args) < 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|deluser' command"}
+		}
+		return aclDelUser(args[1:])
+
+	case "LIST":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|list' command"}
+		}
+		result := []Value{}
+		for _, name := range userNames() {
+			result = append(result, bulkValue(users[name].describe()))
+		}
+		return Value{typ: ValueTypArray, array: result}
+
+	case "USERS":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|users' command"}
+		}
+		result := []Value{}
+		for _, name := range userNames() {
+			result = append(result, bulkValue(name))
+		}
+		return Value{typ: ValueTypArray, array: result}
+
+	case "WHOAMI":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|whoami' command"}
+		}
+		return bulkValue(c.user.name)
+
+	case "LOG":
+		return aclLog(args[1:])
+
+	case "CAT":
+		if len(args) > 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|cat' command"}
+		}
+		names := aclCategoryNames()
+		if len(args) == 2 {
+			names = commandsInCategory(strings.ToLower(args[1].bulk))
+			if names == nil {
+				return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unknown category '%s'", args[1].bulk)}
+			}
+		}
+		result := make([]Value, 0, len(names))
+		for _, name := range names {
+			result = append(result, bulkValue(name))
+		}
+		return Value{typ: ValueTypArray, array: result}
+
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", args[0].bulk)}
+	}
+}
+
+// aclSetUser handles the ACL SETUSER subcommand. The rules are applied to a copy
+// of the user, so either all of them take effect or none does.
+func aclSetUser(name string, rules []Value) Value {
+	u := newUser(name)
+	if existing, ok := users[name]; ok {
+		u = existing.clone()
+	}
+
+	for _, rule := range rules {
+		if err := u.applyRule(rule.bulk); err != nil {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %s", rule.bulk, err)}
+		}
+	}
+
+	// Connections authenticated as the user see the new rules right away
+	if existing, ok := users[name]; ok {
+		*existing = *u
+	} else {
+		users[name] = u
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// aclDelUser handles the ACL DELUSER subcommand. Connections authenticated as
+// a deleted user are closed.
+func aclDelUser(names []Value) Value {
+	for _, name := range names {
+		if name.bulk == "default" {
+			return Value{typ: ValueTypSimpleError, str: "ERR The 'default' user cannot be removed"}
+		}
+	}
+
+	deleted := 0
+	for _, name := range names {
+		u, ok := users[name.bulk]
+		if !ok {
+			continue
+		}
+		delete(users, name.bulk)
+		deleted++
+
+		clientsMu.RLock()
+		for _, client := range clients {
+			if client.user == u {
+				client.conn.Close()
+			}
+		}
+		clientsMu.RUnlock()
+	}
+
+	return Value{typ: ValueTypInteger, num: deleted}
+}
+
+// clone returns a copy of the user that can be changed independently.
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = map[string]struct{}{}
+	for digest := range u.passwords {
+		c.passwords[digest] = struct{}{}
+	}
+	c.commandRules = append([]string{}, u.commandRules...)
+	c.keyPatterns = append([]string{}, u.keyPatterns...)
+	c.channelPatterns = append([]string{}, u.channelPatterns...)
+	return &c
+}
+
+// value builds the ACL GETUSER reply for the user.
+func (u *User) value() Value {
+	flags := []Value{}
+	if u.enabled {
+		flags = append(flags, bulkValue("on"))
+	} else {
+		flags = append(flags, bulkValue("off"))
+	}
+	if u.nopass {
+		flags = append(flags, bulkValue("nopass"))
+	}
+
+	passwords := []Value{}
+	for _, digest := range u.sortedPasswords() {
+		passwords = append(passwords, bulkValue(digest))
+	}
+
+	channels := ""
+	if len(u.channelPatterns) > 0 {
+		channels = u.describeChannels()
+	}
+
+	return Value{typ: ValueTypMap, array: []Value{
+		bulkValue("flags"), {typ: ValueTypArray, array: flags},
+		bulkValue("passwords"), {typ: ValueTypArray, array: passwords},
+		bulkValue("commands"), bulkValue(u.describeCommands()),
+		bulkValue("keys"), bulkValue(u.describeKeys()),
+		bulkValue("channels"), bulkValue(channels),
+		bulkValue("selectors"), {typ: ValueTypArray, array: []Value{}},
+	}}
+}
+
+// userNames returns the names of every user in order.
+func userNames() []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
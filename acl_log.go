@@ -0,0 +1,126 @@
+/*
+This file contains the ACL log, which records the operations ACLs denied so
+operators can find out why a client gets NOPERM errors. Each entry says whether
+a command, a key, a channel or a password was refused, which user and client
+asked and when. Repeated denials of the same thing are counted in one entry
+instead of filling up the log. For a detailed description of the log, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/commands/acl-log/
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclLogGroupingWindow is how long after its last update an entry still
+// absorbs identical denials.
+const aclLogGroupingWindow = 60 * time.Second
+
+// aclLogEntry is a denied operation in the ACL log.
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string // command, key, channel or auth
+	context    string // toplevel, multi or lua
+	object     string // Command, key or channel that was refused
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// aclLogEntries holds the log, newest entry first. Denials are logged while
+// commands hold execMu for reading, so the log has a lock of its own.
+var aclLogEntries = []*aclLogEntry{}
+var aclLogNextID int64
+var aclLogMu = sync.Mutex{}
+
+// aclLogDenial adds a denial to the log, or counts it in an entry for the same
+// denial if there is a recent one.
+func aclLogDenial(c *Client, reason, object, username string) {
+	context := "toplevel"
+	if c.conn == nil {
+		context = "lua"
+	} else if c.tx.active {
+		context = "multi"
+	}
+
+	aclLogMu.Lock()
+	defer aclLogMu.Unlock()
+
+	now := time.Now()
+	for _, e := range aclLogEntries {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username &&
+			now.Sub(e.updated) < aclLogGroupingWindow {
+			e.count++
+			e.updated = now
+			e.clientInfo = c.info()
+			return
+		}
+	}
+
+	aclLogEntries = append([]*aclLogEntry{{
+		id:         aclLogNextID,
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: c.info(),
+		created:    now,
+		updated:    now,
+	}}, aclLogEntries...)
+	aclLogNextID++
+
+	if len(aclLogEntries) > config.acllogMaxLen {
+		aclLogEntries = aclLogEntries[:config.acllogMaxLen]
+	}
+}
+
+// aclLog handles the ACL LOG subcommand.
+func aclLog(args []Value) Value {
+	aclLogMu.Lock()
+	defer aclLogMu.Unlock()
+
+	count := len(aclLogEntries)
+	if len(args) > 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'acl|log' command"}
+	}
+	if len(args) == 1 {
+		if strings.ToUpper(args[0].bulk) == "RESET" {
+			aclLogEntries = []*aclLogEntry{}
+			return Value{typ: ValueTypSimpleString, str: "OK"}
+		}
+
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is out of range, must be positive"}
+		}
+		count = min(n, count)
+	}
+
+	now := time.Now()
+	result := make([]Value, 0, count)
+	for _, e := range aclLogEntries[:count] {
+		age := now.Sub(e.created).Seconds()
+		result = append(result, Value{typ: ValueTypMap, array: []Value{
+			bulkValue("count"), {typ: ValueTypInteger, num: e.count},
+			bulkValue("reason"), bulkValue(e.reason),
+			bulkValue("context"), bulkValue(e.context),
+			bulkValue("object"), bulkValue(e.object),
+			bulkValue("username"), bulkValue(e.username),
+			bulkValue("age-seconds"), bulkValue(strconv.FormatFloat(age, 'f', 3, 64)),
+			bulkValue("client-info"), bulkValue(e.clientInfo),
+			bulkValue("entry-id"), {typ: ValueTypInteger, num: int(e.id)},
+			bulkValue("timestamp-created"), {typ: ValueTypInteger, num: int(e.created.UnixMilli())},
+			bulkValue("timestamp-last-updated"), {typ: ValueTypInteger, num: int(e.updated.UnixMilli())},
+		}})
+	}
+	return Value{typ: ValueTypArray, array: result}
+}
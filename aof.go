@@ -1,9 +1,16 @@
 /*
 This file contains the basic implementation of an append-only file for persistent
 storage. It ensures data durability by appending commands to a file and syncing
-it to disk. The file is synced every second to minimize data loss in case of
-a crash. For a detailed description of the AOF persistence mode, refer to the
-Redis documentation:
+it to disk. Commands are first appended to a buffer in memory, which a background
+goroutine writes to the file, so a slow disk doesn't slow down every write
+command. How often the file is synced is the appendfsync policy: "always"
+syncs before the replies of the clients are sent, so every write is on disk
+once it's acknowledged, and the writes of all the commands run meanwhile share
+a single sync; "everysec" syncs once a second if anything was written, losing
+at most a second of writes in case of a crash, and "no" leaves it to the
+operating system. The commands are appended to the last incremental file of the
+multi-part AOF, described in aof_manifest.go. For a detailed description of the
+AOF persistence mode, refer to the Redis documentation:
 
 https://redis.io/docs/latest/operate/oss_and_stack/management/persistence/
 */
@@ -12,88 +19,578 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Policies of appendfsync
+const (
+	aofFsyncAlways   = "always"
+	aofFsyncEverysec = "everysec"
+	aofFsyncNo       = "no"
+)
+
+// aofTimestampPrefix starts the timestamp annotations written to the AOF with
+// aof-timestamp-enabled, followed by the Unix time in seconds.
+const aofTimestampPrefix = "#TS:"
+
+// aofFsync is the appendfsync policy. It's read by the sync goroutine outside of
+// execMu, so it's atomic.
+var aofFsync atomic.Value
+
+// serverAof is the AOF of the running server, for commands that execute other
+// commands, such as scripts.
+var serverAof *Aof
+
 type Aof struct {
-	file *os.File
-	rd   *bufio.Reader
-	mu   sync.Mutex
+	dir  string // The appenddirname directory holding the files
+	name string // The appendfilename the files are named after
+
+	// fileMu serializes the writes and syncs of the file, mu guards the rest,
+	// so commands can be buffered while the file is being written. When both
+	// are needed fileMu is locked first.
+	fileMu   sync.Mutex
+	mu       sync.Mutex
+	manifest *aofManifest // Guarded by fileMu
+	file     *os.File     // The incremental file appended to, guarded by fileMu
+	unsynced bool         // Whether anything was written since the last sync, guarded by fileMu
+
+	// Offsets in all the commands ever appended: the end of the ones buffered,
+	// guarded by mu, and of the ones written to the file and synced to disk,
+	// guarded by fileMu
+	appendOff  int64
+	writtenOff int64
+	syncOff    int64
+
+	buf     []byte        // Commands waiting to be written to the file
+	flushCh chan struct{} // Wakes up the writer goroutine
+	db      int           // Database selected by the last SELECT buffered, -1 if unknown
+
+	// lastTimestamp is the Unix time of the last timestamp annotation buffered,
+	// 0 if there's none in the incremental file
+	lastTimestamp int64
+
+	// writeErr is the error of the last write or sync, nil if it succeeded
+	writeErr error
+
+	size     int64 // Current size of all the files, including the buffered commands
+	baseSize int64 // Size after the last rewrite, or at startup
+	incrSize int64 // Size of the incremental file appended to
+
+	rewriting     bool
+	rewrites      int
+	lastRewriteOK bool
 }
 
-// NewAof creates a new Aof instance and starts a goroutine to sync the file to disk every second.
-func NewAof(path string) (*Aof, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+// NewAof creates a new Aof instance for the files named name in dir, reading
+// their manifest. The files are only appended to once Open is called, after
+// they're read.
+func NewAof(dir, name string) (*Aof, error) {
+	if filepath.Base(name) != name {
+		return nil, fmt.Errorf("appendfilename %q can't contain a path", name)
+	}
+
+	manifest, err := loadAofManifest(dir, name)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't load the manifest: %w", err)
 	}
 
 	aof := &Aof{
-		file: f,
-		rd:   bufio.NewReader(f),
+		dir:           dir,
+		name:          name,
+		manifest:      manifest,
+		flushCh:       make(chan struct{}, 1),
+		db:            -1,
+		lastRewriteOK: true,
 	}
 
-	// Start a goroutine to sync AOF to disk every second
-	go aof.periodicSync()
+	for _, f := range manifest.files() {
+		info, err := os.Stat(aof.filePath(f.name))
+		if err != nil {
+			return nil, err
+		}
+		aof.size += info.Size()
+	}
+	aof.baseSize = aof.size
 
 	return aof, nil
 }
 
-// periodicSync syncs the AOF file to disk every second.
+// Open opens the last incremental file for appending, creating one if there's
+// none, and starts the goroutines that write the buffered commands to it and
+// sync it to disk.
+func (aof *Aof) Open() error {
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	if incrs := aof.manifest.incrs; len(incrs) > 0 {
+		last := incrs[len(incrs)-1]
+		f, err := os.OpenFile(aof.filePath(last.name), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		aof.file = f
+		aof.incrSize = info.Size()
+	} else {
+		f, err := aof.openNewIncr()
+		if err != nil {
+			return err
+		}
+		aof.file = f
+	}
+
+	go aof.flushLoop()
+
+	// Start a goroutine to sync AOF to disk every second, if the policy asks
+	go aof.periodicSync()
+
+	return nil
+}
+
+// openNewIncr creates the next incremental file and adds it to the manifest.
+// The caller must hold fileMu.
+func (aof *Aof) openNewIncr() (*os.File, error) {
+	seq := aof.manifest.nextIncrSeq()
+	name := fmt.Sprintf("%s.%d.incr.aof", aof.name, seq)
+
+	f, err := os.OpenFile(aof.filePath(name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := *aof.manifest
+	manifest.incrs = append(append([]aofFile{}, manifest.incrs...), aofFile{name: name, seq: seq, typ: aofFileIncr})
+	if err := manifest.persist(aof.dir, aof.name); err != nil {
+		f.Close()
+		os.Remove(aof.filePath(name))
+		return nil, err
+	}
+	aof.manifest = &manifest
+
+	return f, nil
+}
+
+// filePath returns the path of the file of the AOF named name.
+func (aof *Aof) filePath(name string) string {
+	return filepath.Join(aof.dir, name)
+}
+
+// flushLoop writes the buffered commands to the file whenever there are some,
+// so a slow disk doesn't delay the commands themselves.
+func (aof *Aof) flushLoop() {
+	for range aof.flushCh {
+		aof.fileMu.Lock()
+		aof.flush()
+		aof.fileMu.Unlock()
+	}
+}
+
+// flush writes the buffered commands to the file. What couldn't be written
+// stays buffered, to be retried. The caller must hold fileMu.
+func (aof *Aof) flush() error {
+	aof.mu.Lock()
+	chunk, end := aof.buf, aof.appendOff
+	aof.buf = nil
+	aof.mu.Unlock()
+
+	if len(chunk) == 0 {
+		return nil
+	}
+
+	n, err := aof.file.Write(chunk)
+	if n > 0 {
+		aof.unsynced = true
+	}
+	if err == nil {
+		aof.writtenOff = end
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.writeErr = err
+	if err != nil {
+		aof.buf = append(chunk[n:], aof.buf...)
+	}
+	return err
+}
+
+// sync syncs the file to disk. The caller must hold fileMu.
+func (aof *Aof) sync() error {
+	err := aof.file.Sync()
+	aof.unsynced = err != nil
+	if err == nil {
+		aof.syncOff = aof.writtenOff
+	}
+	return err
+}
+
+// periodicSync flushes the buffered commands every second, retrying the ones
+// that failed to be written, and syncs the file to disk when something was
+// written since the last sync, unless the policy is no. With always this syncs
+// the writes no client waits for, like the ones of the master of a replica.
 func (aof *Aof) periodicSync() {
 	for {
 		time.Sleep(time.Second)
 
+		aof.fileMu.Lock()
+		if aof.flush() != nil || aofFsync.Load() == aofFsyncNo || !aof.unsynced {
+			aof.fileMu.Unlock()
+			continue
+		}
+
+		start := time.Now()
+		err := aof.sync()
+		latencyAddSampleIfNeeded("aof-fsync", time.Since(start))
+		aof.fileMu.Unlock()
+
 		aof.mu.Lock()
-		aof.file.Sync()
+		aof.writeErr = err
 		aof.mu.Unlock()
 	}
 }
 
-// Close closes the AOF file.
+// Close writes the buffered commands, syncs the AOF file to disk and closes it.
 func (aof *Aof) Close() error {
-	aof.mu.Lock()
-	defer aof.mu.Unlock()
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
 
+	if err := aof.flush(); err != nil {
+		aof.file.Close()
+		return err
+	}
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return err
+	}
 	return aof.file.Close()
 }
 
-// Write writes a RESP value to the AOF file.
-func (aof *Aof) Write(value Value) error {
+// Write appends a RESP value to the AOF, preceded by a SELECT if the command
+// runs against a different database than the previous one, and with
+// aof-timestamp-enabled by a timestamp annotation once a second. The value is
+// buffered and written by the writer goroutine, and with the policy always
+// synced before the client replies, see Sync. It returns the offset the AOF
+// must be synced up to for the value to be on disk. Writes are refused while
+// the last one failed, since they would be lost.
+func (aof *Aof) Write(db int, value Value) (int64, error) {
 	aof.mu.Lock()
-	defer aof.mu.Unlock()
+	if aof.writeErr != nil {
+		err := aof.writeErr
+		aof.mu.Unlock()
+		return 0, err
+	}
 
-	_, err := aof.file.Write(value.Marshal())
-	if err != nil {
+	start := len(aof.buf)
+	if now := time.Now().Unix(); config.aofTimestampEnabled && now != aof.lastTimestamp {
+		aof.buf = append(aof.buf, aofTimestampPrefix+strconv.FormatInt(now, 10)+"\r\n"...)
+		aof.lastTimestamp = now
+	}
+	if db != aof.db {
+		aof.buf = append(aof.buf, aofSelect(db)...)
+		aof.db = db
+	}
+	aof.buf = value.MarshalTo(aof.buf)
+	aof.size += int64(len(aof.buf) - start)
+	aof.incrSize += int64(len(aof.buf) - start)
+	aof.appendOff += int64(len(aof.buf) - start)
+	off := aof.appendOff
+	aof.mu.Unlock()
+
+	select {
+	case aof.flushCh <- struct{}{}:
+	default:
+		// The writer goroutine is already due to run
+	}
+	return off, nil
+}
+
+// Sync returns once the commands appended up to off are synced to disk,
+// writing and syncing every command appended so far if they aren't yet. The
+// callers waiting meanwhile are likely served by the same sync.
+func (aof *Aof) Sync(off int64) error {
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	if aof.syncOff >= off {
+		return nil
+	}
+	if err := aof.flush(); err != nil {
 		return err
 	}
 
+	start := time.Now()
+	err := aof.sync()
+	latencyAddSampleIfNeeded("aof-fsync-always", time.Since(start))
+
+	aof.mu.Lock()
+	aof.writeErr = err
+	aof.mu.Unlock()
+
+	return err
+}
+
+// aofSyncedConn is the connection of a client as its replies are written to.
+// With the policy always the writes of the client are synced to the AOF before
+// anything is sent, so the writes of a pipeline are acknowledged after a single
+// sync, shared with the other clients replying meanwhile. If the sync fails the
+// connection is closed, since the writes it would acknowledge may be lost.
+type aofSyncedConn struct {
+	net.Conn
+	client *Client
+}
+
+func (c aofSyncedConn) Write(p []byte) (int, error) {
+	if err := c.syncWrites(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// WriteBuffers writes bufs with a single vectored write, once the writes of the
+// client are synced.
+func (c aofSyncedConn) WriteBuffers(bufs *net.Buffers) (int64, error) {
+	if err := c.syncWrites(); err != nil {
+		return 0, err
+	}
+	return bufs.WriteTo(c.Conn)
+}
+
+// syncWrites syncs the writes of the client to the AOF with the policy always,
+// closing the connection if that fails.
+func (c aofSyncedConn) syncWrites() error {
+	// The offset is only set once the AOF is open
+	if off := c.client.aofOff.Load(); off > 0 && aofFsync.Load() == aofFsyncAlways {
+		if err := serverAof.Sync(off); err != nil {
+			fmt.Println("Error syncing the AOF before replying:", err)
+			c.Conn.Close()
+			return err
+		}
+	}
 	return nil
 }
 
-// Read reads all RESP values from the AOF file and applies the provided function to each value.
-func (aof *Aof) Read(fn func(value Value)) error {
+// aofAbsoluteExpire returns value with a relative time to live turned into an
+// absolute expiration time, so replaying the AOF later doesn't give the key a
+// fresh time to live. EXPIRE, PEXPIRE and EXPIREAT become PEXPIREAT, SETEX and
+// PSETEX become SET with PXAT, as do the EX, PX and EXAT options of SET, and
+// RESTORE, along with RESTORE-ASKING sent by MIGRATE, takes ABSTTL.
+func aofAbsoluteExpire(value Value) Value {
+	args := value.array
+	if len(args) < 3 {
+		return value
+	}
+	switch strings.ToUpper(args[0].bulk) {
+	case "RESTORE", "RESTORE-ASKING":
+		return aofRestoreAbsoluteExpire(value)
+	case "SET":
+		return aofSetAbsoluteExpire(value)
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		return aofExpireAbsolute(value)
+	case "SETEX", "PSETEX":
+		return aofSetexAbsolute(value)
+	}
+	return value
+}
+
+// aofRestoreAbsoluteExpire returns RESTORE with its time to live turned into
+// an absolute time with ABSTTL.
+func aofRestoreAbsoluteExpire(value Value) Value {
+	args := value.array
+	if len(args) < 4 {
+		return value
+	}
+	ttl, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil || ttl <= 0 {
+		return value
+	}
+	for _, arg := range args[4:] {
+		if strings.ToUpper(arg.bulk) == "ABSTTL" {
+			return value
+		}
+	}
+
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Millisecond).UnixMilli()
+	translated := append([]Value{}, args...)
+	translated[2] = bulkValue(strconv.FormatInt(expireAt, 10))
+	translated = append(translated, bulkValue("ABSTTL"))
+	return Value{typ: ValueTypArray, array: translated}
+}
+
+// aofExpireAbsolute returns EXPIRE, PEXPIRE or EXPIREAT as PEXPIREAT, keeping
+// its options.
+func aofExpireAbsolute(value Value) Value {
+	args := value.array
+	n, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil || n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+		return value
+	}
+
+	var expireAt int64
+	switch strings.ToUpper(args[0].bulk) {
+	case "EXPIRE":
+		expireAt = time.Now().UnixMilli() + n*1000
+	case "PEXPIRE":
+		expireAt = time.Now().UnixMilli() + n
+	case "EXPIREAT":
+		expireAt = n * 1000
+	}
+
+	translated := append([]Value{bulkValue("PEXPIREAT"), args[1], bulkValue(strconv.FormatInt(expireAt, 10))}, args[3:]...)
+	return Value{typ: ValueTypArray, array: translated}
+}
+
+// aofSetexAbsolute returns SETEX or PSETEX as SET with PXAT.
+func aofSetexAbsolute(value Value) Value {
+	args := value.array
+	if len(args) != 4 {
+		return value
+	}
+	n, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/1000 {
+		return value
+	}
+
+	if strings.ToUpper(args[0].bulk) == "SETEX" {
+		n *= 1000
+	}
+	expireAt := time.Now().UnixMilli() + n
+	return Value{typ: ValueTypArray, array: []Value{bulkValue("SET"), args[1], args[3], bulkValue("PXAT"), bulkValue(strconv.FormatInt(expireAt, 10))}}
+}
+
+// aofSetAbsoluteExpire returns SET with its EX, PX or EXAT option turned into
+// PXAT, the way Redis replicates it.
+func aofSetAbsoluteExpire(value Value) Value {
+	args := value.array
+	for i := 3; i+1 < len(args); i++ {
+		n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+		if err != nil || n <= 0 || n > math.MaxInt64/1000 {
+			continue
+		}
+
+		var expireAt int64
+		switch strings.ToUpper(args[i].bulk) {
+		case "EX":
+			expireAt = time.Now().Add(time.Duration(n) * time.Second).UnixMilli()
+		case "PX":
+			expireAt = time.Now().Add(time.Duration(n) * time.Millisecond).UnixMilli()
+		case "EXAT":
+			expireAt = n * 1000
+		default:
+			continue
+		}
+
+		translated := append([]Value{}, args...)
+		translated[i] = bulkValue("PXAT")
+		translated[i+1] = bulkValue(strconv.FormatInt(expireAt, 10))
+		return Value{typ: ValueTypArray, array: translated}
+	}
+	return value
+}
+
+// aofSelect returns the SELECT command for database db, encoded as written
+// to the AOF.
+func aofSelect(db int) []byte {
+	return Value{typ: ValueTypArray, array: []Value{bulkValue("SELECT"), bulkValue(strconv.Itoa(db))}}.Marshal()
+}
+
+// WriteOK reports whether the last write or sync of the AOF succeeded.
+func (aof *Aof) WriteOK() bool {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	aof.file.Seek(0, io.SeekStart)
+	return aof.writeErr == nil
+}
 
-	reader := NewResp(aof.file)
+// Read reads all RESP values from the files of the AOF, in the order of the
+// manifest, and applies the provided function to each value. It returns the
+// file where reading stopped and the offset just past the last complete command
+// in it, along with the error of scanAof. Only the last file may end in the
+// middle of a command, as the others were complete when the next one started.
+func (aof *Aof) Read(fn func(value Value)) (string, int64, error) {
+	aof.fileMu.Lock()
+	files := aof.manifest.files()
+	aof.fileMu.Unlock()
 
-	for {
-		value, err := reader.Read()
+	for i, f := range files {
+		loadingNextFile()
+		valid, err := readAofFile(aof.filePath(f.name), fn)
+		if errors.Is(err, io.ErrUnexpectedEOF) && i < len(files)-1 {
+			err = fmt.Errorf("%w: %s is truncated but isn't the last file", errBadAofFormat, f.name)
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+			return f.name, valid, err
 		}
+	}
+	return "", 0, nil
+}
+
+// readAofFile reads the RESP values of the AOF file at path, applying fn to
+// each. An RDB preamble, written by a rewrite, is loaded into the databases
+// first. The bytes read are accounted for in loadingProgress. It returns the
+// offset just past the last complete command along with the error of scanAof.
+func readAofFile(path string, fn func(value Value)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	if !hasRdbPreamble(rd) {
+		return scanAof(&loadingReader{rd}, fn, nil)
+	}
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return 0, err
+	}
+	n, err := loadRdbData(data)
+	if err != nil {
+		return 0, fmt.Errorf("%w: RDB preamble: %s", errBadAofFormat, err)
+	}
+	valid, err := scanAof(&loadingReader{bytes.NewReader(data[n:])}, fn, nil)
+	return int64(n) + valid, err
+}
+
+// hasRdbPreamble reports whether the AOF read by rd starts with an RDB image.
+func hasRdbPreamble(rd *bufio.Reader) bool {
+	magic, _ := rd.Peek(5)
+	return string(magic) == "REDIS"
+}
 
-		fn(value)
+// Truncate cuts the file of the AOF named name at size, dropping an incomplete
+// last command, so new commands are appended after the last complete one. It
+// must be called before Open.
+func (aof *Aof) Truncate(name string, size int64) error {
+	path := aof.filePath(name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(path, size); err != nil {
+		return err
 	}
 
+	aof.mu.Lock()
+	aof.size -= info.Size() - size
+	aof.baseSize = aof.size
+	aof.mu.Unlock()
 	return nil
 }
@@ -0,0 +1,275 @@
+/*
+This file contains the validation of the AOF. A crash in the middle of a write
+can leave the file ending with an incomplete command, and a damaged disk can
+corrupt it anywhere. When loading, an incomplete last command is dropped if
+aof-load-truncated is enabled, while anything else stops the server. Running the
+binary as "--check-aof [--fix] <file>" reports whether a file is valid and, with
+--fix, truncates it to the last valid command. Given a manifest it checks every
+file of the AOF, but only the last one can be fixed. An RDB preamble can't be
+fixed, it must be valid for the file to be. With aof-timestamp-enabled, the
+"--check-aof --truncate-to-timestamp <unix time> <file>" mode drops the commands
+executed after the given time from the last file, restoring the dataset as it was
+then, for example before an accidental deletion. For a detailed description of
+the recovery, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/persistence/#what-should-i-do-if-my-aof-gets-truncated
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadAofFormat = errors.New("bad file format")
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// scanAof reads the commands of an AOF from r, calling fn for each, and returns
+// the offset just past the last complete command. Annotations, the lines
+// starting with '#' between commands, are passed to annotation along with their
+// offset, unless it's nil. The error is nil if the file ends cleanly,
+// io.ErrUnexpectedEOF if it ends in the middle of a command and errBadAofFormat
+// if it holds something other than commands.
+func scanAof(r io.Reader, fn func(value Value), annotation func(offset int64, line string)) (int64, error) {
+	cr := &countingReader{r: r}
+	reader := NewResp(cr)
+
+	valid := int64(0)
+	for {
+		if b, err := reader.reader.Peek(1); err == nil && b[0] == '#' {
+			line, err := reader.reader.ReadString('\n')
+			if err != nil {
+				return valid, io.ErrUnexpectedEOF
+			}
+			if !strings.HasSuffix(line, "\r\n") {
+				return valid, errBadAofFormat
+			}
+			if annotation != nil {
+				annotation(valid, strings.TrimSuffix(line, "\r\n"))
+			}
+			valid = cr.n - int64(reader.reader.Buffered())
+			continue
+		}
+
+		value, err := reader.Read()
+		consumed := cr.n - int64(reader.reader.Buffered())
+		if err == io.EOF && consumed == valid {
+			return valid, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, io.ErrUnexpectedEOF
+		}
+		if err != nil || value.typ != ValueTypArray || len(value.array) == 0 {
+			return valid, errBadAofFormat
+		}
+		for _, arg := range value.array {
+			if arg.typ != ValueTypBulkString {
+				return valid, errBadAofFormat
+			}
+		}
+
+		valid = consumed
+		fn(value)
+	}
+}
+
+// checkAof runs the --check-aof mode with the arguments that follow it, and
+// returns the exit code.
+func checkAof(args []string) int {
+	fix := false
+	truncateTo := int64(-1)
+	switch {
+	case len(args) == 2 && args[0] == "--fix":
+		fix = true
+		args = args[1:]
+	case len(args) == 3 && args[0] == "--truncate-to-timestamp":
+		ts, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || ts < 0 {
+			fmt.Println("Invalid timestamp:", args[1])
+			return 1
+		}
+		truncateTo = ts
+		args = args[2:]
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: --check-aof [--fix|--truncate-to-timestamp <timestamp>] <file.manifest|file.aof>")
+		return 1
+	}
+	path := args[0]
+	if !strings.HasSuffix(path, ".manifest") {
+		if truncateTo >= 0 {
+			return truncateAofToTimestamp(path, truncateTo)
+		}
+		return checkAofFile(path, fix, true)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Cannot read manifest %s: %s\n", path, err)
+		return 1
+	}
+	manifest, err := parseAofManifest(string(content))
+	if err != nil {
+		fmt.Printf("Invalid manifest %s: %s\n", path, err)
+		return 1
+	}
+
+	files := manifest.files()
+	if truncateTo >= 0 {
+		// The commands of the other files were all executed before the last
+		// one started, so only the last one can be truncated
+		if len(files) == 0 {
+			fmt.Println("The manifest lists no AOF file")
+			return 1
+		}
+		return truncateAofToTimestamp(filepath.Join(filepath.Dir(path), files[len(files)-1].name), truncateTo)
+	}
+	for i, file := range files {
+		fmt.Printf("Start checking the AOF file %s\n", file.name)
+		if code := checkAofFile(filepath.Join(filepath.Dir(path), file.name), fix, i == len(files)-1); code != 0 {
+			return code
+		}
+	}
+	fmt.Println("All AOF files and manifest are valid")
+	return 0
+}
+
+// checkAofFile checks the AOF file at path and returns the exit code. Only the
+// last file of an AOF can be fixed, as the others must be complete.
+func checkAofFile(path string, fix, last bool) int {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Printf("Cannot open file %s: %s\n", path, err)
+		return 1
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Printf("Cannot stat file %s: %s\n", path, err)
+		return 1
+	}
+	size := info.Size()
+
+	var valid int64
+	rd := bufio.NewReader(f)
+	if hasRdbPreamble(rd) {
+		fmt.Println("The AOF appears to start with an RDB preamble.")
+		fmt.Println("Checking the RDB preamble to decide if the AOF is valid...")
+
+		data, readErr := io.ReadAll(rd)
+		if readErr != nil {
+			fmt.Printf("Cannot read file %s: %s\n", path, readErr)
+			return 1
+		}
+		n, rdbErr := parseRdb(data, rdbHandler{
+			key:      func(int, string, Object, time.Time) error { return nil },
+			function: func(string) error { return nil },
+		})
+		if rdbErr != nil {
+			fmt.Println("RDB preamble of AOF file is not sane, aborting:", rdbErr)
+			return 1
+		}
+		fmt.Println("RDB preamble is OK, proceeding with AOF tail...")
+
+		valid, err = scanAof(bytes.NewReader(data[n:]), func(Value) {}, nil)
+		valid += int64(n)
+	} else {
+		valid, err = scanAof(rd, func(Value) {}, nil)
+	}
+	if err != nil {
+		fmt.Printf("0x%x: Expected a complete command, found %s\n", valid, err)
+	}
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", path, size, valid, size-valid)
+
+	if valid == size {
+		fmt.Println("AOF is valid")
+		return 0
+	}
+	if !last {
+		fmt.Println("AOF is not valid, and only the last file of an AOF can be fixed.")
+		return 1
+	}
+	if !fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		return 1
+	}
+
+	fmt.Printf("This will shrink the AOF from %d bytes, with %d bytes, to %d bytes\n", size, size-valid, valid)
+	if err := f.Truncate(valid); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		return 1
+	}
+	if err := f.Sync(); err != nil {
+		fmt.Println("Failed to sync AOF:", err)
+		return 1
+	}
+	fmt.Println("Successfully truncated AOF")
+	return 0
+}
+
+// truncateAofToTimestamp truncates the AOF file at path before its first
+// timestamp annotation later than ts, dropping the commands executed after ts,
+// and returns the exit code. The file must be valid and can't start with an RDB
+// preamble.
+func truncateAofToTimestamp(path string, ts int64) int {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Printf("Cannot open file %s: %s\n", path, err)
+		return 1
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	if hasRdbPreamble(rd) {
+		fmt.Printf("The AOF %s starts with an RDB preamble, it can't be truncated to a timestamp\n", path)
+		return 1
+	}
+
+	truncateAt := int64(-1)
+	_, err = scanAof(rd, func(Value) {}, func(offset int64, line string) {
+		annotated, err := strconv.ParseInt(strings.TrimPrefix(line, aofTimestampPrefix), 10, 64)
+		if truncateAt < 0 && strings.HasPrefix(line, aofTimestampPrefix) && err == nil && annotated > ts {
+			truncateAt = offset
+		}
+	})
+	if err != nil {
+		fmt.Printf("AOF %s is not valid, use the --fix option first: %s\n", path, err)
+		return 1
+	}
+	if truncateAt < 0 {
+		fmt.Printf("AOF %s has no timestamp annotation later than %d, nothing to truncate\n", path, ts)
+		return 0
+	}
+
+	if err := f.Truncate(truncateAt); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		return 1
+	}
+	if err := f.Sync(); err != nil {
+		fmt.Println("Failed to sync AOF:", err)
+		return 1
+	}
+	fmt.Printf("Successfully truncated AOF %s to timestamp %d, at offset %d\n", path, ts, truncateAt)
+	return 0
+}
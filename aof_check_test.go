@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanAof(t *testing.T) {
+	set := string(requestValue("SET", "a", "1").Marshal())
+	del := string(requestValue("DEL", "a").Marshal())
+	tests := []struct {
+		name     string
+		data     string
+		commands int
+		valid    int
+		err      error
+	}{
+		{"empty", "", 0, 0, nil},
+		{"complete", set + del, 2, len(set + del), nil},
+		{"annotation", set + "#TS:1700000000\r\n" + del, 2, len(set+del) + 16, nil},
+		{"truncated command", set + del[:5], 1, len(set), io.ErrUnexpectedEOF},
+		{"truncated bulk", set + del[:len(del)-2], 1, len(set), io.ErrUnexpectedEOF},
+		{"truncated annotation", set + "#TS:17", 1, len(set), io.ErrUnexpectedEOF},
+		{"annotation without crlf", set + "#TS:1700000000\n" + del, 1, len(set), errBadAofFormat},
+		{"not an array", set + "+OK\r\n", 1, len(set), errBadAofFormat},
+		{"empty array", set + "*0\r\n", 1, len(set), errBadAofFormat},
+		{"not bulk strings", set + "*1\r\n:1\r\n", 1, len(set), errBadAofFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := 0
+			valid, err := scanAof(strings.NewReader(tt.data), func(Value) { commands++ }, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if valid != int64(tt.valid) || commands != tt.commands {
+				t.Fatalf("got %d commands valid up to %d, want %d up to %d", commands, valid, tt.commands, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCheckAofFile(t *testing.T) {
+	set := string(requestValue("SET", "a", "1").Marshal())
+	tests := []struct {
+		name string
+		data string
+		fix  bool
+		last bool
+		code int
+		size int // Of the file after the check
+	}{
+		{"valid", set + set, false, true, 0, 2 * len(set)},
+		{"truncated", set + set[:4], false, true, 1, len(set) + 4},
+		{"truncated fixed", set + set[:4], true, true, 0, len(set)},
+		{"truncated not last", set + set[:4], true, false, 1, len(set) + 4},
+		{"bad format fixed", set + "garbage\r\n" + set, true, true, 0, len(set)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if code := checkAofFile(path, tt.fix, tt.last); code != tt.code {
+				t.Fatalf("got exit code %d, want %d", code, tt.code)
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.Size() != int64(tt.size) {
+				t.Fatalf("got size %d, %v, want %d", info.Size(), err, tt.size)
+			}
+		})
+	}
+}
+
+func TestCheckAofManifest(t *testing.T) {
+	set := string(requestValue("SET", "a", "1").Marshal())
+	tests := []struct {
+		name  string
+		base  string
+		incr  string
+		code  int
+		fixed int // Size of the incremental file after --fix
+	}{
+		{"valid", set, set, 0, len(set)},
+		{"last truncated", set, set + set[:4], 0, len(set)},
+		{"base truncated", set[:4], set, 1, len(set)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest := &aofManifest{
+				base:  &aofFile{name: "appendonly.aof.1.base.aof", seq: 1, typ: aofFileBase},
+				incrs: []aofFile{{name: "appendonly.aof.1.incr.aof", seq: 1, typ: aofFileIncr}},
+			}
+			if err := manifest.persist(dir, "appendonly.aof"); err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(filepath.Join(dir, manifest.base.name), []byte(tt.base), 0644)
+			incr := filepath.Join(dir, manifest.incrs[0].name)
+			os.WriteFile(incr, []byte(tt.incr), 0644)
+
+			if code := checkAof([]string{"--fix", filepath.Join(dir, "appendonly.aof.manifest")}); code != tt.code {
+				t.Fatalf("got exit code %d, want %d", code, tt.code)
+			}
+			info, err := os.Stat(incr)
+			if err != nil || info.Size() != int64(tt.fixed) {
+				t.Fatalf("got size %d, %v, want %d", info.Size(), err, tt.fixed)
+			}
+		})
+	}
+}
+
+func TestLoadTruncatedAof(t *testing.T) {
+	defer func(truncated bool) { config.aofLoadTruncated = truncated }(config.aofLoadTruncated)
+	config.aofLoadTruncated = true
+
+	// The incomplete command at the end is dropped, and the next ones are
+	// appended after the last complete one
+	set := string(requestValue("SET", "a", "1").Marshal())
+	dir := t.TempDir()
+	manifest := &aofManifest{incrs: []aofFile{{name: "appendonly.aof.1.incr.aof", seq: 1, typ: aofFileIncr}}}
+	if err := manifest.persist(dir, "appendonly.aof"); err != nil {
+		t.Fatal(err)
+	}
+	incr := filepath.Join(dir, manifest.incrs[0].name)
+	if err := os.WriteFile(incr, []byte(set+"*3\r\n$3\r\nSET\r\n$1\r\nb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(t)
+	aof := openTestAof(t, dir)
+	runAll(t, []step{
+		{0, []string{"GET", "a"}, "$1\r\n1\r\n"},
+		{0, []string{"GET", "b"}, "$-1\r\n"},
+		{0, []string{"SET", "b", "2"}, "+OK\r\n"},
+	}, c)
+	closeTestAof(aof)
+
+	// The file holds the first SET, and the SELECT and SET appended
+	commands := 0
+	f, err := os.Open(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := scanAof(f, func(Value) { commands++ }, nil); err != nil || commands != 3 {
+		t.Fatalf("got %d commands, %v, want 3", commands, err)
+	}
+}
+
+func TestTruncateAofToTimestamp(t *testing.T) {
+	set := string(requestValue("SET", "a", "1").Marshal())
+	del := string(requestValue("DEL", "a").Marshal())
+	annotated := "#TS:100\r\n" + set + "#TS:200\r\n" + del + "#TS:300\r\n" + set
+	tests := []struct {
+		name string
+		data string
+		ts   string
+		code int
+		want string // The file after truncating
+	}{
+		{"before the first", annotated, "50", 0, ""},
+		{"at the first", annotated, "100", 0, "#TS:100\r\n" + set},
+		{"between", annotated, "250", 0, "#TS:100\r\n" + set + "#TS:200\r\n" + del},
+		{"after the last", annotated, "300", 0, annotated},
+		{"no annotations", set + del, "50", 0, set + del},
+		{"truncated file", annotated[:len(annotated)-3], "50", 1, annotated[:len(annotated)-3]},
+		{"rdb preamble", "REDIS0011" + set, "50", 1, "REDIS0011" + set},
+		{"bad timestamp", annotated, "x", 1, annotated},
+		{"negative timestamp", annotated, "-1", 1, annotated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if code := checkAof([]string{"--truncate-to-timestamp", tt.ts, path}); code != tt.code {
+				t.Fatalf("got exit code %d, want %d", code, tt.code)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateAofManifestToTimestamp(t *testing.T) {
+	// Only the last file of the manifest is truncated
+	set := string(requestValue("SET", "a", "1").Marshal())
+	dir := t.TempDir()
+	manifest := &aofManifest{
+		base:  &aofFile{name: "appendonly.aof.1.base.aof", seq: 1, typ: aofFileBase},
+		incrs: []aofFile{{name: "appendonly.aof.1.incr.aof", seq: 1, typ: aofFileIncr}},
+	}
+	if err := manifest.persist(dir, "appendonly.aof"); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, manifest.base.name)
+	incr := filepath.Join(dir, manifest.incrs[0].name)
+	os.WriteFile(base, []byte("#TS:300\r\n"+set), 0644)
+	os.WriteFile(incr, []byte("#TS:100\r\n"+set+"#TS:300\r\n"+set), 0644)
+
+	if code := checkAof([]string{"--truncate-to-timestamp", "200", filepath.Join(dir, "appendonly.aof.manifest")}); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if got, _ := os.ReadFile(base); string(got) != "#TS:300\r\n"+set {
+		t.Fatalf("got base file %q, want it unchanged", got)
+	}
+	if got, _ := os.ReadFile(incr); string(got) != "#TS:100\r\n"+set {
+		t.Fatalf("got incremental file %q, want %q", got, "#TS:100\r\n"+set)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+This file contains the manifest of the multi-part AOF. The AOF is split into
+files kept in the appenddirname directory: a base file, written by the last
+rewrite either in the RDB format or as commands, and incremental files holding
+the commands executed since. The manifest lists them in the order they're
+loaded, one per line in the form "file <name> seq <n> type <b|h|i>", and it is
+only ever replaced atomically, so the AOF is always the files it names. A rewrite
+starts a new incremental file for the commands executed meanwhile, and once the
+new base file is written the manifest drops the files it replaces, so nothing has
+to be copied and a rewrite that didn't complete leaves the AOF untouched. An AOF
+of a single file, written by an older version, is moved into the directory as the
+base file. For a detailed description of the layout, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/persistence/#log-rewriting
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Types of the files listed in the manifest
+const (
+	aofFileBase    = 'b'
+	aofFileHistory = 'h'
+	aofFileIncr    = 'i'
+)
+
+// aofFile is a file listed in the manifest.
+type aofFile struct {
+	name string
+	seq  int
+	typ  byte
+}
+
+// aofManifest lists the files making up the AOF.
+type aofManifest struct {
+	base  *aofFile  // Nil before the first rewrite, if there was no AOF before
+	incrs []aofFile // In the order they're loaded, the last one is appended to
+}
+
+// aofManifestName returns the name of the manifest of the AOF named name.
+func aofManifestName(name string) string {
+	return name + ".manifest"
+}
+
+// String returns the manifest as written to its file.
+func (m *aofManifest) String() string {
+	b := strings.Builder{}
+	line := func(f aofFile, typ byte) {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", f.name, f.seq, typ)
+	}
+
+	if m.base != nil {
+		line(*m.base, aofFileBase)
+	}
+	for _, f := range m.incrs {
+		line(f, aofFileIncr)
+	}
+	return b.String()
+}
+
+// files returns the files of the manifest in the order they're loaded.
+func (m *aofManifest) files() []aofFile {
+	files := []aofFile{}
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// nextIncrSeq returns the sequence number of the next incremental file.
+func (m *aofManifest) nextIncrSeq() int {
+	if len(m.incrs) == 0 {
+		return 1
+	}
+	return m.incrs[len(m.incrs)-1].seq + 1
+}
+
+// nextBaseSeq returns the sequence number of the next base file.
+func (m *aofManifest) nextBaseSeq() int {
+	if m.base == nil {
+		return 1
+	}
+	return m.base.seq + 1
+}
+
+// parseAofManifest parses the content of a manifest. History files, left
+// behind by a rewrite that couldn't delete them, aren't part of the AOF and are
+// skipped.
+func parseAofManifest(content string) (*aofManifest, error) {
+	m := &aofManifest{}
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid line %d of the manifest", i+1)
+		}
+		f := aofFile{seq: -1}
+		for j := 0; j < len(fields); j += 2 {
+			switch value := fields[j+1]; fields[j] {
+			case "file":
+				f.name = value
+			case "seq":
+				seq, err := strconv.Atoi(value)
+				if err != nil || seq < 0 {
+					return nil, fmt.Errorf("invalid sequence number on line %d of the manifest", i+1)
+				}
+				f.seq = seq
+			case "type":
+				if len(value) != 1 {
+					return nil, fmt.Errorf("invalid file type on line %d of the manifest", i+1)
+				}
+				f.typ = value[0]
+			}
+		}
+		if f.name == "" || f.seq < 0 || filepath.Base(f.name) != f.name {
+			return nil, fmt.Errorf("invalid line %d of the manifest", i+1)
+		}
+
+		switch f.typ {
+		case aofFileBase:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file information in the manifest")
+			}
+			m.base = &f
+		case aofFileIncr:
+			if len(m.incrs) > 0 && f.seq <= m.incrs[len(m.incrs)-1].seq {
+				return nil, errors.New("found a non-monotonic sequence number in the manifest")
+			}
+			m.incrs = append(m.incrs, f)
+		case aofFileHistory:
+		default:
+			return nil, fmt.Errorf("unknown file type on line %d of the manifest", i+1)
+		}
+	}
+	return m, nil
+}
+
+// loadAofManifest reads the manifest of the AOF named name in dir. An AOF of a
+// single file in the working directory is moved into dir as the base file, and
+// without either an empty manifest is created.
+func loadAofManifest(dir, name string) (*aofManifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, aofManifestName(name)))
+	if err == nil {
+		return parseAofManifest(string(content))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &aofManifest{}
+	if _, err := os.Stat(name); err == nil {
+		fmt.Printf("Moving the AOF %s into %s to upgrade it to the multi-part layout\n", name, dir)
+		if err := os.Rename(name, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+		m.base = &aofFile{name: name, seq: 1, typ: aofFileBase}
+	}
+
+	if err := m.persist(dir, name); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// persist writes the manifest of the AOF named name in dir, replacing the
+// previous one atomically.
+func (m *aofManifest) persist(dir, name string) error {
+	path := filepath.Join(dir, aofManifestName(name))
+	tmp := filepath.Join(dir, "temp-"+aofManifestName(name))
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(m.String())
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs dir to disk, so the files renamed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAofManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		files   []aofFile
+		want    string // Written back, if different from content
+	}{
+		{"empty", "", []aofFile{}, ""},
+		{"base only", "file a.1.base.rdb seq 1 type b\n", []aofFile{{"a.1.base.rdb", 1, aofFileBase}}, ""},
+		{"base and incrs", "file a.2.base.aof seq 2 type b\nfile a.3.incr.aof seq 3 type i\nfile a.4.incr.aof seq 4 type i\n",
+			[]aofFile{{"a.2.base.aof", 2, aofFileBase}, {"a.3.incr.aof", 3, aofFileIncr}, {"a.4.incr.aof", 4, aofFileIncr}}, ""},
+		{"incrs only", "file a.1.incr.aof seq 1 type i\n", []aofFile{{"a.1.incr.aof", 1, aofFileIncr}}, ""},
+		{"base after incrs", "file a.1.incr.aof seq 1 type i\nfile a.1.base.rdb seq 1 type b\n",
+			[]aofFile{{"a.1.base.rdb", 1, aofFileBase}, {"a.1.incr.aof", 1, aofFileIncr}},
+			"file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\n"},
+		{"history skipped", "file a.1.base.rdb seq 1 type h\nfile a.2.base.rdb seq 2 type b\n",
+			[]aofFile{{"a.2.base.rdb", 2, aofFileBase}}, "file a.2.base.rdb seq 2 type b\n"},
+		{"comments and blank lines", "# written by a rewrite\n\n  file a.1.incr.aof seq 1 type i  \r\n",
+			[]aofFile{{"a.1.incr.aof", 1, aofFileIncr}}, "file a.1.incr.aof seq 1 type i\n"},
+		{"fields in any order", "type i seq 1 file a.1.incr.aof\n", []aofFile{{"a.1.incr.aof", 1, aofFileIncr}},
+			"file a.1.incr.aof seq 1 type i\n"},
+		{"unknown fields", "file a.1.incr.aof seq 1 type i startoffset 0\n", []aofFile{{"a.1.incr.aof", 1, aofFileIncr}},
+			"file a.1.incr.aof seq 1 type i\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseAofManifest(tt.content)
+			if err != nil {
+				t.Fatalf("parseAofManifest: %v", err)
+			}
+			if got := m.files(); !slices.Equal(got, tt.files) {
+				t.Fatalf("got files %v, want %v", got, tt.files)
+			}
+
+			want := tt.want
+			if want == "" {
+				want = tt.content
+			}
+			if got := m.String(); got != want {
+				t.Fatalf("got %q written back, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseAofManifestInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"odd fields", "file a.1.incr.aof seq 1 type\n", "invalid line 1"},
+		{"no name", "seq 1 type i\n", "invalid line 1"},
+		{"no seq", "file a.1.incr.aof type i\n", "invalid line 1"},
+		{"path", "file ../a.1.incr.aof seq 1 type i\n", "invalid line 1"},
+		{"bad seq", "file a.1.incr.aof seq x type i\n", "invalid sequence number on line 1"},
+		{"negative seq", "file a.1.incr.aof seq -1 type i\n", "invalid sequence number on line 1"},
+		{"long type", "file a.1.incr.aof seq 1 type ii\n", "invalid file type on line 1"},
+		{"unknown type", "file a.1.incr.aof seq 1 type x\n", "unknown file type on line 1"},
+		{"two bases", "file a.1.base.rdb seq 1 type b\nfile a.2.base.rdb seq 2 type b\n", "duplicate base file"},
+		{"incrs out of order", "file a.2.incr.aof seq 2 type i\nfile a.1.incr.aof seq 1 type i\n", "non-monotonic sequence number"},
+		{"incrs same seq", "file a.1.incr.aof seq 1 type i\nfile b.1.incr.aof seq 1 type i\n", "non-monotonic sequence number"},
+		{"line number", "# comment\nfile a.1.incr.aof seq 1 type i\nfile\n", "invalid line 3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAofManifest(tt.content)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAofManifestNextSeq(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest *aofManifest
+		base     int
+		incr     int
+	}{
+		{"empty", &aofManifest{}, 1, 1},
+		{"base", &aofManifest{base: &aofFile{"a.3.base.rdb", 3, aofFileBase}}, 4, 1},
+		{"incrs", &aofManifest{incrs: []aofFile{{"a.2.incr.aof", 2, aofFileIncr}, {"a.5.incr.aof", 5, aofFileIncr}}}, 1, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if base, incr := tt.manifest.nextBaseSeq(), tt.manifest.nextIncrSeq(); base != tt.base || incr != tt.incr {
+				t.Fatalf("got base %d and incr %d, want %d and %d", base, incr, tt.base, tt.incr)
+			}
+		})
+	}
+}
+
+func TestLoadAofManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string // Existing manifest, if any
+		single   bool   // Whether an AOF of a single file is in the working directory
+		want     string
+	}{
+		{"existing", "file a.aof.1.incr.aof seq 1 type i\n", false, "file a.aof.1.incr.aof seq 1 type i\n"},
+		{"existing ignores a single file", "file a.aof.1.incr.aof seq 1 type i\n", true, "file a.aof.1.incr.aof seq 1 type i\n"},
+		{"created", "", false, ""},
+		{"single file upgraded", "", true, "file a.aof seq 1 type b\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The single file is looked for in the working directory
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			work := t.TempDir()
+			if err := os.Chdir(work); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			dir := filepath.Join(work, "appendonlydir")
+			if tt.manifest != "" {
+				os.Mkdir(dir, 0755)
+				os.WriteFile(filepath.Join(dir, "a.aof.manifest"), []byte(tt.manifest), 0644)
+			}
+			if tt.single {
+				os.WriteFile("a.aof", []byte("*1\r\n$4\r\nPING\r\n"), 0644)
+			}
+
+			m, err := loadAofManifest(dir, "a.aof")
+			if err != nil {
+				t.Fatalf("loadAofManifest: %v", err)
+			}
+			if got := m.String(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "a.aof.manifest"))
+			if err != nil || string(content) != tt.want {
+				t.Fatalf("got %q, %v persisted, want %q", content, err, tt.want)
+			}
+
+			// The single file is moved into the directory once upgraded
+			_, moved := os.Stat(filepath.Join(dir, "a.aof"))
+			if upgraded := tt.single && tt.manifest == ""; (moved == nil) != upgraded {
+				t.Fatalf("got the single file moved %v, want %v", moved == nil, upgraded)
+			}
+		})
+	}
+}
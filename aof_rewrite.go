@@ -0,0 +1,262 @@
+/*
+This file contains the AOF rewrite. As commands are appended the AOF keeps growing,
+even when they overwrite the same keys again and again. A rewrite replaces it with
+the shortest base file that recreates the current dataset: with
+aof-use-rdb-preamble, a snapshot in the RDB format, otherwise a RESTORE per key
+and a FUNCTION LOAD per library. BGREWRITEAOF first starts a new incremental file
+for the commands executed from then on, and writes the base file in the
+background from a copy of the databases, the way BGSAVE does. Once it's written,
+the manifest is replaced by one listing the new base file and the incremental
+files started since, and the files it no longer lists are deleted. The rewrite
+also starts on its own once the AOF grew by auto-aof-rewrite-percentage since the
+last rewrite. For a detailed description of the rewrite, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/persistence/#log-rewriting
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// rewriteBackground starts rewriting the AOF in the background. The caller must
+// hold execMu for writing, so the copy of the databases and the start of the new
+// incremental file see the same commands.
+func (aof *Aof) rewriteBackground() error {
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	aof.mu.Lock()
+	rewriting := aof.rewriting
+	aof.mu.Unlock()
+	if rewriting {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+
+	// The commands executed so far must be in the incremental files the new
+	// base file replaces
+	if err := aof.flush(); err != nil {
+		return err
+	}
+	if err := aof.sync(); err != nil {
+		return err
+	}
+	f, err := aof.openNewIncr()
+	if err != nil {
+		return err
+	}
+	aof.file.Close()
+	aof.file = f
+	incrSeq := aof.manifest.nextIncrSeq() - 1
+
+	aof.mu.Lock()
+	aof.rewriting = true
+	aof.db = -1
+	aof.lastTimestamp = 0
+	aof.incrSize = 0
+	aof.mu.Unlock()
+
+	snap := takeSnapshot()
+	fmt.Println("Background append only file rewriting started")
+
+	go func() {
+		if err := aof.rewrite(snap, incrSeq); err != nil {
+			fmt.Println("Background AOF rewrite error:", err)
+
+			aof.mu.Lock()
+			aof.rewriting = false
+			aof.lastRewriteOK = false
+			aof.mu.Unlock()
+			return
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+
+	return nil
+}
+
+// rewrite writes snap as the new base file and replaces the manifest with one
+// listing it, followed by the incremental files from incrSeq on.
+func (aof *Aof) rewrite(snap *rdbSnapshot, incrSeq int) error {
+	f, err := os.CreateTemp(aof.dir, fmt.Sprintf("temp-rewriteaof-bg-%d-*.aof", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	// The dataset is written either in the RDB format, which is smaller and
+	// faster to load, or as commands
+	w := bufio.NewWriter(f)
+	ext := "aof"
+	if config.aofUseRdbPreamble {
+		snap.aofBase = true
+		err = snap.write(w)
+		ext = "rdb"
+	} else {
+		err = writeSnapshotCommands(w, snap)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	old := aof.manifest
+	manifest := &aofManifest{}
+	seq := old.nextBaseSeq()
+	manifest.base = &aofFile{name: fmt.Sprintf("%s.%d.base.%s", aof.name, seq, ext), seq: seq, typ: aofFileBase}
+	for _, incr := range old.incrs {
+		if incr.seq >= incrSeq {
+			manifest.incrs = append(manifest.incrs, incr)
+		}
+	}
+
+	basePath := aof.filePath(manifest.base.name)
+	if err := os.Rename(tmp, basePath); err != nil {
+		return err
+	}
+	if err := manifest.persist(aof.dir, aof.name); err != nil {
+		os.Remove(basePath)
+		return err
+	}
+	aof.manifest = manifest
+
+	// The files replaced by the new base file are no longer part of the AOF
+	for _, file := range old.files() {
+		if file.typ == aofFileBase || file.seq < incrSeq {
+			if err := os.Remove(aof.filePath(file.name)); err != nil {
+				fmt.Println("Error removing the AOF file no longer in use:", err)
+			}
+		}
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.size = info.Size() + aof.incrSize
+	aof.baseSize = aof.size
+	aof.rewriting = false
+	aof.rewrites++
+	aof.lastRewriteOK = true
+
+	return nil
+}
+
+// writeSnapshotCommands writes the commands recreating snap to w.
+func writeSnapshotCommands(w *bufio.Writer, snap *rdbSnapshot) error {
+	command := func(args ...string) error {
+		value := Value{typ: ValueTypArray}
+		for _, arg := range args {
+			value.array = append(value.array, bulkValue(arg))
+		}
+		return writeValue(w, value, false)
+	}
+
+	for _, code := range snap.functions {
+		if err := command("FUNCTION", "LOAD", code); err != nil {
+			return err
+		}
+	}
+
+	for id, entries := range snap.dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		if _, err := w.Write(aofSelect(id)); err != nil {
+			return err
+		}
+
+		// RESTORE recreates a value of any type exactly, along with its
+		// expiration time
+		for _, e := range entries {
+			args := []string{"RESTORE", e.key, "0", string(serializeObject(e.obj)), "REPLACE"}
+			if !e.expire.IsZero() {
+				args[2] = strconv.FormatInt(e.expire.UnixMilli(), 10)
+				args = append(args, "ABSTTL")
+			}
+			if err := command(args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// aofRewriteIfNeeded starts a rewrite if the AOF grew past both
+// auto-aof-rewrite-min-size and auto-aof-rewrite-percentage of its size after
+// the last rewrite. The caller must hold execMu for writing.
+func aofRewriteIfNeeded() {
+	if serverAof == nil || config.autoAofRewritePerc == 0 {
+		return
+	}
+
+	serverAof.mu.Lock()
+	size, base, rewriting := serverAof.size, serverAof.baseSize, serverAof.rewriting
+	serverAof.mu.Unlock()
+
+	if rewriting || size < config.autoAofRewriteMinSize {
+		return
+	}
+
+	base = max(base, 1)
+	if growth := (size - base) * 100 / base; growth >= int64(config.autoAofRewritePerc) {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+		serverAof.rewriteBackground()
+	}
+}
+
+// aofInfo returns the lines of the persistence section of INFO about the AOF.
+func aofInfo() []string {
+	if serverAof == nil {
+		return []string{"aof_rewrite_in_progress:0", "aof_last_bgrewrite_status:ok"}
+	}
+
+	serverAof.mu.Lock()
+	defer serverAof.mu.Unlock()
+
+	status := "ok"
+	if !serverAof.lastRewriteOK {
+		status = "err"
+	}
+
+	return []string{
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(serverAof.rewriting)),
+		fmt.Sprintf("aof_rewrites:%d", serverAof.rewrites),
+		"aof_last_bgrewrite_status:" + status,
+		fmt.Sprintf("aof_current_size:%d", serverAof.size),
+		fmt.Sprintf("aof_base_size:%d", serverAof.baseSize),
+		fmt.Sprintf("aof_buffer_length:%d", len(serverAof.buf)),
+	}
+}
+
+// bgrewriteaof handles the BGREWRITEAOF command.
+func bgrewriteaof(c *Client, args []Value) Value {
+	if serverAof == nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR Append only file is disabled"}
+	}
+
+	if err := serverAof.rewriteBackground(); err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+	}
+	return Value{typ: ValueTypSimpleString, str: "Background append only file rewriting started"}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestAof loads and opens an AOF in dir as the AOF of the server, which is
+// closed at the end of the test.
+func openTestAof(t *testing.T, dir string) *Aof {
+	t.Helper()
+	defer func(dir, name string) {
+		config.appenddirname, config.appendfilename = dir, name
+	}(config.appenddirname, config.appendfilename)
+	config.appenddirname, config.appendfilename = dir, "appendonly.aof"
+
+	loadAof()
+	aof := serverAof
+	t.Cleanup(func() { closeTestAof(aof) })
+	return aof
+}
+
+// closeTestAof closes aof, which stops being the AOF of the server.
+func closeTestAof(aof *Aof) {
+	execMu.Lock()
+	if serverAof == aof {
+		serverAof = nil
+	}
+	execMu.Unlock()
+	aof.Close()
+}
+
+// waitRewrite waits for the rewrite of aof in progress to end.
+func waitRewrite(t *testing.T, aof *Aof) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		aof.mu.Lock()
+		rewriting := aof.rewriting
+		aof.mu.Unlock()
+		if !rewriting {
+			return
+		}
+	}
+	t.Fatal("the rewrite didn't end")
+}
+
+// aofFileNames returns the names of the files listed in the manifest of aof.
+func aofFileNames(aof *Aof) []string {
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	names := []string{}
+	for _, f := range aof.manifest.files() {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+func TestAofRewrite(t *testing.T) {
+	defer func(preamble bool) { config.aofUseRdbPreamble = preamble }(config.aofUseRdbPreamble)
+
+	tests := []struct {
+		name     string
+		preamble bool
+		base     string
+	}{
+		{"commands", false, "appendonly.aof.1.base.aof"},
+		{"rdb preamble", true, "appendonly.aof.1.base.rdb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.aofUseRdbPreamble = tt.preamble
+			dir := t.TempDir()
+			c := newTestClient(t)
+			aof := openTestAof(t, dir)
+
+			runAll(t, []step{
+				{0, []string{"SET", "a", "1"}, "+OK\r\n"},
+				{0, []string{"SET", "a", "2"}, "+OK\r\n"},
+				{0, []string{"RPUSH", "l", "x", "y"}, ":2\r\n"},
+				{0, []string{"SET", "e", "v"}, "+OK\r\n"},
+				{0, []string{"PEXPIRE", "e", "100000"}, ":1\r\n"},
+				{0, []string{"SELECT", "1"}, "+OK\r\n"},
+				{0, []string{"SET", "b", "3"}, "+OK\r\n"},
+			}, c)
+
+			execMu.Lock()
+			err := aof.rewriteBackground()
+			execMu.Unlock()
+			if err != nil {
+				t.Fatalf("rewriteBackground: %v", err)
+			}
+			// Written while rewriting, it's in the incremental file kept
+			run(c, "SET", "c", "4")
+			waitRewrite(t, aof)
+
+			want := []string{tt.base, "appendonly.aof.2.incr.aof"}
+			if got := aofFileNames(aof); !slices.Equal(got, want) {
+				t.Fatalf("got files %q, want %q", got, want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "appendonly.aof.1.incr.aof")); !os.IsNotExist(err) {
+				t.Fatalf("the replaced incremental file is still there: %v", err)
+			}
+			base, err := os.ReadFile(filepath.Join(dir, tt.base))
+			if err != nil || strings.HasPrefix(string(base), "REDIS") != tt.preamble {
+				t.Fatalf("got base file starting with %.9q, %v, want an RDB preamble %v", base, err, tt.preamble)
+			}
+
+			// The dataset loaded back is the one rewritten, and the commands
+			// that followed
+			closeTestAof(aof)
+			c = newTestClient(t)
+			openTestAof(t, dir)
+			runAll(t, []step{
+				{0, []string{"GET", "a"}, "$1\r\n2\r\n"},
+				{0, []string{"LRANGE", "l", "0", "-1"}, "*2\r\n$1\r\nx\r\n$1\r\ny\r\n"},
+				{0, []string{"PEXPIRE", "e", "100000", "NX"}, ":0\r\n"},
+				{0, []string{"SELECT", "1"}, "+OK\r\n"},
+				{0, []string{"GET", "b"}, "$1\r\n3\r\n"},
+				{0, []string{"GET", "c"}, "$1\r\n4\r\n"},
+			}, c)
+		})
+	}
+}
+
+func TestAofRewriteIfNeeded(t *testing.T) {
+	defer func(perc int, minSize int64) {
+		config.autoAofRewritePerc, config.autoAofRewriteMinSize = perc, minSize
+	}(config.autoAofRewritePerc, config.autoAofRewriteMinSize)
+
+	tests := []struct {
+		name    string
+		perc    int
+		minSize int64
+		base    int64
+		size    int64
+		want    bool
+	}{
+		{"disabled", 0, 0, 100, 1000, false},
+		{"below the minimum size", 100, 2000, 100, 1000, false},
+		{"not grown enough", 100, 0, 600, 1000, false},
+		{"grown", 100, 0, 500, 1000, true},
+		{"no base size", 100, 0, 0, 1000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestClient(t)
+			aof := openTestAof(t, t.TempDir())
+			config.autoAofRewritePerc, config.autoAofRewriteMinSize = tt.perc, tt.minSize
+
+			aof.mu.Lock()
+			aof.size, aof.baseSize = tt.size, tt.base
+			aof.mu.Unlock()
+			execMu.Lock()
+			aofRewriteIfNeeded()
+			execMu.Unlock()
+			waitRewrite(t, aof)
+
+			aof.mu.Lock()
+			rewrites := aof.rewrites
+			aof.mu.Unlock()
+			if got := rewrites == 1; got != tt.want {
+				t.Fatalf("got rewritten %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
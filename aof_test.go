@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// argStrings returns the arguments of a command.
+func argStrings(v Value) []string {
+	args := []string{}
+	for _, arg := range v.array {
+		args = append(args, arg.bulk)
+	}
+	return args
+}
+
+func TestAofAbsoluteExpire(t *testing.T) {
+	// The relative times are offsets in milliseconds from the time of the
+	// translation, and the absolute ones are kept as is
+	tests := []struct {
+		name     string
+		args     []string
+		want     []string
+		at       int // Index of the expiration time in want
+		relative int64
+	}{
+		{"expire", []string{"EXPIRE", "k", "100"}, []string{"PEXPIREAT", "k", ""}, 2, 100000},
+		{"expire options", []string{"expire", "k", "100", "NX"}, []string{"PEXPIREAT", "k", "", "NX"}, 2, 100000},
+		{"expire in the past", []string{"EXPIRE", "k", "-5"}, []string{"PEXPIREAT", "k", ""}, 2, -5000},
+		{"pexpire", []string{"PEXPIRE", "k", "1500", "GT"}, []string{"PEXPIREAT", "k", "", "GT"}, 2, 1500},
+		{"expireat", []string{"EXPIREAT", "k", "2000000000"}, []string{"PEXPIREAT", "k", "2000000000000"}, -1, 0},
+		{"pexpireat", []string{"PEXPIREAT", "k", "2000000000000"}, []string{"PEXPIREAT", "k", "2000000000000"}, -1, 0},
+		{"setex", []string{"SETEX", "k", "10", "v"}, []string{"SET", "k", "v", "PXAT", ""}, 4, 10000},
+		{"psetex", []string{"PSETEX", "k", "250", "v"}, []string{"SET", "k", "v", "PXAT", ""}, 4, 250},
+		{"set ex", []string{"SET", "k", "v", "EX", "10"}, []string{"SET", "k", "v", "PXAT", ""}, 4, 10000},
+		{"set px", []string{"SET", "k", "v", "NX", "PX", "250"}, []string{"SET", "k", "v", "NX", "PXAT", ""}, 5, 250},
+		{"set exat", []string{"SET", "k", "v", "EXAT", "2000000000"}, []string{"SET", "k", "v", "PXAT", "2000000000000"}, -1, 0},
+		{"set without expiration", []string{"SET", "k", "v"}, []string{"SET", "k", "v"}, -1, 0},
+		{"restore", []string{"RESTORE", "k", "500", "payload"}, []string{"RESTORE", "k", "", "payload", "ABSTTL"}, 2, 500},
+		{"restore absttl", []string{"RESTORE", "k", "2000000000000", "payload", "ABSTTL"}, []string{"RESTORE", "k", "2000000000000", "payload", "ABSTTL"}, -1, 0},
+		{"restore without ttl", []string{"RESTORE", "k", "0", "payload"}, []string{"RESTORE", "k", "0", "payload"}, -1, 0},
+		{"other command", []string{"PERSIST", "k"}, []string{"PERSIST", "k"}, -1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now().UnixMilli()
+			got := argStrings(aofAbsoluteExpire(requestValue(tt.args...)))
+			after := time.Now().UnixMilli()
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if tt.at >= 0 {
+				at, err := strconv.ParseInt(got[tt.at], 10, 64)
+				if err != nil || at < before+tt.relative || at > after+tt.relative {
+					t.Fatalf("got expiration time %q, want %d ms from now", got[tt.at], tt.relative)
+				}
+				got[tt.at] = ""
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAofWriteTimestamps(t *testing.T) {
+	defer func(timestamps bool) { config.aofTimestampEnabled = timestamps }(config.aofTimestampEnabled)
+	config.aofTimestampEnabled = true
+
+	aof, err := NewAof(t.TempDir(), "appendonly.aof")
+	if err != nil {
+		t.Fatalf("NewAof: %v", err)
+	}
+
+	// The first command of each second is preceded by an annotation, which
+	// the commands are read past
+	for range 3 {
+		aof.Write(0, requestValue("SET", "a", "1"))
+	}
+	aof.mu.Lock()
+	aof.lastTimestamp--
+	aof.mu.Unlock()
+	aof.Write(0, requestValue("SET", "a", "1"))
+
+	commands := 0
+	annotations := []string{}
+	_, err = scanAof(bytes.NewReader(aof.buf), func(Value) { commands++ }, func(_ int64, line string) {
+		annotations = append(annotations, line)
+	})
+	if err != nil || commands != 5 {
+		t.Fatalf("got %d commands, %v, want 5", commands, err)
+	}
+	if len(annotations) != 2 || !strings.HasPrefix(annotations[0], aofTimestampPrefix) {
+		t.Fatalf("got annotations %q, want two timestamps", annotations)
+	}
+}
+
+func TestAofWrite(t *testing.T) {
+	defer func(timestamps bool) { config.aofTimestampEnabled = timestamps }(config.aofTimestampEnabled)
+	config.aofTimestampEnabled = false
+
+	// A SELECT precedes the commands against another database than the
+	// previous one
+	tests := []struct {
+		name   string
+		db     int
+		args   []string
+		prefix string
+	}{
+		{"first", 0, []string{"SET", "a", "1"}, string(aofSelect(0))},
+		{"same database", 0, []string{"SET", "b", "2"}, ""},
+		{"other database", 3, []string{"DEL", "a"}, string(aofSelect(3))},
+		{"back", 0, []string{"SET", "c", "3"}, string(aofSelect(0))},
+	}
+
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatalf("NewAof: %v", err)
+	}
+	if err := aof.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer aof.Close()
+	path := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+
+	want := ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want += tt.prefix + string(requestValue(tt.args...).Marshal())
+			off, err := aof.Write(tt.db, requestValue(tt.args...))
+			if err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if off != int64(len(want)) {
+				t.Fatalf("got offset %d, want %d", off, len(want))
+			}
+
+			// Once synced up to the offset, the command is in the file
+			if err := aof.Sync(off); err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil || string(got) != want {
+				t.Fatalf("got file %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestAofPersistsWrites(t *testing.T) {
+	c := newTestClient(t)
+	aof := openTestAof(t, t.TempDir())
+	runAll(t, []step{
+		{0, []string{"SET", "k", "v"}, "+OK\r\n"},
+		{0, []string{"SADD", "s", "x"}, ":1\r\n"},
+		{0, []string{"PFADD", "h", "a"}, ":1\r\n"},
+		{0, []string{"GEOADD", "g", "1", "1", "m"}, ":1\r\n"},
+		{0, []string{"XADD", "st", "1-1", "f", "v"}, "$3\r\n1-1\r\n"},
+	}, c)
+
+	// Only the commands that changed the dataset are appended, as they were
+	// sent
+	tests := []struct {
+		name      string
+		args      []string
+		persisted bool
+	}{
+		{"read", []string{"GET", "k"}, false},
+		{"write", []string{"SET", "k", "w"}, true},
+		{"write not done", []string{"SET", "k", "x", "NX"}, false},
+		{"error", []string{"LPUSH", "k", "x"}, false},
+		{"wrong arity", []string{"SET", "k"}, false},
+		{"sort", []string{"SORT", "s", "ALPHA"}, false},
+		{"function list", []string{"FUNCTION", "LIST"}, false},
+		{"function flush", []string{"FUNCTION", "FLUSH"}, true},
+		{"set member present", []string{"SADD", "s", "x"}, false},
+		{"set member added", []string{"SADD", "s", "y"}, true},
+		{"hyperloglog unchanged", []string{"PFADD", "h", "a"}, false},
+		{"geo member unchanged", []string{"GEOADD", "g", "1", "1", "m"}, false},
+		{"geo member moved", []string{"GEOADD", "g", "2", "2", "m"}, true},
+		{"stream entry missing", []string{"XDEL", "st", "9-9"}, false},
+		{"stream entry deleted", []string{"XDEL", "st", "1-1"}, true},
+		{"persist without expiration", []string{"PERSIST", "k"}, false},
+		{"delete missing", []string{"DEL", "missing"}, false},
+		{"move missing", []string{"MOVE", "missing", "1"}, false},
+		{"move", []string{"MOVE", "k", "1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aof.mu.Lock()
+			before := aof.appendOff
+			aof.mu.Unlock()
+
+			run(c, tt.args...)
+
+			aof.mu.Lock()
+			appended := aof.appendOff - before
+			aof.mu.Unlock()
+			want := int64(0)
+			if tt.persisted {
+				want = int64(len(requestValue(tt.args...).Marshal()))
+			}
+			if appended != want {
+				t.Fatalf("got %d bytes appended, want %d", appended, want)
+			}
+		})
+	}
+}
+
+func TestReadAofFilePreamble(t *testing.T) {
+	// An AOF file written by a rewrite with aof-use-rdb-preamble, to which
+	// commands were appended afterwards
+	c := newTestClient(t)
+	run(c, "SET", "a", "1")
+	snap := takeSnapshot()
+	snap.aofBase = true
+	buf := &bytes.Buffer{}
+	if err := snap.write(buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rdbLen := buf.Len()
+	buf.Write(requestValue("SET", "b", "2").Marshal())
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resetDatabases()
+	commands := []string{}
+	valid, err := readAofFile(path, func(value Value) {
+		commands = append(commands, strings.Join(argStrings(value), " "))
+	})
+	if err != nil || valid != int64(buf.Len()) {
+		t.Fatalf("got valid up to %d, %v, want %d", valid, err, buf.Len())
+	}
+	if !slices.Equal(commands, []string{"SET b 2"}) {
+		t.Fatalf("got commands %q after the preamble of %d bytes", commands, rdbLen)
+	}
+	if got := run(c, "GET", "a"); got != "$1\r\n1\r\n" {
+		t.Fatalf("got %q for the key of the preamble", got)
+	}
+}
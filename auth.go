@@ -0,0 +1,49 @@
+/*
+This file contains password authentication. A connection has to authenticate
+with AUTH before it can run any command that isn't flagged no_auth, unless the
+default user needs no password. AUTH with a single password authenticates as the
+default user, whose password is the one set with requirepass. AUTH with a username
+and a password authenticates as any user defined with ACL SETUSER. Connections
+that were open before a password was set keep working. For a detailed description
+of the command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/auth/
+*/
+
+package main
+
+// auth handles the AUTH command.
+func auth(c *Client, args []Value) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	if len(args) == 1 && defaultUser().nopass {
+		return Value{typ: ValueTypSimpleError, str: "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+	}
+
+	username := "default"
+	if len(args) == 2 {
+		username = args[0].bulk
+	}
+
+	u := authenticate(username, args[len(args)-1].bulk)
+	if u == nil {
+		aclLogDenial(c, "auth", "AUTH", username)
+		return Value{typ: ValueTypSimpleError, str: "WRONGPASS invalid username-password pair or user is disabled."}
+	}
+
+	c.user = u
+	c.authenticated = true
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// authenticate returns the user with the given name and password, or nil if
+// there is none or it's disabled.
+func authenticate(username, password string) *User {
+	u, ok := users[username]
+	if !ok || !u.enabled || !u.checkPassword(password) {
+		return nil
+	}
+	return u
+}
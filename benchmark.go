@@ -0,0 +1,264 @@
+/*
+This file contains the benchmark mode, which measures the performance of a
+running server without external tools. Running the binary as "--benchmark"
+connects a number of clients to the server, which send the commands of each
+test, pipelined or not, until the requested number of commands ran. Every test
+reports its throughput and the latency percentiles of its commands, measured
+from sending a pipeline to reading its last reply, like redis-benchmark does.
+For a detailed description of benchmarking Redis, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/optimization/benchmarks/
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchmarkTests are the commands the benchmark can send, by test name, given
+// a key and a value. The keys are random when a keyspace size is given.
+var benchmarkTests = map[string]func(key, value string) []string{
+	"ping": func(key, value string) []string { return []string{"PING"} },
+	"set":  func(key, value string) []string { return []string{"SET", "key:" + key, value} },
+	"get":  func(key, value string) []string { return []string{"GET", "key:" + key} },
+	"hset": func(key, value string) []string { return []string{"HSET", "myhash", "element:" + key, value} },
+	"hget": func(key, value string) []string { return []string{"HGET", "myhash", "element:" + key} },
+	"xadd": func(key, value string) []string { return []string{"XADD", "mystream", "*", "myfield", value} },
+	"publish": func(key, value string) []string {
+		return []string{"PUBLISH", "channel:" + key, value}
+	},
+}
+
+// benchmarkOptions are the settings of a benchmark run.
+type benchmarkOptions struct {
+	addr     string
+	password string
+	clients  int
+	requests int
+	pipeline int
+	dataSize int
+	keyspace int
+}
+
+// benchmarkResult is what a test measured.
+type benchmarkResult struct {
+	elapsed   time.Duration
+	latencies []time.Duration // Of every command, sorted
+	errors    int64           // Commands that got an error reply
+}
+
+// runBenchmark runs the benchmark mode with the command line arguments that
+// follow --benchmark, returning the exit code of the process.
+func runBenchmark(args []string) int {
+	fs := flag.NewFlagSet("--benchmark", flag.ContinueOnError)
+	host := fs.String("h", "127.0.0.1", "Server hostname")
+	port := fs.Int("p", 6379, "Server port")
+	password := fs.String("a", "", "Password of the default user")
+	clients := fs.Int("c", 50, "Number of parallel connections")
+	requests := fs.Int("n", 100000, "Total number of requests of each test")
+	pipeline := fs.Int("P", 1, "Number of requests sent in each pipeline")
+	dataSize := fs.Int("d", 3, "Size in bytes of the values")
+	keyspace := fs.Int("r", 0, "Use random keys among this many, a single key if 0")
+	tests := fs.String("t", "ping,set,get,hset,hget", "Comma separated tests to run, of "+benchmarkTestNames())
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 || *clients < 1 || *requests < 1 || *pipeline < 1 || *dataSize < 0 || *keyspace < 0 {
+		fs.Usage()
+		return 1
+	}
+
+	names := strings.Split(strings.ToLower(*tests), ",")
+	for _, name := range names {
+		if _, ok := benchmarkTests[name]; !ok {
+			fmt.Printf("Unknown test %q, the tests are %s\n", name, benchmarkTestNames())
+			return 1
+		}
+	}
+
+	opts := benchmarkOptions{
+		addr:     net.JoinHostPort(*host, strconv.Itoa(*port)),
+		password: *password,
+		clients:  *clients,
+		requests: *requests,
+		pipeline: *pipeline,
+		dataSize: *dataSize,
+		keyspace: *keyspace,
+	}
+	for _, name := range names {
+		result, err := runBenchmarkTest(opts, benchmarkTests[name])
+		if err != nil {
+			fmt.Printf("Error running the %s test: %s\n", name, err)
+			return 1
+		}
+		printBenchmarkResult(strings.ToUpper(name), opts, result)
+	}
+	return 0
+}
+
+// benchmarkTestNames returns the names of the tests, sorted.
+func benchmarkTestNames() string {
+	names := []string{}
+	for name := range benchmarkTests {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+// runBenchmarkTest sends opts.requests commands made by test, spread over the
+// clients, and measures how long they take.
+func runBenchmarkTest(opts benchmarkOptions, test func(key, value string) []string) (benchmarkResult, error) {
+	// Every client connects before the clock starts
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < opts.clients; i++ {
+		conn, err := benchmarkConnect(opts)
+		if err != nil {
+			return benchmarkResult{}, err
+		}
+		conns = append(conns, conn)
+	}
+
+	value := strings.Repeat("x", opts.dataSize)
+	claimed := atomic.Int64{}
+	errs := atomic.Int64{}
+	latencies := make([][]time.Duration, len(conns))
+	failures := make([]error, len(conns))
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := bufio.NewWriter(conn)
+			resp := NewResp(conn)
+			buf := []byte{}
+			for {
+				// Claim the next pipeline of the requests left
+				end := claimed.Add(int64(opts.pipeline))
+				n := min(int64(opts.pipeline), int64(opts.requests)-(end-int64(opts.pipeline)))
+				if n <= 0 {
+					return
+				}
+
+				buf = buf[:0]
+				for j := int64(0); j < n; j++ {
+					key := "__rand_int__"
+					if opts.keyspace > 0 {
+						key = fmt.Sprintf("%012d", rand.Intn(opts.keyspace))
+					}
+					buf = commandValue(test(key, value)...).MarshalTo(buf)
+				}
+
+				sent := time.Now()
+				w.Write(buf)
+				if err := w.Flush(); err != nil {
+					failures[i] = err
+					return
+				}
+				for j := int64(0); j < n; j++ {
+					reply, err := resp.ReadReply()
+					if err != nil {
+						failures[i] = err
+						return
+					}
+					if reply.typ == ValueTypSimpleError {
+						errs.Add(1)
+					}
+				}
+				latency := time.Since(sent)
+				for j := int64(0); j < n; j++ {
+					latencies[i] = append(latencies[i], latency)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := benchmarkResult{elapsed: time.Since(start), errors: errs.Load()}
+	if err := errors.Join(failures...); err != nil {
+		return result, err
+	}
+	for _, l := range latencies {
+		result.latencies = append(result.latencies, l...)
+	}
+	slices.Sort(result.latencies)
+	return result, nil
+}
+
+// benchmarkConnect opens a connection to the server, authenticated if a
+// password is given.
+func benchmarkConnect(opts benchmarkOptions) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", opts.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if opts.password == "" {
+		return conn, nil
+	}
+
+	if _, err := conn.Write(commandValue("AUTH", opts.password).Marshal()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := NewResp(conn).ReadReply()
+	if err == nil && reply.typ == ValueTypSimpleError {
+		err = errors.New(reply.str)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// printBenchmarkResult prints what a test measured, in the format of
+// redis-benchmark.
+func printBenchmarkResult(name string, opts benchmarkOptions, result benchmarkResult) {
+	fmt.Printf("====== %s ======\n", name)
+	fmt.Printf("  %d requests completed in %.2f seconds\n", opts.requests, result.elapsed.Seconds())
+	fmt.Printf("  %d parallel clients\n", opts.clients)
+	fmt.Printf("  %d bytes payload\n", opts.dataSize)
+	fmt.Printf("  pipeline %d\n", opts.pipeline)
+	if result.errors > 0 {
+		fmt.Printf("  %d error replies\n", result.errors)
+	}
+	fmt.Println()
+
+	fmt.Printf("throughput summary: %.2f requests per second\n", float64(opts.requests)/result.elapsed.Seconds())
+	fmt.Println("latency summary (msec):")
+	fmt.Printf("%10s%10s%10s%10s%10s%10s%10s\n", "avg", "min", "p50", "p95", "p99", "p99.9", "max")
+
+	l := result.latencies
+	total := time.Duration(0)
+	for _, d := range l {
+		total += d
+	}
+	percentile := func(p float64) time.Duration {
+		return l[min(int(float64(len(l))*p/100), len(l)-1)]
+	}
+	msec := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	fmt.Printf("%10.3f%10.3f%10.3f%10.3f%10.3f%10.3f%10.3f\n\n",
+		msec(total/time.Duration(len(l))), msec(l[0]), msec(percentile(50)), msec(percentile(95)),
+		msec(percentile(99)), msec(percentile(99.9)), msec(l[len(l)-1]))
+}
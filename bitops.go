@@ -0,0 +1,483 @@
+/*
+This file contains the bit operation commands that work on string values. BITOP
+combines one or more strings bitwise and stores the result in a destination key,
+BITPOS scans a string for the first set or clear bit, and BITFIELD reads and
+writes arbitrary-width integers packed into a string. Strings are treated as bit
+arrays where the most significant bit of the first byte is bit 0. For a detailed
+description of these commands, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/bitop/
+https://redis.io/docs/latest/commands/bitpos/
+https://redis.io/docs/latest/commands/bitfield/
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// bitop handles the BITOP command.
+func bitop(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'bitop' command"}
+	}
+
+	op := strings.ToUpper(args[0].bulk)
+	dest := args[1].bulk
+	keys := args[2:]
+
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR BITOP NOT must be called with a single source key."}
+		}
+	default:
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	defer c.db.lockKeys(true, append(argKeys(keys), dest)...)()
+
+	// Collect the source strings, missing keys behave like empty strings
+	srcs := make([][]byte, 0, len(keys))
+	maxLen := 0
+	for _, k := range keys {
+		e, errValue := c.db.shard(k.bulk).lookup(k.bulk, KeyTypString)
+		if errValue != nil {
+			return *errValue
+		}
+		value := ""
+		if e != nil {
+			e.touch()
+			value = e.str
+		}
+		src := []byte(value)
+		if len(src) > maxLen {
+			maxLen = len(src)
+		}
+		srcs = append(srcs, src)
+	}
+
+	// Shorter strings are zero-padded up to the length of the longest one
+	res := make([]byte, maxLen)
+	for i := 0; i < maxLen; i++ {
+		b := byteAt(srcs[0], i)
+		if op == "NOT" {
+			res[i] = ^b
+			continue
+		}
+		for _, src := range srcs[1:] {
+			switch op {
+			case "AND":
+				b &= byteAt(src, i)
+			case "OR":
+				b |= byteAt(src, i)
+			case "XOR":
+				b ^= byteAt(src, i)
+			}
+		}
+		res[i] = b
+	}
+
+	s := c.db.shard(dest)
+	if maxLen == 0 {
+		s.remove(dest, config.lazyfreeLazyServerDel)
+	} else {
+		s.add(dest, Object{typ: KeyTypString, str: string(res)})
+	}
+
+	return Value{typ: ValueTypInteger, num: maxLen}
+}
+
+// bitpos handles the BITPOS command.
+func bitpos(c *Client, args []Value) Value {
+	if len(args) < 2 || len(args) > 5 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'bitpos' command"}
+	}
+
+	key := args[0].bulk
+
+	bit, err := strconv.Atoi(args[1].bulk)
+	if err != nil || (bit != 0 && bit != 1) {
+		return Value{typ: ValueTypSimpleError, str: "ERR The bit argument must be 1 or 0."}
+	}
+
+	// Parse the optional range and its unit
+	start, end := 0, -1
+	endGiven := false
+	bitUnit := false
+	if len(args) >= 3 {
+		if start, err = strconv.Atoi(args[2].bulk); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		}
+	}
+	if len(args) >= 4 {
+		if end, err = strconv.Atoi(args[3].bulk); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		}
+		endGiven = true
+	}
+	if len(args) == 5 {
+		switch strings.ToUpper(args[4].bulk) {
+		case "BYTE":
+		case "BIT":
+			bitUnit = true
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	e, errValue := s.lookup(key, KeyTypString)
+	value := ""
+	if e != nil {
+		e.touch()
+		value = e.str
+	}
+	s.mu.RUnlock()
+
+	if errValue != nil {
+		return *errValue
+	}
+
+	// A missing key is an empty string, which has no set bits but infinite clear bits
+	if e == nil {
+		if bit == 1 {
+			return Value{typ: ValueTypInteger, num: -1}
+		}
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	// Normalize the range to absolute bit offsets
+	total := len(value)
+	if bitUnit {
+		total *= 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return Value{typ: ValueTypInteger, num: -1}
+	}
+	if !bitUnit {
+		start *= 8
+		end = end*8 + 7
+	}
+
+	for pos := start; pos <= end; pos++ {
+		if int(value[pos/8]>>(7-pos%8))&1 == bit {
+			return Value{typ: ValueTypInteger, num: pos}
+		}
+	}
+
+	// Looking for a clear bit without an explicit end treats the string as
+	// zero-padded on the right, so the first clear bit is just past the end
+	if bit == 0 && !endGiven {
+		return Value{typ: ValueTypInteger, num: end + 1}
+	}
+
+	return Value{typ: ValueTypInteger, num: -1}
+}
+
+// byteAt returns the byte at index i, or zero if i is past the end of b.
+func byteAt(b []byte, i int) byte {
+	if i < len(b) {
+		return b[i]
+	}
+	return 0
+}
+
+// Overflow behaviours for BITFIELD SET and INCRBY
+const (
+	bitfieldOverflowWrap = iota
+	bitfieldOverflowSat
+	bitfieldOverflowFail
+)
+
+// bitfieldOp is a single parsed BITFIELD subcommand.
+type bitfieldOp struct {
+	kind     string
+	signed   bool
+	bits     int
+	offset   uint64
+	value    int64
+	overflow int
+}
+
+// maxBitOffset is the largest bit offset accepted, matching the 512MB string limit.
+const maxBitOffset = 512*1024*1024*8 - 1
+
+// bitfield handles the BITFIELD command.
+func bitfield(c *Client, args []Value) Value {
+	return bitfieldGeneric(c, "bitfield", args, false)
+}
+
+// bitfieldRo handles the BITFIELD_RO command.
+func bitfieldRo(c *Client, args []Value) Value {
+	return bitfieldGeneric(c, "bitfield_ro", args, true)
+}
+
+// bitfieldGeneric implements BITFIELD and BITFIELD_RO, the read-only variant
+// which only takes GET, so it can run on replicas.
+func bitfieldGeneric(c *Client, name string, args []Value, readOnly bool) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+
+	// Parse every subcommand up front so a syntax error leaves the key untouched
+	ops := []bitfieldOp{}
+	overflow := bitfieldOverflowWrap
+	write := false
+	for i := 1; i < len(args); i++ {
+		sub := strings.ToUpper(args[i].bulk)
+		remaining := len(args) - i - 1
+
+		switch {
+		case readOnly && sub != "GET":
+			return Value{typ: ValueTypSimpleError, str: "ERR BITFIELD_RO only supports the GET subcommand"}
+		case sub == "OVERFLOW" && remaining >= 1:
+			switch strings.ToUpper(args[i+1].bulk) {
+			case "WRAP":
+				overflow = bitfieldOverflowWrap
+			case "SAT":
+				overflow = bitfieldOverflowSat
+			case "FAIL":
+				overflow = bitfieldOverflowFail
+			default:
+				return Value{typ: ValueTypSimpleError, str: "ERR Invalid OVERFLOW type specified"}
+			}
+			i++
+			continue
+		case sub == "GET" && remaining >= 2:
+		case (sub == "SET" || sub == "INCRBY") && remaining >= 3:
+			write = true
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+
+		op := bitfieldOp{kind: sub, overflow: overflow}
+
+		var errValue *Value
+		op.signed, op.bits, errValue = parseBitfieldType(args[i+1].bulk)
+		if errValue != nil {
+			return *errValue
+		}
+		op.offset, errValue = parseBitfieldOffset(args[i+2].bulk, op.bits)
+		if errValue != nil {
+			return *errValue
+		}
+
+		if sub != "GET" {
+			v, err := strconv.ParseInt(args[i+3].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			op.value = v
+			i++
+		}
+		i += 2
+
+		ops = append(ops, op)
+	}
+
+	s := c.db.shard(key)
+	if write {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+
+	e, errValue := s.lookup(key, KeyTypString)
+	if errValue != nil {
+		return *errValue
+	}
+	value := ""
+	if e != nil {
+		e.touch()
+		value = e.str
+	}
+
+	buf := []byte(value)
+	changed := false
+	results := make([]Value, 0, len(ops))
+	for _, op := range ops {
+		// Grow the string with zero bytes so the addressed bits exist
+		if op.kind != "GET" {
+			need := int((op.offset + uint64(op.bits) + 7) / 8)
+			if need > len(buf) {
+				buf = append(buf, make([]byte, need-len(buf))...)
+			}
+		}
+
+		old := getBitfield(buf, op.offset, op.bits, op.signed)
+
+		switch op.kind {
+		case "GET":
+			results = append(results, Value{typ: ValueTypInteger, num: int(old)})
+		case "SET", "INCRBY":
+			base, incr := op.value, int64(0)
+			if op.kind == "INCRBY" {
+				base, incr = old, op.value
+			}
+
+			res, ok := bitfieldOverflow(base, incr, op.bits, op.signed, op.overflow)
+			if !ok {
+				results = append(results, Value{typ: ValueTypNull})
+				continue
+			}
+			setBitfield(buf, op.offset, op.bits, uint64(res))
+			changed = true
+
+			if op.kind == "SET" {
+				results = append(results, Value{typ: ValueTypInteger, num: int(old)})
+			} else {
+				results = append(results, Value{typ: ValueTypInteger, num: int(res)})
+			}
+		}
+	}
+
+	// Nothing is written when every SET and INCRBY failed with OVERFLOW FAIL,
+	// or there was none
+	if !changed {
+		c.unchanged()
+		return Value{typ: ValueTypArray, array: results}
+	}
+	if e == nil {
+		e = s.add(key, Object{typ: KeyTypString})
+	}
+	e.str = string(buf)
+
+	return Value{typ: ValueTypArray, array: results}
+}
+
+// parseBitfieldType parses an encoding such as i8 or u16.
+func parseBitfieldType(s string) (signed bool, bits int, errValue *Value) {
+	invalid := &Value{typ: ValueTypSimpleError, str: "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."}
+
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u' && s[0] != 'I' && s[0] != 'U') {
+		return false, 0, invalid
+	}
+
+	signed = s[0] == 'i' || s[0] == 'I'
+	bits, err := strconv.Atoi(s[1:])
+	if err != nil || bits < 1 || (signed && bits > 64) || (!signed && bits > 63) {
+		return false, 0, invalid
+	}
+
+	return signed, bits, nil
+}
+
+// parseBitfieldOffset parses a bit offset, where "#N" means N times the type width.
+func parseBitfieldOffset(s string, bits int) (uint64, *Value) {
+	invalid := &Value{typ: ValueTypSimpleError, str: "ERR bit offset is not an integer or out of range"}
+
+	multiply := strings.HasPrefix(s, "#")
+	if multiply {
+		s = s[1:]
+	}
+
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, invalid
+	}
+	if multiply {
+		offset *= int64(bits)
+	}
+	if offset > maxBitOffset {
+		return 0, invalid
+	}
+
+	return uint64(offset), nil
+}
+
+// getBitfield reads bits starting at offset, sign-extending the result when signed.
+func getBitfield(buf []byte, offset uint64, bits int, signed bool) int64 {
+	var v uint64
+	for i := 0; i < bits; i++ {
+		pos := offset + uint64(i)
+		bit := uint64(byteAt(buf, int(pos/8))>>(7-pos%8)) & 1
+		v = v<<1 | bit
+	}
+
+	if signed && bits < 64 && v&(1<<(bits-1)) != 0 {
+		v |= ^uint64(0) << bits
+	}
+
+	return int64(v)
+}
+
+// setBitfield writes the low bits of v starting at offset, most significant bit first.
+func setBitfield(buf []byte, offset uint64, bits int, v uint64) {
+	for i := 0; i < bits; i++ {
+		pos := offset + uint64(i)
+		mask := byte(1) << (7 - pos%8)
+		if v>>(bits-1-i)&1 == 1 {
+			buf[pos/8] |= mask
+		} else {
+			buf[pos/8] &^= mask
+		}
+	}
+}
+
+// bitfieldOverflow computes value+incr for an integer of the given width and
+// applies the overflow behaviour. It returns false when FAIL rejects the result.
+func bitfieldOverflow(value, incr int64, bits int, signed bool, overflow int) (int64, bool) {
+	var max, min int64
+	if signed {
+		max = int64(^uint64(0) >> (65 - bits))
+		min = -max - 1
+	} else {
+		max = int64(^uint64(0) >> (64 - bits))
+		min = 0
+	}
+
+	// The int64 sum itself may wrap when the width is 64 bits
+	sum := value + incr
+	wrapped := (incr > 0 && sum < value) || (incr < 0 && sum > value)
+	up := (wrapped && incr > 0) || (!wrapped && sum > max)
+	down := (wrapped && incr < 0) || (!wrapped && sum < min)
+
+	if !up && !down {
+		return sum, true
+	}
+
+	switch overflow {
+	case bitfieldOverflowSat:
+		if up {
+			return max, true
+		}
+		return min, true
+	case bitfieldOverflowFail:
+		return 0, false
+	}
+
+	// WRAP keeps the low bits of the two's complement sum
+	res := uint64(sum)
+	if bits < 64 {
+		res &= ^uint64(0) >> (64 - bits)
+		if signed && res&(1<<(bits-1)) != 0 {
+			res |= ^uint64(0) << bits
+		}
+	}
+
+	return int64(res), true
+}
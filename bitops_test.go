@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBitfieldPropagation(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     func(*Client, []Value) Value
+		args    []string
+		want    string // The reply
+		changed bool
+	}{
+		{"get", bitfield, []string{"k", "GET", "u8", "0"}, "*1\r\n:0\r\n", false},
+		{"set", bitfield, []string{"k", "SET", "u8", "0", "200"}, "*1\r\n:0\r\n", true},
+		{"incrby", bitfield, []string{"k", "INCRBY", "i8", "0", "1"}, "*1\r\n:1\r\n", true},
+		{"incrby failed", bitfield, []string{"k", "OVERFLOW", "FAIL", "INCRBY", "u8", "0", "256"}, "*1\r\n$-1\r\n", false},
+		{"set and failed incrby", bitfield, []string{"k", "SET", "u8", "0", "255", "OVERFLOW", "FAIL", "INCRBY", "u8", "0", "1"}, "*2\r\n:0\r\n$-1\r\n", true},
+		{"read-only get", bitfieldRo, []string{"k", "GET", "u8", "0", "GET", "i4", "4"}, "*2\r\n:0\r\n:0\r\n", false},
+		{"read-only set", bitfieldRo, []string{"k", "SET", "u8", "0", "1"}, "-ERR BITFIELD_RO only supports the GET subcommand\r\n", false},
+		{"read-only overflow", bitfieldRo, []string{"k", "OVERFLOW", "SAT", "GET", "u8", "0"}, "-ERR BITFIELD_RO only supports the GET subcommand\r\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initDatabases(1)
+			c := newFakeClient(0)
+
+			reply := tt.cmd(c, requestValue(tt.args...).array)
+			if got := string(reply.Marshal()); got != tt.want {
+				t.Fatalf("got reply %q, want %q", got, tt.want)
+			}
+			// Errors are never propagated, so they needn't mark themselves unchanged
+			if changed := c.propagated == nil; reply.typ != ValueTypSimpleError && changed != tt.changed {
+				t.Fatalf("got changed %v, want %v", changed, tt.changed)
+			}
+			if exists := lookupKeyType(c.db, "k") != KeyTypNone; exists != tt.changed {
+				t.Fatalf("got key created %v, want %v", exists, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+This file contains the framework used by blocking commands such as XREAD with the
+BLOCK option. A client that has to wait registers a wakeup channel for the keys it
+is interested in, and every command that adds data to a key signals it as ready,
+which wakes up all clients waiting on that key. Woken clients simply re-run their
+check, so a spurious wakeup is harmless. Each connection is served by its own
+goroutine, so a blocked client only parks its own goroutine.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+// blockOnKeys registers a wakeup channel for the given keys. The channel is
+// buffered so signalling never blocks and a wakeup is never lost.
+func blockOnKeys(db *DB, keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	db.blockedClientsMu.Lock()
+	defer db.blockedClientsMu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := db.blockedClients[key]; !ok {
+			db.blockedClients[key] = map[chan struct{}]struct{}{}
+		}
+		db.blockedClients[key][ch] = struct{}{}
+	}
+
+	return ch
+}
+
+// unblockKeys removes a wakeup channel previously registered with blockOnKeys.
+func unblockKeys(db *DB, keys []string, ch chan struct{}) {
+	db.blockedClientsMu.Lock()
+	defer db.blockedClientsMu.Unlock()
+
+	for _, key := range keys {
+		delete(db.blockedClients[key], ch)
+		if len(db.blockedClients[key]) == 0 {
+			delete(db.blockedClients, key)
+		}
+	}
+}
+
+// signalKeyReady wakes up every client blocked on key.
+func signalKeyReady(db *DB, key string) {
+	db.blockedClientsMu.Lock()
+	defer db.blockedClientsMu.Unlock()
+
+	for ch := range db.blockedClients[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// blockUntil calls try until it reports success, waiting for one of keys to be
+// signalled between attempts. A zero timeout waits forever. It returns false if
+// the timeout expired before try succeeded. The caller must hold execMu for
+// reading, it's released while waiting.
+func blockUntil(db *DB, keys []string, timeout time.Duration, try func() bool) bool {
+	// Inside a transaction nobody else can run, so waiting would never end
+	if noBlocking.Load() {
+		return try()
+	}
+
+	// Register before the first attempt so a write in between is not missed
+	ch := blockOnKeys(db, keys)
+	defer unblockKeys(db, keys, ch)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		if try() {
+			return true
+		}
+
+		// Let other commands, including EXEC, run while waiting
+		execMu.RUnlock()
+		select {
+		case <-ch:
+			execMu.RLock()
+		case <-expired:
+			execMu.RLock()
+			return false
+		}
+	}
+}
@@ -0,0 +1,394 @@
+/*
+This file contains the state the server keeps for each client. A Client is created
+when a connection is accepted and passed to every command handler, so commands that
+depend on the connection, like SELECT, MULTI or SUBSCRIBE, are ordinary handlers.
+Fake clients without a connection run the commands of the AOF and of scripts.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reply modes of a client
+const (
+	ReplyModeOn   = "on"   // Every command gets a reply
+	ReplyModeOff  = "off"  // No command gets a reply
+	ReplyModeSkip = "skip" // The next command gets no reply
+
+	// Set by CLIENT REPLY SKIP, whose own reply is dropped before the mode
+	// becomes ReplyModeSkip
+	replyModeSkipNext = "skip-next"
+)
+
+// Client holds the state of a connection.
+type Client struct {
+	id     int64
+	conn   net.Conn // nil for fake clients
+	writer *Writer  // nil for fake clients
+	name   string
+
+	// Client library reported with CLIENT SETINFO
+	libName string
+	libVer  string
+
+	dbIndex int // Database selected with SELECT
+	db      *DB // Database of the command being run
+
+	user          *User // nil for fake clients, which may run anything
+	authenticated bool
+	replyMode     string
+	quitting      bool // Set by QUIT, the connection closes after the reply
+	asking        bool // Set by ASKING, the next command may use an importing slot
+
+	tx  *Transaction
+	sub *Subscriber
+
+	// Unix time in milliseconds the client last sent a command, and whether
+	// one is running, which may block for any time
+	lastInteraction atomic.Int64
+	running         atomic.Bool
+
+	// Channel the executor sends the replies of the client back on, see
+	// executor.go
+	executorReply chan executorReply
+
+	// Unix time in milliseconds the messages queued for the client first went
+	// over the soft output buffer limit, 0 while they're under it, and whether
+	// it was disconnected for going over the limit
+	obufSoftLimitSince atomic.Int64
+	obufLimitReached   atomic.Bool
+
+	woff   int64        // Replication offset after the last write of the client
+	aofOff atomic.Int64 // AOF offset after the last write of the client
+	master bool         // Applies the stream of the master, which is sent on as received
+
+	// Commands persisted and replicated in place of the one running, when its
+	// handler set them with propagateInstead, nil otherwise
+	propagated []Value
+
+	// Settings a replica sends with REPLCONF before it synchronizes
+	replListeningPort int
+	replCapa          []string
+
+	// Client side caching settings, see tracking.go
+	tracking         bool
+	trackingRedirect int64 // ID of the client receiving the invalidations, 0 for itself
+	trackingBcast    bool
+	trackingPrefixes []string
+	trackedKeys      map[string]struct{} // Keys read in the default mode, until invalidated
+}
+
+// nextClientID is the ID of the most recently created client.
+var nextClientID atomic.Int64
+
+// clients maps the ID of every connected client to its state.
+var clients = map[int64]*Client{}
+var clientsMu = sync.RWMutex{}
+
+// newClient creates the state of a new connection.
+func newClient(conn net.Conn) *Client {
+	c := &Client{
+		id:        nextClientID.Add(1),
+		conn:      conn,
+		db:        databases[0],
+		replyMode: ReplyModeOn,
+		tx:        &Transaction{},
+	}
+	c.writer = NewWriter(aofSyncedConn{Conn: conn, client: c})
+	c.sub = newSubscriber(c)
+	c.lastInteraction.Store(time.Now().UnixMilli())
+
+	// Without a password every connection is authenticated from the start. A
+	// busy script can't change the users, so connections don't wait for it.
+	unlock, busy := lockExec(false)
+	c.deauthenticate()
+	if busy == nil {
+		unlock()
+	}
+
+	clientsMu.Lock()
+	clients[c.id] = c
+	clientsMu.Unlock()
+	serverStats.totalConnectionsReceived.Add(1)
+
+	return c
+}
+
+// clientsCronInterval is how often clients idle for longer than the timeout
+// parameter are looked for.
+const clientsCronInterval = time.Second
+
+// clientsCron closes the connections idle for longer than the timeout
+// parameter. Clients running a command, like one blocked in XREAD, and the
+// subscribed ones, which only receive messages, are never idle, nor are the
+// replicas, which their own timeout covers.
+func clientsCron() {
+	for {
+		time.Sleep(clientsCronInterval)
+
+		execMu.RLock()
+		timeout := int64(config.timeout) * 1000
+		execMu.RUnlock()
+		if timeout == 0 {
+			continue
+		}
+
+		now := time.Now().UnixMilli()
+		idle := []*Client{}
+		clientsMu.RLock()
+		for _, c := range clients {
+			if !c.running.Load() && now-c.lastInteraction.Load() > timeout {
+				idle = append(idle, c)
+			}
+		}
+		clientsMu.RUnlock()
+
+		for _, c := range idle {
+			if c.master || c.sub.count() > 0 || isReplica(c.id) {
+				continue
+			}
+			fmt.Printf("Closing idle client %s\n", c.conn.RemoteAddr())
+			c.conn.Close()
+		}
+	}
+}
+
+// outputBufferLimit is the limit client-output-buffer-limit sets for a class
+// of clients: a client whose output not written yet reaches hard bytes, or stays
+// at soft bytes or more for longer than softSeconds, is disconnected, so a
+// client that doesn't read what it's sent can't make the server hold on to it
+// all. A limit of zero is disabled.
+type outputBufferLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int
+}
+
+// reached reports whether size bytes of output not written yet go over the
+// limit, given since when they have been over the soft limit in softSince,
+// which it updates.
+func (l outputBufferLimit) reached(size int64, softSince *atomic.Int64) bool {
+	if l.hard > 0 && size >= l.hard {
+		return true
+	}
+	if l.soft == 0 || size < l.soft {
+		softSince.Store(0)
+		return false
+	}
+
+	now := time.Now().UnixMilli()
+	since := softSince.Load()
+	if since == 0 {
+		softSince.CompareAndSwap(0, now)
+		return false
+	}
+	return now-since > int64(l.softSeconds)*1000
+}
+
+// push queues a message for the client, such as one published to a channel it
+// subscribed to, without waiting for the connection. The client is
+// disconnected once the output it didn't read goes over the limit of class.
+func (c *Client) push(v Value, class string) {
+	size := c.writer.Queue(v)
+	if !config.clientOutputLimits[class].reached(int64(size), &c.obufSoftLimitSince) {
+		return
+	}
+	if c.obufLimitReached.CompareAndSwap(false, true) {
+		fmt.Printf("Client %s closed for overcoming of output buffer limits.\n", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+}
+
+// lookupClient returns the connected client with the given ID, or nil.
+func lookupClient(id int64) *Client {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+
+	return clients[id]
+}
+
+// newFakeClient creates a client without a connection that starts out with the
+// given database selected.
+func newFakeClient(dbIndex int) *Client {
+	return &Client{
+		id:            nextClientID.Add(1),
+		dbIndex:       dbIndex,
+		db:            databases[dbIndex],
+		authenticated: true,
+		replyMode:     ReplyModeOn,
+		tx:            &Transaction{},
+	}
+}
+
+// close releases everything the client holds on to in the server.
+func (c *Client) close() {
+	clientsMu.Lock()
+	delete(clients, c.id)
+	clientsMu.Unlock()
+
+	c.disableTracking()
+	c.tx.unwatch()
+	dropReplica(c.id)
+	if c.sub != nil {
+		c.sub.unsubscribeAll()
+	}
+}
+
+// deauthenticate makes the client the default user again, which is only
+// authenticated if it needs no password. The caller must hold execMu.
+func (c *Client) deauthenticate() {
+	c.user = defaultUser()
+	c.authenticated = c.user.enabled && c.user.nopass
+}
+
+// resetCommand handles the RESET command, which returns the connection to the
+// state it had when it was opened.
+func resetCommand(c *Client, args []Value) Value {
+	c.tx.reset()
+	c.sub.unsubscribeAll()
+	c.disableTracking()
+
+	c.dbIndex = 0
+	c.db = databases[0]
+	c.name = ""
+	c.replyMode = ReplyModeOn
+	c.writer.SetProtocol(ProtocolResp2)
+	c.deauthenticate()
+
+	return Value{typ: ValueTypSimpleString, str: "RESET"}
+}
+
+// quitCommand handles the QUIT command.
+func quitCommand(c *Client, args []Value) Value {
+	c.quitting = true
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// info describes the client in the format of CLIENT LIST.
+func (c *Client) info() string {
+	addr, laddr := "", ""
+	if c.conn != nil {
+		addr, laddr = c.conn.RemoteAddr().String(), c.conn.LocalAddr().String()
+	}
+	user := ""
+	if c.user != nil {
+		user = c.user.name
+	}
+	multi := -1
+	if c.tx.active {
+		multi = len(c.tx.queue)
+	}
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s db=%d multi=%d user=%s lib-name=%s lib-ver=%s",
+		c.id, addr, laddr, c.name, c.dbIndex, multi, user, c.libName, c.libVer)
+}
+
+// reply buffers v for the client unless its reply mode suppresses it. The
+// buffered replies are flushed once the commands received so far have run.
+func (c *Client) reply(v Value) {
+	switch c.replyMode {
+	case ReplyModeOff:
+		return
+	case replyModeSkipNext:
+		c.replyMode = ReplyModeSkip
+		return
+	case ReplyModeSkip:
+		c.replyMode = ReplyModeOn
+		return
+	}
+	c.writer.Buffer(v)
+}
+
+// clientCommand handles the CLIENT command.
+func clientCommand(c *Client, args []Value) Value {
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "ID":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'client|id' command"}
+		}
+		return Value{typ: ValueTypInteger, num: int(c.id)}
+	case "TRACKING":
+		return clientTracking(c, args[1:])
+	case "SETINFO":
+		return clientSetInfo(c, args[1:])
+	case "REPLY":
+		return clientReply(c, args[1:])
+	case "GETREDIR":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'client|getredir' command"}
+		}
+		if !c.tracking {
+			return Value{typ: ValueTypInteger, num: -1}
+		}
+		return Value{typ: ValueTypInteger, num: int(c.trackingRedirect)}
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0].bulk)}
+	}
+}
+
+// clientReply handles the CLIENT REPLY subcommand. Only ON is replied to, SKIP
+// drops the reply to the next command too.
+func clientReply(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'client|reply' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "ON":
+		c.replyMode = ReplyModeOn
+	case "OFF":
+		c.replyMode = ReplyModeOff
+	case "SKIP":
+		if c.replyMode != ReplyModeOff {
+			c.replyMode = replyModeSkipNext
+		}
+	default:
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// clientSetInfo handles the CLIENT SETINFO subcommand.
+func clientSetInfo(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'client|setinfo' command"}
+	}
+
+	attr := strings.ToLower(args[0].bulk)
+	value := args[1].bulk
+
+	if attr != "lib-name" && attr != "lib-ver" {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unrecognized option '%s'", args[0].bulk)}
+	}
+
+	if !validClientName(value) {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", attr)}
+	}
+
+	if attr == "lib-name" {
+		c.libName = value
+	} else {
+		c.libVer = value
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// validClientName reports whether s can be used as a client name or library
+// info. They are shown in CLIENT LIST, so they must not break up its lines.
+func validClientName(s string) bool {
+	for _, ch := range s {
+		if ch < '!' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,938 @@
+/*
+This file contains cluster mode, enabled with cluster-enabled. The keyspace is
+split in 16384 hash slots, the slot of a key being the CRC16 of its name, and
+every node serves some of them. Keys sharing a hash tag, the part of their name
+between braces, are in the same slot, and the keys of a command, or of a
+transaction, must all be in one. A command for keys of a slot served by another
+node gets a MOVED redirection to it, which smart clients follow and remember.
+While a slot migrates, the keys already moved get an ASK redirection to the
+importing node, which serves them only after ASKING, for that one command.
+
+Nodes are introduced with CLUSTER MEET. Every second each node reads CLUSTER
+NODES from the others, learning about the nodes they know and the slots they
+claim, the claim with the highest config epoch winning, and keeps what it learned
+in cluster-config-file. For a detailed description of the cluster, refer to the
+Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/reference/cluster-spec/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clusterSlots is the number of hash slots the keyspace is split in.
+	clusterSlots = 16384
+
+	// clusterRefreshPeriod is how often the nodes read the state of the others.
+	clusterRefreshPeriod = time.Second
+
+	// clusterCallTimeout bounds the calls to the other nodes.
+	clusterCallTimeout = time.Second
+
+	// clusterBusPortOffset gives the cluster bus port CLUSTER NODES reports.
+	clusterBusPortOffset = 10000
+)
+
+// clusterNode is a node of the cluster.
+type clusterNode struct {
+	id          string
+	ip          string // Empty for this node until another one tells its address
+	port        int
+	configEpoch int64
+	linkUp      bool
+	pongTime    time.Time // When the node last answered
+}
+
+// addr returns the address of the node.
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+// The state of the cluster, guarded by clusterMu. The slots migrating to other
+// nodes and importing from them map to those nodes.
+var clusterMu = sync.RWMutex{}
+var clusterMyself *clusterNode
+var clusterNodes = map[string]*clusterNode{}
+var clusterSlotOwners [clusterSlots]*clusterNode
+var clusterSlotsAssigned int
+var clusterMigrating = map[int]*clusterNode{}
+var clusterImporting = map[int]*clusterNode{}
+var clusterCurrentEpoch int64
+
+// clusterMeets holds the addresses given to CLUSTER MEET that weren't reached
+// yet. It's guarded by clusterMu.
+var clusterMeets = map[string]bool{}
+
+// crc16Table is the table of the CRC16 variant used for hash slots, XMODEM.
+var crc16Table = func() [256]uint16 {
+	table := [256]uint16{}
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 returns the CRC16 of s.
+func crc16(s string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the hash slot of key. Only the part of the key between the
+// first { and the } after it is hashed, when it isn't empty, so keys sharing
+// that hash tag are in the same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+// commandSlot returns the slot of the keys at positions in argv, -1 if they're
+// in different slots.
+func commandSlot(argv []Value, positions []int) int {
+	slot := keyHashSlot(argv[positions[0]].bulk)
+	for _, pos := range positions[1:] {
+		if keyHashSlot(argv[pos].bulk) != slot {
+			return -1
+		}
+	}
+	return slot
+}
+
+// initCluster loads the state of the cluster from cluster-config-file, or
+// starts a new one with only this node.
+func initCluster() error {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	data, err := os.ReadFile(config.clusterConfigFile)
+	if os.IsNotExist(err) {
+		clusterMyself = &clusterNode{id: randomHex(40), port: config.port}
+		clusterNodes[clusterMyself.id] = clusterMyself
+		fmt.Println("No cluster configuration found, I'm", clusterMyself.id)
+		return clusterSaveConfig()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := clusterLoadConfig(string(data)); err != nil {
+		return fmt.Errorf("%s: %s", config.clusterConfigFile, err)
+	}
+	clusterMyself.port = config.port
+	fmt.Println("Node configuration loaded, I'm", clusterMyself.id)
+	return nil
+}
+
+// clusterLoadConfig applies the lines of a cluster configuration file, in the
+// format of CLUSTER NODES. The caller must hold clusterMu for writing.
+func clusterLoadConfig(data string) error {
+	migrating, importing := map[int]string{}, map[int]string{}
+
+	for i, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for j := 1; j+1 < len(fields); j += 2 {
+				if fields[j] == "currentEpoch" {
+					clusterCurrentEpoch, _ = strconv.ParseInt(fields[j+1], 10, 64)
+				}
+			}
+			continue
+		}
+
+		n, slots, err := parseClusterNodeLine(fields)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", i+1, err)
+		}
+		clusterNodes[n.id] = n
+		if strings.Contains(fields[2], "myself") {
+			clusterMyself = n
+		}
+		for _, s := range slots {
+			switch {
+			case s.migratingTo != "":
+				migrating[s.start] = s.migratingTo
+			case s.importingFrom != "":
+				importing[s.start] = s.importingFrom
+			default:
+				for slot := s.start; slot <= s.end; slot++ {
+					clusterAssignSlot(slot, n)
+				}
+			}
+		}
+	}
+	if clusterMyself == nil {
+		return errors.New("no myself node")
+	}
+
+	for slot, id := range migrating {
+		if n := clusterNodes[id]; n != nil {
+			clusterMigrating[slot] = n
+		}
+	}
+	for slot, id := range importing {
+		if n := clusterNodes[id]; n != nil {
+			clusterImporting[slot] = n
+		}
+	}
+	return nil
+}
+
+// clusterSlotRange is a range of slots of a CLUSTER NODES line, or a slot
+// migrating or importing.
+type clusterSlotRange struct {
+	start, end    int
+	migratingTo   string
+	importingFrom string
+}
+
+// parseClusterNodeLine parses the fields of a CLUSTER NODES line.
+func parseClusterNodeLine(fields []string) (*clusterNode, []clusterSlotRange, error) {
+	if len(fields) < 8 {
+		return nil, nil, errors.New("too few fields")
+	}
+
+	addr, _, _ := strings.Cut(fields[1], "@")
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	epoch, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := &clusterNode{id: fields[0], ip: host, port: port, configEpoch: epoch}
+
+	slots := []clusterSlotRange{}
+	for _, field := range fields[8:] {
+		if strings.HasPrefix(field, "[") {
+			field = strings.Trim(field, "[]")
+			if slot, id, ok := strings.Cut(field, "->-"); ok {
+				start, err := strconv.Atoi(slot)
+				if err != nil {
+					return nil, nil, err
+				}
+				slots = append(slots, clusterSlotRange{start: start, end: start, migratingTo: id})
+			} else if slot, id, ok := strings.Cut(field, "-<-"); ok {
+				start, err := strconv.Atoi(slot)
+				if err != nil {
+					return nil, nil, err
+				}
+				slots = append(slots, clusterSlotRange{start: start, end: start, importingFrom: id})
+			}
+			continue
+		}
+
+		first, last, isRange := strings.Cut(field, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 0 || end >= clusterSlots || start > end {
+			return nil, nil, fmt.Errorf("invalid slot range '%s'", field)
+		}
+		slots = append(slots, clusterSlotRange{start: start, end: end})
+	}
+	return n, slots, nil
+}
+
+// clusterSaveConfig writes the state of the cluster to cluster-config-file.
+// The caller must hold clusterMu.
+func clusterSaveConfig() error {
+	lines := append(clusterNodesLines(), fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0", clusterCurrentEpoch))
+
+	tmp := config.clusterConfigFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, config.clusterConfigFile)
+}
+
+// clusterSaveConfigOrLog saves the state of the cluster, logging a failure.
+// The caller must hold clusterMu.
+func clusterSaveConfigOrLog() {
+	if err := clusterSaveConfig(); err != nil {
+		fmt.Println("Error saving the cluster configuration:", err)
+	}
+}
+
+// clusterAssignSlot makes n serve slot, nil for none. The caller must hold
+// clusterMu for writing.
+func clusterAssignSlot(slot int, n *clusterNode) {
+	if clusterSlotOwners[slot] == nil && n != nil {
+		clusterSlotsAssigned++
+	} else if clusterSlotOwners[slot] != nil && n == nil {
+		clusterSlotsAssigned--
+	}
+	clusterSlotOwners[slot] = n
+}
+
+// clusterBumpEpoch gives this node a config epoch higher than any other, so its
+// claims win. The caller must hold clusterMu for writing.
+func clusterBumpEpoch() {
+	clusterCurrentEpoch++
+	clusterMyself.configEpoch = clusterCurrentEpoch
+}
+
+// clusterRedirect checks whether the keys of a command sent by c are served by
+// this node, returning the redirection or error to reply with otherwise.
+func clusterRedirect(c *Client, cmd *Command, argv []Value) *Value {
+	if !config.clusterEnabled || c.master || c.user == nil {
+		return nil
+	}
+	positions := cmd.keyPositions(argv)
+	if len(positions) == 0 {
+		return nil
+	}
+
+	// The keys of a command, and of every command of a transaction, must be in
+	// the same slot
+	crossSlot := &Value{typ: ValueTypSimpleError, str: "CROSSSLOT Keys in request don't hash to the same slot"}
+	slot := commandSlot(argv, positions)
+	if slot < 0 {
+		return crossSlot
+	}
+	if c.tx.active {
+		for _, queued := range c.tx.queue {
+			queuedPositions := queued.cmd.keyPositions(queued.value.array)
+			if len(queuedPositions) == 0 {
+				continue
+			}
+			if commandSlot(queued.value.array, queuedPositions) != slot {
+				return crossSlot
+			}
+			break
+		}
+	}
+
+	clusterMu.RLock()
+	defer clusterMu.RUnlock()
+
+	if clusterSlotsAssigned < clusterSlots {
+		return &Value{typ: ValueTypSimpleError, str: "CLUSTERDOWN The cluster is down"}
+	}
+
+	missing := 0
+	for _, pos := range positions {
+		if lookupKeyType(databases[c.dbIndex], argv[pos].bulk) == KeyTypNone {
+			missing++
+		}
+	}
+
+	owner := clusterSlotOwners[slot]
+	if owner == clusterMyself {
+		// Keys not found may have moved to the importing node already
+		if target := clusterMigrating[slot]; target != nil && missing > 0 {
+			if missing < len(positions) {
+				return &Value{typ: ValueTypSimpleError, str: "TRYAGAIN Multiple keys request during rehashing of slot"}
+			}
+			return &Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ASK %d %s", slot, target.addr())}
+		}
+		return nil
+	}
+
+	if clusterImporting[slot] != nil && (c.asking || cmd.hasFlag("asking")) {
+		if len(positions) > 1 && missing > 0 {
+			return &Value{typ: ValueTypSimpleError, str: "TRYAGAIN Multiple keys request during rehashing of slot"}
+		}
+		return nil
+	}
+	return &Value{typ: ValueTypSimpleError, str: fmt.Sprintf("MOVED %d %s", slot, owner.addr())}
+}
+
+// asking handles the ASKING command.
+func asking(c *Client, args []Value) Value {
+	if !config.clusterEnabled {
+		return Value{typ: ValueTypSimpleError, str: "ERR This instance has cluster support disabled"}
+	}
+	c.asking = true
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// clusterCommand handles the CLUSTER command.
+func clusterCommand(c *Client, args []Value) Value {
+	if !config.clusterEnabled {
+		return Value{typ: ValueTypSimpleError, str: "ERR This instance has cluster support disabled"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	nargs := map[string]int{
+		"KEYSLOT": 2, "COUNTKEYSINSLOT": 2, "GETKEYSINSLOT": 3, "MYID": 1, "NODES": 1, "SLOTS": 1,
+		"INFO": 1, "MEET": 3, "SETSLOT": -3, "ADDSLOTS": -2, "DELSLOTS": -2, "ADDSLOTSRANGE": -3,
+	}
+	n, ok := nargs[sub]
+	if !ok {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", args[0].bulk)}
+	}
+	if n >= 0 && len(args) != n || n < 0 && len(args) < -n || sub == "ADDSLOTSRANGE" && len(args)%2 == 0 {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(sub))}
+	}
+
+	switch sub {
+	case "KEYSLOT":
+		return Value{typ: ValueTypInteger, num: keyHashSlot(args[1].bulk)}
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		slot, err := strconv.Atoi(args[1].bulk)
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			return Value{typ: ValueTypSimpleError, str: "ERR Invalid slot"}
+		}
+		keys := keysInSlot(slot)
+		if sub == "COUNTKEYSINSLOT" {
+			return Value{typ: ValueTypInteger, num: len(keys)}
+		}
+		count, err := strconv.Atoi(args[2].bulk)
+		if err != nil || count < 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR Invalid number of keys"}
+		}
+		sort.Strings(keys)
+		values := []Value{}
+		for _, key := range keys[:min(count, len(keys))] {
+			values = append(values, bulkValue(key))
+		}
+		return Value{typ: ValueTypArray, array: values}
+	case "MEET":
+		port, err := strconv.Atoi(args[2].bulk)
+		if err != nil || port <= 0 || port > 65535 || net.ParseIP(args[1].bulk) == nil {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[1].bulk, args[2].bulk)}
+		}
+		clusterMu.Lock()
+		clusterMeets[net.JoinHostPort(args[1].bulk, args[2].bulk)] = true
+		clusterMu.Unlock()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	switch sub {
+	case "MYID":
+		return bulkValue(clusterMyself.id)
+	case "NODES":
+		return bulkValue(strings.Join(clusterNodesLines(), "\n") + "\n")
+	case "SLOTS":
+		return clusterSlotsValue()
+	case "INFO":
+		return Value{typ: ValueTypVerbatimString, str: "txt", bulk: strings.Join(clusterInfoLines(), "\r\n") + "\r\n"}
+	case "SETSLOT":
+		return clusterSetSlot(args[1:])
+	default: // ADDSLOTS, DELSLOTS, ADDSLOTSRANGE
+		return clusterChangeSlots(sub, args[1:])
+	}
+}
+
+// keysInSlot returns the keys of slot this node holds.
+func keysInSlot(slot int) []string {
+	keys := []string{}
+	for _, key := range dbKeys(databases[0]) {
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// clusterChangeSlots handles CLUSTER ADDSLOTS, DELSLOTS and ADDSLOTSRANGE. Either
+// every slot given is changed or none is. The caller must hold clusterMu for
+// writing.
+func clusterChangeSlots(sub string, args []Value) Value {
+	slots := []int{}
+	for i := 0; i < len(args); i++ {
+		start, err := strconv.Atoi(args[i].bulk)
+		end := start
+		if err == nil && sub == "ADDSLOTSRANGE" {
+			end, err = strconv.Atoi(args[i+1].bulk)
+			i++
+		}
+		if err != nil || start < 0 || end >= clusterSlots {
+			return Value{typ: ValueTypSimpleError, str: "ERR Invalid or out of range slot"}
+		}
+		if start > end {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", start, end)}
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+
+	seen := map[int]bool{}
+	for _, slot := range slots {
+		if seen[slot] {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Slot %d specified multiple times", slot)}
+		}
+		seen[slot] = true
+		if sub == "DELSLOTS" && clusterSlotOwners[slot] == nil {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Slot %d is already unassigned", slot)}
+		}
+		if sub != "DELSLOTS" && clusterSlotOwners[slot] != nil {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Slot %d is already busy", slot)}
+		}
+	}
+
+	for _, slot := range slots {
+		if sub == "DELSLOTS" {
+			clusterAssignSlot(slot, nil)
+		} else {
+			clusterAssignSlot(slot, clusterMyself)
+			delete(clusterImporting, slot)
+		}
+	}
+	clusterSaveConfigOrLog()
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// clusterSetSlot handles CLUSTER SETSLOT, which moves a slot between nodes. The
+// caller must hold clusterMu for writing.
+func clusterSetSlot(args []Value) Value {
+	slot, err := strconv.Atoi(args[0].bulk)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return Value{typ: ValueTypSimpleError, str: "ERR Invalid or out of range slot"}
+	}
+	action := strings.ToUpper(args[1].bulk)
+
+	if action == "STABLE" {
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+		delete(clusterMigrating, slot)
+		delete(clusterImporting, slot)
+		clusterSaveConfigOrLog()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+	if len(args) != 3 || action != "MIGRATING" && action != "IMPORTING" && action != "NODE" {
+		return Value{typ: ValueTypSimpleError, str: "ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"}
+	}
+	n := clusterNodes[args[2].bulk]
+	if n == nil {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR I don't know about node %s", args[2].bulk)}
+	}
+
+	switch action {
+	case "MIGRATING":
+		if clusterSlotOwners[slot] != clusterMyself {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot)}
+		}
+		if n == clusterMyself {
+			return Value{typ: ValueTypSimpleError, str: "ERR Target node is not different from the source node"}
+		}
+		clusterMigrating[slot] = n
+	case "IMPORTING":
+		if clusterSlotOwners[slot] == clusterMyself {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot)}
+		}
+		if n == clusterMyself {
+			return Value{typ: ValueTypSimpleError, str: "ERR Source node is not different from the target node"}
+		}
+		clusterImporting[slot] = n
+	case "NODE":
+		if clusterSlotOwners[slot] == clusterMyself && n != clusterMyself && len(keysInSlot(slot)) > 0 {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)}
+		}
+		delete(clusterMigrating, slot)
+
+		// The node that imported the slot claims it with a new epoch, so the
+		// other nodes take its word over that of the old owner
+		if n == clusterMyself && clusterImporting[slot] != nil {
+			delete(clusterImporting, slot)
+			clusterBumpEpoch()
+		}
+		clusterAssignSlot(slot, n)
+	}
+
+	clusterSaveConfigOrLog()
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// clusterNodesLines returns the lines of CLUSTER NODES, one per node. The
+// caller must hold clusterMu.
+func clusterNodesLines() []string {
+	ids := make([]string, 0, len(clusterNodes))
+	for id := range clusterNodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		n := clusterNodes[id]
+		flags, link, pong := "master", "disconnected", int64(0)
+		if n == clusterMyself {
+			flags, link = "myself,master", "connected"
+		} else if n.linkUp {
+			link = "connected"
+		}
+		if !n.pongTime.IsZero() {
+			pong = n.pongTime.UnixMilli()
+		}
+
+		line := fmt.Sprintf("%s %s:%d@%d %s - 0 %d %d %s", n.id, n.ip, n.port, n.port+clusterBusPortOffset,
+			flags, pong, n.configEpoch, link)
+		for _, r := range clusterSlotRanges(n) {
+			if r[0] == r[1] {
+				line += fmt.Sprintf(" %d", r[0])
+			} else {
+				line += fmt.Sprintf(" %d-%d", r[0], r[1])
+			}
+		}
+		if n == clusterMyself {
+			line += clusterTransitionsField(clusterMigrating, "->-")
+			line += clusterTransitionsField(clusterImporting, "-<-")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// clusterTransitionsField returns the fields of CLUSTER NODES for the slots
+// migrating or importing, separated from the other node by sep.
+func clusterTransitionsField(transitions map[int]*clusterNode, sep string) string {
+	slots := make([]int, 0, len(transitions))
+	for slot := range transitions {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	s := ""
+	for _, slot := range slots {
+		s += fmt.Sprintf(" [%d%s%s]", slot, sep, transitions[slot].id)
+	}
+	return s
+}
+
+// clusterSlotRanges returns the ranges of slots n serves. The caller must hold
+// clusterMu.
+func clusterSlotRanges(n *clusterNode) [][2]int {
+	ranges := [][2]int{}
+	for slot := 0; slot < clusterSlots; slot++ {
+		if clusterSlotOwners[slot] != n {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == slot-1 {
+			ranges[len(ranges)-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// clusterSlotsValue returns the reply of CLUSTER SLOTS. The caller must hold
+// clusterMu.
+func clusterSlotsValue() Value {
+	ranges := []Value{}
+	for slot := 0; slot < clusterSlots; {
+		n := clusterSlotOwners[slot]
+		end := slot
+		for end+1 < clusterSlots && clusterSlotOwners[end+1] == n {
+			end++
+		}
+		if n != nil {
+			ranges = append(ranges, Value{typ: ValueTypArray, array: []Value{
+				{typ: ValueTypInteger, num: slot},
+				{typ: ValueTypInteger, num: end},
+				{typ: ValueTypArray, array: []Value{bulkValue(n.ip), {typ: ValueTypInteger, num: n.port}, bulkValue(n.id)}},
+			}})
+		}
+		slot = end + 1
+	}
+	return Value{typ: ValueTypArray, array: ranges}
+}
+
+// clusterInfoLines returns the lines of CLUSTER INFO. The caller must hold
+// clusterMu.
+func clusterInfoLines() []string {
+	state := "ok"
+	if clusterSlotsAssigned < clusterSlots {
+		state = "fail"
+	}
+	serving := map[*clusterNode]bool{}
+	for _, n := range clusterSlotOwners {
+		if n != nil {
+			serving[n] = true
+		}
+	}
+
+	return []string{
+		"cluster_state:" + state,
+		"cluster_slots_assigned:" + strconv.Itoa(clusterSlotsAssigned),
+		"cluster_slots_ok:" + strconv.Itoa(clusterSlotsAssigned),
+		"cluster_slots_pfail:0",
+		"cluster_slots_fail:0",
+		"cluster_known_nodes:" + strconv.Itoa(len(clusterNodes)),
+		"cluster_size:" + strconv.Itoa(len(serving)),
+		"cluster_current_epoch:" + strconv.FormatInt(clusterCurrentEpoch, 10),
+		"cluster_my_epoch:" + strconv.FormatInt(clusterMyself.configEpoch, 10),
+	}
+}
+
+// clusterInfo returns the lines of the cluster section of INFO.
+func clusterInfo() []string {
+	return []string{"cluster_enabled:" + strconv.Itoa(boolToInt(config.clusterEnabled))}
+}
+
+// clusterCron reads the state of the other nodes every second.
+func clusterCron() {
+	conns := map[string]*clusterConn{}
+	ticker := time.NewTicker(clusterRefreshPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		clusterMu.RLock()
+		addrs := []string{}
+		for _, n := range clusterNodes {
+			if n != clusterMyself {
+				addrs = append(addrs, n.addr())
+			}
+		}
+		for addr := range clusterMeets {
+			addrs = append(addrs, addr)
+		}
+		clusterMu.RUnlock()
+
+		for _, addr := range addrs {
+			if conns[addr] == nil {
+				conns[addr] = &clusterConn{addr: addr}
+			}
+			clusterRefresh(conns[addr])
+		}
+	}
+}
+
+// clusterConn is a connection to another node, used by clusterCron only.
+type clusterConn struct {
+	addr string
+	conn net.Conn
+	resp *Resp
+}
+
+// call sends args to the node and returns its reply, connecting first if
+// needed.
+func (c *clusterConn) call(args ...string) (Value, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, clusterCallTimeout)
+		if err != nil {
+			return Value{}, err
+		}
+		c.conn, c.resp = conn, NewResp(conn)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(clusterCallTimeout))
+	_, err := c.conn.Write(commandValue(args...).Marshal())
+	var reply Value
+	if err == nil {
+		reply, err = c.resp.ReadReply()
+	}
+	if err == nil && reply.typ == ValueTypSimpleError {
+		err = errors.New(reply.str)
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// clusterRefresh reads CLUSTER NODES from the node at the address of c and
+// updates the state of the cluster with it, introducing this node to it if it
+// doesn't know about it.
+func clusterRefresh(c *clusterConn) {
+	reply, err := c.call("CLUSTER", "NODES")
+	localIP := ""
+	if err == nil {
+		localIP, _, _ = net.SplitHostPort(c.conn.LocalAddr().String())
+	}
+
+	clusterMu.Lock()
+	myIP, myPort, known := clusterApplyNodes(c.addr, reply.bulk, localIP, err)
+	clusterMu.Unlock()
+
+	if err == nil && !known && myIP != "" {
+		c.call("CLUSTER", "MEET", myIP, strconv.Itoa(myPort))
+	}
+}
+
+// clusterApplyNodes updates the state of the cluster with the CLUSTER NODES
+// reply of the node at addr, or the error reaching it. It returns the address
+// of this node and whether the other one knows about it. The caller must hold
+// clusterMu for writing.
+func clusterApplyNodes(addr string, nodes string, localIP string, callErr error) (string, int, bool) {
+	var peer *clusterNode
+	for _, n := range clusterNodes {
+		if n != clusterMyself && n.addr() == addr {
+			peer = n
+		}
+	}
+	if callErr != nil {
+		if peer != nil && peer.linkUp {
+			fmt.Printf("Lost the link to node %s at %s: %s\n", peer.id, addr, callErr)
+			peer.linkUp = false
+		}
+		return "", 0, true
+	}
+
+	changed := false
+	if clusterMyself.ip == "" && localIP != "" {
+		clusterMyself.ip = localIP
+		changed = true
+	}
+
+	// The line of the node itself tells its ID and the slots it serves
+	type nodeLine struct {
+		node  *clusterNode
+		slots []clusterSlotRange
+		self  bool
+	}
+	lines := []nodeLine{}
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		n, slots, err := parseClusterNodeLine(fields)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, nodeLine{n, slots, strings.Contains(fields[2], "myself")})
+	}
+
+	known := false
+	for _, l := range lines {
+		if l.node.id == clusterMyself.id {
+			known = true
+			continue
+		}
+		if !l.self {
+			// Nodes the other one knows about are met too
+			if clusterNodes[l.node.id] == nil && l.node.ip != "" {
+				clusterMeets[l.node.addr()] = true
+			}
+			continue
+		}
+
+		if peer != nil && peer.id != l.node.id {
+			fmt.Printf("Node at %s changed its ID from %s to %s\n", addr, peer.id, l.node.id)
+			clusterForgetNode(peer)
+			peer = nil
+		}
+		if peer == nil {
+			peer = clusterNodes[l.node.id]
+		}
+		if peer == nil {
+			host, portStr, _ := net.SplitHostPort(addr)
+			port, _ := strconv.Atoi(portStr)
+			peer = &clusterNode{id: l.node.id, ip: host, port: port}
+			clusterNodes[peer.id] = peer
+			fmt.Printf("Met node %s at %s\n", peer.id, addr)
+			changed = true
+		}
+		delete(clusterMeets, addr)
+		if !peer.linkUp {
+			peer.linkUp = true
+		}
+		peer.pongTime = time.Now()
+		if l.node.configEpoch != peer.configEpoch {
+			peer.configEpoch = l.node.configEpoch
+			changed = true
+		}
+		if peer.configEpoch > clusterCurrentEpoch {
+			clusterCurrentEpoch = peer.configEpoch
+			changed = true
+		}
+		if clusterApplyClaims(peer, l.slots) {
+			changed = true
+		}
+	}
+
+	if changed {
+		clusterSaveConfigOrLog()
+	}
+	return clusterMyself.ip, clusterMyself.port, known
+}
+
+// clusterApplyClaims updates the owners of the slots with the ones peer claims
+// to serve, reporting whether any changed. A claim wins over that of another
+// node with a lower config epoch. The caller must hold clusterMu for writing.
+func clusterApplyClaims(peer *clusterNode, ranges []clusterSlotRange) bool {
+	claimed := map[int]bool{}
+	for _, r := range ranges {
+		if r.migratingTo != "" || r.importingFrom != "" {
+			continue
+		}
+		for slot := r.start; slot <= r.end; slot++ {
+			claimed[slot] = true
+		}
+	}
+
+	changed := false
+	for slot := 0; slot < clusterSlots; slot++ {
+		owner := clusterSlotOwners[slot]
+		switch {
+		case claimed[slot] && owner != peer && (owner == nil || peer.configEpoch > owner.configEpoch):
+			if owner == clusterMyself {
+				fmt.Printf("Slot %d moved to node %s with a newer config epoch\n", slot, peer.id)
+				delete(clusterMigrating, slot)
+			}
+			delete(clusterImporting, slot)
+			clusterAssignSlot(slot, peer)
+			changed = true
+		case !claimed[slot] && owner == peer:
+			clusterAssignSlot(slot, nil)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// clusterForgetNode removes n from the cluster, along with its slots. The
+// caller must hold clusterMu for writing.
+func clusterForgetNode(n *clusterNode) {
+	for slot := 0; slot < clusterSlots; slot++ {
+		if clusterSlotOwners[slot] == n {
+			clusterAssignSlot(slot, nil)
+		}
+	}
+	for slot, target := range clusterMigrating {
+		if target == n {
+			delete(clusterMigrating, slot)
+		}
+	}
+	for slot, source := range clusterImporting {
+		if source == n {
+			delete(clusterImporting, slot)
+		}
+	}
+	delete(clusterNodes, n.id)
+}
@@ -0,0 +1,468 @@
+/*
+This file contains the command table, which describes every command the server
+supports: the handler that executes it, its arity, its flags and the positions of
+its key arguments. The dispatcher uses the table to find handlers and validate
+arity, and the COMMAND command exposes it to clients so tools like redis-cli and
+cluster-aware clients can discover what the server supports. For a detailed
+description of the metadata, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/command/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Command describes a command and how to execute it.
+type Command struct {
+	name     string
+	handler  func(c *Client, args []Value) Value
+	arity    int      // Number of arguments including the name, -N means at least N
+	flags    []string // Flags such as write, readonly or fast
+	firstKey int      // Position of the first key argument, 0 when there are no keys
+	lastKey  int      // Position of the last key argument, negative counts from the end
+	step     int      // Distance between key arguments
+	group    string   // Command group used for documentation and ACL categories
+	since    string   // Redis version that introduced the command
+	summary  string
+
+	// exclusive commands run with every other command stopped
+	exclusive bool
+
+	// getKeys returns the positions of the key arguments for commands whose keys
+	// can't be described by firstKey, lastKey and step alone
+	getKeys func(argv []Value) []int
+
+	// writes reports whether a call with args modifies the dataset, for
+	// container commands without the write flag whose subcommands may write
+	writes func(args []Value) bool
+
+	stats *commandStats
+}
+
+// commandTable lists every supported command.
+var commandTable = []Command{
+	{name: "ping", handler: ping, arity: -1, flags: []string{"fast"}, group: "connection", since: "1.0.0", summary: "Returns the server's liveliness response."},
+	{name: "echo", handler: echo, arity: 2, flags: []string{"fast"}, group: "connection", since: "1.0.0", summary: "Returns the given string."},
+	{name: "client", handler: clientCommand, arity: -2, flags: []string{"noscript", "loading", "stale"}, group: "connection", since: "2.4.0", summary: "A container for client connection commands."},
+	{name: "quit", handler: quitCommand, arity: -1, flags: []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"}, group: "connection", since: "1.0.0", summary: "Closes the connection."},
+	{name: "reset", handler: resetCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"}, group: "connection", since: "6.2.0", summary: "Resets the connection."},
+	{name: "auth", handler: auth, arity: -2, flags: []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"}, group: "connection", since: "1.0.0", summary: "Authenticates the connection."},
+	{name: "acl", handler: aclCommand, arity: -2, flags: []string{"admin", "noscript", "loading", "stale"}, exclusive: true, group: "server", since: "6.0.0", summary: "A container for Access List Control commands."},
+	{name: "hello", handler: hello, arity: -1, flags: []string{"noscript", "loading", "stale", "fast", "no_auth", "allow_busy"}, group: "connection", since: "6.0.0", summary: "Handshakes with the Redis server."},
+	{name: "info", handler: info, arity: -1, flags: []string{"loading", "stale"}, group: "server", since: "1.0.0", summary: "Returns information and statistics about the server."},
+	{name: "time", handler: timeCommand, arity: 1, flags: []string{"loading", "stale", "fast"}, group: "server", since: "2.6.0", summary: "Returns the server time."},
+	{name: "set", handler: set, arity: -3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "string", since: "1.0.0", summary: "Sets the string value of a key."},
+	{name: "setex", handler: setex, arity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "string", since: "2.0.0", summary: "Sets the string value and expiration time of a key. Creates the key if it doesn't exist."},
+	{name: "psetex", handler: psetex, arity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "string", since: "2.6.0", summary: "Sets both string value and expiration time in milliseconds of a key. The key is created if it doesn't exist."},
+	{name: "get", handler: get, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "string", since: "1.0.0", summary: "Returns the string value of a key."},
+	{name: "hset", handler: hset, arity: -4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "hash", since: "2.0.0", summary: "Creates or modifies the value of a field in a hash."},
+	{name: "hmset", handler: hset, arity: -4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "hash", since: "2.0.0", summary: "Sets the values of multiple fields."},
+	{name: "hget", handler: hget, arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "hash", since: "2.0.0", summary: "Returns the value of a field in a hash."},
+	{name: "hgetall", handler: hgetall, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "hash", since: "2.0.0", summary: "Returns all fields and values in a hash."},
+	{name: "lpush", handler: lpush, arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist."},
+	{name: "rpush", handler: rpush, arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Appends one or more elements to a list. Creates the key if it doesn't exist."},
+	{name: "lpushx", handler: lpushx, arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "2.2.0", summary: "Prepends one or more elements to a list only when the list exists."},
+	{name: "rpushx", handler: rpushx, arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "2.2.0", summary: "Appends an element to a list only when the list exists."},
+	{name: "lpop", handler: lpop, arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped."},
+	{name: "rpop", handler: rpop, arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped."},
+	{name: "llen", handler: llen, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Returns the length of a list."},
+	{name: "lrange", handler: lrange, arity: 4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Returns a range of elements from a list."},
+	{name: "lindex", handler: lindex, arity: 3, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Returns an element from a list by its index."},
+	{name: "lset", handler: lset, arity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Sets the value of an element in a list by its index."},
+	{name: "lrem", handler: lrem, arity: 4, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Removes elements from a list. Deletes the list if the last element was removed."},
+	{name: "ltrim", handler: ltrim, arity: 4, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "1.0.0", summary: "Removes elements from both ends of a list. Deletes the list if all elements were trimmed."},
+	{name: "linsert", handler: linsert, arity: 5, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "list", since: "2.2.0", summary: "Inserts an element before or after another element in a list."},
+	{name: "sadd", handler: sadd, arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "set", since: "1.0.0", summary: "Adds one or more members to a set. Creates the key if it doesn't exist."},
+	{name: "srem", handler: srem, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "set", since: "1.0.0", summary: "Removes one or more members from a set. Deletes the set if the last member was removed."},
+	{name: "sismember", handler: sismember, arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "set", since: "1.0.0", summary: "Determines whether a member belongs to a set."},
+	{name: "smembers", handler: smembers, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "set", since: "1.0.0", summary: "Returns all members of a set."},
+	{name: "scard", handler: scard, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "set", since: "1.0.0", summary: "Returns the number of members in a set."},
+	{name: "bitop", handler: bitop, arity: -4, flags: []string{"write", "denyoom"}, firstKey: 2, lastKey: -1, step: 1, group: "bitmap", since: "2.6.0", summary: "Performs bitwise operations on multiple strings, and stores the result."},
+	{name: "bitpos", handler: bitpos, arity: -3, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "bitmap", since: "2.8.7", summary: "Finds the first set (1) or clear (0) bit in a string."},
+	{name: "bitfield", handler: bitfield, arity: -2, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "bitmap", since: "3.2.0", summary: "Performs arbitrary bitfield integer operations on strings."},
+	{name: "bitfield_ro", handler: bitfieldRo, arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "bitmap", since: "6.0.0", summary: "Performs arbitrary read-only bitfield integer operations on strings."},
+	{name: "pfadd", handler: pfadd, arity: -2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "hyperloglog", since: "2.8.9", summary: "Adds elements to a HyperLogLog key. Creates the key if it doesn't exist."},
+	{name: "pfcount", handler: pfcount, arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: -1, step: 1, group: "hyperloglog", since: "2.8.9", summary: "Returns the approximated cardinality of the set(s) observed by the HyperLogLog key(s)."},
+	{name: "pfmerge", handler: pfmerge, arity: -2, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: -1, step: 1, group: "hyperloglog", since: "2.8.9", summary: "Merges one or more HyperLogLog values into a single key."},
+	{name: "xadd", handler: xadd, arity: -5, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Appends a new message to a stream. Creates the key if it doesn't exist."},
+	{name: "xlen", handler: xlen, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Return the number of messages in a stream."},
+	{name: "xrange", handler: xrange, arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Returns the messages from a stream within a range of IDs."},
+	{name: "xrevrange", handler: xrevrange, arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Returns the messages from a stream within a range of IDs in reverse order."},
+	{name: "xread", handler: xread, arity: -4, flags: []string{"readonly", "blocking", "movablekeys"}, getKeys: streamsKeys, group: "stream", since: "5.0.0", summary: "Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise."},
+	{name: "xgroup", handler: xgroup, arity: -2, flags: []string{"write", "denyoom"}, firstKey: 2, lastKey: 2, step: 1, group: "stream", since: "5.0.0", summary: "Creates, destroys and manages consumer groups and their consumers."},
+	{name: "xreadgroup", handler: xreadgroup, arity: -7, flags: []string{"write", "blocking", "movablekeys"}, getKeys: streamsKeys, group: "stream", since: "5.0.0", summary: "Returns new or historical messages from a stream for a consumer in a group. Blocks until a message is available otherwise."},
+	{name: "xack", handler: xack, arity: -4, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Returns the number of messages that were successfully acknowledged by the consumer group member of a stream."},
+	{name: "xpending", handler: xpending, arity: -3, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Returns the information and entries from a stream consumer group's pending entries list."},
+	{name: "xclaim", handler: xclaim, arity: -6, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Changes, or acquires, ownership of a message in a consumer group, as if the message was delivered a consumer group member."},
+	{name: "xautoclaim", handler: xautoclaim, arity: -6, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "6.2.0", summary: "Changes, or acquires, ownership of messages in a consumer group, as if the messages were delivered to as consumer group member."},
+	{name: "xtrim", handler: xtrim, arity: -4, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Deletes messages from the beginning of a stream."},
+	{name: "xdel", handler: xdel, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "stream", since: "5.0.0", summary: "Returns the number of messages after removing them from a stream."},
+	{name: "xinfo", handler: xinfo, arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, group: "stream", since: "5.0.0", summary: "A container for stream introspection commands."},
+	{name: "geoadd", handler: geoadd, arity: -5, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "geo", since: "3.2.0", summary: "Adds one or more members to a geospatial index. The key is created if it doesn't exist."},
+	{name: "geopos", handler: geopos, arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "geo", since: "3.2.0", summary: "Returns the longitude and latitude of members from a geospatial index."},
+	{name: "geodist", handler: geodist, arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "geo", since: "3.2.0", summary: "Returns the distance between two members of a geospatial index."},
+	{name: "geosearch", handler: geosearch, arity: -7, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "geo", since: "6.2.0", summary: "Queries a geospatial index for members inside an area of a box or a circle."},
+	{name: "object", handler: object, arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, group: "generic", since: "2.2.3", summary: "A container for object introspection commands."},
+	{name: "dump", handler: dump, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "2.6.0", summary: "Returns a serialized representation of the value stored at a key."},
+	{name: "restore", handler: restore, arity: -4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "2.6.0", summary: "Creates a key from the serialized representation of a value."},
+	{name: "restore-asking", handler: restore, arity: -4, flags: []string{"write", "denyoom", "asking"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "3.0.0", summary: "An internal command for migrating keys in a cluster."},
+	{name: "migrate", handler: migrate, arity: -6, flags: []string{"movablekeys"}, getKeys: migrateKeys, exclusive: true, group: "generic", since: "2.6.0", summary: "Atomically transfers a key from one Redis instance to another."},
+	{name: "sort", handler: sortCommand, arity: -2, flags: []string{"write", "denyoom", "movablekeys"}, firstKey: 1, lastKey: 1, step: 1, getKeys: sortKeys, group: "generic", since: "1.0.0", summary: "Sorts the elements in a list, a set, or a sorted set, optionally storing the result."},
+	{name: "sort_ro", handler: sortRo, arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "7.0.0", summary: "Returns the sorted elements of a list, a set, or a sorted set."},
+	{name: "debug", handler: debug, arity: -2, flags: []string{"admin", "noscript", "loading", "stale", "protected"}, exclusive: true, group: "server", since: "1.0.0", summary: "A container for debugging commands."},
+	{name: "save", handler: saveCommand, arity: 1, flags: []string{"admin", "noscript", "no_async_loading", "no_multi"}, exclusive: true, group: "server", since: "1.0.0", summary: "Synchronously saves the database(s) to disk."},
+	{name: "bgsave", handler: bgsave, arity: -1, flags: []string{"admin", "noscript", "no_async_loading"}, exclusive: true, group: "server", since: "1.0.0", summary: "Asynchronously saves the database(s) to disk."},
+	{name: "bgrewriteaof", handler: bgrewriteaof, arity: 1, flags: []string{"admin", "noscript", "no_async_loading"}, exclusive: true, group: "server", since: "1.0.0", summary: "Asynchronously rewrites the append-only file to disk."},
+	{name: "lastsave", handler: lastsave, arity: 1, flags: []string{"random", "loading", "stale", "fast"}, group: "server", since: "1.0.0", summary: "Returns the Unix timestamp of the last successful save to disk."},
+	{name: "shutdown", handler: shutdownCommand, arity: -1, flags: []string{"admin", "noscript", "loading", "stale", "no_multi", "allow_busy"}, exclusive: true, group: "server", since: "1.0.0", summary: "Synchronously saves the database(s) to disk and shuts down the Redis server."},
+	{name: "wait", handler: waitCommand, arity: 3, flags: []string{"noscript", "blocking"}, group: "generic", since: "3.0.0", summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed."},
+	{name: "replicaof", handler: replicaofCommand, arity: 3, flags: []string{"admin", "noscript", "stale", "no_async_loading"}, exclusive: true, group: "server", since: "5.0.0", summary: "Configures a server as replica of another, or promotes it to a master."},
+	{name: "slaveof", handler: replicaofCommand, arity: 3, flags: []string{"admin", "noscript", "stale", "no_async_loading"}, exclusive: true, group: "server", since: "1.0.0", summary: "Sets a Redis server as a replica of another, or promotes it to being a master."},
+	{name: "failover", handler: failoverCommand, arity: -1, flags: []string{"admin", "noscript", "stale"}, exclusive: true, group: "server", since: "6.2.0", summary: "Starts a coordinated failover from a server to one of its replicas."},
+	{name: "replconf", handler: replconfCommand, arity: -1, flags: []string{"admin", "noscript", "loading", "stale", "allow_busy"}, group: "server", since: "3.0.0", summary: "An internal command for configuring the replication stream."},
+	{name: "psync", handler: psyncCommand, arity: -3, flags: []string{"admin", "noscript", "no_async_loading", "no_multi"}, exclusive: true, group: "server", since: "2.8.0", summary: "An internal command used in replication."},
+	{name: "sync", handler: syncCommand, arity: 1, flags: []string{"admin", "noscript", "no_async_loading", "no_multi"}, exclusive: true, group: "server", since: "1.0.0", summary: "An internal command used in replication."},
+	{name: "role", handler: roleCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}, group: "server", since: "2.8.12", summary: "Returns the replication role."},
+	{name: "cluster", handler: clusterCommand, arity: -2, flags: []string{"loading", "stale"}, exclusive: true, group: "cluster", since: "3.0.0", summary: "A container for Redis Cluster commands."},
+	{name: "asking", handler: asking, arity: 1, flags: []string{"fast"}, group: "cluster", since: "3.0.0", summary: "Signals that a cluster client is following an -ASK redirect."},
+	{name: "config", handler: configCommand, arity: -2, flags: []string{"admin", "noscript", "loading", "stale"}, exclusive: true, group: "server", since: "2.0.0", summary: "A container for server configuration commands."},
+	{name: "latency", handler: latency, arity: -2, flags: []string{"admin", "noscript", "loading", "stale"}, group: "server", since: "2.8.13", summary: "A container for latency diagnostics commands."},
+	{name: "memory", handler: memoryCommand, arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, group: "server", since: "4.0.0", summary: "A container for memory diagnostics commands."},
+	{name: "multi", handler: multiCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}, group: "transactions", since: "1.2.0", summary: "Starts a transaction."},
+	{name: "exec", handler: execCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "skip_slowlog"}, exclusive: true, group: "transactions", since: "1.2.0", summary: "Executes all commands in a transaction."},
+	{name: "discard", handler: discardCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}, group: "transactions", since: "2.0.0", summary: "Discards a transaction."},
+	{name: "watch", handler: watchCommand, arity: -2, flags: []string{"noscript", "loading", "stale", "fast"}, firstKey: 1, lastKey: -1, step: 1, group: "transactions", since: "2.2.0", summary: "Monitors changes to keys to determine the execution of a transaction."},
+	{name: "unwatch", handler: unwatchCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}, group: "transactions", since: "2.2.0", summary: "Forgets about watched keys of a transaction."},
+	{name: "subscribe", handler: subscribeCommand, arity: -2, flags: []string{"pubsub", "noscript", "loading", "stale"}, group: "pubsub", since: "2.0.0", summary: "Listens for messages published to channels."},
+	{name: "unsubscribe", handler: unsubscribeCommand, arity: -1, flags: []string{"pubsub", "noscript", "loading", "stale"}, group: "pubsub", since: "2.0.0", summary: "Stops listening to messages posted to channels."},
+	{name: "psubscribe", handler: psubscribeCommand, arity: -2, flags: []string{"pubsub", "noscript", "loading", "stale"}, group: "pubsub", since: "2.0.0", summary: "Listens for messages published to channels that match one or more patterns."},
+	{name: "punsubscribe", handler: punsubscribeCommand, arity: -1, flags: []string{"pubsub", "noscript", "loading", "stale"}, group: "pubsub", since: "2.0.0", summary: "Stops listening to messages published to channels that match one or more patterns."},
+	{name: "publish", handler: publish, arity: 3, flags: []string{"pubsub", "loading", "stale", "fast"}, group: "pubsub", since: "2.0.0", summary: "Posts a message to a channel."},
+	{name: "pubsub", handler: pubsubCommand, arity: -2, flags: []string{"pubsub", "loading", "stale"}, group: "pubsub", since: "2.8.0", summary: "A container for Pub/Sub commands."},
+	{name: "ssubscribe", handler: ssubscribeCommand, arity: -2, flags: []string{"pubsub", "noscript", "loading", "stale"}, firstKey: 1, lastKey: -1, step: 1, group: "pubsub", since: "7.0.0", summary: "Listens for messages published to shard channels."},
+	{name: "sunsubscribe", handler: sunsubscribeCommand, arity: -1, flags: []string{"pubsub", "noscript", "loading", "stale"}, firstKey: 1, lastKey: -1, step: 1, group: "pubsub", since: "7.0.0", summary: "Stops listening to messages posted to shard channels."},
+	{name: "spublish", handler: spublish, arity: 3, flags: []string{"pubsub", "loading", "stale", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "pubsub", since: "7.0.0", summary: "Posts a message to a shard channel."},
+	{name: "eval", handler: eval, arity: -3, flags: []string{"noscript", "stale", "skip_monitor", "may_replicate", "no_mandatory_keys", "movablekeys"}, getKeys: evalKeys, exclusive: true, group: "scripting", since: "2.6.0", summary: "Executes a server-side Lua script."},
+	{name: "evalsha", handler: evalsha, arity: -3, flags: []string{"noscript", "stale", "skip_monitor", "may_replicate", "no_mandatory_keys", "movablekeys"}, getKeys: evalKeys, exclusive: true, group: "scripting", since: "2.6.0", summary: "Executes a server-side Lua script by SHA1 digest."},
+	{name: "script", handler: script, arity: -2, flags: []string{"noscript"}, group: "scripting", since: "2.6.0", summary: "A container for Lua scripts management commands."},
+	{name: "function", handler: functionCommand, arity: -2, flags: []string{"noscript", "may_replicate"}, writes: functionModifies, group: "scripting", since: "7.0.0", summary: "A container for function commands."},
+	{name: "fcall", handler: fcall, arity: -3, flags: []string{"noscript", "stale", "skip_monitor", "may_replicate", "no_mandatory_keys", "movablekeys"}, getKeys: evalKeys, exclusive: true, group: "scripting", since: "7.0.0", summary: "Invokes a function."},
+	{name: "fcall_ro", handler: fcallRO, arity: -3, flags: []string{"noscript", "stale", "skip_monitor", "no_mandatory_keys", "movablekeys"}, getKeys: evalKeys, exclusive: true, group: "scripting", since: "7.0.0", summary: "Invokes a read-only function."},
+	{name: "select", handler: selectCommand, arity: 2, flags: []string{"loading", "stale", "fast"}, group: "connection", since: "1.0.0", summary: "Changes the selected database."},
+	{name: "swapdb", handler: swapdb, arity: 3, flags: []string{"write", "fast"}, exclusive: true, group: "server", since: "4.0.0", summary: "Swaps two Redis databases."},
+	{name: "del", handler: del, arity: -2, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 1, group: "generic", since: "1.0.0", summary: "Deletes one or more keys."},
+	{name: "unlink", handler: unlink, arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: -1, step: 1, group: "generic", since: "4.0.0", summary: "Asynchronously deletes one or more keys."},
+	{name: "expire", handler: expire, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "1.0.0", summary: "Sets the expiration time of a key in seconds."},
+	{name: "pexpire", handler: pexpire, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "2.6.0", summary: "Sets the expiration time of a key in milliseconds."},
+	{name: "expireat", handler: expireat, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "1.2.0", summary: "Sets the expiration time of a key to a Unix timestamp."},
+	{name: "pexpireat", handler: pexpireat, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "2.6.0", summary: "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+	{name: "persist", handler: persist, arity: 2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, group: "generic", since: "2.2.0", summary: "Removes the expiration time of a key."},
+	{name: "flushdb", handler: flushdb, arity: -1, flags: []string{"write"}, exclusive: true, group: "server", since: "1.0.0", summary: "Remove all keys from the current database."},
+	{name: "flushall", handler: flushall, arity: -1, flags: []string{"write"}, exclusive: true, group: "server", since: "1.0.0", summary: "Removes all keys from all databases."},
+	{name: "move", handler: move, arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, exclusive: true, group: "generic", since: "1.0.0", summary: "Moves a key to another database."},
+	{name: "command", handler: command, arity: -1, flags: []string{"loading", "stale"}, group: "server", since: "2.8.13", summary: "Returns detailed information about all commands."},
+}
+
+// Commands maps upper-case command names to their entry in the command table,
+// under the names set with rename-command. originalCommands maps the names the
+// commands were defined with, for ACL rules and statistics.
+var Commands = map[string]*Command{}
+var originalCommands = map[string]*Command{}
+
+func init() {
+	for i := range commandTable {
+		commandTable[i].stats = &commandStats{}
+		Commands[strings.ToUpper(commandTable[i].name)] = &commandTable[i]
+		originalCommands[strings.ToUpper(commandTable[i].name)] = &commandTable[i]
+	}
+}
+
+// renameCommand makes the command called oldName available as newName instead,
+// as the rename-command directive does. An empty newName disables the command.
+func renameCommand(oldName, newName string) error {
+	oldName, newName = strings.ToUpper(oldName), strings.ToUpper(newName)
+
+	cmd, ok := Commands[oldName]
+	if !ok {
+		return errors.New("no such command in rename-command")
+	}
+	if newName != "" {
+		if _, ok := Commands[newName]; ok {
+			return errors.New("target command name already exists")
+		}
+		Commands[newName] = cmd
+	}
+	delete(Commands, oldName)
+
+	return nil
+}
+
+// hasFlag reports whether the command has the given flag.
+func (c *Command) hasFlag(flag string) bool {
+	for _, f := range c.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// isWrite reports whether a call with args, which exclude the name, may modify
+// the dataset and so has to be persisted and replicated.
+func (c *Command) isWrite(args []Value) bool {
+	return c.hasFlag("write") || (c.writes != nil && c.writes(args))
+}
+
+// checkArity reports whether argc, which includes the command name, is valid.
+func (c *Command) checkArity(argc int) bool {
+	if c.arity >= 0 {
+		return argc == c.arity
+	}
+	return argc >= -c.arity
+}
+
+// keyPositions returns the positions of the key arguments in argv, which
+// includes the command name.
+func (c *Command) keyPositions(argv []Value) []int {
+	if c.getKeys != nil {
+		return c.getKeys(argv)
+	}
+	if c.firstKey == 0 {
+		return nil
+	}
+
+	last := c.lastKey
+	if last < 0 {
+		last = len(argv) + last
+	}
+
+	positions := []int{}
+	for i := c.firstKey; i <= last && i < len(argv); i += c.step {
+		positions = append(positions, i)
+	}
+	return positions
+}
+
+// streamsKeys returns the key positions of XREAD and XREADGROUP, which list
+// their keys after STREAMS followed by the same number of IDs.
+func streamsKeys(argv []Value) []int {
+	for i := 1; i < len(argv); i++ {
+		if strings.ToUpper(argv[i].bulk) != "STREAMS" {
+			continue
+		}
+
+		remaining := len(argv) - i - 1
+		if remaining == 0 || remaining%2 != 0 {
+			return nil
+		}
+
+		positions := []int{}
+		for j := i + 1; j <= i+remaining/2; j++ {
+			positions = append(positions, j)
+		}
+		return positions
+	}
+	return nil
+}
+
+// sortKeys returns the key positions of SORT, which are the sorted key and
+// the destination of STORE.
+func sortKeys(argv []Value) []int {
+	positions := []int{1}
+
+	// Skip over option arguments so a pattern that reads "store" isn't mistaken
+	// for the option
+	for i := 2; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i].bulk) {
+		case "LIMIT":
+			i += 2
+		case "BY", "GET":
+			i++
+		case "STORE":
+			if i+1 < len(argv) {
+				positions = append(positions, i+1)
+			}
+			i++
+		}
+	}
+	return positions
+}
+
+// aclCategories derives the ACL categories of the command from its group and flags.
+func (c *Command) aclCategories() []string {
+	categories := []string{}
+
+	switch c.group {
+	case "transactions":
+		categories = append(categories, "@transaction")
+	case "scripting":
+		categories = append(categories, "@scripting")
+	case "pubsub":
+		categories = append(categories, "@pubsub")
+	case "connection", "hash", "list", "set", "stream", "geo", "hyperloglog", "bitmap", "string":
+		categories = append(categories, "@"+c.group)
+	case "sorted-set":
+		categories = append(categories, "@sortedset")
+	case "generic":
+		categories = append(categories, "@keyspace")
+	}
+
+	if c.hasFlag("write") {
+		categories = append(categories, "@write")
+	}
+	if c.hasFlag("readonly") {
+		categories = append(categories, "@read")
+	}
+	if c.hasFlag("fast") {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+	if c.hasFlag("blocking") {
+		categories = append(categories, "@blocking")
+	}
+	if c.hasFlag("admin") {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+
+	return categories
+}
+
+// infoValue builds the COMMAND INFO reply for the command.
+func (c *Command) infoValue() Value {
+	flags := make([]Value, 0, len(c.flags))
+	for _, f := range c.flags {
+		flags = append(flags, Value{typ: ValueTypSimpleString, str: f})
+	}
+
+	categories := []Value{}
+	for _, cat := range c.aclCategories() {
+		categories = append(categories, Value{typ: ValueTypSimpleString, str: cat})
+	}
+
+	return Value{typ: ValueTypArray, array: []Value{
+		bulkValue(c.name),
+		{typ: ValueTypInteger, num: c.arity},
+		{typ: ValueTypArray, array: flags},
+		{typ: ValueTypInteger, num: c.firstKey},
+		{typ: ValueTypInteger, num: c.lastKey},
+		{typ: ValueTypInteger, num: c.step},
+		{typ: ValueTypArray, array: categories},
+		{typ: ValueTypArray, array: []Value{}}, // Tips
+		{typ: ValueTypArray, array: []Value{}}, // Key specifications
+		{typ: ValueTypArray, array: []Value{}}, // Subcommands
+	}}
+}
+
+// docsValue builds the COMMAND DOCS reply for the command.
+func (c *Command) docsValue() Value {
+	return Value{typ: ValueTypMap, array: []Value{
+		bulkValue("summary"), bulkValue(c.summary),
+		bulkValue("since"), bulkValue(c.since),
+		bulkValue("group"), bulkValue(c.group),
+	}}
+}
+
+// sortedCommandNames returns the upper-case names of all commands in order.
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// command handles the COMMAND command.
+func command(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		values := []Value{}
+		for _, name := range sortedCommandNames() {
+			values = append(values, Commands[name].infoValue())
+		}
+		return Value{typ: ValueTypArray, array: values}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "COUNT":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'command|count' command"}
+		}
+		return Value{typ: ValueTypInteger, num: len(Commands)}
+
+	case "INFO":
+		names := []string{}
+		for _, arg := range args[1:] {
+			names = append(names, strings.ToUpper(arg.bulk))
+		}
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+
+		values := []Value{}
+		for _, name := range names {
+			cmd, ok := Commands[name]
+			if !ok {
+				values = append(values, Value{typ: ValueTypNullArray})
+				continue
+			}
+			values = append(values, cmd.infoValue())
+		}
+		return Value{typ: ValueTypArray, array: values}
+
+	case "DOCS":
+		names := []string{}
+		for _, arg := range args[1:] {
+			names = append(names, strings.ToUpper(arg.bulk))
+		}
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+
+		// Unknown commands are left out of the reply
+		values := []Value{}
+		for _, name := range names {
+			cmd, ok := Commands[name]
+			if !ok {
+				continue
+			}
+			values = append(values, bulkValue(cmd.name), cmd.docsValue())
+		}
+		return Value{typ: ValueTypMap, array: values}
+
+	case "GETKEYS":
+		if len(args) < 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'command|getkeys' command"}
+		}
+
+		argv := args[1:]
+		cmd, ok := Commands[strings.ToUpper(argv[0].bulk)]
+		if !ok {
+			return Value{typ: ValueTypSimpleError, str: "ERR Invalid command specified"}
+		}
+		if !cmd.checkArity(len(argv)) {
+			return Value{typ: ValueTypSimpleError, str: "ERR Invalid number of arguments specified for command"}
+		}
+
+		positions := cmd.keyPositions(argv)
+		if len(positions) == 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR The command has no key arguments"}
+		}
+
+		keys := make([]Value, 0, len(positions))
+		for _, pos := range positions {
+			keys = append(keys, bulkValue(argv[pos].bulk))
+		}
+		return Value{typ: ValueTypArray, array: keys}
+
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", args[0].bulk)}
+	}
+}
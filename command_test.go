@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// getKeys runs COMMAND GETKEYS for the command args, returning the keys it
+// found or the error it replied with.
+func getKeys(args ...string) ([]string, string) {
+	request := requestValue(append([]string{"GETKEYS"}, args...)...)
+	reply := command(nil, request.array)
+	if reply.typ == ValueTypSimpleError {
+		return nil, reply.str
+	}
+	keys := []string{}
+	for _, v := range reply.array {
+		keys = append(keys, v.bulk)
+	}
+	return keys, ""
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"fixed position", []string{"GET", "k"}, []string{"k"}},
+		{"key range", []string{"BITOP", "AND", "dst", "a", "b"}, []string{"dst", "a", "b"}},
+		{"sort", []string{"SORT", "src"}, []string{"src"}},
+		{"sort store", []string{"SORT", "src", "STORE", "dst"}, []string{"src", "dst"}},
+		{"sort store lower case", []string{"sort", "src", "store", "dst"}, []string{"src", "dst"}},
+		{"sort store after options", []string{"SORT", "src", "BY", "w_*", "LIMIT", "0", "10", "GET", "#", "DESC", "ALPHA", "STORE", "dst"}, []string{"src", "dst"}},
+		{"sort by pattern named store", []string{"SORT", "src", "BY", "store"}, []string{"src"}},
+		{"sort get pattern named store", []string{"SORT", "src", "GET", "STORE", "STORE", "dst"}, []string{"src", "dst"}},
+		{"sort limit values named store", []string{"SORT", "src", "LIMIT", "STORE", "STORE"}, []string{"src"}},
+		{"sort_ro", []string{"SORT_RO", "src", "GET", "#"}, []string{"src"}},
+		{"xread", []string{"XREAD", "COUNT", "2", "STREAMS", "s1", "s2", "0", "0"}, []string{"s1", "s2"}},
+		{"xreadgroup", []string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "s1", ">"}, []string{"s1"}},
+		{"eval", []string{"EVAL", "return 1", "2", "k1", "k2", "arg"}, []string{"k1", "k2"}},
+		{"migrate", []string{"MIGRATE", "host", "6379", "k", "0", "1000"}, []string{"k"}},
+		{"migrate keys", []string{"MIGRATE", "host", "6379", "", "0", "1000", "KEYS", "k1", "k2"}, []string{"k1", "k2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, errStr := getKeys(tt.args...)
+			if errStr != "" {
+				t.Fatalf("got %q", errStr)
+			}
+			if !slices.Equal(keys, tt.want) {
+				t.Fatalf("got %q, want %q", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandGetKeysInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown command", []string{"NOSUCHCOMMAND", "k"}, "ERR Invalid command specified"},
+		{"wrong arity", []string{"GET"}, "ERR Invalid number of arguments specified for command"},
+		{"no keys", []string{"PING"}, "ERR The command has no key arguments"},
+		{"eval without keys", []string{"EVAL", "return 1", "0"}, "ERR The command has no key arguments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errStr := getKeys(tt.args...)
+			if !strings.HasPrefix(errStr, tt.want) {
+				t.Fatalf("got %q, want %q", errStr, tt.want)
+			}
+		})
+	}
+}
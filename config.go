@@ -0,0 +1,737 @@
+/*
+This file contains the server configuration. Every parameter is registered in a
+single table with its default value and how to parse and format it, so CONFIG GET,
+CONFIG SET and CONFIG REWRITE all work the same way for every parameter. Values
+live in the config variable, which commands read while holding execMu; CONFIG is
+an exclusive command, so a value never changes while a command is using it. For a
+detailed description of the commands, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/config-set/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// serverConfig holds the value of every configuration parameter.
+type serverConfig struct {
+	bind                    string
+	port                    int
+	databases               int
+	appendonly              bool
+	appendfilename          string
+	appenddirname           string
+	aofLoadTruncated        bool
+	aofUseRdbPreamble       bool
+	aofTimestampEnabled     bool
+	autoAofRewritePerc      int
+	autoAofRewriteMinSize   int64
+	dbfilename              string
+	logfile                 string
+	save                    []savePoint
+	requirepass             string
+	protectedMode           bool
+	singleThreadedExecution bool
+	timeout                 int
+	tcpKeepalive            int
+	clientOutputLimits      map[string]outputBufferLimit
+	replDisableTCPNodelay   bool
+	enableDebugCmd          string
+	acllogMaxLen            int
+	latencyTracking         bool
+	latencyPercentiles      []float64
+	maxmemory               int64
+	maxmemoryPolicy         string
+	maxmemorySamples        int
+	lfuLogFactor            int
+	lfuDecayTime            int
+	hashMaxListpackEntries  int
+	hashMaxListpackValue    int
+	listMaxListpackSize     int
+	setMaxIntsetEntries     int
+	activedefrag            bool
+	activeDefragThreshold   int
+	lazyfreeLazyEviction    bool
+	lazyfreeLazyExpire      bool
+	lazyfreeLazyServerDel   bool
+	lazyfreeLazyUserDel     bool
+	lazyfreeLazyUserFlush   bool
+	busyReplyThreshold      int
+	masteruser              string
+	masterauth              string
+	replDisklessSync        bool
+	replBacklogSize         int64
+	replicaReadOnly         bool
+	minReplicasToWrite      int
+	minReplicasMaxLag       int
+	clusterEnabled          bool
+	clusterConfigFile       string
+	mirrorUser              string
+	mirrorPassword          string
+}
+
+// savePoint is a save rule: save after seconds if at least changes keys changed.
+type savePoint struct {
+	seconds int
+	changes int
+}
+
+// config is the configuration of the running server.
+var config serverConfig
+
+// configFile is the path of the configuration file, empty if there's none.
+var configFile string
+
+// configParam is a configuration parameter.
+type configParam struct {
+	name         string
+	mutable      bool // Whether CONFIG SET may change it
+	list         bool // Whether the value is a list of words, written unquoted
+	defaultValue string
+	get          func() string
+	set          func(value string) error
+}
+
+var configParams = []*configParam{
+	{
+		name:         "bind",
+		list:         true,
+		defaultValue: "",
+		get:          func() string { return config.bind },
+		set: func(value string) error {
+			config.bind = strings.Join(strings.Fields(value), " ")
+			return nil
+		},
+	},
+	intParam("port", false, &config.port, 6379, 0, 65535),
+	{
+		// The working directory, where the AOF and RDB files are kept
+		name:         "dir",
+		mutable:      true,
+		defaultValue: ".",
+		get: func() string {
+			dir, _ := os.Getwd()
+			return dir
+		},
+		set: func(value string) error {
+			if err := os.Chdir(value); err != nil {
+				return errors.New(strings.TrimPrefix(err.Error(), "chdir "+value+": "))
+			}
+			return nil
+		},
+	},
+	intParam("databases", false, &config.databases, defaultDatabases, 1, 1<<20),
+	boolParam("single-threaded-execution", false, &config.singleThreadedExecution, false),
+	boolParam("appendonly", false, &config.appendonly, true),
+	stringParam("appendfilename", false, &config.appendfilename, "database.aof"),
+	stringParam("appenddirname", false, &config.appenddirname, "appendonlydir"),
+	boolParam("aof-load-truncated", true, &config.aofLoadTruncated, true),
+	boolParam("aof-use-rdb-preamble", true, &config.aofUseRdbPreamble, true),
+	boolParam("aof-timestamp-enabled", true, &config.aofTimestampEnabled, false),
+	{
+		name:         "appendfsync",
+		mutable:      true,
+		defaultValue: aofFsyncEverysec,
+		get:          func() string { return aofFsync.Load().(string) },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			switch value {
+			case aofFsyncAlways, aofFsyncEverysec, aofFsyncNo:
+				aofFsync.Store(value)
+				return nil
+			}
+			return errors.New("argument(s) must be one of the following: always, everysec, no")
+		},
+	},
+	intParam("auto-aof-rewrite-percentage", true, &config.autoAofRewritePerc, 100, 0, math.MaxInt32),
+	memoryParam("auto-aof-rewrite-min-size", true, &config.autoAofRewriteMinSize, 64*1024*1024),
+	stringParam("dbfilename", true, &config.dbfilename, "dump.rdb"),
+	stringParam("logfile", false, &config.logfile, ""),
+	{
+		name:         "save",
+		mutable:      true,
+		list:         true,
+		defaultValue: "3600 1 300 100 60 10000",
+		get:          func() string { return formatSavePoints(config.save) },
+		set: func(value string) error {
+			points, err := parseSavePoints(value)
+			if err != nil {
+				return err
+			}
+			config.save = points
+			return nil
+		},
+	},
+	boolParam("protected-mode", true, &config.protectedMode, true),
+	intParam("timeout", true, &config.timeout, 0, 0, math.MaxInt32),
+	intParam("tcp-keepalive", true, &config.tcpKeepalive, 300, 0, math.MaxInt32),
+	{
+		name:         "client-output-buffer-limit",
+		mutable:      true,
+		list:         true,
+		defaultValue: "normal 0 0 0 slave 268435456 67108864 60 pubsub 33554432 8388608 60",
+		get:          func() string { return formatOutputBufferLimits(config.clientOutputLimits) },
+		set: func(value string) error {
+			limits, err := parseOutputBufferLimits(value, config.clientOutputLimits)
+			if err != nil {
+				return err
+			}
+			config.clientOutputLimits = limits
+			return nil
+		},
+	},
+	atomicParam("proto-max-bulk-len", &protoMaxBulkLen, 512*1024*1024, 1024*1024, math.MaxInt64),
+	atomicParam("proto-max-multibulk-len", &protoMaxMultibulkLen, 1024*1024, 1, math.MaxInt32),
+	atomicParam("proto-max-nesting", &protoMaxNesting, 1, 1, 1000),
+	enumParam("enable-debug-command", false, &config.enableDebugCmd, "yes", "yes", "no", "local"),
+	{
+		name:         "requirepass",
+		mutable:      true,
+		defaultValue: "",
+		get:          func() string { return config.requirepass },
+		set: func(value string) error {
+			// The password is the one of the default user
+			rules := []string{"resetpass", ">" + value}
+			if value == "" {
+				rules = []string{"nopass"}
+			}
+			for _, rule := range rules {
+				defaultUser().applyRule(rule)
+			}
+			config.requirepass = value
+			return nil
+		},
+	},
+	intParam("acllog-max-len", true, &config.acllogMaxLen, 128, 0, math.MaxInt32),
+	boolParam("latency-tracking", true, &config.latencyTracking, true),
+	latencyTrackingPercentilesParam(),
+	{
+		name:         "latency-monitor-threshold",
+		mutable:      true,
+		defaultValue: "0",
+		get:          func() string { return strconv.FormatInt(latencyThreshold.Load(), 10) },
+		set: func(value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+			latencyThreshold.Store(n)
+			return nil
+		},
+	},
+	{
+		// The master to replicate from at startup, REPLICAOF changes it later
+		name:         "replicaof",
+		defaultValue: "",
+		get: func() string {
+			if replicaOf == nil {
+				return ""
+			}
+			return replicaOf.host + " " + strconv.Itoa(replicaOf.port)
+		},
+		set: func(value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				replicaOf = nil
+				return nil
+			}
+			if len(fields) != 2 {
+				return errors.New("wrong number of arguments")
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil || port < 0 || port > 65535 {
+				return errors.New("Invalid master port")
+			}
+			replicaOf = newMasterLink(fields[0], port)
+			return nil
+		},
+	},
+	stringParam("masteruser", true, &config.masteruser, ""),
+	stringParam("masterauth", true, &config.masterauth, ""),
+	boolParam("replica-read-only", true, &config.replicaReadOnly, true),
+	boolParam("repl-diskless-sync", true, &config.replDisklessSync, true),
+	boolParam("repl-disable-tcp-nodelay", true, &config.replDisableTCPNodelay, false),
+	intParam("min-replicas-to-write", true, &config.minReplicasToWrite, 0, 0, math.MaxInt32),
+	intParam("min-replicas-max-lag", true, &config.minReplicasMaxLag, 10, 0, math.MaxInt32),
+	replBacklogSizeParam(),
+	{
+		// The Redis server every write is mirrored to, see mirror.go
+		name:         "mirror-target",
+		mutable:      true,
+		defaultValue: "",
+		get:          mirrorTarget,
+		set:          setMirrorTarget,
+	},
+	stringParam("mirror-user", true, &config.mirrorUser, ""),
+	stringParam("mirror-password", true, &config.mirrorPassword, ""),
+	boolParam("cluster-enabled", false, &config.clusterEnabled, false),
+	stringParam("cluster-config-file", false, &config.clusterConfigFile, "nodes.conf"),
+	memoryParam("maxmemory", true, &config.maxmemory, 0),
+	enumParam("maxmemory-policy", true, &config.maxmemoryPolicy, "noeviction",
+		"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+		"allkeys-lru", "allkeys-lfu", "allkeys-random", "noeviction"),
+	intParam("maxmemory-samples", true, &config.maxmemorySamples, 5, 1, 64),
+	intParam("lfu-log-factor", true, &config.lfuLogFactor, 10, 0, math.MaxInt32),
+	intParam("lfu-decay-time", true, &config.lfuDecayTime, 1, 0, math.MaxInt32),
+	intParam("hash-max-listpack-entries", true, &config.hashMaxListpackEntries, 128, 0, math.MaxInt32),
+	intParam("hash-max-listpack-value", true, &config.hashMaxListpackValue, 64, 0, math.MaxInt32),
+	intParam("list-max-listpack-size", true, &config.listMaxListpackSize, -2, -5, math.MaxInt32),
+	intParam("set-max-intset-entries", true, &config.setMaxIntsetEntries, 512, 0, math.MaxInt32),
+	boolParam("activedefrag", true, &config.activedefrag, false),
+	intParam("active-defrag-map-threshold", true, &config.activeDefragThreshold, 50, 1, 100),
+
+	// Which deletions release big values in the background, see lazyfree.go
+	boolParam("lazyfree-lazy-eviction", true, &config.lazyfreeLazyEviction, false),
+	boolParam("lazyfree-lazy-expire", true, &config.lazyfreeLazyExpire, false),
+	boolParam("lazyfree-lazy-server-del", true, &config.lazyfreeLazyServerDel, false),
+	boolParam("lazyfree-lazy-user-del", true, &config.lazyfreeLazyUserDel, false),
+	boolParam("lazyfree-lazy-user-flush", true, &config.lazyfreeLazyUserFlush, false),
+
+	// lua-time-limit is the name busy-reply-threshold had before Redis 7
+	intParam("busy-reply-threshold", true, &config.busyReplyThreshold, 5000, 0, math.MaxInt32),
+	intParam("lua-time-limit", true, &config.busyReplyThreshold, 5000, 0, math.MaxInt32),
+}
+
+// configParamsByName maps the name of every parameter to its definition.
+var configParamsByName = map[string]*configParam{}
+
+func init() {
+	for _, param := range configParams {
+		configParamsByName[param.name] = param
+		if err := param.set(param.defaultValue); err != nil {
+			panic("invalid default for " + param.name + ": " + err.Error())
+		}
+	}
+}
+
+// boolParam defines a yes/no parameter stored in p.
+func boolParam(name string, mutable bool, p *bool, def bool) *configParam {
+	return &configParam{
+		name:         name,
+		mutable:      mutable,
+		defaultValue: formatBool(def),
+		get:          func() string { return formatBool(*p) },
+		set: func(value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				*p = true
+			case "no":
+				*p = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+// intParam defines an integer parameter stored in p, limited to [min, max].
+func intParam(name string, mutable bool, p *int, def, min, max int) *configParam {
+	return &configParam{
+		name:         name,
+		mutable:      mutable,
+		defaultValue: strconv.Itoa(def),
+		get:          func() string { return strconv.Itoa(*p) },
+		set: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*p = n
+			return nil
+		},
+	}
+}
+
+// memoryParam defines a memory size parameter stored in p, in bytes.
+func memoryParam(name string, mutable bool, p *int64, def int64) *configParam {
+	return &configParam{
+		name:         name,
+		mutable:      mutable,
+		defaultValue: strconv.FormatInt(def, 10),
+		get:          func() string { return strconv.FormatInt(*p, 10) },
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			*p = n
+			return nil
+		},
+	}
+}
+
+// atomicParam defines a mutable parameter stored in p, for the values read
+// outside of execMu. Sizes may be given with a memory unit.
+func atomicParam(name string, p *atomic.Int64, def, min, max int64) *configParam {
+	return &configParam{
+		name:         name,
+		mutable:      true,
+		defaultValue: strconv.FormatInt(def, 10),
+		get:          func() string { return strconv.FormatInt(p.Load(), 10) },
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			p.Store(n)
+			return nil
+		},
+	}
+}
+
+// replBacklogSizeParam defines repl-backlog-size, which resizes the backlog
+// kept so far.
+func replBacklogSizeParam() *configParam {
+	param := memoryParam("repl-backlog-size", true, &config.replBacklogSize, 1024*1024)
+	set := param.set
+	param.set = func(value string) error {
+		if err := set(value); err != nil {
+			return err
+		}
+		replMu.Lock()
+		if replBacklogBuf != nil {
+			replBacklogBuf = replBacklogBuf.resize(config.replBacklogSize)
+		}
+		replMu.Unlock()
+		return nil
+	}
+	return param
+}
+
+// stringParam defines a free-form string parameter stored in p.
+func stringParam(name string, mutable bool, p *string, def string) *configParam {
+	return &configParam{
+		name:         name,
+		mutable:      mutable,
+		defaultValue: def,
+		get:          func() string { return *p },
+		set: func(value string) error {
+			*p = value
+			return nil
+		},
+	}
+}
+
+// enumParam defines a parameter stored in p that takes one of values.
+func enumParam(name string, mutable bool, p *string, def string, values ...string) *configParam {
+	return &configParam{
+		name:         name,
+		mutable:      mutable,
+		defaultValue: def,
+		get:          func() string { return *p },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			for _, allowed := range values {
+				if value == allowed {
+					*p = value
+					return nil
+				}
+			}
+			return fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(values, ", "))
+		},
+	}
+}
+
+// formatBool formats a boolean the way configuration files spell it.
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory parses a memory size such as 100, 1k, 512mb or 2GB into bytes.
+// Units with a b are powers of 1024, the ones without are powers of 1000.
+func parseMemory(value string) (int64, error) {
+	s := strings.ToLower(value)
+
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			mul = unit.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// parseSavePoints parses save rules given as pairs of seconds and changes. An
+// empty string disables saving.
+func parseSavePoints(value string) ([]savePoint, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid save parameters")
+	}
+
+	points := []savePoint{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		points = append(points, savePoint{seconds: seconds, changes: changes})
+	}
+	return points, nil
+}
+
+// formatSavePoints formats save rules the way parseSavePoints reads them.
+func formatSavePoints(points []savePoint) string {
+	fields := make([]string, 0, len(points)*2)
+	for _, p := range points {
+		fields = append(fields, strconv.Itoa(p.seconds), strconv.Itoa(p.changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+// outputBufferClasses are the classes of clients client-output-buffer-limit
+// sets limits for, in the order they're formatted.
+var outputBufferClasses = []string{"normal", "replica", "pubsub"}
+
+// parseOutputBufferLimits parses the limits of client-output-buffer-limit,
+// given for one or more classes of clients as the class followed by the hard
+// limit, the soft limit and the seconds the soft limit may be exceeded for.
+// The classes not given keep their limits in current.
+func parseOutputBufferLimits(value string, current map[string]outputBufferLimit) (map[string]outputBufferLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return nil, errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+
+	limits := maps.Clone(current)
+	if limits == nil {
+		limits = map[string]outputBufferLimit{}
+	}
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = "replica"
+		}
+		if !slices.Contains(outputBufferClasses, class) {
+			return nil, errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+
+		hard, err1 := parseMemory(fields[i+1])
+		soft, err2 := parseMemory(fields[i+2])
+		seconds, err3 := strconv.Atoi(fields[i+3])
+		if err1 != nil || err2 != nil || err3 != nil || seconds < 0 {
+			return nil, errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		limits[class] = outputBufferLimit{hard: hard, soft: soft, softSeconds: seconds}
+	}
+	return limits, nil
+}
+
+// formatOutputBufferLimits formats the limits of every class of clients the way
+// parseOutputBufferLimits reads them, with the name Redis gives replicas.
+func formatOutputBufferLimits(limits map[string]outputBufferLimit) string {
+	fields := []string{}
+	for _, class := range outputBufferClasses {
+		limit := limits[class]
+		if class == "replica" {
+			class = "slave"
+		}
+		fields = append(fields, class, strconv.FormatInt(limit.hard, 10),
+			strconv.FormatInt(limit.soft, 10), strconv.Itoa(limit.softSeconds))
+	}
+	return strings.Join(fields, " ")
+}
+
+// configCommand handles the CONFIG command.
+func configCommand(c *Client, args []Value) Value {
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "GET":
+		if len(args) < 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'config|get' command"}
+		}
+		return configGet(args[1:])
+	case "SET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'config|set' command"}
+		}
+		return configSet(args[1:])
+	case "REWRITE":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'config|rewrite' command"}
+		}
+		if configFile == "" {
+			return Value{typ: ValueTypSimpleError, str: "ERR The server is running without a config file"}
+		}
+		if err := rewriteConfig(configFile); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR Rewriting config file: " + err.Error()}
+		}
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	case "RESETSTAT":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'config|resetstat' command"}
+		}
+		resetStats()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0].bulk)}
+	}
+}
+
+// configGet handles the CONFIG GET subcommand, returning every parameter that
+// matches one of the glob-style patterns.
+func configGet(patterns []Value) Value {
+	names := []string{}
+	for _, param := range configParams {
+		for _, pattern := range patterns {
+			if stringMatch(strings.ToLower(pattern.bulk), param.name) {
+				names = append(names, param.name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]Value, 0, len(names)*2)
+	for _, name := range names {
+		result = append(result, bulkValue(name), bulkValue(configParamsByName[name].get()))
+	}
+	return Value{typ: ValueTypMap, array: result}
+}
+
+// configSet handles the CONFIG SET subcommand. Either every parameter is set or,
+// if one of them is rejected, none of them is.
+func configSet(pairs []Value) Value {
+	params := []*configParam{}
+	seen := map[string]bool{}
+
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(pairs[i].bulk)
+		param, ok := configParamsByName[name]
+		if !ok {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", pairs[i].bulk)}
+		}
+		if !param.mutable {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)}
+		}
+		if seen[name] {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)}
+		}
+		seen[name] = true
+		params = append(params, param)
+	}
+
+	// Remember the old values so a failure can undo the parameters already set
+	old := make([]string, len(params))
+	for i, param := range params {
+		old[i] = param.get()
+	}
+
+	for i, param := range params {
+		if err := param.set(pairs[i*2+1].bulk); err != nil {
+			for j := 0; j < i; j++ {
+				params[j].set(old[j])
+			}
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", param.name, err)}
+		}
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// rewriteConfig writes the current configuration to path. Lines for other
+// directives and comments are kept, the lines of known parameters are replaced
+// with their current values, and parameters changed from their defaults that
+// weren't in the file are appended.
+func rewriteConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := []string{}
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+
+	written := map[string]bool{}
+	out := []string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			out = append(out, line)
+			continue
+		}
+
+		name := strings.ToLower(fields[0])
+
+		// The sentinel directives are written anew at the end
+		if sentinelMode && name == "sentinel" {
+			continue
+		}
+
+		param, ok := configParamsByName[name]
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+
+		// Directives that appear several times, like save, are written once
+		if !written[name] {
+			out = append(out, formatConfigLine(param))
+			written[name] = true
+		}
+	}
+
+	for _, param := range configParams {
+		if !written[param.name] && param.get() != param.defaultValue {
+			out = append(out, formatConfigLine(param))
+		}
+	}
+	if sentinelMode {
+		out = append(out, sentinelConfigLines()...)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(out, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// formatConfigLine formats the directive setting param to its current value.
+func formatConfigLine(param *configParam) string {
+	value := param.get()
+	if value == "" || (!param.list && strings.ContainsAny(value, " \t\"'")) {
+		value = strconv.Quote(value)
+	}
+	return param.name + " " + value
+}
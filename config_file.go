@@ -0,0 +1,208 @@
+/*
+This file contains the parser of the configuration file. The file uses the format
+of redis.conf: one directive per line followed by its arguments, which may be
+quoted, with comments starting with #. Directives are applied through the same
+parameter table CONFIG SET uses, except rename-command, which changes the names
+commands are dispatched under and can only be given in the file, before any
+client connects. Directives this server doesn't know are skipped
+with a warning, so the configuration file of an existing Redis deployment can be
+reused as is. Parameters given as command line flags are applied after the file.
+For a detailed description of the format, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/config-file/
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadConfigFile applies every directive of the configuration file at path.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// List directives such as save may appear on several lines, each adding to
+	// the value of the ones before instead of replacing it
+	lists := map[string][]string{}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		args, err := splitConfigArgs(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+
+		name := strings.ToLower(args[0])
+
+		if name == "include" {
+			if len(args) != 2 {
+				return fmt.Errorf("line %d: wrong number of arguments", i+1)
+			}
+			if err := loadConfigFile(args[1]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if name == "rename-command" {
+			if len(args) != 3 {
+				return fmt.Errorf("line %d: wrong number of arguments", i+1)
+			}
+			if err := renameCommand(args[1], args[2]); err != nil {
+				return fmt.Errorf("line %d: %s", i+1, err)
+			}
+			continue
+		}
+
+		// The state of a sentinel is kept in sentinel directives
+		if name == "sentinel" {
+			if !sentinelMode {
+				return fmt.Errorf("line %d: sentinel directive while not in sentinel mode", i+1)
+			}
+			if err := sentinelConfigDirective(args[1:]); err != nil {
+				return fmt.Errorf("line %d: %s", i+1, err)
+			}
+			continue
+		}
+
+		param, ok := configParamsByName[name]
+		if !ok {
+			fmt.Printf("Skipping unsupported directive '%s' in %s\n", args[0], path)
+			continue
+		}
+
+		var value string
+		switch {
+		case param.list:
+			if len(args) == 2 && args[1] == "" {
+				// An empty value clears the list, like save ""
+				lists[name] = []string{}
+			} else {
+				lists[name] = append(lists[name], args[1:]...)
+			}
+			value = strings.Join(lists[name], " ")
+		case len(args) == 2:
+			value = args[1]
+		default:
+			return fmt.Errorf("line %d: wrong number of arguments for '%s'", i+1, args[0])
+		}
+
+		if err := param.set(value); err != nil {
+			return fmt.Errorf("line %d: '%s': %s", i+1, args[0], err)
+		}
+	}
+
+	return nil
+}
+
+// splitConfigArgs splits a configuration line into arguments. Arguments are
+// separated by spaces and may be enclosed in double quotes, which allow
+// backslash escapes, or single quotes, which are taken literally.
+func splitConfigArgs(line string) ([]string, error) {
+	args := []string{}
+
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == '\r') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		arg := strings.Builder{}
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					default:
+						arg.WriteByte(line[i])
+					}
+					i++
+					continue
+				}
+				arg.WriteByte(line[i])
+				i++
+			}
+		case '\'':
+			i++
+			end := strings.IndexByte(line[i:], '\'')
+			if end < 0 {
+				return nil, errors.New("unbalanced quotes")
+			}
+			arg.WriteString(line[i : i+end])
+			i += end + 1
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\r' {
+				arg.WriteByte(line[i])
+				i++
+			}
+		}
+
+		// A closing quote must be followed by a space or the end of the line
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\r' {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+
+		args = append(args, arg.String())
+	}
+}
+
+// loadConfig loads the configuration from the command line. The first argument
+// may name a configuration file, and every parameter can be given as a flag
+// after it, such as --port 6380, which overrides the file.
+func loadConfig(args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		// Keep an absolute path, the dir directive changes the working directory
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := loadConfigFile(path); err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+		configFile = path
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	for _, param := range configParams {
+		flags.Func(param.name, fmt.Sprintf("set the %s parameter (default %q)", param.name, param.defaultValue), param.set)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+/*
+This file contains numbered databases. Every database is a separate keyspace with
+its own keys of every type, along with their expiration times and the clients
+blocked on or watching them. A connection starts on database 0 and switches with
+SELECT, SWAPDB exchanges the contents of two databases for every client, and MOVE
+transfers a key from one to another.
+
+The keys of a database are spread over shards by a hash of their name, each with
+its own lock, so clients working on unrelated keys don't wait for each other.
+Commands on several keys lock all of their shards, always in the same order. For
+a detailed description of the commands, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/select/
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultDatabases is the number of databases unless configured otherwise.
+const defaultDatabases = 16
+
+// dbShards is the number of shards the keys of a database are spread over. Each
+// shard has its own lock, so commands on keys of different shards never wait
+// for each other.
+const dbShards = 64
+
+// dbShard holds the keys of a database that hash to it. mu guards its maps and
+// the entries in them.
+type dbShard struct {
+	mu shardMutex
+
+	// keys maps every key to its value, whatever its type, and metadata.
+	keys map[string]*keyEntry
+
+	// expires holds the entries of the keys that have an expiration time, for
+	// the expiration cycle.
+	expires map[string]*keyEntry
+
+	// The most entries keys and expires held since they were last rebuilt,
+	// and the keys whose collections became sparse, see defrag.go.
+	keysPeak    int
+	expiresPeak int
+	sparseKeys  map[string]struct{}
+}
+
+// shardMutex is the lock of a shard. It isn't taken while the executor owns the
+// databases, see executor.go.
+type shardMutex struct {
+	rw sync.RWMutex
+}
+
+func (m *shardMutex) Lock() {
+	if !executorOwnsStore.Load() {
+		m.rw.Lock()
+	}
+}
+
+func (m *shardMutex) Unlock() {
+	if !executorOwnsStore.Load() {
+		m.rw.Unlock()
+	}
+}
+
+func (m *shardMutex) RLock() {
+	if !executorOwnsStore.Load() {
+		m.rw.RLock()
+	}
+}
+
+func (m *shardMutex) RUnlock() {
+	if !executorOwnsStore.Load() {
+		m.rw.RUnlock()
+	}
+}
+
+// DB is a numbered database.
+type DB struct {
+	id int
+
+	// shards holds the keys, each in the shard its name hashes to.
+	shards [dbShards]dbShard
+
+	// hiddenKeys stores the keys of a replica whose time has passed, out of
+	// sight of the clients until the master deletes them.
+	hiddenKeys   map[string]hiddenKey
+	hiddenKeysMu sync.Mutex
+
+	// blockedClients maps a key to the wakeup channels of the clients waiting on it.
+	blockedClients   map[string]map[chan struct{}]struct{}
+	blockedClientsMu sync.Mutex
+
+	// watchedKeys maps a key to the transactions watching it.
+	watchedKeys   map[string]map[*Transaction]struct{}
+	watchedKeysMu sync.Mutex
+}
+
+// databases holds every database, indexed by number. Swapping two databases
+// swaps their entries, so connections keep their database number but see the
+// other contents.
+var databases []*DB
+
+// newDB creates an empty database.
+func newDB(id int) *DB {
+	db := &DB{
+		id:             id,
+		hiddenKeys:     map[string]hiddenKey{},
+		blockedClients: map[string]map[chan struct{}]struct{}{},
+		watchedKeys:    map[string]map[*Transaction]struct{}{},
+	}
+	for i := range db.shards {
+		db.shards[i].keys = map[string]*keyEntry{}
+		db.shards[i].expires = map[string]*keyEntry{}
+	}
+	return db
+}
+
+// shardIndex returns the shard key hashes to, using 32-bit FNV-1a.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % dbShards)
+}
+
+// shard returns the shard holding key.
+func (db *DB) shard(key string) *dbShard {
+	return &db.shards[shardIndex(key)]
+}
+
+// lockKeys locks the shards holding keys, for writing or reading, and returns
+// the function that unlocks them. The shards are locked in order, so commands
+// locking several of them can't deadlock.
+func (db *DB) lockKeys(write bool, keys ...string) func() {
+	var locked [dbShards]bool
+	for _, key := range keys {
+		locked[shardIndex(key)] = true
+	}
+
+	shards := []*dbShard{}
+	for i := range db.shards {
+		if !locked[i] {
+			continue
+		}
+		s := &db.shards[i]
+		if write {
+			s.mu.Lock()
+		} else {
+			s.mu.RLock()
+		}
+		shards = append(shards, s)
+	}
+
+	return func() {
+		for _, s := range shards {
+			if write {
+				s.mu.Unlock()
+			} else {
+				s.mu.RUnlock()
+			}
+		}
+	}
+}
+
+// argKeys returns the keys among args, for locking them together.
+func argKeys(args []Value) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.bulk
+	}
+	return keys
+}
+
+// initDatabases creates n empty databases.
+func initDatabases(n int) {
+	databases = make([]*DB, n)
+	for i := range databases {
+		databases[i] = newDB(i)
+	}
+}
+
+// parseDBIndex parses a database number, checking it's in range.
+func parseDBIndex(arg string) (int, *Value) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, &Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	if index < 0 || index >= len(databases) {
+		return 0, &Value{typ: ValueTypSimpleError, str: "ERR DB index is out of range"}
+	}
+	return index, nil
+}
+
+// selectDB handles the SELECT command, returning the database to switch to.
+func selectDB(args []Value) (int, Value) {
+	index, errValue := parseDBIndex(args[0].bulk)
+	if errValue != nil {
+		return 0, *errValue
+	}
+	if config.clusterEnabled && index != 0 {
+		return 0, Value{typ: ValueTypSimpleError, str: "ERR SELECT is not allowed in cluster mode"}
+	}
+	return index, Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// swapdb handles the SWAPDB command.
+func swapdb(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'swapdb' command"}
+	}
+	if config.clusterEnabled {
+		return Value{typ: ValueTypSimpleError, str: "ERR SWAPDB is not allowed in cluster mode"}
+	}
+
+	a, errValue := parseDBIndex(args[0].bulk)
+	if errValue != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR invalid first DB index"}
+	}
+	b, errValue := parseDBIndex(args[1].bulk)
+	if errValue != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR invalid second DB index"}
+	}
+
+	databases[a], databases[b] = databases[b], databases[a]
+	databases[a].id, databases[b].id = a, b
+
+	// Clients watching keys in either database may now see different values
+	for _, swapped := range []*DB{databases[a], databases[b]} {
+		swapped.watchedKeysMu.Lock()
+		for key := range swapped.watchedKeys {
+			for tx := range swapped.watchedKeys[key] {
+				tx.casDirty.Store(true)
+			}
+		}
+		swapped.watchedKeysMu.Unlock()
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// flushdb handles the FLUSHDB command.
+func flushdb(c *Client, args []Value) Value {
+	async, errValue := parseFlushMode(args)
+	if errValue != nil {
+		return *errValue
+	}
+	if async {
+		emptyDBAsync(c.db)
+	} else {
+		emptyDB(c.db)
+	}
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// flushall handles the FLUSHALL command.
+func flushall(c *Client, args []Value) Value {
+	async, errValue := parseFlushMode(args)
+	if errValue != nil {
+		return *errValue
+	}
+	for _, db := range databases {
+		if async {
+			emptyDBAsync(db)
+		} else {
+			emptyDB(db)
+		}
+	}
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// parseFlushMode parses the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL, and reports whether the keys are released in the background, see
+// lazyfree.go. Without one, lazyfree-lazy-user-flush decides.
+func parseFlushMode(args []Value) (bool, *Value) {
+	if len(args) > 1 {
+		return false, &Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+	if len(args) == 0 {
+		return config.lazyfreeLazyUserFlush, nil
+	}
+	switch strings.ToUpper(args[0].bulk) {
+	case "ASYNC":
+		return true, nil
+	case "SYNC":
+		return false, nil
+	}
+	return false, &Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+}
+
+// move handles the MOVE command.
+func move(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'move' command"}
+	}
+	if config.clusterEnabled {
+		return Value{typ: ValueTypSimpleError, str: "ERR MOVE is not allowed in cluster mode"}
+	}
+
+	key := args[0].bulk
+
+	index, errValue := parseDBIndex(args[1].bulk)
+	if errValue != nil {
+		return *errValue
+	}
+
+	dst := databases[index]
+	if dst == c.db {
+		return Value{typ: ValueTypSimpleError, str: "ERR source and destination objects are the same"}
+	}
+
+	expireIfNeeded(c.db, key)
+	if lookupKeyType(dst, key) != KeyTypNone {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	var obj Object
+	if !viewObject(c.db, key, func(o Object) { obj = o }) {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	expireAt, hasExpire := keyExpireTime(c.db, key)
+
+	unlinkKey(c.db, key, false)
+	storeObject(dst, key, obj)
+	if hasExpire {
+		setExpire(dst, key, expireAt)
+	}
+	touchKey(dst, key)
+	signalModifiedKey(dst, key)
+	signalKeyReady(dst, key)
+
+	return Value{typ: ValueTypInteger, num: 1}
+}
+
+// selectCommand handles the SELECT command.
+func selectCommand(c *Client, args []Value) Value {
+	index, reply := selectDB(args)
+	if reply.typ != ValueTypSimpleError {
+		c.dbIndex = index
+		c.db = databases[index]
+	}
+	return reply
+}
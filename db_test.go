@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkKeys returns n keys spread over the shards or, with sameShard, all
+// hashing to one shard, which is how a database guarded by a single lock does.
+func benchmarkKeys(n int, sameShard bool) []string {
+	keys := make([]string, 0, n)
+	for i := 0; len(keys) < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if !sameShard || shardIndex(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// BenchmarkSetGetParallel runs SET and GET on unrelated keys from parallel
+// clients. Run with -cpu 1,4,8 to compare the keys spread over the shards with
+// the keys of a single shard, whose clients all wait on the same lock.
+func BenchmarkSetGetParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name      string
+		sameShard bool
+	}{
+		{"sharded", false},
+		{"single-shard", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			initDatabases(1)
+			keys := benchmarkKeys(1024, bc.sameShard)
+			value := Value{typ: ValueTypBulkString, bulk: "value"}
+
+			var clientIndex atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				c := newFakeClient(0)
+				i := int(clientIndex.Add(1)) * 97
+				for pb.Next() {
+					key := Value{typ: ValueTypBulkString, bulk: keys[i%len(keys)]}
+					set(c, []Value{key, value})
+					get(c, []Value{key})
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,161 @@
+/*
+This file contains the DEBUG command, a collection of subcommands meant for
+testing the server rather than for production use. SLEEP holds the server for a
+while to exercise timeouts, OBJECT describes how a key is stored,
+SET-ACTIVE-EXPIRE turns the background expiration cycle on and off so tests can
+observe lazy expiration on its own, and RELOAD saves the dataset and loads it
+back, so tests can check that every value survives a round trip through the RDB
+format. For a detailed description of the command, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/commands/debug/
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugHeapProfileFile is where DEBUG JMAP writes the heap profile.
+const debugHeapProfileFile = "heap.pprof"
+
+// debug handles the DEBUG command.
+func debug(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'debug' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "SLEEP":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'debug|sleep' command"}
+		}
+
+		seconds, err := strconv.ParseFloat(args[1].bulk, 64)
+		if err != nil || seconds < 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not a valid float"}
+		}
+
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+
+	case "OBJECT":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'debug|object' command"}
+		}
+
+		key := args[1].bulk
+
+		var serialized []byte
+		var typ string
+		ok := viewObject(c.db, key, func(obj Object) {
+			typ = obj.typ
+			serialized = serializeObject(obj)
+		})
+		if !ok {
+			return Value{typ: ValueTypSimpleError, str: "ERR no such key"}
+		}
+
+		// The dump footer isn't part of the value itself
+		length := len(serialized) - 10
+
+		return Value{typ: ValueTypSimpleString, str: fmt.Sprintf(
+			"Value at:0x0 refcount:1 encoding:%s serializedlength:%d lru:0 lru_seconds_idle:%d",
+			objectEncoding(c.db, key, typ), length, int(keyIdleTime(c.db, key).Seconds()),
+		)}
+
+	case "SET-ACTIVE-EXPIRE":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'debug|set-active-expire' command"}
+		}
+
+		switch args[1].bulk {
+		case "0":
+			activeExpireEnabled.Store(false)
+		case "1":
+			activeExpireEnabled.Store(true)
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		}
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+
+	case "JMAP":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'debug|jmap' command"}
+		}
+
+		// The Go equivalent of a Java heap map is a heap profile
+		f, err := os.Create(debugHeapProfileFile)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+		}
+		defer f.Close()
+
+		if err := pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+		}
+
+		fmt.Println("Wrote heap profile to", debugHeapProfileFile)
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+
+	case "RELOAD":
+		return debugReload(args[1:])
+
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try DEBUG HELP.", args[0].bulk)}
+	}
+}
+
+// debugReload handles DEBUG RELOAD, which saves the snapshot, empties the
+// dataset and loads the snapshot back. NOSAVE loads the existing snapshot
+// instead, and NOFLUSH keeps the dataset, loading the snapshot over it.
+func debugReload(args []Value) Value {
+	save, flush := true, true
+	for _, arg := range args {
+		switch strings.ToUpper(arg.bulk) {
+		case "NOSAVE":
+			save = false
+		case "NOFLUSH":
+			flush = false
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR DEBUG RELOAD only supports the NOSAVE and NOFLUSH flags"}
+		}
+	}
+
+	// Saving a dataset that isn't loaded yet would lose the rest of it
+	if loading.Load() {
+		return Value{typ: ValueTypSimpleError, str: loadingError}
+	}
+
+	if save {
+		if err := rdbSave(); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+		}
+	} else if _, err := os.Stat(config.dbfilename); err != nil {
+		// The dataset is only emptied if there's a snapshot to replace it
+		fmt.Println("Error trying to load the RDB dump:", err)
+		return Value{typ: ValueTypSimpleError, str: "ERR Error trying to load the RDB dump, check server logs."}
+	}
+
+	if flush {
+		for _, db := range databases {
+			emptyDB(db)
+		}
+		flushLibraries()
+	}
+
+	if err := loadRdb(config.dbfilename); err != nil {
+		fmt.Println("Error trying to load the RDB dump:", err)
+		return Value{typ: ValueTypSimpleError, str: "ERR Error trying to load the RDB dump, check server logs."}
+	}
+
+	fmt.Println("DB reloaded by DEBUG RELOAD")
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
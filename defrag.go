@@ -0,0 +1,179 @@
+/*
+This file contains the compaction of sparse maps, the counterpart of the active
+defragmentation of Redis, enabled with activedefrag. Go maps never shrink: a
+shard that once held millions of keys keeps the buckets for them after they're
+deleted, and so do sets once their members are removed and the pending entries
+lists of stream consumer groups once their entries are acknowledged. Every map that may shrink records the most
+entries it held, and once at least active-defrag-map-threshold percent of them
+are gone, a background cycle rebuilds it with the entries it still holds,
+letting the garbage collector free the old one. The shard maps are checked on
+every cycle, while streams are noted when a write leaves them sparse. The
+memory reclaimed is estimated from the entries the maps no longer have room
+for, and reported by INFO along with the maps rebuilt. For a detailed
+description of active defragmentation, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/config-file/
+*/
+
+package main
+
+import "time"
+
+// activeDefragInterval is how often the compaction cycle runs.
+const activeDefragInterval = time.Second
+
+// activeDefragMinEntries is the number of entries a map must have held to be
+// worth rebuilding.
+const activeDefragMinEntries = 1024
+
+// Memory an entry takes in the maps compaction rebuilds, besides its key and
+// value, which are freed when it's deleted.
+const (
+	keysEntrySize       = stringHeaderSize + mapEntryOverhead + pointerSize
+	setMemberSize       = stringHeaderSize + mapEntryOverhead
+	groupPendingSize    = streamIDSize + pointerSize + mapEntryOverhead
+	consumerPendingSize = streamIDSize + mapEntryOverhead
+)
+
+// sparse reports whether a map holding n entries, after holding up to peak,
+// lost enough of them to be rebuilt.
+func sparse(n, peak int) bool {
+	return peak >= activeDefragMinEntries && (peak-n)*100 >= peak*config.activeDefragThreshold
+}
+
+// compactMap returns a copy of m sized for the entries it holds.
+func compactMap[K comparable, V any](m map[K]V) map[K]V {
+	compacted := make(map[K]V, len(m))
+	for k, v := range m {
+		compacted[k] = v
+	}
+	return compacted
+}
+
+// noteSparse records the most entries the maps of the value of key held, and
+// notes key for the next cycle if any of them became sparse. The caller must
+// hold s.mu for writing.
+func (s *dbShard) noteSparse(key string, e *keyEntry) {
+	found := false
+	switch e.typ {
+	case KeyTypSet:
+		if set := e.set; set.dict != nil {
+			set.peak = max(set.peak, len(set.dict))
+			found = sparse(len(set.dict), set.peak)
+		}
+	case KeyTypStream:
+		for _, g := range e.stream.groups {
+			g.peak = max(g.peak, len(g.pending))
+			found = found || sparse(len(g.pending), g.peak)
+			for _, c := range g.consumers {
+				c.peak = max(c.peak, len(c.pending))
+				found = found || sparse(len(c.pending), c.peak)
+			}
+		}
+	}
+	if !found || !config.activedefrag {
+		return
+	}
+
+	if s.sparseKeys == nil {
+		s.sparseKeys = map[string]struct{}{}
+	}
+	s.sparseKeys[key] = struct{}{}
+}
+
+// activeDefragCycle periodically rebuilds the maps that became sparse, shard by
+// shard, so commands only wait for the shard being compacted.
+func activeDefragCycle() {
+	for {
+		time.Sleep(activeDefragInterval)
+
+		execMu.RLock()
+		if config.activedefrag {
+			for _, db := range databases {
+				for i := range db.shards {
+					s := &db.shards[i]
+					s.mu.Lock()
+					s.compact()
+					s.mu.Unlock()
+				}
+			}
+		}
+		execMu.RUnlock()
+	}
+}
+
+// compact rebuilds the maps of s that became sparse, and those of the values
+// noted since the last cycle. The caller must hold s.mu for writing.
+func (s *dbShard) compact() {
+	reclaimed := 0
+	if sparse(len(s.keys), s.keysPeak) {
+		reclaimed += (s.keysPeak - len(s.keys)) * keysEntrySize
+		s.keys, s.keysPeak = compactMap(s.keys), len(s.keys)
+		serverStats.activeDefragHits.Add(1)
+	}
+	if sparse(len(s.expires), s.expiresPeak) {
+		reclaimed += (s.expiresPeak - len(s.expires)) * keysEntrySize
+		s.expires, s.expiresPeak = compactMap(s.expires), len(s.expires)
+		serverStats.activeDefragHits.Add(1)
+	}
+
+	// The keys noted may have been deleted or replaced since
+	for key := range s.sparseKeys {
+		e, ok := s.keys[key]
+		if !ok {
+			continue
+		}
+		if n := compactObject(e.Object); n > 0 {
+			reclaimed += n
+			serverStats.activeDefragKeyHits.Add(1)
+		}
+	}
+	s.sparseKeys = nil
+
+	serverStats.activeDefragReclaimed.Add(int64(reclaimed))
+}
+
+// compactObject rebuilds the maps of obj that became sparse, returning the
+// memory reclaimed.
+func compactObject(obj Object) int {
+	switch obj.typ {
+	case KeyTypSet:
+		return compactSet(obj.set)
+	case KeyTypStream:
+		return compactStream(obj.stream)
+	}
+	return 0
+}
+
+// compactSet rebuilds the map of set if it became sparse, returning the memory
+// reclaimed.
+func compactSet(set *Set) int {
+	if set.dict == nil || !sparse(len(set.dict), set.peak) {
+		return 0
+	}
+	reclaimed := (set.peak - len(set.dict)) * setMemberSize
+	set.dict, set.peak = compactMap(set.dict), len(set.dict)
+	serverStats.activeDefragHits.Add(1)
+	return reclaimed
+}
+
+// compactStream rebuilds the pending entries lists of the consumer groups of
+// stream that became sparse, returning the memory reclaimed.
+func compactStream(stream *Stream) int {
+	reclaimed := 0
+	for _, g := range stream.groups {
+		if sparse(len(g.pending), g.peak) {
+			reclaimed += (g.peak - len(g.pending)) * groupPendingSize
+			g.pending, g.peak = compactMap(g.pending), len(g.pending)
+			serverStats.activeDefragHits.Add(1)
+		}
+		for _, c := range g.consumers {
+			if sparse(len(c.pending), c.peak) {
+				reclaimed += (c.peak - len(c.pending)) * consumerPendingSize
+				c.pending, c.peak = compactMap(c.pending), len(c.pending)
+				serverStats.activeDefragHits.Add(1)
+			}
+		}
+	}
+	return reclaimed
+}
@@ -0,0 +1,462 @@
+/*
+This file contains the DUMP and RESTORE commands along with the serialization
+format they use. A serialized value starts with a type byte followed by the
+type-specific body, where integers are encoded as varints and strings are prefixed
+with their length. The payload ends with a two byte format version and a CRC64
+checksum of everything before it, so corrupted or foreign payloads are rejected.
+The format is modeled on the one Redis uses but is not binary compatible with it.
+For a detailed description of the commands, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/dump/
+https://redis.io/docs/latest/commands/restore/
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpVersion is the version of the serialization format written by DUMP.
+const dumpVersion = 1
+
+// Type bytes of serialized values
+const (
+	dumpTypeString = 0
+	dumpTypeList   = 1
+	dumpTypeSet    = 2
+	dumpTypeHash   = 4
+	dumpTypeZSet   = 5
+	dumpTypeStream = 15
+)
+
+// dumpFooterLen is the size of the version and checksum trailer.
+const dumpFooterLen = 10
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+var errBadDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// dumpWriter accumulates a serialized value.
+type dumpWriter struct {
+	buf []byte
+}
+
+func (w *dumpWriter) writeUint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *dumpWriter) writeInt(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *dumpWriter) writeString(s string) {
+	w.writeUint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *dumpWriter) writeFloat(f float64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(f))
+}
+
+func (w *dumpWriter) writeStreamID(id StreamID) {
+	w.writeUint(id.ms)
+	w.writeUint(id.seq)
+}
+
+// writeTime writes a time as unix milliseconds, with zero meaning unset.
+func (w *dumpWriter) writeTime(t time.Time) {
+	if t.IsZero() {
+		w.writeInt(0)
+		return
+	}
+	w.writeInt(t.UnixMilli())
+}
+
+// dumpReader decodes a serialized value. The first error sticks, so callers
+// can decode a whole structure and check err once at the end.
+type dumpReader struct {
+	buf []byte
+	err error
+}
+
+func (r *dumpReader) readUint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errBadDumpPayload
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *dumpReader) readInt() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errBadDumpPayload
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *dumpReader) readString() string {
+	n := r.readUint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errBadDumpPayload
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *dumpReader) readFloat() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 8 {
+		r.err = errBadDumpPayload
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(r.buf))
+	r.buf = r.buf[8:]
+	return f
+}
+
+func (r *dumpReader) readStreamID() StreamID {
+	return StreamID{ms: r.readUint(), seq: r.readUint()}
+}
+
+func (r *dumpReader) readTime() time.Time {
+	ms := r.readInt()
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// readCount reads a collection length, rejecting lengths that can't possibly
+// fit in the remaining payload so a corrupt length can't exhaust memory.
+func (r *dumpReader) readCount() int {
+	n := r.readUint()
+	if r.err == nil && n > uint64(len(r.buf)) {
+		r.err = errBadDumpPayload
+		return 0
+	}
+	return int(n)
+}
+
+// serializeObject encodes a value in the DUMP format, including the footer.
+func serializeObject(obj Object) []byte {
+	w := &dumpWriter{}
+
+	switch obj.typ {
+	case KeyTypString:
+		w.buf = append(w.buf, dumpTypeString)
+		w.writeString(obj.str)
+	case KeyTypHash:
+		w.buf = append(w.buf, dumpTypeHash)
+		w.writeUint(uint64(obj.hash.Len()))
+		obj.hash.Range(func(k, v string) bool {
+			w.writeString(k)
+			w.writeString(v)
+			return true
+		})
+	case KeyTypList:
+		w.buf = append(w.buf, dumpTypeList)
+		w.writeUint(uint64(obj.list.Len()))
+		obj.list.Range(0, obj.list.Len()-1, func(elem string) bool {
+			w.writeString(elem)
+			return true
+		})
+	case KeyTypSet:
+		w.buf = append(w.buf, dumpTypeSet)
+		w.writeUint(uint64(obj.set.Len()))
+		obj.set.Range(func(member string) bool {
+			w.writeString(member)
+			return true
+		})
+	case KeyTypZSet:
+		w.buf = append(w.buf, dumpTypeZSet)
+		w.writeUint(uint64(obj.zset.Len()))
+		for _, m := range obj.zset.Members() {
+			w.writeString(m.member)
+			w.writeFloat(m.score)
+		}
+	case KeyTypStream:
+		w.buf = append(w.buf, dumpTypeStream)
+		serializeStream(w, obj.stream)
+	}
+
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, dumpVersion)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, crc64.Checksum(w.buf, crc64Table))
+
+	return w.buf
+}
+
+// serializeStream encodes the entries, metadata and consumer groups of a stream.
+func serializeStream(w *dumpWriter, s *Stream) {
+	w.writeUint(uint64(len(s.entries)))
+	for _, entry := range s.entries {
+		w.writeStreamID(entry.id)
+		w.writeUint(uint64(len(entry.fields)))
+		for _, f := range entry.fields {
+			w.writeString(f)
+		}
+	}
+
+	w.writeStreamID(s.lastID)
+	w.writeUint(s.entriesAdded)
+	w.writeStreamID(s.maxDeletedID)
+
+	w.writeUint(uint64(len(s.groups)))
+	for _, g := range s.groups {
+		w.writeString(g.name)
+		w.writeStreamID(g.lastID)
+		w.writeInt(g.entriesRead)
+
+		w.writeUint(uint64(len(g.pending)))
+		for id, pe := range g.pending {
+			w.writeStreamID(id)
+			w.writeString(pe.consumer)
+			w.writeTime(pe.deliveryTime)
+			w.writeUint(uint64(pe.deliveryCount))
+		}
+
+		w.writeUint(uint64(len(g.consumers)))
+		for _, c := range g.consumers {
+			w.writeString(c.name)
+			w.writeTime(c.seenTime)
+			w.writeTime(c.activeTime)
+		}
+	}
+}
+
+// deserializeObject decodes a DUMP payload after verifying its footer.
+func deserializeObject(payload []byte) (Object, error) {
+	if len(payload) < dumpFooterLen+1 {
+		return Object{}, errBadDumpPayload
+	}
+
+	body := payload[:len(payload)-8]
+	version := binary.LittleEndian.Uint16(payload[len(payload)-dumpFooterLen:])
+	checksum := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if version > dumpVersion || crc64.Checksum(body, crc64Table) != checksum {
+		return Object{}, errBadDumpPayload
+	}
+
+	r := &dumpReader{buf: payload[1 : len(payload)-dumpFooterLen]}
+
+	var obj Object
+	switch payload[0] {
+	case dumpTypeString:
+		obj = Object{typ: KeyTypString, str: r.readString()}
+	case dumpTypeHash:
+		hash := map[string]string{}
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			k := r.readString()
+			hash[k] = r.readString()
+		}
+		obj = Object{typ: KeyTypHash, hash: hashFromMap(hash)}
+	case dumpTypeList:
+		elems := []string{}
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			elems = append(elems, r.readString())
+		}
+		obj = Object{typ: KeyTypList, list: listFromElements(elems)}
+	case dumpTypeSet:
+		set := newSet()
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			set.Add(r.readString())
+		}
+		obj = Object{typ: KeyTypSet, set: set}
+	case dumpTypeZSet:
+		zset := newSortedSet()
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			member := r.readString()
+			zset.Add(member, r.readFloat())
+		}
+		obj = Object{typ: KeyTypZSet, zset: zset}
+	case dumpTypeStream:
+		obj = Object{typ: KeyTypStream, stream: deserializeStream(r)}
+	default:
+		return Object{}, errors.New("ERR Bad data format")
+	}
+
+	if r.err != nil {
+		return Object{}, r.err
+	}
+	if len(r.buf) != 0 {
+		return Object{}, errors.New("ERR Bad data format")
+	}
+
+	return obj, nil
+}
+
+// deserializeStream decodes a stream written by serializeStream.
+func deserializeStream(r *dumpReader) *Stream {
+	s := &Stream{}
+
+	for n := r.readCount(); n > 0 && r.err == nil; n-- {
+		entry := StreamEntry{id: r.readStreamID()}
+		for m := r.readCount(); m > 0 && r.err == nil; m-- {
+			entry.fields = append(entry.fields, r.readString())
+		}
+		s.entries = append(s.entries, entry)
+	}
+
+	s.lastID = r.readStreamID()
+	s.entriesAdded = r.readUint()
+	s.maxDeletedID = r.readStreamID()
+
+	groups := r.readCount()
+	if groups > 0 {
+		s.groups = map[string]*StreamGroup{}
+	}
+	for ; groups > 0 && r.err == nil; groups-- {
+		name := r.readString()
+		lastID := r.readStreamID()
+		g := newStreamGroup(name, lastID, r.readInt())
+
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			id := r.readStreamID()
+			pe := &StreamPendingEntry{consumer: r.readString(), deliveryTime: r.readTime(), deliveryCount: int(r.readUint())}
+			g.pending[id] = pe
+			g.consumer(pe.consumer, true).pending[id] = struct{}{}
+		}
+
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			c := g.consumer(r.readString(), true)
+			c.seenTime = r.readTime()
+			c.activeTime = r.readTime()
+		}
+
+		s.groups[name] = g
+	}
+
+	return s
+}
+
+// dump handles the DUMP command.
+func dump(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'dump' command"}
+	}
+
+	key := args[0].bulk
+
+	var payload []byte
+	ok := viewObject(c.db, key, func(obj Object) {
+		payload = serializeObject(obj)
+	})
+	if !ok {
+		return Value{typ: ValueTypNull}
+	}
+
+	return Value{typ: ValueTypBulkString, bulk: string(payload)}
+}
+
+// restore handles the RESTORE command.
+func restore(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'restore' command"}
+	}
+
+	key := args[0].bulk
+
+	ttl, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	if ttl < 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR Invalid TTL value, must be >= 0"}
+	}
+
+	replace, absTTL := false, false
+	idle := time.Duration(-1)
+	freq := -1
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "ABSTTL":
+			absTTL = true
+		case opt == "IDLETIME" && i+1 < len(args):
+			secs, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			if secs < 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR Invalid IDLETIME value, must be >= 0"}
+			}
+			idle = time.Duration(secs) * time.Second
+			i++
+		case opt == "FREQ" && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			if n < 0 || n > 255 {
+				return Value{typ: ValueTypSimpleError, str: "ERR Invalid FREQ value, must be >= 0 and <= 255"}
+			}
+			freq = int(n)
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	if !replace && lookupKeyType(c.db, key) != KeyTypNone {
+		return Value{typ: ValueTypSimpleError, str: "BUSYKEY Target key name already exists."}
+	}
+
+	obj, err := deserializeObject([]byte(args[2].bulk))
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+
+		// A key restored with a TTL in the past is deleted right away
+		if !time.Now().Before(expireAt) {
+			deleteKey(c.db, key)
+			return Value{typ: ValueTypSimpleString, str: "OK"}
+		}
+	}
+
+	storeObject(c.db, key, obj)
+	if !expireAt.IsZero() {
+		setExpire(c.db, key, expireAt)
+	}
+	if idle >= 0 {
+		setKeyIdleTime(c.db, key, idle)
+	}
+	if freq >= 0 {
+		setKeyFreq(c.db, key, uint8(freq))
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
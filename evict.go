@@ -0,0 +1,148 @@
+/*
+This file contains eviction, which keeps the memory the server uses under
+maxmemory. Before a command of a client runs, keys are evicted until the memory
+used is back under the limit, picked according to maxmemory-policy: the least
+recently used, the least frequently used, random ones, or the ones closest to
+expiring, among all the keys or only those with an expiration time. Like Redis,
+the server doesn't keep the keys ordered by the policy: it samples
+maxmemory-samples keys of every database and evicts the best candidate among
+them. When nothing can be evicted, commands that may add data are refused with
+an OOM error, while the others still run.
+
+The memory used is not read from the Go runtime, whose heap holds garbage until
+the collector runs: it's the memory allocated at startup plus the size of the
+keys and their values, accounted as they're added, modified and deleted. An
+evicted key therefore frees its size right away. For a detailed description of
+eviction, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/reference/eviction/
+*/
+
+package main
+
+import (
+	"math/rand"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+)
+
+// oomError is the reply to a command that may add data when the memory used is
+// above maxmemory and no key can be evicted.
+const oomError = "OOM command not allowed when used memory > 'maxmemory'."
+
+// usedMemory returns the memory used by the server: what it allocated at
+// startup and the size of the keys of every database.
+func usedMemory() int64 {
+	return int64(startupAllocated) + datasetBytes.Load()
+}
+
+// allocatedMemory returns the memory used by the values allocated on the heap,
+// including garbage not collected yet.
+func allocatedMemory() int64 {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64())
+}
+
+// oomCheck evicts keys if the memory used is above maxmemory, and returns the
+// error refusing cmd if that wasn't enough and cmd may add data. The master of
+// a replica and the fake clients replaying the AOF are never refused, and a
+// replica leaves eviction to its master. The caller must hold execMu.
+func oomCheck(c *Client, cmd *Command) *Value {
+	if config.maxmemory == 0 || c.user == nil || c.master || replicaOf != nil {
+		return nil
+	}
+	if performEvictions() || !cmd.hasFlag("denyoom") {
+		return nil
+	}
+	return &Value{typ: ValueTypSimpleError, str: oomError}
+}
+
+// evictionCandidate is a sampled key, along with how good a candidate for
+// eviction it is under the policy, higher being better.
+type evictionCandidate struct {
+	db    *DB
+	key   string
+	score int64
+}
+
+// performEvictions evicts keys until the memory used is under maxmemory, and
+// reports whether it is. The caller must hold execMu.
+func performEvictions() bool {
+	// The values released in the background count as freed already, or more
+	// keys would be evicted than needed
+	for usedMemory()-lazyfreePendingBytes.Load() > config.maxmemory {
+		// Evicting keys is a write, which a failover waits not to happen
+		if config.maxmemoryPolicy == "noeviction" || writesPaused() {
+			return false
+		}
+
+		best, ok := evictionCandidate{}, false
+		for _, db := range databases {
+			if candidate, found := sampleEvictionCandidate(db); found && (!ok || candidate.score > best.score) {
+				best, ok = candidate, true
+			}
+		}
+		if !ok {
+			return false
+		}
+
+		if !unlinkKey(best.db, best.key, config.lazyfreeLazyEviction) {
+			continue
+		}
+		serverStats.evictedKeys.Add(1)
+		propagateDel(best.db, best.key)
+	}
+	return true
+}
+
+// sampleEvictionCandidate samples maxmemory-samples keys of db, and returns the
+// best one to evict under the policy, if db has any key the policy may evict.
+func sampleEvictionCandidate(db *DB) (evictionCandidate, bool) {
+	policy := config.maxmemoryPolicy
+	volatile := policy == "volatile-lru" || policy == "volatile-lfu" || policy == "volatile-random" || policy == "volatile-ttl"
+	random := policy == "allkeys-random" || policy == "volatile-random"
+	samples := config.maxmemorySamples
+	if random {
+		samples = 1
+	}
+
+	best := evictionCandidate{db: db}
+	found := false
+	sampleKeys(db, samples, volatile, func(key string, e *keyEntry) {
+		score := int64(0)
+		switch {
+		case random:
+			// The key of a random database
+			score = rand.Int63()
+		case policy == "volatile-ttl":
+			// The sooner a key expires, the better
+			score = -e.expireAt.UnixNano()
+		case strings.HasSuffix(policy, "-lfu"):
+			// The less often a key is accessed, the better
+			score = 255 - int64(e.freq())
+		default:
+			score = int64(e.idleTime())
+		}
+		if !found || score > best.score {
+			best.key, best.score = key, score
+			found = true
+		}
+	})
+	return best, found
+}
+
+// memoryInfo returns the lines of the memory section of INFO.
+func memoryInfo() []string {
+	return []string{
+		"used_memory:" + strconv.FormatInt(usedMemory(), 10),
+		"used_memory_startup:" + strconv.FormatUint(startupAllocated, 10),
+		"used_memory_dataset:" + strconv.FormatInt(datasetBytes.Load(), 10),
+		"allocator_allocated:" + strconv.FormatInt(allocatedMemory(), 10),
+		"maxmemory:" + strconv.FormatInt(config.maxmemory, 10),
+		"maxmemory_policy:" + config.maxmemoryPolicy,
+		"lazyfree_pending_objects:" + strconv.FormatInt(lazyfreePendingObjects.Load(), 10),
+		"lazyfreed_objects:" + strconv.FormatInt(lazyfreedObjects.Load(), 10),
+	}
+}
@@ -0,0 +1,123 @@
+/*
+This file contains the single-threaded execution mode, enabled with
+single-threaded-execution. By default every connection runs its commands on its
+own goroutine, and the commands of different clients run in parallel, holding
+the read side of execMu and the locks of the shards they use. In this mode the
+connections only read the requests and write the replies, and a single goroutine
+runs the commands one at a time, as the event loop of Redis does. It holds execMu
+for writing while it runs a batch of them, and since everything else reaching the
+databases, background jobs included, holds execMu too, the executor owns them and
+its commands skip the locks of the shards. The commands that may block, like
+XREAD with BLOCK or WAIT, still run on their connection, as waiting on the
+executor would stall every other client, and so do the commands sent while the
+dataset loads, or while a failover pauses writes. For a detailed description of
+the architecture of Redis, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/reference/internals/
+*/
+
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// executorQueueLen is how many commands may wait for the executor before the
+// connections sending more block.
+const executorQueueLen = 1024
+
+// executorBatchLen is how many commands the executor runs before it lets the
+// background jobs waiting for execMu run.
+const executorBatchLen = 128
+
+// executorRequest is a command a connection hands to the executor, along with
+// the channel its reply is sent back on.
+type executorRequest struct {
+	c     *Client
+	value Value
+	reply chan executorReply
+}
+
+// executorReply is the reply to a command run by the executor. A command the
+// executor hands back is run on its connection instead.
+type executorReply struct {
+	value    Value
+	handBack bool
+}
+
+// executorQueue holds the commands waiting for the executor.
+var executorQueue = make(chan executorRequest, executorQueueLen)
+
+// executorOwnsStore is set while the executor runs commands. Nothing else
+// reaches the databases then, so the locks of the shards are skipped.
+var executorOwnsStore atomic.Bool
+
+// executorLoop runs the commands of every client, one at a time, in batches of
+// the commands queued at once.
+func executorLoop() {
+	for req := range executorQueue {
+		execMu.Lock()
+		executorOwnsStore.Store(true)
+
+		executorRun(req)
+	batch:
+		for i := 1; i < executorBatchLen; i++ {
+			select {
+			case req = <-executorQueue:
+				executorRun(req)
+			default:
+				break batch
+			}
+		}
+
+		executorOwnsStore.Store(false)
+		execMu.Unlock()
+	}
+}
+
+// executorRun runs a single command on the executor and sends back its reply.
+func executorRun(req executorRequest) {
+	// A failover started by a command of the batch pauses the writes from then
+	// on. Waiting for them to resume would stall every other client, so the
+	// commands are handed back to their connection to wait there.
+	if writesPaused() {
+		req.reply <- executorReply{handBack: true}
+		return
+	}
+	req.reply <- executorReply{value: processCommand(req.c, req.value, true)}
+}
+
+// runCommand runs a command sent by c, on the executor in single-threaded mode
+// or else on the connection of c, returning its reply.
+func runCommand(c *Client, value Value) Value {
+	if !config.singleThreadedExecution || !runsOnExecutor(value) {
+		return processCommand(c, value, false)
+	}
+
+	if c.executorReply == nil {
+		c.executorReply = make(chan executorReply, 1)
+	}
+	executorQueue <- executorRequest{c: c, value: value, reply: c.executorReply}
+	reply := <-c.executorReply
+	if reply.handBack {
+		return processCommand(c, value, false)
+	}
+	return reply.value
+}
+
+// runsOnExecutor reports whether a command may run on the executor, which it
+// mustn't if it may wait for other clients, or while a script keeps the
+// executor busy, as the command is answered with BUSY instead. The dataset is
+// loaded without execMu, so the commands allowed meanwhile take the locks of
+// the shards on their connection.
+func runsOnExecutor(value Value) bool {
+	if loading.Load() {
+		return false
+	}
+	cmd, ok := Commands[strings.ToUpper(value.array[0].bulk)]
+	if !ok {
+		return true
+	}
+	return !cmd.hasFlag("blocking") && !writesPaused() && busyScript() == nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startExecutor sync.Once
+
+// singleThreaded runs the test in single-threaded mode, starting the executor
+// the first time.
+func singleThreaded(t *testing.T) {
+	startExecutor.Do(func() { go executorLoop() })
+	config.singleThreadedExecution = true
+	t.Cleanup(func() { config.singleThreadedExecution = false })
+}
+
+func TestExecutorRunsEveryClient(t *testing.T) {
+	singleThreaded(t)
+	newTestClient(t)
+
+	const clients, pushes = 8, 200
+	var wg sync.WaitGroup
+	for i := range clients {
+		c := connectTestClient(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range pushes {
+				if j%10 == 0 {
+					run(c, "MULTI")
+					run(c, "RPUSH", "list", strconv.Itoa(i))
+					run(c, "SADD", "set", strconv.Itoa(i*pushes+j))
+					run(c, "EXEC")
+					continue
+				}
+				run(c, "RPUSH", "list", strconv.Itoa(i))
+				run(c, "SADD", "set", strconv.Itoa(i*pushes+j))
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := connectTestClient(t)
+	want := ":" + strconv.Itoa(clients*pushes) + "\r\n"
+	if got := run(c, "LLEN", "list"); got != want {
+		t.Fatalf("LLEN: got %q, want %q", got, want)
+	}
+	if got := run(c, "SCARD", "set"); got != want {
+		t.Fatalf("SCARD: got %q, want %q", got, want)
+	}
+}
+
+func TestExecutorHandsBackPausedWrites(t *testing.T) {
+	singleThreaded(t)
+	c := newTestClient(t)
+	run(c, "SET", "k", "1")
+
+	pauseWrites()
+	defer resumeWrites()
+
+	// A write reaching the executor while writes are paused is handed back to
+	// its connection instead of stalling the executor
+	reply := make(chan executorReply, 1)
+	executorQueue <- executorRequest{c: c, value: requestValue("SET", "k", "2"), reply: reply}
+	select {
+	case r := <-reply:
+		if !r.handBack {
+			t.Fatalf("got %q, want the write handed back", r.value.Marshal())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the executor waited for the writes to resume")
+	}
+
+	// The write waits on its connection, while the other clients keep going
+	done := make(chan string, 1)
+	go func() { done <- run(c, "SET", "k", "3") }()
+
+	other := connectTestClient(t)
+	if got := run(other, "GET", "k"); got != "$1\r\n1\r\n" {
+		t.Fatalf("GET while paused: got %q", got)
+	}
+	select {
+	case got := <-done:
+		t.Fatalf("the write ran while paused, replying %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resumeWrites()
+	select {
+	case got := <-done:
+		if got != "+OK\r\n" {
+			t.Fatalf("SET after resuming: got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the write didn't run once the writes resumed")
+	}
+	if got := run(other, "GET", "k"); got != "$1\r\n3\r\n" {
+		t.Fatalf("GET after resuming: got %q", got)
+	}
+}
+
+func TestRunsOnExecutor(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		loading bool
+		paused  bool
+		want    bool
+	}{
+		{"read", []string{"GET", "k"}, false, false, true},
+		{"write", []string{"SET", "k", "v"}, false, false, true},
+		{"transaction", []string{"EXEC"}, false, false, true},
+		{"unknown command", []string{"NOSUCHCOMMAND"}, false, false, true},
+		{"blocking", []string{"XREAD", "BLOCK", "0", "STREAMS", "s", "$"}, false, false, false},
+		{"wait", []string{"WAIT", "1", "0"}, false, false, false},
+		{"while loading", []string{"GET", "k"}, true, false, false},
+		{"while paused", []string{"GET", "k"}, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loading.Store(tt.loading)
+			defer loading.Store(false)
+			if tt.paused {
+				pauseWrites()
+				defer resumeWrites()
+			}
+
+			if got := runsOnExecutor(requestValue(tt.args...)); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+/*
+This file contains key expiration. Keys with a time to live have their absolute
+expiration time recorded in a separate map, and a background goroutine
+periodically samples them and deletes the ones whose time has passed, the way
+the active expire cycle of Redis does. Commands also expire their keys before
+running. Each deletion is sent to the AOF and the replicas as a DEL.
+A replica doesn't expire keys on its own: it hides them from its clients, and
+only deletes them when the DEL of its master arrives, so the two datasets don't
+drift apart if their clocks do. For a detailed description of how Redis expires
+keys, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/expire/
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// expireCycleInterval is how often the background goroutine looks for
+	// expired keys.
+	expireCycleInterval = 100 * time.Millisecond
+
+	// activeExpireTimeLimit bounds the time a cycle spends expiring keys, a
+	// quarter of the interval as in Redis.
+	activeExpireTimeLimit = expireCycleInterval / 4
+
+	// activeExpireKeysPerLoop is the number of keys with a time to live looked
+	// at in each round of sampling.
+	activeExpireKeysPerLoop = 20
+
+	// activeExpireAcceptableStale is the percentage of sampled keys found
+	// expired under which a database is left alone until the next cycle.
+	activeExpireAcceptableStale = 10
+)
+
+// activeExpireEnabled controls whether the background expiration cycle runs.
+// When it's off, keys are only deleted when they are accessed after expiring.
+var activeExpireEnabled atomic.Bool
+
+func init() {
+	activeExpireEnabled.Store(true)
+}
+
+// setExpire sets the absolute expiration time of key, if it exists.
+func setExpire(db *DB, key string, at time.Time) {
+	s := db.shard(key)
+	s.mu.Lock()
+	if e, ok := s.keys[key]; ok {
+		s.setExpire(key, e, at)
+	}
+	s.mu.Unlock()
+}
+
+// clearExpire removes the expiration time of key, making it persistent.
+func clearExpire(db *DB, key string) {
+	setExpire(db, key, time.Time{})
+}
+
+// keyExpireTime returns the expiration time of key, if it has one.
+func keyExpireTime(db *DB, key string) (time.Time, bool) {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.expires[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.expireAt, true
+}
+
+// expireCount returns the number of keys of db that have an expiration time.
+func expireCount(db *DB) int {
+	n := 0
+	for i := range db.shards {
+		s := &db.shards[i]
+		s.mu.RLock()
+		n += len(s.expires)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// expire handles the EXPIRE command.
+func expire(c *Client, args []Value) Value {
+	return expireGeneric(c, "expire", args, time.Now().UnixMilli(), 1000)
+}
+
+// pexpire handles the PEXPIRE command.
+func pexpire(c *Client, args []Value) Value {
+	return expireGeneric(c, "pexpire", args, time.Now().UnixMilli(), 1)
+}
+
+// expireat handles the EXPIREAT command.
+func expireat(c *Client, args []Value) Value {
+	return expireGeneric(c, "expireat", args, 0, 1000)
+}
+
+// pexpireat handles the PEXPIREAT command, the form every expiration command of
+// Redis is replicated as, see aofAbsoluteExpire.
+func pexpireat(c *Client, args []Value) Value {
+	return expireGeneric(c, "pexpireat", args, 0, 1)
+}
+
+// expireGeneric implements the expiration commands, which take a time in
+// units of unit milliseconds, relative to base, in unix milliseconds, or
+// absolute if base is zero. A time in the past deletes the key.
+func expireGeneric(c *Client, name string, args []Value, base, unit int64) Value {
+	key := args[0].bulk
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	if n > (math.MaxInt64-base)/unit || n < math.MinInt64/unit {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR invalid expire time in '%s' command", name)}
+	}
+	at := time.UnixMilli(base + n*unit)
+
+	nx, xx, gt, lt := false, false, false, false
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unsupported option %s", arg.bulk)}
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return Value{typ: ValueTypSimpleError, str: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if gt && lt {
+		return Value{typ: ValueTypSimpleError, str: "ERR GT and LT options at the same time are not compatible"}
+	}
+
+	if lookupKeyType(c.db, key) == KeyTypNone {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	// A key without a time to live lives forever, longer than any time given
+	current, hasExpire := keyExpireTime(c.db, key)
+	if nx && hasExpire || xx && !hasExpire || gt && (!hasExpire || !at.After(current)) || lt && hasExpire && !at.Before(current) {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	// A replica keeps the key until the master deletes it, as their clocks
+	// may differ
+	if !time.Now().Before(at) && replicaOf == nil {
+		unlinkKey(c.db, key, config.lazyfreeLazyExpire)
+	} else {
+		setExpire(c.db, key, at)
+	}
+	return Value{typ: ValueTypInteger, num: 1}
+}
+
+// persist handles the PERSIST command.
+func persist(c *Client, args []Value) Value {
+	if _, ok := keyExpireTime(c.db, args[0].bulk); !ok {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	clearExpire(c.db, args[0].bulk)
+	return Value{typ: ValueTypInteger, num: 1}
+}
+
+// hiddenKey is a key of a replica whose time has passed, with its expiration time.
+type hiddenKey struct {
+	obj Object
+	at  time.Time
+}
+
+// expireIfNeeded deletes key if its expiration time has passed, reporting
+// whether it expired. A replica hides it instead. The caller must hold execMu.
+func expireIfNeeded(db *DB, key string) bool {
+	at, ok := keyExpireTime(db, key)
+	if !ok || time.Now().Before(at) {
+		return false
+	}
+
+	if replicaOf != nil {
+		hideKey(db, key, at)
+		return true
+	}
+
+	unlinkKey(db, key, config.lazyfreeLazyExpire)
+	serverStats.expiredKeys.Add(1)
+	propagateDel(db, key)
+	return true
+}
+
+// propagateDel sends the deletion of keys, expired or moved to another server,
+// to the AOF and the replicas. It returns the replication offset right after it.
+func propagateDel(db *DB, keys ...string) int64 {
+	del := commandValue(append([]string{"DEL"}, keys...)...)
+	dirty.Add(1)
+	if serverAof != nil {
+		// Like the writes of clients, a deletion the AOF refused isn't sent
+		// to the replicas
+		if _, err := serverAof.Write(db.id, del); err != nil {
+			fmt.Println("Error writing to AOF:", err)
+			return masterReplOffset.Load()
+		}
+	}
+	return propagate(db.id, del)
+}
+
+// hideKey moves key out of the keyspace of a replica.
+func hideKey(db *DB, key string, at time.Time) {
+	var obj Object
+	if !viewObject(db, key, func(o Object) { obj = o }) {
+		return
+	}
+	unlinkKey(db, key, false)
+
+	db.hiddenKeysMu.Lock()
+	db.hiddenKeys[key] = hiddenKey{obj: obj, at: at}
+	db.hiddenKeysMu.Unlock()
+}
+
+// unhideKey puts key back in the keyspace before a command of the master runs
+// against it, unless it has been written since it was hidden.
+func unhideKey(db *DB, key string) {
+	db.hiddenKeysMu.Lock()
+	hidden, ok := db.hiddenKeys[key]
+	delete(db.hiddenKeys, key)
+	db.hiddenKeysMu.Unlock()
+
+	if !ok || lookupKeyType(db, key) != KeyTypNone {
+		return
+	}
+	storeObject(db, key, hidden.obj)
+	setExpire(db, key, hidden.at)
+}
+
+// expireHiddenKeys deletes the keys hidden while this server was a replica,
+// once it's a master that decides when they expire. The caller must hold
+// execMu for writing.
+func expireHiddenKeys() {
+	for _, db := range databases {
+		db.hiddenKeysMu.Lock()
+		hidden := db.hiddenKeys
+		db.hiddenKeys = map[string]hiddenKey{}
+		db.hiddenKeysMu.Unlock()
+
+		for key := range hidden {
+			serverStats.expiredKeys.Add(1)
+			propagateDel(db, key)
+		}
+	}
+}
+
+// sampleExpiredKeys looks at up to n keys of db that have an expiration time,
+// and returns how many it looked at along with the ones whose time has passed.
+func sampleExpiredKeys(db *DB, n int) (int, []string) {
+	now := time.Now()
+	expired := []string{}
+	sampled := sampleKeys(db, n, true, func(key string, e *keyEntry) {
+		if !now.Before(e.expireAt) {
+			expired = append(expired, key)
+		}
+	})
+	return sampled, expired
+}
+
+// activeExpireDB deletes the expired keys of db found by sampling, as long as
+// the samples keep finding more than activeExpireAcceptableStale percent of them
+// expired, or until deadline. It reports whether the deadline was reached.
+func activeExpireDB(db *DB, deadline time.Time) bool {
+	for {
+		sampled, expired := sampleExpiredKeys(db, activeExpireKeysPerLoop)
+		for _, key := range expired {
+			expireIfNeeded(db, key)
+		}
+
+		if sampled == 0 || len(expired)*100 <= sampled*activeExpireAcceptableStale {
+			return false
+		}
+		if !time.Now().Before(deadline) {
+			return true
+		}
+	}
+}
+
+// expireCycle periodically deletes keys whose expiration time has passed. It
+// samples the keys with a time to live instead of scanning them all, so the
+// effort follows the share of them that expired, and stops once it used up its
+// share of the interval. The next cycle starts from the database it stopped at.
+func expireCycle() {
+	next := 0
+	for {
+		time.Sleep(expireCycleInterval)
+
+		// Deletions would move the replication offset a failover waits for
+		if !activeExpireEnabled.Load() || writesPaused() {
+			continue
+		}
+
+		// Deleting keys is a write, so it mustn't happen in the middle of EXEC
+		execMu.RLock()
+		deadline := time.Now().Add(activeExpireTimeLimit)
+		for i := range databases {
+			db := databases[(next+i)%len(databases)]
+			if activeExpireDB(db, deadline) {
+				serverStats.expiredTimeCapReached.Add(1)
+				next = db.id
+				break
+			}
+		}
+		execMu.RUnlock()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReplicaHidesExpiredKeys(t *testing.T) {
+	defer func(link *masterLink) { replicaOf = link }(replicaOf)
+
+	// Client 1 applies the stream of the master, which set e with an
+	// expiration time that has passed
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"hidden from clients", []step{
+			{0, []string{"GET", "e"}, "$-1\r\n"},
+			{0, []string{"OBJECT", "ENCODING", "e"}, "$-1\r\n"},
+			{1, []string{"GET", "e"}, "$1\r\nv\r\n"},
+		}},
+		{"expired again by the master", []step{
+			{0, []string{"GET", "e"}, "$-1\r\n"},
+			{1, []string{"PEXPIREAT", "e", "2"}, ":1\r\n"},
+			{0, []string{"GET", "e"}, "$-1\r\n"},
+		}},
+		{"deleted by the master", []step{
+			{0, []string{"GET", "e"}, "$-1\r\n"},
+			{1, []string{"DEL", "e"}, ":1\r\n"},
+			{1, []string{"GET", "e"}, "$-1\r\n"},
+		}},
+		{"persisted by the master", []step{
+			{0, []string{"GET", "e"}, "$-1\r\n"},
+			{1, []string{"PERSIST", "e"}, ":1\r\n"},
+			{0, []string{"GET", "e"}, "$1\r\nv\r\n"},
+		}},
+		{"written by the master", []step{
+			{0, []string{"GET", "e"}, "$-1\r\n"},
+			{1, []string{"SET", "e", "w"}, "+OK\r\n"},
+			{0, []string{"GET", "e"}, "$1\r\nw\r\n"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			master := connectTestClient(t)
+			master.user = nil
+			master.master = true
+			replicaOf = newMasterLink("127.0.0.1", 6379)
+			defer func() { replicaOf = nil }()
+
+			run(master, "SET", "e", "v")
+			run(master, "PEXPIREAT", "e", "1")
+			runAll(t, tt.steps, c, master)
+		})
+	}
+}
+
+func TestExpireHiddenKeys(t *testing.T) {
+	defer func(link *masterLink) { replicaOf = link }(replicaOf)
+
+	c := newTestClient(t)
+	master := connectTestClient(t)
+	master.user = nil
+	master.master = true
+	replicaOf = newMasterLink("127.0.0.1", 6379)
+
+	run(master, "SET", "e", "v")
+	run(master, "PEXPIREAT", "e", "1")
+	run(c, "GET", "e")
+
+	// Once a master, this server deletes the keys it hid
+	replicaOf = nil
+	expired := serverStats.expiredKeys.Load()
+	expireHiddenKeys()
+	if got := serverStats.expiredKeys.Load() - expired; got != 1 {
+		t.Fatalf("got %d keys expired, want 1", got)
+	}
+	if got := run(master, "GET", "e"); got != "$-1\r\n" {
+		t.Fatalf("got %q after the keys expired", got)
+	}
+}
@@ -0,0 +1,749 @@
+/*
+This file contains the export and import of the dataset in human-readable formats,
+for backups that can be inspected and edited without tools that understand the
+RDB format. Running the binary as "--export <dump.rdb> <file>" writes every key of
+a snapshot, with its database, type, value and expiration time, to a JSON or CSV
+file chosen by the extension, and "--import <file> <dump.rdb>" writes a snapshot
+back from one, for the server to load at startup. JSON keeps everything, including
+the consumer groups of streams, but can only hold strings that are valid UTF-8.
+CSV holds any string, with a row per string, hash field, list element, sorted set member and
+stream entry field, but keeps only the entries of streams. Function libraries
+aren't exported, FUNCTION DUMP and FUNCTION RESTORE move them. For a detailed
+description of the RDB snapshots these files are converted from and to, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/persistence/
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// exportCSVHeader names the columns of an exported CSV file.
+var exportCSVHeader = []string{"db", "key", "type", "expire_at", "id", "field", "value"}
+
+// exportedKey is a key of an exported JSON file.
+type exportedKey struct {
+	DB       int             `json:"db"`
+	Key      string          `json:"key"`
+	Type     string          `json:"type"`
+	ExpireAt int64           `json:"expire_at,omitempty"` // Unix time in milliseconds
+	Value    json.RawMessage `json:"value"`
+}
+
+// exportedZSetMember is a member of an exported sorted set. The score is a
+// string, as JSON numbers can't be infinite.
+type exportedZSetMember struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// exportedStream is an exported stream. Times are Unix times in milliseconds,
+// -1 when unset.
+type exportedStream struct {
+	LastID       string                `json:"last_id"`
+	EntriesAdded uint64                `json:"entries_added"`
+	MaxDeletedID string                `json:"max_deleted_id"`
+	Entries      []exportedStreamEntry `json:"entries"`
+	Groups       []exportedStreamGroup `json:"groups,omitempty"`
+}
+
+// exportedStreamEntry is an entry of an exported stream.
+type exportedStreamEntry struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"` // Alternating field names and values
+}
+
+// exportedStreamGroup is a consumer group of an exported stream.
+type exportedStreamGroup struct {
+	Name        string `json:"name"`
+	LastID      string `json:"last_id"`
+	EntriesRead int64  `json:"entries_read"`
+
+	Consumers []exportedStreamConsumer `json:"consumers"`
+	Pending   []exportedPendingEntry   `json:"pending"`
+}
+
+// exportedStreamConsumer is a consumer of an exported consumer group.
+type exportedStreamConsumer struct {
+	Name       string `json:"name"`
+	SeenTime   int64  `json:"seen_time"`
+	ActiveTime int64  `json:"active_time"`
+}
+
+// exportedPendingEntry is an entry of the PEL of an exported consumer group.
+type exportedPendingEntry struct {
+	ID            string `json:"id"`
+	Consumer      string `json:"consumer"`
+	DeliveryTime  int64  `json:"delivery_time"`
+	DeliveryCount int    `json:"delivery_count"`
+}
+
+// exportDataset runs the --export mode with the arguments that follow it, and
+// returns the exit code.
+func exportDataset(args []string) int {
+	if len(args) != 2 {
+		fmt.Println("Usage: --export <dump.rdb> <file.json|file.csv>")
+		return 1
+	}
+	src, dst := args[0], args[1]
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		fmt.Printf("Cannot read file %s: %s\n", src, err)
+		return 1
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		fmt.Printf("Cannot create file %s: %s\n", dst, err)
+		return 1
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	var write func(db int, key string, obj Object, expire time.Time) error
+	var finish func() error
+	switch strings.ToLower(filepath.Ext(dst)) {
+	case ".json":
+		write, finish = exportJSON(w)
+	case ".csv":
+		write, finish = exportCSV(w)
+	default:
+		fmt.Println("The export file must end with .json or .csv")
+		return 1
+	}
+
+	keys := 0
+	_, err = parseRdb(data, rdbHandler{
+		key: func(db int, key string, obj Object, expire time.Time) error {
+			keys++
+			return write(db, key, obj, expire)
+		},
+		function: func(string) error { return nil },
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Printf("Cannot export %s: %s\n", src, err)
+		os.Remove(dst)
+		return 1
+	}
+
+	fmt.Printf("Exported %d keys from %s to %s\n", keys, src, dst)
+	return 0
+}
+
+// exportJSON returns the functions writing the keys as a JSON array to w, and
+// completing it.
+func exportJSON(w *bufio.Writer) (func(int, string, Object, time.Time) error, func() error) {
+	w.WriteString("[")
+	first := true
+
+	write := func(db int, key string, obj Object, expire time.Time) error {
+		if !jsonSafe(key, obj) {
+			return fmt.Errorf("key '%s' holds a string that isn't valid UTF-8, export it to CSV instead", key)
+		}
+
+		value, err := json.Marshal(exportValue(obj))
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(exportedKey{DB: db, Key: key, Type: obj.typ, ExpireAt: millisOrZero(expire), Value: value})
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			w.WriteString(",")
+		}
+		first = false
+		w.WriteString("\n  ")
+		_, err = w.Write(line)
+		return err
+	}
+	finish := func() error {
+		_, err := w.WriteString("\n]\n")
+		return err
+	}
+	return write, finish
+}
+
+// exportValue returns the JSON representation of the value of obj.
+func exportValue(obj Object) any {
+	switch obj.typ {
+	case KeyTypHash:
+		return obj.hash.Map()
+	case KeyTypList:
+		return obj.list.Elements()
+	case KeyTypSet:
+		members := obj.set.Members()
+		sort.Strings(members)
+		return members
+	case KeyTypZSet:
+		members := []exportedZSetMember{}
+		for _, m := range obj.zset.sorted {
+			members = append(members, exportedZSetMember{Member: m.member, Score: strconv.FormatFloat(m.score, 'g', -1, 64)})
+		}
+		return members
+	case KeyTypStream:
+		return exportStream(obj.stream)
+	default:
+		return obj.str
+	}
+}
+
+// exportStream returns the JSON representation of s.
+func exportStream(s *Stream) exportedStream {
+	out := exportedStream{
+		LastID:       s.lastID.String(),
+		EntriesAdded: s.entriesAdded,
+		MaxDeletedID: s.maxDeletedID.String(),
+	}
+	out.Entries = []exportedStreamEntry{}
+	for _, e := range s.entries {
+		out.Entries = append(out.Entries, exportedStreamEntry{ID: e.id.String(), Fields: e.fields})
+	}
+
+	names := []string{}
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := s.groups[name]
+		eg := exportedStreamGroup{Name: g.name, LastID: g.lastID.String(), EntriesRead: g.entriesRead}
+
+		consumers := []string{}
+		for name := range g.consumers {
+			consumers = append(consumers, name)
+		}
+		sort.Strings(consumers)
+		for _, name := range consumers {
+			c := g.consumers[name]
+			eg.Consumers = append(eg.Consumers, exportedStreamConsumer{c.name, millisOrUnset(c.seenTime), millisOrUnset(c.activeTime)})
+		}
+
+		for _, id := range g.pendingIDs() {
+			pe := g.pending[id]
+			eg.Pending = append(eg.Pending, exportedPendingEntry{id.String(), pe.consumer, millisOrUnset(pe.deliveryTime), pe.deliveryCount})
+		}
+
+		out.Groups = append(out.Groups, eg)
+	}
+
+	return out
+}
+
+// jsonSafe reports whether every string of key and obj is valid UTF-8, which
+// JSON would otherwise alter.
+func jsonSafe(key string, obj Object) bool {
+	strs := []string{key, obj.str}
+	if obj.hash != nil {
+		obj.hash.Range(func(field, value string) bool {
+			strs = append(strs, field, value)
+			return true
+		})
+	}
+	if obj.list != nil {
+		strs = append(strs, obj.list.Elements()...)
+	}
+	if obj.zset != nil {
+		for member := range obj.zset.dict {
+			strs = append(strs, member)
+		}
+	}
+	if obj.stream != nil {
+		for _, e := range obj.stream.entries {
+			strs = append(strs, e.fields...)
+		}
+		for _, g := range obj.stream.groups {
+			strs = append(strs, g.name)
+			for name := range g.consumers {
+				strs = append(strs, name)
+			}
+		}
+	}
+
+	for _, s := range strs {
+		if !utf8.ValidString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// exportCSV returns the functions writing the keys as CSV rows to w, and
+// completing the file.
+func exportCSV(w *bufio.Writer) (func(int, string, Object, time.Time) error, func() error) {
+	cw := csv.NewWriter(w)
+	cw.Write(exportCSVHeader)
+
+	write := func(db int, key string, obj Object, expire time.Time) error {
+		expireAt := ""
+		if !expire.IsZero() {
+			expireAt = strconv.FormatInt(expire.UnixMilli(), 10)
+		}
+		row := func(id, field, value string) {
+			cw.Write([]string{strconv.Itoa(db), key, obj.typ, expireAt, id, field, value})
+		}
+
+		switch obj.typ {
+		case KeyTypHash:
+			values := obj.hash.Map()
+			fields := []string{}
+			for field := range values {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				row("", field, values[field])
+			}
+		case KeyTypList:
+			for _, elem := range obj.list.Elements() {
+				row("", "", elem)
+			}
+		case KeyTypSet:
+			members := obj.set.Members()
+			sort.Strings(members)
+			for _, member := range members {
+				row("", member, "")
+			}
+		case KeyTypZSet:
+			for _, m := range obj.zset.sorted {
+				row("", m.member, strconv.FormatFloat(m.score, 'g', -1, 64))
+			}
+		case KeyTypStream:
+			if len(obj.stream.groups) > 0 {
+				fmt.Printf("The consumer groups of stream '%s' aren't exported to CSV\n", key)
+			}
+			// A row without an ID keeps a stream without entries
+			if len(obj.stream.entries) == 0 {
+				row("", "", "")
+			}
+			for _, e := range obj.stream.entries {
+				for i := 0; i+1 < len(e.fields); i += 2 {
+					row(e.id.String(), e.fields[i], e.fields[i+1])
+				}
+			}
+		default:
+			row("", "", obj.str)
+		}
+
+		cw.Flush()
+		return cw.Error()
+	}
+	finish := func() error {
+		cw.Flush()
+		return cw.Error()
+	}
+	return write, finish
+}
+
+// importDataset runs the --import mode with the arguments that follow it, and
+// returns the exit code.
+func importDataset(args []string) int {
+	if len(args) != 2 {
+		fmt.Println("Usage: --import <file.json|file.csv> <dump.rdb>")
+		return 1
+	}
+	src, dst := args[0], args[1]
+
+	f, err := os.Open(src)
+	if err != nil {
+		fmt.Printf("Cannot open file %s: %s\n", src, err)
+		return 1
+	}
+	defer f.Close()
+
+	var snap *rdbSnapshot
+	switch strings.ToLower(filepath.Ext(src)) {
+	case ".json":
+		snap, err = importJSON(bufio.NewReader(f))
+	case ".csv":
+		snap, err = importCSV(bufio.NewReader(f))
+	default:
+		fmt.Println("The import file must end with .json or .csv")
+		return 1
+	}
+	if err != nil {
+		fmt.Printf("Cannot import %s: %s\n", src, err)
+		return 1
+	}
+
+	if err := saveSnapshot(snap, dst); err != nil {
+		fmt.Printf("Cannot write %s: %s\n", dst, err)
+		return 1
+	}
+
+	keys := 0
+	for _, entries := range snap.dbs {
+		keys += len(entries)
+	}
+	fmt.Printf("Imported %d keys from %s to %s\n", keys, src, dst)
+	return 0
+}
+
+// addEntry adds e to database db of snap.
+func (snap *rdbSnapshot) addEntry(db int, e rdbEntry) error {
+	if db < 0 {
+		return fmt.Errorf("key '%s': invalid database %d", e.key, db)
+	}
+	for len(snap.dbs) <= db {
+		snap.dbs = append(snap.dbs, nil)
+	}
+	snap.dbs[db] = append(snap.dbs[db], e)
+	return nil
+}
+
+// importJSON reads the keys of an exported JSON file.
+func importJSON(r io.Reader) (*rdbSnapshot, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("expected an array of keys")
+	}
+
+	snap := &rdbSnapshot{}
+	for dec.More() {
+		var k exportedKey
+		if err := dec.Decode(&k); err != nil {
+			return nil, err
+		}
+
+		obj, err := importValue(k.Type, k.Value)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %s", k.Key, err)
+		}
+		if err := snap.addEntry(k.DB, rdbEntry{key: k.Key, obj: obj, expire: timeOrZero(k.ExpireAt)}); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// importValue decodes the JSON representation of a value of type typ.
+func importValue(typ string, value json.RawMessage) (Object, error) {
+	switch typ {
+	case KeyTypString:
+		obj := Object{typ: typ}
+		return obj, json.Unmarshal(value, &obj.str)
+
+	case KeyTypHash:
+		hash := map[string]string{}
+		if err := json.Unmarshal(value, &hash); err != nil {
+			return Object{}, err
+		}
+		if len(hash) == 0 {
+			return Object{}, errors.New("empty hash")
+		}
+		return Object{typ: typ, hash: hashFromMap(hash)}, nil
+
+	case KeyTypList:
+		var elems []string
+		if err := json.Unmarshal(value, &elems); err != nil {
+			return Object{}, err
+		}
+		if len(elems) == 0 {
+			return Object{}, errors.New("empty list")
+		}
+		return Object{typ: typ, list: listFromElements(elems)}, nil
+
+	case KeyTypSet:
+		var members []string
+		if err := json.Unmarshal(value, &members); err != nil {
+			return Object{}, err
+		}
+		if len(members) == 0 {
+			return Object{}, errors.New("empty set")
+		}
+		return Object{typ: typ, set: setFromMembers(members)}, nil
+
+	case KeyTypZSet:
+		var members []exportedZSetMember
+		if err := json.Unmarshal(value, &members); err != nil {
+			return Object{}, err
+		}
+		if len(members) == 0 {
+			return Object{}, errors.New("empty sorted set")
+		}
+		zset := newSortedSet()
+		for _, m := range members {
+			score, err := strconv.ParseFloat(m.Score, 64)
+			if err != nil {
+				return Object{}, fmt.Errorf("invalid score '%s'", m.Score)
+			}
+			zset.Add(m.Member, score)
+		}
+		return Object{typ: typ, zset: zset}, nil
+
+	case KeyTypStream:
+		var es exportedStream
+		if err := json.Unmarshal(value, &es); err != nil {
+			return Object{}, err
+		}
+		s, err := importStream(es)
+		if err != nil {
+			return Object{}, err
+		}
+		return Object{typ: typ, stream: s}, nil
+
+	default:
+		return Object{}, fmt.Errorf("unsupported type '%s'", typ)
+	}
+}
+
+// importStream rebuilds a stream from its JSON representation.
+func importStream(es exportedStream) (*Stream, error) {
+	s := &Stream{entriesAdded: es.EntriesAdded}
+	for _, e := range es.Entries {
+		id, err := parseStreamID(e.ID, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry ID '%s'", e.ID)
+		}
+		if len(e.Fields) == 0 || len(e.Fields)%2 != 0 {
+			return nil, fmt.Errorf("entry %s must have fields and values", e.ID)
+		}
+		if err := appendImportedEntry(s, StreamEntry{id: id, fields: e.Fields}); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if s.lastID, err = parseStreamID(es.LastID, 0); err != nil {
+		return nil, fmt.Errorf("invalid last ID '%s'", es.LastID)
+	}
+	if s.maxDeletedID, err = parseStreamID(es.MaxDeletedID, 0); err != nil {
+		return nil, fmt.Errorf("invalid max deleted ID '%s'", es.MaxDeletedID)
+	}
+	if len(s.entries) > 0 && s.lastID.Less(s.entries[len(s.entries)-1].id) {
+		return nil, errors.New("the last ID is smaller than the ID of the last entry")
+	}
+
+	for _, eg := range es.Groups {
+		lastID, err := parseStreamID(eg.LastID, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last ID '%s' of group '%s'", eg.LastID, eg.Name)
+		}
+		if s.groups == nil {
+			s.groups = map[string]*StreamGroup{}
+		}
+		if _, ok := s.groups[eg.Name]; ok {
+			return nil, fmt.Errorf("duplicate group '%s'", eg.Name)
+		}
+		g := newStreamGroup(eg.Name, lastID, eg.EntriesRead)
+
+		for _, ec := range eg.Consumers {
+			c := g.consumer(ec.Name, true)
+			c.seenTime = timeOrZero(ec.SeenTime)
+			c.activeTime = timeOrZero(ec.ActiveTime)
+		}
+
+		// Every pending entry is owned by one of the consumers
+		for _, ep := range eg.Pending {
+			id, err := parseStreamID(ep.ID, 0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pending ID '%s' of group '%s'", ep.ID, eg.Name)
+			}
+			c := g.consumer(ep.Consumer, false)
+			if c == nil {
+				return nil, fmt.Errorf("pending entry %s of group '%s' has an unknown consumer", ep.ID, eg.Name)
+			}
+			g.pending[id] = &StreamPendingEntry{consumer: c.name, deliveryTime: timeOrZero(ep.DeliveryTime), deliveryCount: ep.DeliveryCount}
+			c.pending[id] = struct{}{}
+		}
+
+		s.groups[eg.Name] = g
+	}
+
+	return s, nil
+}
+
+// appendImportedEntry appends e to s, checking the entries are in ID order.
+func appendImportedEntry(s *Stream, e StreamEntry) error {
+	if len(s.entries) > 0 && !s.entries[len(s.entries)-1].id.Less(e.id) {
+		return fmt.Errorf("entry %s isn't after the previous one", e.id)
+	}
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+// importCSV reads the keys of an exported CSV file, whose rows of the same key
+// are consecutive.
+func importCSV(r io.Reader) (*rdbSnapshot, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(exportCSVHeader)
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(header, ",") != strings.Join(exportCSVHeader, ",") {
+		return nil, fmt.Errorf("expected the header %s", strings.Join(exportCSVHeader, ","))
+	}
+
+	snap := &rdbSnapshot{}
+	var cur *rdbEntry
+	curDB := -1
+	flush := func() error {
+		if cur == nil {
+			return nil
+		}
+		if cur.obj.stream != nil && len(cur.obj.stream.entries) > 0 {
+			s := cur.obj.stream
+			s.lastID = s.entries[len(s.entries)-1].id
+			s.entriesAdded = uint64(len(s.entries))
+		}
+		err := snap.addEntry(curDB, *cur)
+		cur = nil
+		return err
+	}
+
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid database '%s'", row[0])
+		}
+		key, typ, id, field, value := row[1], row[2], row[4], row[5], row[6]
+
+		if cur == nil || db != curDB || key != cur.key {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			expireAt := int64(0)
+			if row[3] != "" {
+				if expireAt, err = strconv.ParseInt(row[3], 10, 64); err != nil {
+					return nil, fmt.Errorf("key '%s': invalid expiration time '%s'", key, row[3])
+				}
+			}
+			cur = &rdbEntry{key: key, obj: Object{typ: typ}, expire: timeOrZero(expireAt)}
+			curDB = db
+		} else if typ != cur.obj.typ {
+			return nil, fmt.Errorf("key '%s' has rows of different types", key)
+		}
+
+		if err := importCSVRow(cur, id, field, value); err != nil {
+			return nil, fmt.Errorf("key '%s': %s", key, err)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// importCSVRow adds the element of a CSV row to the value of e.
+func importCSVRow(e *rdbEntry, id, field, value string) error {
+	obj := &e.obj
+	switch obj.typ {
+	case KeyTypString:
+		obj.str = value
+
+	case KeyTypHash:
+		if obj.hash == nil {
+			obj.hash = newHash()
+		}
+		obj.hash.Set(field, value)
+
+	case KeyTypList:
+		if obj.list == nil {
+			obj.list = newList()
+		}
+		obj.list.Push(value, false)
+
+	case KeyTypSet:
+		if obj.set == nil {
+			obj.set = newSet()
+		}
+		obj.set.Add(field)
+
+	case KeyTypZSet:
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid score '%s'", value)
+		}
+		if obj.zset == nil {
+			obj.zset = newSortedSet()
+		}
+		obj.zset.Add(field, score)
+
+	case KeyTypStream:
+		if obj.stream == nil {
+			obj.stream = &Stream{}
+		}
+		if id == "" {
+			return nil
+		}
+		streamID, err := parseStreamID(id, 0)
+		if err != nil {
+			return fmt.Errorf("invalid entry ID '%s'", id)
+		}
+
+		// The fields of an entry are on consecutive rows
+		s := obj.stream
+		if n := len(s.entries); n > 0 && s.entries[n-1].id == streamID {
+			s.entries[n-1].fields = append(s.entries[n-1].fields, field, value)
+			return nil
+		}
+		return appendImportedEntry(s, StreamEntry{id: streamID, fields: []string{field, value}})
+
+	default:
+		return fmt.Errorf("unsupported type '%s'", obj.typ)
+	}
+	return nil
+}
+
+// millisOrZero returns t as a Unix time in milliseconds, or 0 if it's unset.
+func millisOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// millisOrUnset returns t as a Unix time in milliseconds, or -1 if it's unset.
+func millisOrUnset(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return t.UnixMilli()
+}
+
+// timeOrZero returns the Unix time in milliseconds ms, or the zero time if it's
+// not positive.
+func timeOrZero(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,326 @@
+/*
+This file contains coordinated failover. FAILOVER hands the role of master over
+to one of the replicas without losing writes: the writes of the clients are
+paused, and once the replica has acknowledged the whole replication stream this
+server becomes its replica, asking it with PSYNC FAILOVER to become a master
+first. The paused writes then get a READONLY error. If no replica catches up
+within the timeout, or the replica can't be reached, the failover is aborted and
+this server stays the master. FAILOVER TO names the replica, and with FORCE it
+takes over at the timeout even if it didn't catch up. For a detailed
+description of the command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/failover/
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a failover, as reported by INFO
+const (
+	failoverStateNone       = "no-failover"
+	failoverStateWaitSync   = "waiting-for-sync"     // Waiting for a replica to catch up
+	failoverStateInProgress = "failover-in-progress" // Synchronizing with the new master
+)
+
+// failoverCheckInterval is how often a failover checks whether a replica
+// caught up.
+const failoverCheckInterval = 100 * time.Millisecond
+
+// failoverJob is a failover in progress.
+type failoverJob struct {
+	host     string // Replica to fail over to, empty for the first to catch up
+	port     int
+	force    bool
+	deadline time.Time // Zero without a timeout
+	state    string
+	aborted  chan struct{}
+}
+
+// currentFailover is the failover in progress, nil if there's none. It's
+// guarded by execMu.
+var currentFailover *failoverJob
+
+// writesResumed is closed when the writes paused by a failover may run again,
+// nil while they aren't paused.
+var writesResumed chan struct{}
+var writesResumedMu = sync.Mutex{}
+
+// pauseWrites makes the write commands wait until resumeWrites is called.
+func pauseWrites() {
+	writesResumedMu.Lock()
+	defer writesResumedMu.Unlock()
+
+	writesResumed = make(chan struct{})
+}
+
+// resumeWrites lets the paused write commands run.
+func resumeWrites() {
+	writesResumedMu.Lock()
+	defer writesResumedMu.Unlock()
+
+	if writesResumed != nil {
+		close(writesResumed)
+		writesResumed = nil
+	}
+}
+
+// writesPaused reports whether write commands are paused.
+func writesPaused() bool {
+	writesResumedMu.Lock()
+	defer writesResumedMu.Unlock()
+
+	return writesResumed != nil
+}
+
+// waitWritesResumed waits until write commands may run.
+func waitWritesResumed() {
+	writesResumedMu.Lock()
+	resumed := writesResumed
+	writesResumedMu.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// failoverCommand handles the FAILOVER command.
+func failoverCommand(c *Client, args []Value) Value {
+	if len(args) > 0 && strings.EqualFold(args[0].bulk, "abort") {
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+		if currentFailover == nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER is not in progress."}
+		}
+		currentFailover.abort()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+
+	f := &failoverJob{state: failoverStateWaitSync, aborted: make(chan struct{})}
+	timeout := int64(0)
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i].bulk) {
+		case "to":
+			if i+2 >= len(args) {
+				return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+			}
+			port, err := strconv.Atoi(args[i+2].bulk)
+			if err != nil || port < 0 || port > 65535 {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			f.host, f.port = args[i+1].bulk, port
+			i += 2
+			if i+1 < len(args) && strings.EqualFold(args[i+1].bulk, "force") {
+				f.force = true
+				i++
+			}
+		case "timeout":
+			if i+1 >= len(args) {
+				return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+			}
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			if n <= 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER timeout must be greater than 0"}
+			}
+			timeout = n
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	if replicaOf != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER is not valid when server is a replica."}
+	}
+	replicasMu.Lock()
+	connected := len(replicas)
+	replicasMu.Unlock()
+	if connected == 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER requires connected replicas."}
+	}
+	if currentFailover != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER already in progress."}
+	}
+	if f.force && (f.host == "" || timeout == 0) {
+		return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER with force option requires both a timeout and target HOST and IP."}
+	}
+	if f.host != "" {
+		r := findReplica(f.host, f.port)
+		if r == nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER target HOST and PORT is not a replica."}
+		}
+		if r.replicaState() != replicaStateOnline {
+			return Value{typ: ValueTypSimpleError, str: "ERR FAILOVER target replica is not online."}
+		}
+	}
+	if timeout > 0 {
+		f.deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+
+	if f.host != "" {
+		fmt.Printf("FAILOVER requested to %s:%d.\n", f.host, f.port)
+	} else {
+		fmt.Println("FAILOVER requested to any replica.")
+	}
+	currentFailover = f
+	pauseWrites()
+	requestAcks()
+	go f.run()
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// findReplica returns the replica at host that listens on port, nil if there's
+// none.
+func findReplica(host string, port int) *replica {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	for _, r := range replicas {
+		ip, _, _ := net.SplitHostPort(r.client.conn.RemoteAddr().String())
+		if ip == host && r.listeningPort == port {
+			return r
+		}
+	}
+	return nil
+}
+
+// abort stops the failover, if it wasn't already. The caller must hold execMu
+// for writing.
+func (f *failoverJob) abort() {
+	select {
+	case <-f.aborted:
+	default:
+		close(f.aborted)
+	}
+}
+
+// run waits for a replica to catch up and then makes it the master, resuming
+// the writes once done either way.
+func (f *failoverJob) run() {
+	defer func() {
+		execMu.Lock()
+		currentFailover = nil
+		resumeWrites()
+		execMu.Unlock()
+	}()
+
+	link := f.waitForSync()
+	if link == nil {
+		return
+	}
+
+	var err error
+	select {
+	case err = <-link.failoverResult:
+	case <-link.stopped:
+		err = fmt.Errorf("replication was reconfigured")
+	case <-f.aborted:
+		err = fmt.Errorf("failover aborted")
+	}
+
+	execMu.Lock()
+	defer execMu.Unlock()
+	if err == nil {
+		fmt.Printf("Failover target %s is now the master.\n", link.addr())
+		return
+	}
+
+	// The replicas reconnect to this server, which is still the master
+	fmt.Printf("FAILOVER to %s failed, unpausing: %s\n", link.addr(), err)
+	if replicaOf == link {
+		link.stop()
+		replicaOf = nil
+		disconnectReplicas()
+	}
+}
+
+// waitForSync waits until a replica acknowledged the whole replication stream,
+// and makes this server its replica. It returns the link to the new master,
+// nil if the failover was aborted or timed out.
+func (f *failoverJob) waitForSync() *masterLink {
+	ticker := time.NewTicker(failoverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		execMu.Lock()
+		host, port, ok := f.caughtUpReplica()
+		if !ok && !f.deadline.IsZero() && time.Now().After(f.deadline) {
+			if !f.force {
+				fmt.Println("FAILOVER timed out waiting for a replica to catch up, unpausing.")
+				execMu.Unlock()
+				return nil
+			}
+			fmt.Printf("FAILOVER to %s:%d forced after timeout.\n", f.host, f.port)
+			host, port, ok = f.host, f.port, true
+		}
+		if ok {
+			link := f.becomeReplica(host, port)
+			execMu.Unlock()
+			return link
+		}
+		execMu.Unlock()
+
+		select {
+		case <-f.aborted:
+			fmt.Println("FAILOVER aborted, unpausing.")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// caughtUpReplica returns the address of a replica to fail over to that
+// acknowledged the whole replication stream, if there is one. The caller must
+// hold execMu for writing.
+func (f *failoverJob) caughtUpReplica() (string, int, bool) {
+	offset := masterReplOffset.Load()
+
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	for _, r := range replicas {
+		host, _, _ := net.SplitHostPort(r.client.conn.RemoteAddr().String())
+		if f.host != "" && (host != f.host || r.listeningPort != f.port) {
+			continue
+		}
+		if r.replicaState() == replicaStateOnline && r.ackOffset >= offset {
+			return host, r.listeningPort, true
+		}
+	}
+	return "", 0, false
+}
+
+// becomeReplica makes this server a replica of the master to be, which its
+// first PSYNC asks to take over. The caller must hold execMu for writing.
+func (f *failoverJob) becomeReplica(host string, port int) *masterLink {
+	f.state = failoverStateInProgress
+	fmt.Printf("Failover target %s:%d caught up, demoting myself.\n", host, port)
+
+	disconnectReplicas()
+	link := newMasterLink(host, port)
+	link.failoverResult = make(chan error, 1)
+	replicaOf = link
+	go link.run()
+	return link
+}
+
+// failoverState returns the state of the failover, as reported by INFO. The
+// caller must hold execMu.
+func failoverState() string {
+	if currentFailover == nil {
+		return failoverStateNone
+	}
+	return currentFailover.state
+}
@@ -0,0 +1,656 @@
+/*
+This file contains server-side functions, the Redis 7 successor of EVAL scripts.
+A library is Lua code starting with a "#!lua name=<library>" line that registers
+named functions with redis.register_function when it's loaded. FCALL then calls a
+function by name. Libraries are part of the dataset: loading one is persisted in
+the AOF, and FUNCTION DUMP and FUNCTION RESTORE move them between servers. For a
+detailed description of functions, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/interact/programmability/functions-intro/
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"sort"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// dumpTypeFunction is the type byte of a library in a FUNCTION DUMP payload.
+const dumpTypeFunction = 245
+
+// FunctionLibrary is a loaded library of functions.
+type FunctionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*LibraryFunction
+}
+
+// LibraryFunction is a function registered by a library.
+type LibraryFunction struct {
+	name        string
+	description string
+	flags       []string
+	library     *FunctionLibrary
+}
+
+// functionLibraries stores the loaded libraries by name, and libraryFunctions
+// stores their functions by name, since function names are global.
+var functionLibraries = map[string]*FunctionLibrary{}
+var libraryFunctions = map[string]*LibraryFunction{}
+var functionsMu = sync.RWMutex{}
+
+// validFunctionFlags are the flags a function may be registered with.
+var validFunctionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+// validFunctionName reports whether name is a valid library or function name.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata reads the library name from the "#!lua name=<library>"
+// line and returns it along with the code that follows.
+func parseLibraryMetadata(code string) (string, string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+
+	line, body, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+	if fields[0] != "lua" {
+		return "", "", fmt.Errorf("ERR Engine '%s' not found", fields[0])
+	}
+
+	name := ""
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return "", "", fmt.Errorf("ERR Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	// Keep the metadata line empty so line numbers in errors stay right
+	return name, "\n" + body, nil
+}
+
+// registeredFunction is a function registered while running library code.
+type registeredFunction struct {
+	fn       *LibraryFunction
+	callback *lua.LFunction
+}
+
+// runLibrary runs the code of a library in L and returns the functions it
+// registered. Library code can only register functions, not call commands.
+func runLibrary(L *lua.LState, name, code string) (map[string]registeredFunction, error) {
+	registered := map[string]registeredFunction{}
+
+	redis := L.GetGlobal("redis").(*lua.LTable)
+	notAllowed := func(L *lua.LState) int {
+		L.RaiseError("attempt to call field 'call' (a nil value)")
+		return 0
+	}
+	redis.RawSetString("call", L.NewFunction(notAllowed))
+	redis.RawSetString("pcall", L.NewFunction(notAllowed))
+
+	redis.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		fn := &LibraryFunction{}
+		var callback *lua.LFunction
+
+		if t, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+			// The named arguments form
+			var err error
+			fn, callback, err = parseRegisterFunctionTable(t)
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+		} else {
+			if L.GetTop() != 2 {
+				L.RaiseError("wrong number of arguments to redis.register_function")
+			}
+			fn.name = L.CheckString(1)
+			callback = L.CheckFunction(2)
+		}
+
+		if !validFunctionName(fn.name) {
+			L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		}
+		if _, ok := registered[fn.name]; ok {
+			L.RaiseError("Function already exists in the library")
+		}
+
+		registered[fn.name] = registeredFunction{fn: fn, callback: callback}
+		return 0
+	}))
+
+	chunk, err := L.Load(strings.NewReader(code), "@user_function")
+	if err != nil {
+		return nil, errors.New(scriptErrorValue(name, err).str)
+	}
+
+	L.Push(chunk)
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, errors.New(scriptErrorValue(name, err).str)
+	}
+
+	return registered, nil
+}
+
+// parseRegisterFunctionTable parses the table form of redis.register_function.
+func parseRegisterFunctionTable(t *lua.LTable) (*LibraryFunction, *lua.LFunction, error) {
+	fn := &LibraryFunction{}
+	var callback *lua.LFunction
+	var err error
+
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch k.String() {
+		case "function_name":
+			fn.name = v.String()
+		case "callback":
+			cb, ok := v.(*lua.LFunction)
+			if !ok {
+				err = errors.New("callback argument given to redis.register_function must be a function")
+				return
+			}
+			callback = cb
+		case "description":
+			fn.description = v.String()
+		case "flags":
+			flags, ok := v.(*lua.LTable)
+			if !ok {
+				err = errors.New("flags argument to redis.register_function must be a table representing function flags")
+				return
+			}
+			flags.ForEach(func(_, flag lua.LValue) {
+				if !validFunctionFlags[flag.String()] {
+					err = fmt.Errorf("unknown flag given")
+					return
+				}
+				fn.flags = append(fn.flags, flag.String())
+			})
+		default:
+			err = errors.New("unknown argument given to redis.register_function")
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fn.name == "" {
+		return nil, nil, errors.New("redis.register_function must get a function name argument")
+	}
+	if callback == nil {
+		return nil, nil, errors.New("redis.register_function must get a callback argument")
+	}
+
+	return fn, callback, nil
+}
+
+// compileLibrary runs the code of a library to find out which functions it
+// registers, without adding it to the registry.
+func compileLibrary(code string) (*FunctionLibrary, error) {
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+
+	// Library code can't call commands, so it doesn't need a database
+	L := newScriptState(nil, false)
+	defer L.Close()
+
+	registered, err := runLibrary(L, name, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(registered) == 0 {
+		return nil, errors.New("ERR No functions registered")
+	}
+
+	lib := &FunctionLibrary{name: name, code: code, functions: map[string]*LibraryFunction{}}
+	for fname, r := range registered {
+		r.fn.library = lib
+		lib.functions[fname] = r.fn
+	}
+
+	return lib, nil
+}
+
+// flushLibraries deletes every library.
+func flushLibraries() {
+	functionsMu.Lock()
+	functionLibraries = map[string]*FunctionLibrary{}
+	libraryFunctions = map[string]*LibraryFunction{}
+	functionsMu.Unlock()
+}
+
+// addLibrary adds a library to the registry, replacing a library with the same
+// name if replace is set. The caller must hold functionsMu.
+func addLibrary(lib *FunctionLibrary, replace bool) error {
+	old, exists := functionLibraries[lib.name]
+	if exists && !replace {
+		return fmt.Errorf("ERR Library '%s' already exists", lib.name)
+	}
+
+	// Function names must be unique across libraries
+	for fname := range lib.functions {
+		if fn, ok := libraryFunctions[fname]; ok && fn.library != old {
+			return fmt.Errorf("ERR Function %s already exists", fname)
+		}
+	}
+
+	if exists {
+		removeLibrary(old)
+	}
+
+	functionLibraries[lib.name] = lib
+	for fname, fn := range lib.functions {
+		libraryFunctions[fname] = fn
+	}
+
+	return nil
+}
+
+// removeLibrary removes a library and its functions from the registry. The
+// caller must hold functionsMu.
+func removeLibrary(lib *FunctionLibrary) {
+	delete(functionLibraries, lib.name)
+	for fname := range lib.functions {
+		delete(libraryFunctions, fname)
+	}
+}
+
+// sortedLibraries returns the loaded libraries ordered by name. The caller must
+// hold functionsMu.
+func sortedLibraries() []*FunctionLibrary {
+	libs := make([]*FunctionLibrary, 0, len(functionLibraries))
+	for _, lib := range functionLibraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// serializeLibraries encodes libraries in the FUNCTION DUMP format, which is the
+// code of every library followed by the same footer as DUMP.
+func serializeLibraries(libs []*FunctionLibrary) []byte {
+	w := &dumpWriter{}
+	for _, lib := range libs {
+		w.buf = append(w.buf, dumpTypeFunction)
+		w.writeString(lib.code)
+	}
+
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, dumpVersion)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, crc64.Checksum(w.buf, crc64Table))
+
+	return w.buf
+}
+
+// deserializeLibraries decodes a FUNCTION DUMP payload into library code.
+func deserializeLibraries(payload []byte) ([]string, error) {
+	if len(payload) < dumpFooterLen {
+		return nil, errBadDumpPayload
+	}
+
+	body := payload[:len(payload)-8]
+	version := binary.LittleEndian.Uint16(payload[len(payload)-dumpFooterLen:])
+	checksum := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if version > dumpVersion || crc64.Checksum(body, crc64Table) != checksum {
+		return nil, errBadDumpPayload
+	}
+
+	r := &dumpReader{buf: payload[:len(payload)-dumpFooterLen]}
+
+	codes := []string{}
+	for len(r.buf) > 0 && r.err == nil {
+		if r.buf[0] != dumpTypeFunction {
+			return nil, errors.New("ERR given type is not a function")
+		}
+		r.buf = r.buf[1:]
+		codes = append(codes, r.readString())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return codes, nil
+}
+
+// functionCommand handles the FUNCTION command.
+func functionCommand(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "LOAD":
+		return functionLoad(args[1:])
+	case "LIST":
+		return functionList(args[1:])
+	case "DELETE":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function|delete' command"}
+		}
+
+		functionsMu.Lock()
+		defer functionsMu.Unlock()
+
+		lib, ok := functionLibraries[args[1].bulk]
+		if !ok {
+			return Value{typ: ValueTypSimpleError, str: "ERR Library not found"}
+		}
+		removeLibrary(lib)
+
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	case "FLUSH":
+		if len(args) > 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function|flush' command"}
+		}
+		if len(args) == 2 {
+			mode := strings.ToUpper(args[1].bulk)
+			if mode != "ASYNC" && mode != "SYNC" {
+				return Value{typ: ValueTypSimpleError, str: "ERR FUNCTION FLUSH only supports SYNC|ASYNC option"}
+			}
+		}
+
+		flushLibraries()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	case "DUMP":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function|dump' command"}
+		}
+
+		functionsMu.RLock()
+		defer functionsMu.RUnlock()
+
+		return Value{typ: ValueTypBulkString, bulk: string(serializeLibraries(sortedLibraries()))}
+	case "RESTORE":
+		return functionRestore(args[1:])
+	case "KILL":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function|kill' command"}
+		}
+		return killScript(true)
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try FUNCTION HELP.", args[0].bulk)}
+	}
+}
+
+// functionLoad handles FUNCTION LOAD.
+func functionLoad(args []Value) Value {
+	replace := false
+	if len(args) == 2 && strings.ToUpper(args[0].bulk) == "REPLACE" {
+		replace = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function|load' command"}
+	}
+
+	lib, err := compileLibrary(args[0].bulk)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	if err := addLibrary(lib, replace); err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	return bulkValue(lib.name)
+}
+
+// functionList handles FUNCTION LIST.
+func functionList(args []Value) Value {
+	withCode := false
+	pattern := "*"
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "WITHCODE":
+			withCode = true
+		case opt == "LIBRARYNAME" && i+1 < len(args):
+			pattern = args[i+1].bulk
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unknown argument %s", args[i].bulk)}
+		}
+	}
+
+	functionsMu.RLock()
+	defer functionsMu.RUnlock()
+
+	values := []Value{}
+	for _, lib := range sortedLibraries() {
+		if !stringMatch(pattern, lib.name) {
+			continue
+		}
+
+		names := make([]string, 0, len(lib.functions))
+		for fname := range lib.functions {
+			names = append(names, fname)
+		}
+		sort.Strings(names)
+
+		fns := []Value{}
+		for _, fname := range names {
+			fn := lib.functions[fname]
+
+			description := Value{typ: ValueTypNull}
+			if fn.description != "" {
+				description = bulkValue(fn.description)
+			}
+			flags := []Value{}
+			for _, flag := range fn.flags {
+				flags = append(flags, bulkValue(flag))
+			}
+
+			fns = append(fns, Value{typ: ValueTypArray, array: []Value{
+				bulkValue("name"), bulkValue(fn.name),
+				bulkValue("description"), description,
+				bulkValue("flags"), {typ: ValueTypArray, array: flags},
+			}})
+		}
+
+		entry := []Value{
+			bulkValue("library_name"), bulkValue(lib.name),
+			bulkValue("engine"), bulkValue("LUA"),
+			bulkValue("functions"), {typ: ValueTypArray, array: fns},
+		}
+		if withCode {
+			entry = append(entry, bulkValue("library_code"), bulkValue(lib.code))
+		}
+		values = append(values, Value{typ: ValueTypArray, array: entry})
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// functionRestore handles FUNCTION RESTORE. APPEND, the default, fails if a
+// library already exists, REPLACE replaces existing libraries and FLUSH deletes
+// every library first.
+func functionRestore(args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'function|restore' command"}
+	}
+
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy = strings.ToUpper(args[1].bulk)
+		if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+			return Value{typ: ValueTypSimpleError, str: "ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."}
+		}
+	}
+
+	codes, err := deserializeLibraries([]byte(args[0].bulk))
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	libs := make([]*FunctionLibrary, 0, len(codes))
+	for _, code := range codes {
+		lib, err := compileLibrary(code)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+		libs = append(libs, lib)
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	// Apply the libraries to a copy of the registry so a failure changes nothing
+	savedLibraries, savedFunctions := functionLibraries, libraryFunctions
+	functionLibraries = map[string]*FunctionLibrary{}
+	libraryFunctions = map[string]*LibraryFunction{}
+	if policy != "FLUSH" {
+		for name, lib := range savedLibraries {
+			functionLibraries[name] = lib
+		}
+		for name, fn := range savedFunctions {
+			libraryFunctions[name] = fn
+		}
+	}
+
+	for _, lib := range libs {
+		if err := addLibrary(lib, policy == "REPLACE"); err != nil {
+			functionLibraries, libraryFunctions = savedLibraries, savedFunctions
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// fcall handles the FCALL command.
+func fcall(c *Client, args []Value) Value {
+	return callFunction(c, args, false)
+}
+
+// fcallRO handles the FCALL_RO command.
+func fcallRO(c *Client, args []Value) Value {
+	return callFunction(c, args, true)
+}
+
+// callFunction runs a function with the given keys and arguments. Like a script,
+// the function gets a client of its own.
+func callFunction(c *Client, args []Value, readOnly bool) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'fcall' command"}
+	}
+
+	keys, argv, errValue := parseNumKeys(args[1:])
+	if errValue != nil {
+		return *errValue
+	}
+
+	functionsMu.RLock()
+	fn, ok := libraryFunctions[args[0].bulk]
+	functionsMu.RUnlock()
+
+	if !ok {
+		return Value{typ: ValueTypSimpleError, str: "ERR Function not found"}
+	}
+
+	noWrites := false
+	for _, flag := range fn.flags {
+		if flag == "no-writes" {
+			noWrites = true
+		}
+	}
+	if readOnly && !noWrites {
+		return Value{typ: ValueTypSimpleError, str: "ERR Can not execute a script with write flag using *_ro command."}
+	}
+
+	sc := newFakeClient(c.dbIndex)
+	sc.user = c.user
+	L := newScriptState(sc, noWrites)
+	defer L.Close()
+
+	// WAIT after the function waits for the writes it made, and so does its
+	// reply with appendfsync always
+	defer func() {
+		c.woff = max(c.woff, sc.woff)
+		c.aofOff.Store(max(c.aofOff.Load(), sc.aofOff.Load()))
+	}()
+
+	// Run the library to get hold of the callback in this interpreter
+	_, body, _ := parseLibraryMetadata(fn.library.code)
+	registered, err := runLibrary(L, fn.library.name, body)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	// Commands may be called again now that loading is done
+	redis := L.GetGlobal("redis").(*lua.LTable)
+	redis.RawSetString("call", L.NewFunction(func(L *lua.LState) int { return scriptCall(sc, L, true, noWrites) }))
+	redis.RawSetString("pcall", L.NewFunction(func(L *lua.LState) int { return scriptCall(sc, L, false, noWrites) }))
+
+	noBlocking.Store(true)
+	defer noBlocking.Store(false)
+
+	running := startScript(L, fn.name, true)
+	defer running.finish()
+
+	L.Push(registered[fn.name].callback)
+	L.Push(luaStrings(L, keys))
+	L.Push(luaStrings(L, argv))
+	if err := L.PCall(2, 1, nil); err != nil {
+		if running.killed.Load() {
+			return killedScriptError(running)
+		}
+		return scriptErrorValue(fn.name, err)
+	}
+
+	return luaToResp(L.Get(-1))
+}
+
+// functionModifies reports whether a FUNCTION call changes the loaded
+// libraries, which means it has to be persisted.
+func functionModifies(args []Value) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LOAD", "DELETE", "FLUSH", "RESTORE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,483 @@
+/*
+This file contains the geospatial commands GEOADD, GEOPOS, GEODIST and GEOSEARCH.
+Locations are stored in a sorted set, using a 52 bit geohash of the coordinates as
+the member's score. The geohash interleaves the bits of the latitude and longitude
+so that nearby points tend to have close scores. Distances are computed with the
+haversine formula on a spherical earth, the same way Redis does, and searches test
+every member of the set against the requested radius or box. For a detailed
+description of the geospatial commands, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/geospatial/
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	geoStep         = 26 // Bits per coordinate, giving a 52 bit geohash
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLonMin       = -180.0
+	geoLonMax       = 180.0
+	geoEarthRadiusM = 6372797.560856 // Earth radius in meters used by Redis
+)
+
+// geoUnits maps distance unit names to their length in meters.
+var geoUnits = map[string]float64{
+	"m":  1,
+	"km": 1000,
+	"mi": 1609.34,
+	"ft": 0.3048,
+}
+
+// geoPoint is a member's location along with its distance from the search center.
+type geoPoint struct {
+	member string
+	lon    float64
+	lat    float64
+	hash   uint64
+	dist   float64
+}
+
+// geoEncode computes the 52 bit geohash of a coordinate pair.
+func geoEncode(lon, lat float64) uint64 {
+	latBits := uint64((lat - geoLatMin) / (geoLatMax - geoLatMin) * (1 << geoStep))
+	lonBits := uint64((lon - geoLonMin) / (geoLonMax - geoLonMin) * (1 << geoStep))
+
+	// Clamp coordinates that sit exactly on the upper bound
+	if latBits >= 1<<geoStep {
+		latBits = 1<<geoStep - 1
+	}
+	if lonBits >= 1<<geoStep {
+		lonBits = 1<<geoStep - 1
+	}
+
+	// Latitude bits go in the even positions and longitude bits in the odd ones
+	var hash uint64
+	for i := 0; i < geoStep; i++ {
+		hash |= (latBits >> i & 1) << (2 * i)
+		hash |= (lonBits >> i & 1) << (2*i + 1)
+	}
+
+	return hash
+}
+
+// geoDecode returns the center of the cell identified by a geohash.
+func geoDecode(hash uint64) (lon, lat float64) {
+	var latBits, lonBits uint64
+	for i := 0; i < geoStep; i++ {
+		latBits |= (hash >> (2 * i) & 1) << i
+		lonBits |= (hash >> (2*i + 1) & 1) << i
+	}
+
+	latScale := (geoLatMax - geoLatMin) / (1 << geoStep)
+	lonScale := (geoLonMax - geoLonMin) / (1 << geoStep)
+
+	lat = geoLatMin + (float64(latBits)+0.5)*latScale
+	lon = geoLonMin + (float64(lonBits)+0.5)*lonScale
+
+	return math.Max(geoLonMin, math.Min(geoLonMax, lon)), math.Max(geoLatMin, math.Min(geoLatMax, lat))
+}
+
+// geoDistance returns the distance in meters between two points.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r := lat1 * math.Pi / 180
+	lat2r := lat2 * math.Pi / 180
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2 - lon1) * math.Pi / 180 / 2)
+
+	return 2 * geoEarthRadiusM * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// parseGeoCoords parses a longitude and latitude pair and validates the ranges.
+func parseGeoCoords(lonArg, latArg string) (float64, float64, *Value) {
+	lon, err1 := strconv.ParseFloat(lonArg, 64)
+	lat, err2 := strconv.ParseFloat(latArg, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, &Value{typ: ValueTypSimpleError, str: "ERR value is not a valid float"}
+	}
+
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, &Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", lon, lat)}
+	}
+
+	return lon, lat, nil
+}
+
+// parseGeoUnit returns the length in meters of a unit name.
+func parseGeoUnit(s string) (float64, *Value) {
+	unit, ok := geoUnits[strings.ToLower(s)]
+	if !ok {
+		return 0, &Value{typ: ValueTypSimpleError, str: "ERR unsupported unit provided. please use M, KM, FT, MI"}
+	}
+	return unit, nil
+}
+
+// formatGeoFloat formats a coordinate or distance the way replies expect.
+func formatGeoFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// geoadd handles the GEOADD command.
+func geoadd(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'geoadd' command"}
+	}
+
+	key := args[0].bulk
+
+	nx, xx, ch := false, false, false
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+			continue
+		case "XX":
+			xx = true
+			continue
+		case "CH":
+			ch = true
+			continue
+		}
+		break
+	}
+
+	if nx && xx {
+		return Value{typ: ValueTypSimpleError, str: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if len(args)-i == 0 || (len(args)-i)%3 != 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	// Validate every triple before touching the set
+	points := []geoPoint{}
+	for ; i < len(args); i += 3 {
+		lon, lat, errValue := parseGeoCoords(args[i].bulk, args[i+1].bulk)
+		if errValue != nil {
+			return *errValue
+		}
+		points = append(points, geoPoint{member: args[i+2].bulk, hash: geoEncode(lon, lat)})
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypZSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		if xx {
+			c.unchanged()
+			return Value{typ: ValueTypInteger, num: 0}
+		}
+		e = s.add(key, Object{typ: KeyTypZSet, zset: newSortedSet()})
+	}
+	e.touch()
+	zset := e.zset
+
+	added, changed := 0, 0
+	for _, p := range points {
+		score := float64(p.hash)
+		old, exists := zset.Score(p.member)
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+
+		zset.Add(p.member, score)
+		if !exists {
+			added++
+		} else if old != score {
+			changed++
+		}
+	}
+
+	if zset.Len() == 0 {
+		s.remove(key, false)
+	}
+	if added+changed == 0 {
+		c.unchanged()
+	}
+
+	if ch {
+		return Value{typ: ValueTypInteger, num: added + changed}
+	}
+	return Value{typ: ValueTypInteger, num: added}
+}
+
+// geopos handles the GEOPOS command.
+func geopos(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'geopos' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypZSet)
+	if errValue != nil {
+		return *errValue
+	}
+	var zset *SortedSet
+	if e != nil {
+		e.touch()
+		zset = e.zset
+	}
+
+	values := make([]Value, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if zset == nil {
+			values = append(values, Value{typ: ValueTypNullArray})
+			continue
+		}
+
+		score, ok := zset.Score(arg.bulk)
+		if !ok {
+			values = append(values, Value{typ: ValueTypNullArray})
+			continue
+		}
+
+		lon, lat := geoDecode(uint64(score))
+		values = append(values, Value{typ: ValueTypArray, array: []Value{
+			bulkValue(formatGeoFloat(lon)),
+			bulkValue(formatGeoFloat(lat)),
+		}})
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// geodist handles the GEODIST command.
+func geodist(c *Client, args []Value) Value {
+	if len(args) != 3 && len(args) != 4 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'geodist' command"}
+	}
+
+	key := args[0].bulk
+
+	unit := 1.0
+	if len(args) == 4 {
+		var errValue *Value
+		if unit, errValue = parseGeoUnit(args[3].bulk); errValue != nil {
+			return *errValue
+		}
+	}
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypZSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypNull}
+	}
+	e.touch()
+	zset := e.zset
+
+	score1, ok1 := zset.Score(args[1].bulk)
+	score2, ok2 := zset.Score(args[2].bulk)
+	if !ok1 || !ok2 {
+		return Value{typ: ValueTypNull}
+	}
+
+	lon1, lat1 := geoDecode(uint64(score1))
+	lon2, lat2 := geoDecode(uint64(score2))
+
+	return bulkValue(fmt.Sprintf("%.4f", geoDistance(lon1, lat1, lon2, lat2)/unit))
+}
+
+// geosearch handles the GEOSEARCH command.
+func geosearch(c *Client, args []Value) Value {
+	if len(args) < 6 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'geosearch' command"}
+	}
+
+	key := args[0].bulk
+
+	var fromMember string
+	var centerLon, centerLat float64
+	hasFromMember, hasFromLonLat := false, false
+	byRadius, byBox := false, false
+	var radius, width, height, unit float64
+	sortDir := 0 // 1 for ASC, -1 for DESC, 0 for unsorted
+	count, anyMatch := 0, false
+	withCoord, withDist, withHash := false, false, false
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		remaining := len(args) - i - 1
+
+		var errValue *Value
+		switch {
+		case opt == "FROMMEMBER" && remaining >= 1:
+			fromMember = args[i+1].bulk
+			hasFromMember = true
+			i++
+		case opt == "FROMLONLAT" && remaining >= 2:
+			centerLon, centerLat, errValue = parseGeoCoords(args[i+1].bulk, args[i+2].bulk)
+			hasFromLonLat = true
+			i += 2
+		case opt == "BYRADIUS" && remaining >= 2:
+			r, err := strconv.ParseFloat(args[i+1].bulk, 64)
+			if err != nil || r < 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR need numeric radius"}
+			}
+			radius = r
+			unit, errValue = parseGeoUnit(args[i+2].bulk)
+			byRadius = true
+			i += 2
+		case opt == "BYBOX" && remaining >= 3:
+			w, err1 := strconv.ParseFloat(args[i+1].bulk, 64)
+			h, err2 := strconv.ParseFloat(args[i+2].bulk, 64)
+			if err1 != nil || err2 != nil || w < 0 || h < 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR need numeric width and height"}
+			}
+			width, height = w, h
+			unit, errValue = parseGeoUnit(args[i+3].bulk)
+			byBox = true
+			i += 3
+		case opt == "ASC":
+			sortDir = 1
+		case opt == "DESC":
+			sortDir = -1
+		case opt == "COUNT" && remaining >= 1:
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil || n <= 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR COUNT must be > 0"}
+			}
+			count = n
+			i++
+			if i+1 < len(args) && strings.ToUpper(args[i+1].bulk) == "ANY" {
+				anyMatch = true
+				i++
+			}
+		case opt == "WITHCOORD":
+			withCoord = true
+		case opt == "WITHDIST":
+			withDist = true
+		case opt == "WITHHASH":
+			withHash = true
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+
+		if errValue != nil {
+			return *errValue
+		}
+	}
+
+	if hasFromMember == hasFromLonLat {
+		return Value{typ: ValueTypSimpleError, str: "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"}
+	}
+	if byRadius == byBox {
+		return Value{typ: ValueTypSimpleError, str: "ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypZSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypArray, array: []Value{}}
+	}
+	e.touch()
+	zset := e.zset
+
+	if hasFromMember {
+		score, ok := zset.Score(fromMember)
+		if !ok {
+			return Value{typ: ValueTypSimpleError, str: "ERR could not decode requested zset member"}
+		}
+		centerLon, centerLat = geoDecode(uint64(score))
+	}
+
+	// Collect every member that falls inside the search area
+	points := []geoPoint{}
+	for _, m := range zset.Members() {
+		hash := uint64(m.score)
+		lon, lat := geoDecode(hash)
+
+		var dist float64
+		if byRadius {
+			dist = geoDistance(centerLon, centerLat, lon, lat)
+			if dist > radius*unit {
+				continue
+			}
+		} else {
+			// The latitude and longitude offsets are checked separately, with the
+			// longitude offset measured along the member's parallel
+			if geoDistance(centerLon, centerLat, centerLon, lat) > height*unit/2 ||
+				geoDistance(centerLon, lat, lon, lat) > width*unit/2 {
+				continue
+			}
+			dist = geoDistance(centerLon, centerLat, lon, lat)
+		}
+
+		points = append(points, geoPoint{member: m.member, lon: lon, lat: lat, hash: hash, dist: dist})
+
+		// ANY returns as soon as enough matches are found
+		if anyMatch && len(points) == count {
+			break
+		}
+	}
+
+	// COUNT without ANY returns the closest matches, so it implies sorting
+	if count > 0 && !anyMatch && sortDir == 0 {
+		sortDir = 1
+	}
+	if sortDir != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if sortDir > 0 {
+				return points[i].dist < points[j].dist
+			}
+			return points[i].dist > points[j].dist
+		})
+	}
+	if count > 0 && len(points) > count {
+		points = points[:count]
+	}
+
+	values := make([]Value, 0, len(points))
+	for _, p := range points {
+		if !withCoord && !withDist && !withHash {
+			values = append(values, bulkValue(p.member))
+			continue
+		}
+
+		item := []Value{bulkValue(p.member)}
+		if withDist {
+			item = append(item, bulkValue(fmt.Sprintf("%.4f", p.dist/unit)))
+		}
+		if withHash {
+			item = append(item, Value{typ: ValueTypInteger, num: int(p.hash)})
+		}
+		if withCoord {
+			item = append(item, Value{typ: ValueTypArray, array: []Value{
+				bulkValue(formatGeoFloat(p.lon)),
+				bulkValue(formatGeoFloat(p.lat)),
+			}})
+		}
+		values = append(values, Value{typ: ValueTypArray, array: item})
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
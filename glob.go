@@ -0,0 +1,94 @@
+/*
+This file contains the glob-style pattern matching Redis uses for pattern
+subscriptions and key patterns. "*" matches any sequence of characters, "?"
+matches a single character, "[abc]" and "[a-z]" match a set or range, "[^a]"
+negates a set, and "\" escapes the next character.
+*/
+
+package main
+
+// stringMatch reports whether str matches the glob-style pattern.
+func stringMatch(pattern, str string) bool {
+	p, s := 0, 0
+
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			// Collapse consecutive stars, then try every possible split
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i <= len(str); i++ {
+				if stringMatch(pattern[p+1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if s >= len(str) {
+				return false
+			}
+			s++
+
+		case '[':
+			if s >= len(str) {
+				return false
+			}
+
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+
+			match := false
+			for p < len(pattern) && pattern[p] != ']' {
+				switch {
+				case pattern[p] == '\\' && p+1 < len(pattern):
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[s] >= start && str[s] <= end {
+						match = true
+					}
+					p += 2
+				default:
+					if pattern[p] == str[s] {
+						match = true
+					}
+				}
+				p++
+			}
+
+			if match == not {
+				return false
+			}
+			s++
+
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+
+		default:
+			if s >= len(str) || pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+
+	return s == len(str)
+}
@@ -1,3 +1,5 @@
 module ipmanlk/redisclone
 
 go 1.22.3
+
+require github.com/yuin/gopher-lua v1.1.1
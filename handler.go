@@ -1,97 +1,216 @@
 /*
 This file contains the implementation of various command handlers for the RESP
-protocol. These handlers process commands such as PING, SET, GET, HSET, HGET, 
-and HGETALL, providing basic functionalities similar to those found in Redis. 
+protocol. These handlers process commands such as PING, SET, GET, HSET, HGET,
+and HGETALL, providing basic functionalities similar to those found in Redis.
 The handlers manage simple key-value pairs and hash maps using in-memory storage.
+Handlers are registered in the command table in command.go.
 */
 
 package main
 
-import "sync"
-
-// Handlers maps command strings to their respective handler functions.
-var Handlers = map[string]func([]Value) Value{
-	"PING":    ping,
-	"SET":     set,
-	"GET":     get,
-	"HSET":    hset,
-	"HGET":    hget,
-	"HGETALL": hgetall,
-}
-
-// SETs stores key-value pairs for the SET command.
-var SETs = map[string]string{}
-var SETsMu = sync.RWMutex{}
-
-// HSETs stores hash maps for the HSET command.
-var HSETs = map[string]map[string]string{}
-var HSETsMu = sync.RWMutex{}
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // ping handles the PING command.
-func ping(args []Value) Value {
+func ping(c *Client, args []Value) Value {
+	// A subscribed RESP2 client gets its reply in the same shape as messages
+	if c.sub != nil && c.sub.count() > 0 && c.writer.Protocol() == ProtocolResp2 {
+		return subscribedPing(args)
+	}
+
 	if len(args) == 0 {
 		return Value{typ: ValueTypSimpleString, str: "PONG"}
 	}
 	return Value{typ: ValueTypSimpleString, str: args[0].bulk}
 }
 
-// set handles the SET command.
-func set(args []Value) Value {
-	if len(args) != 2 {
+// echo handles the ECHO command.
+func echo(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'echo' command"}
+	}
+	return Value{typ: ValueTypBulkString, bulk: args[0].bulk}
+}
+
+// timeCommand handles the TIME command.
+func timeCommand(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'time' command"}
+	}
+
+	now := time.Now()
+	return Value{typ: ValueTypArray, array: []Value{
+		{typ: ValueTypBulkString, bulk: strconv.FormatInt(now.Unix(), 10)},
+		{typ: ValueTypBulkString, bulk: strconv.Itoa(now.Nanosecond() / 1000)},
+	}}
+}
+
+// set handles the SET command. Only the absolute PXAT form of the expiration
+// options is persisted and replicated, so the key expires at the same time
+// everywhere.
+func set(c *Client, args []Value) Value {
+	if len(args) < 2 {
 		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'set' command"}
 	}
 
 	key := args[0].bulk
 	value := args[1].bulk
 
-	SETsMu.Lock()
-	SETs[key] = value
-	SETsMu.Unlock()
+	nx, xx, get, keepTTL := false, false, false, false
+	var expireAt time.Time
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i].bulk); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "GET":
+			get = true
+		case opt == "KEEPTTL" && expireAt.IsZero():
+			keepTTL = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") && !keepTTL && expireAt.IsZero() && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			if n <= 0 || n > math.MaxInt64/1000 {
+				return Value{typ: ValueTypSimpleError, str: "ERR invalid expire time in 'set' command"}
+			}
+			switch opt {
+			case "EX":
+				expireAt = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				expireAt = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				expireAt = time.Unix(n, 0)
+			case "PXAT":
+				expireAt = time.UnixMilli(n)
+			}
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
 
-	return Value{typ: ValueTypSimpleString, str: "OK"}
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// SET replaces a value of any type, but GET can only return a string
+	old, exists := s.keys[key]
+	if get && exists && old.typ != KeyTypString {
+		return wrongTypeError
+	}
+	reply := Value{typ: ValueTypSimpleString, str: "OK"}
+	if get {
+		reply = Value{typ: ValueTypNull}
+		if exists {
+			reply = Value{typ: ValueTypBulkString, bulk: old.str}
+		}
+	}
+	if nx && exists || xx && !exists {
+		c.unchanged()
+		if get {
+			return reply
+		}
+		return Value{typ: ValueTypNull}
+	}
+
+	// Overwriting a key discards its time to live, unless it's kept
+	if keepTTL && exists {
+		expireAt = old.expireAt
+	}
+	e := s.add(key, Object{typ: KeyTypString, str: value})
+	s.setExpire(key, e, expireAt)
+
+	return reply
+}
+
+// setex handles the SETEX command.
+func setex(c *Client, args []Value) Value {
+	return setexGeneric(c, "setex", args, "EX")
+}
+
+// psetex handles the PSETEX command.
+func psetex(c *Client, args []Value) Value {
+	return setexGeneric(c, "psetex", args, "PX")
+}
+
+// setexGeneric implements SETEX and PSETEX, which take the time to live before
+// the value, as SET with the EX or PX option unit.
+func setexGeneric(c *Client, name string, args []Value, unit string) Value {
+	if len(args) != 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	if n <= 0 || n > math.MaxInt64/1000 {
+		return Value{typ: ValueTypSimpleError, str: "ERR invalid expire time in '" + name + "' command"}
+	}
+
+	return set(c, []Value{args[0], args[2], bulkValue(unit), args[1]})
 }
 
 // get handles the GET command.
-func get(args []Value) Value {
+func get(c *Client, args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'get' command"}
 	}
 
 	key := args[0].bulk
 
-	SETsMu.RLock()
-	value, ok := SETs[key]
-	SETsMu.RUnlock()
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if !ok {
+	e, errValue := s.lookup(key, KeyTypString)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
 		return Value{typ: ValueTypNull}
 	}
+	e.touch()
 
-	return Value{typ: ValueTypBulkString, bulk: value}
+	return Value{typ: ValueTypBulkString, bulk: e.str}
 }
 
-// hset handles the HSET command.
-func hset(args []Value) Value {
-	if len(args) != 3 {
+// hset handles the HSET and HMSET commands.
+func hset(c *Client, args []Value) Value {
+	if len(args) < 3 || len(args)%2 == 0 {
 		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'hset' command"}
 	}
 
 	hash := args[0].bulk
-	key := args[1].bulk
-	value := args[2].bulk
 
-	HSETsMu.Lock()
-	if _, ok := HSETs[hash]; !ok {
-		HSETs[hash] = map[string]string{}
+	s := c.db.shard(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(hash, KeyTypHash)
+	if errValue != nil {
+		return *errValue
 	}
-	HSETs[hash][key] = value
-	HSETsMu.Unlock()
+	if e == nil {
+		e = s.add(hash, Object{typ: KeyTypHash, hash: newHash()})
+	}
+	for i := 1; i < len(args); i += 2 {
+		e.hash.Set(args[i].bulk, args[i+1].bulk)
+	}
+	e.touch()
 
 	return Value{typ: ValueTypSimpleString, str: "OK"}
 }
 
 // hget handles the HGET command.
-func hget(args []Value) Value {
+func hget(c *Client, args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'hget' command"}
 	}
@@ -99,10 +218,20 @@ func hget(args []Value) Value {
 	hash := args[0].bulk
 	key := args[1].bulk
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash][key]
-	HSETsMu.RUnlock()
+	s := c.db.shard(hash)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
+	e, errValue := s.lookup(hash, KeyTypHash)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypNull}
+	}
+	e.touch()
+
+	value, ok := e.hash.Get(key)
 	if !ok {
 		return Value{typ: ValueTypNull}
 	}
@@ -111,26 +240,32 @@ func hget(args []Value) Value {
 }
 
 // hgetall handles the HGETALL command.
-func hgetall(args []Value) Value {
+func hgetall(c *Client, args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'hgetall' command"}
 	}
 
 	hash := args[0].bulk
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash]
-	HSETsMu.RUnlock()
+	s := c.db.shard(hash)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if !ok {
+	e, errValue := s.lookup(hash, KeyTypHash)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
 		return Value{typ: ValueTypNull}
 	}
+	e.touch()
 
-	values := make([]Value, 0, len(value)*2)
-	for k, v := range value {
+	values := make([]Value, 0, e.hash.Len()*2)
+	e.hash.Range(func(k, v string) bool {
 		values = append(values, Value{typ: ValueTypBulkString, bulk: k})
 		values = append(values, Value{typ: ValueTypBulkString, bulk: v})
-	}
+		return true
+	})
 
-	return Value{typ: ValueTypArray, array: values}
+	return Value{typ: ValueTypMap, array: values}
 }
@@ -0,0 +1,179 @@
+/*
+This file contains the hash data type, which maps fields to values. Like Redis,
+a small hash is stored packed: its fields and values follow each other in a
+single byte slice, each prefixed by its length, which takes a fraction of the
+memory of a Go map and is fast to scan for a few entries. Once the hash has more
+than hash-max-listpack-entries fields, or a field or value longer than
+hash-max-listpack-value bytes, it's converted to a map for good. For a detailed
+description of hashes and their encodings, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/hashes/
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"maps"
+)
+
+// Hash holds the fields of a hash, packed or in a map.
+type Hash struct {
+	packed []byte            // Fields and values, each after its length as a uvarint
+	count  int               // Number of fields in packed
+	dict   map[string]string // Set once the hash outgrew the packed encoding
+}
+
+// newHash creates an empty hash.
+func newHash() *Hash {
+	return &Hash{}
+}
+
+// hashFromMap creates a hash holding the fields of m, packed if it's small
+// enough. m is kept by the hash if it isn't.
+func hashFromMap(m map[string]string) *Hash {
+	if len(m) > config.hashMaxListpackEntries {
+		for field, value := range m {
+			m[field] = sharedString(value)
+		}
+		return &Hash{dict: m}
+	}
+	h := newHash()
+	for field, value := range m {
+		h.Set(field, value)
+	}
+	return h
+}
+
+// Len returns the number of fields.
+func (h *Hash) Len() int {
+	if h.dict != nil {
+		return len(h.dict)
+	}
+	return h.count
+}
+
+// Get returns the value of field.
+func (h *Hash) Get(field string) (string, bool) {
+	if h.dict != nil {
+		value, ok := h.dict[field]
+		return value, ok
+	}
+	for p := h.packed; len(p) > 0; {
+		var f, v []byte
+		f, v, p = nextPackedField(p)
+		if string(f) == field {
+			return string(v), true
+		}
+	}
+	return "", false
+}
+
+// Set sets field to value, reporting whether the field is new.
+func (h *Hash) Set(field, value string) bool {
+	if h.dict == nil && (len(field) > config.hashMaxListpackValue || len(value) > config.hashMaxListpackValue) {
+		h.convert()
+	}
+	if h.dict != nil {
+		_, exists := h.dict[field]
+		h.dict[field] = sharedString(value)
+		return !exists
+	}
+
+	// An existing field has its value replaced where it is
+	for p := h.packed; len(p) > 0; {
+		start := len(h.packed) - len(p)
+		var f []byte
+		f, _, p = nextPackedField(p)
+		if string(f) == field {
+			rest := h.packed[len(h.packed)-len(p):]
+			packed := append(h.packed[:start:start], appendPackedField(nil, field, value)...)
+			h.packed = append(packed, rest...)
+			return false
+		}
+	}
+
+	if h.count == config.hashMaxListpackEntries {
+		h.convert()
+		h.dict[field] = value
+		return true
+	}
+	h.packed = appendPackedField(h.packed, field, value)
+	h.count++
+	return true
+}
+
+// Range calls fn for every field and its value, until it returns false.
+func (h *Hash) Range(fn func(field, value string) bool) {
+	if h.dict != nil {
+		for field, value := range h.dict {
+			if !fn(field, value) {
+				return
+			}
+		}
+		return
+	}
+	for p := h.packed; len(p) > 0; {
+		var f, v []byte
+		f, v, p = nextPackedField(p)
+		if !fn(string(f), string(v)) {
+			return
+		}
+	}
+}
+
+// Map returns the fields of the hash in a new map.
+func (h *Hash) Map() map[string]string {
+	if h.dict != nil {
+		return maps.Clone(h.dict)
+	}
+	m := make(map[string]string, h.count)
+	h.Range(func(field, value string) bool {
+		m[field] = value
+		return true
+	})
+	return m
+}
+
+// Clone returns a copy of the hash.
+func (h *Hash) Clone() *Hash {
+	if h.dict != nil {
+		return &Hash{dict: maps.Clone(h.dict)}
+	}
+	return &Hash{packed: append([]byte(nil), h.packed...), count: h.count}
+}
+
+// encoding returns the name Redis gives to the encoding of the hash.
+func (h *Hash) encoding() string {
+	if h.dict != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+// convert moves the fields of a packed hash to a map.
+func (h *Hash) convert() {
+	dict := make(map[string]string, h.count)
+	h.Range(func(field, value string) bool {
+		dict[field] = sharedString(value)
+		return true
+	})
+	h.dict, h.packed, h.count = dict, nil, 0
+}
+
+// appendPackedField appends field and value to p, each after its length.
+func appendPackedField(p []byte, field, value string) []byte {
+	p = binary.AppendUvarint(p, uint64(len(field)))
+	p = append(p, field...)
+	p = binary.AppendUvarint(p, uint64(len(value)))
+	return append(p, value...)
+}
+
+// nextPackedField returns the field and value at the start of p, and what
+// follows them.
+func nextPackedField(p []byte) (field, value, rest []byte) {
+	n, size := binary.Uvarint(p)
+	field, p = p[size:size+int(n)], p[size+int(n):]
+	n, size = binary.Uvarint(p)
+	return field, p[size : size+int(n)], p[size+int(n):]
+}
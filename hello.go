@@ -0,0 +1,98 @@
+/*
+This file contains the HELLO command, which clients send right after connecting
+to pick the protocol version, optionally authenticating and naming the
+connection in the same round trip. The reply describes the server. RESP2 is the
+protocol every connection starts with, RESP3 adds reply types such as maps and
+sets. For a detailed description of the command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/hello/
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions a connection can speak
+const (
+	ProtocolResp2 = 2
+	ProtocolResp3 = 3
+)
+
+// hello handles the HELLO command.
+func hello(c *Client, args []Value) Value {
+	protocol := c.writer.Protocol()
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if n != ProtocolResp2 && n != ProtocolResp3 {
+			return Value{typ: ValueTypSimpleError, str: "NOPROTO unsupported protocol version"}
+		}
+		protocol = n
+	}
+
+	var user *User
+	name := c.name
+	setName := false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+			}
+			username, password := args[i+1].bulk, args[i+2].bulk
+			if user = authenticate(username, password); user == nil {
+				aclLogDenial(c, "auth", "AUTH", username)
+				return Value{typ: ValueTypSimpleError, str: "WRONGPASS invalid username-password pair or user is disabled."}
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+			}
+			if !validClientName(args[i+1].bulk) {
+				return Value{typ: ValueTypSimpleError, str: "ERR Client names cannot contain spaces, newlines or special characters."}
+			}
+			name = args[i+1].bulk
+			setName = true
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+		}
+	}
+
+	if user != nil {
+		c.user = user
+		c.authenticated = true
+	}
+	if !c.authenticated {
+		return Value{typ: ValueTypSimpleError, str: "NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	// Nothing changes unless every option was valid
+	if setName {
+		c.name = name
+	}
+	c.writer.SetProtocol(protocol)
+
+	role := "master"
+	if replicaOf != nil {
+		role = "replica"
+	}
+
+	return Value{typ: ValueTypMap, array: []Value{
+		bulkValue("server"), bulkValue("redis"),
+		bulkValue("version"), bulkValue(redisVersion),
+		bulkValue("proto"), {typ: ValueTypInteger, num: protocol},
+		bulkValue("id"), {typ: ValueTypInteger, num: int(c.id)},
+		bulkValue("mode"), bulkValue(serverMode()),
+		bulkValue("role"), bulkValue(role),
+		bulkValue("modules"), {typ: ValueTypArray, array: []Value{}},
+	}}
+}
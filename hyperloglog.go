@@ -0,0 +1,416 @@
+/*
+This file contains a HyperLogLog implementation for approximate cardinality
+counting, along with the PFADD, PFCOUNT and PFMERGE commands. A HyperLogLog is
+stored as a regular string value so it can be read with GET and copied with SET.
+The string starts with a 16 byte header followed by either a dense encoding, where
+every one of the 16384 registers takes 6 bits, or a sparse encoding that only lists
+the non-zero registers and is much smaller for low cardinalities. The layout is
+inspired by Redis but is not binary compatible with it. For a detailed description
+of the data structure, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/probabilistic/hyperloglogs/
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+const (
+	hllP         = 14        // Number of hash bits used to select a register
+	hllRegisters = 1 << hllP // Number of registers
+	hllQ         = 64 - hllP // Number of hash bits used to count leading zeros
+	hllBits      = 6         // Bits per register in the dense encoding
+	hllHeaderLen = 16        // Magic, encoding, padding and cached cardinality
+	hllDenseLen  = hllRegisters * hllBits / 8
+	hllAlphaInf  = 0.721347520444481703680 // Bias correction constant for the estimator
+
+	// Sparse HyperLogLogs are promoted to dense once they grow past this size
+	hllSparseMaxBytes = 3000
+)
+
+// Encodings stored in the fifth header byte
+const (
+	hllDense  = 0
+	hllSparse = 1
+)
+
+// hllMagic identifies a string value as a HyperLogLog.
+const hllMagic = "HYLL"
+
+// hllCacheInvalid marks the cached cardinality in the header as stale.
+const hllCacheInvalid = uint64(1) << 63
+
+// pfadd handles the PFADD command.
+func pfadd(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'pfadd' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, registers, errValue := lookupHLL(s, key)
+	if errValue != nil {
+		return *errValue
+	}
+
+	// Creating the key counts as a modification even without elements
+	updated := e == nil
+	for _, elem := range args[1:] {
+		if hllAdd(registers, elem.bulk) {
+			updated = true
+		}
+	}
+
+	if !updated {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	if e == nil {
+		e = s.add(key, Object{typ: KeyTypString})
+	}
+	e.str = hllEncode(registers, hllCacheInvalid)
+	e.touch()
+
+	return Value{typ: ValueTypInteger, num: 1}
+}
+
+// pfcount handles the PFCOUNT command.
+func pfcount(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'pfcount' command"}
+	}
+
+	defer c.db.lockKeys(true, argKeys(args)...)()
+
+	// A single key can use and refresh the cardinality cached in its header
+	if len(args) == 1 {
+		e, registers, errValue := lookupHLL(c.db.shard(args[0].bulk), args[0].bulk)
+		if errValue != nil {
+			return *errValue
+		}
+		if e == nil {
+			return Value{typ: ValueTypInteger, num: 0}
+		}
+		e.touch()
+
+		cached := binary.LittleEndian.Uint64([]byte(e.str[8:hllHeaderLen]))
+		if cached&hllCacheInvalid == 0 {
+			return Value{typ: ValueTypInteger, num: int(cached)}
+		}
+
+		count := hllCount(registers)
+		e.str = hllEncode(registers, count)
+
+		return Value{typ: ValueTypInteger, num: int(count)}
+	}
+
+	// Multiple keys are counted as the union of their registers
+	merged := make([]uint8, hllRegisters)
+	for _, arg := range args {
+		e, registers, errValue := lookupHLL(c.db.shard(arg.bulk), arg.bulk)
+		if errValue != nil {
+			return *errValue
+		}
+		if e == nil {
+			continue
+		}
+		hllMerge(merged, registers)
+		e.touch()
+	}
+
+	return Value{typ: ValueTypInteger, num: int(hllCount(merged))}
+}
+
+// pfmerge handles the PFMERGE command.
+func pfmerge(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'pfmerge' command"}
+	}
+
+	dest := args[0].bulk
+
+	defer c.db.lockKeys(true, argKeys(args)...)()
+
+	// The destination is part of the union when it already exists
+	merged := make([]uint8, hllRegisters)
+	for _, arg := range args {
+		e, registers, errValue := lookupHLL(c.db.shard(arg.bulk), arg.bulk)
+		if errValue != nil {
+			return *errValue
+		}
+		if e != nil {
+			hllMerge(merged, registers)
+		}
+	}
+
+	s := c.db.shard(dest)
+	e := s.keys[dest]
+	if e == nil {
+		e = s.add(dest, Object{typ: KeyTypString})
+	}
+	e.str = hllEncode(merged, hllCacheInvalid)
+	e.touch()
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// lookupHLL returns the entry of the HyperLogLog at key, nil if it doesn't
+// exist, and its registers, which are empty for a missing key. The caller must
+// hold s.mu.
+func lookupHLL(s *dbShard, key string) (*keyEntry, []uint8, *Value) {
+	e, errValue := s.lookup(key, KeyTypString)
+	if errValue != nil {
+		return nil, nil, errValue
+	}
+
+	raw := ""
+	if e != nil {
+		raw = e.str
+	}
+	registers, ok := hllDecode(raw)
+	if e != nil && (raw == "" || !ok) {
+		return nil, nil, &Value{typ: ValueTypSimpleError, str: "WRONGTYPE Key is not a valid HyperLogLog string value."}
+	}
+	return e, registers, nil
+}
+
+// hllAdd hashes elem into the registers and reports whether a register changed.
+func hllAdd(registers []uint8, elem string) bool {
+	hash := murmurHash64A([]byte(elem), 0xadc83b19)
+
+	index := hash & (hllRegisters - 1)
+
+	// Count the run of zeros in the remaining bits, the sentinel bit bounds it
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(bits.TrailingZeros64(hash) + 1)
+
+	if count > registers[index] {
+		registers[index] = count
+		return true
+	}
+
+	return false
+}
+
+// hllMerge sets every register in dst to the maximum of itself and src.
+func hllMerge(dst, src []uint8) {
+	for i, v := range src {
+		if v > dst[i] {
+			dst[i] = v
+		}
+	}
+}
+
+// hllCount estimates the cardinality using the improved estimator by Otmar Ertl,
+// which needs no bias correction tables and is accurate across the whole range.
+func hllCount(registers []uint8) uint64 {
+	m := float64(hllRegisters)
+
+	histogram := make([]int, hllQ+2)
+	for _, v := range registers {
+		histogram[v]++
+	}
+
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// hllSigma is the sigma function of the Ertl estimator.
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+// hllTau is the tau function of the Ertl estimator.
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// hllDecode unpacks a HyperLogLog string into one byte per register. An empty
+// string yields empty registers; any other non-HyperLogLog string reports false.
+func hllDecode(raw string) ([]uint8, bool) {
+	registers := make([]uint8, hllRegisters)
+	if raw == "" {
+		return registers, true
+	}
+
+	if len(raw) < hllHeaderLen || raw[:4] != hllMagic {
+		return nil, false
+	}
+
+	body := raw[hllHeaderLen:]
+	switch raw[4] {
+	case hllDense:
+		if len(body) != hllDenseLen {
+			return nil, false
+		}
+		for i := range registers {
+			registers[i] = hllDenseGet(body, i)
+		}
+	case hllSparse:
+		// Each entry is a two byte register index followed by its value
+		if len(body)%3 != 0 {
+			return nil, false
+		}
+		for i := 0; i < len(body); i += 3 {
+			index := int(body[i])<<8 | int(body[i+1])
+			if index >= hllRegisters || body[i+2] > hllQ+1 {
+				return nil, false
+			}
+			registers[index] = body[i+2]
+		}
+	default:
+		return nil, false
+	}
+
+	return registers, true
+}
+
+// hllEncode packs the registers into a HyperLogLog string, using the sparse
+// encoding while it stays below hllSparseMaxBytes.
+func hllEncode(registers []uint8, cached uint64) string {
+	nonZero := 0
+	for _, v := range registers {
+		if v != 0 {
+			nonZero++
+		}
+	}
+
+	header := make([]byte, hllHeaderLen, hllHeaderLen+hllDenseLen)
+	copy(header, hllMagic)
+	binary.LittleEndian.PutUint64(header[8:], cached)
+
+	if nonZero*3 <= hllSparseMaxBytes {
+		header[4] = hllSparse
+		buf := header
+		for i, v := range registers {
+			if v != 0 {
+				buf = append(buf, byte(i>>8), byte(i), v)
+			}
+		}
+		return string(buf)
+	}
+
+	header[4] = hllDense
+	buf := append(header, make([]byte, hllDenseLen)...)
+	for i, v := range registers {
+		hllDenseSet(buf[hllHeaderLen:], i, v)
+	}
+
+	return string(buf)
+}
+
+// hllDenseGet reads the 6 bit register at index from a dense body.
+func hllDenseGet(body string, index int) uint8 {
+	bit := index * hllBits
+	b0 := uint16(body[bit/8])
+	b1 := uint16(0)
+	if bit/8+1 < len(body) {
+		b1 = uint16(body[bit/8+1])
+	}
+	return uint8((b0|b1<<8)>>(bit%8)) & (1<<hllBits - 1)
+}
+
+// hllDenseSet writes the 6 bit register at index into a dense body.
+func hllDenseSet(body []byte, index int, v uint8) {
+	bit := index * hllBits
+	word := uint16(v&(1<<hllBits-1)) << (bit % 8)
+	mask := uint16(1<<hllBits-1) << (bit % 8)
+
+	body[bit/8] = body[bit/8]&^byte(mask) | byte(word)
+	if bit/8+1 < len(body) {
+		body[bit/8+1] = body[bit/8+1]&^byte(mask>>8) | byte(word>>8)
+	}
+}
+
+// murmurHash64A is the 64 bit MurmurHash2 variant used by Redis for HyperLogLog.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(key))*m
+
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	switch len(key) {
+	case 7:
+		h ^= uint64(key[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(key[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(key[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(key[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(key[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(key[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(key[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
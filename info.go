@@ -0,0 +1,134 @@
+/*
+This file contains the INFO command, which reports information and statistics
+about the server in a format that is easy for computers to parse and for humans
+to read. The reply is made of sections, each with a header line and fields in
+the form name:value. For a detailed description of the command and its fields,
+refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/info/
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisVersion is the version of Redis the server reports being compatible with.
+const redisVersion = "7.2.4"
+
+// serverStartTime is when the server started, for the uptime.
+var serverStartTime = time.Now()
+
+// serverRunID identifies this run of the server.
+var serverRunID = randomHex(40)
+
+// serverMode returns the mode the server runs in.
+func serverMode() string {
+	if sentinelMode {
+		return "sentinel"
+	}
+	return "standalone"
+}
+
+// infoSection is a section of the INFO reply.
+type infoSection struct {
+	name           string
+	defaultSection bool // Whether it's reported when no section is asked for
+	lines          func() []string
+}
+
+var infoSections = []infoSection{
+	{name: "server", defaultSection: true, lines: serverInfo},
+	{name: "clients", defaultSection: true, lines: clientsInfo},
+	{name: "memory", defaultSection: true, lines: memoryInfo},
+	{name: "persistence", defaultSection: true, lines: persistenceInfo},
+	{name: "stats", defaultSection: true, lines: statsInfo},
+	{name: "replication", defaultSection: true, lines: replicationInfo},
+	{name: "commandstats", lines: commandStatsInfo},
+	{name: "errorstats", defaultSection: true, lines: errorStatsInfo},
+	{name: "latencystats", defaultSection: true, lines: latencyStatsInfo},
+	{name: "cluster", defaultSection: true, lines: clusterInfo},
+	{name: "keyspace", defaultSection: true, lines: keyspaceInfo},
+}
+
+// info handles the INFO command.
+func info(c *Client, args []Value) Value {
+	requested := map[string]bool{}
+	for _, arg := range args {
+		requested[strings.ToLower(arg.bulk)] = true
+	}
+	if len(requested) == 0 {
+		requested["default"] = true
+	}
+
+	b := strings.Builder{}
+	for _, section := range infoSections {
+		if !requested[section.name] && !requested["all"] && !requested["everything"] &&
+			!(requested["default"] && section.defaultSection) {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, line := range section.lines() {
+			b.WriteString(line + "\r\n")
+		}
+	}
+
+	return Value{typ: ValueTypVerbatimString, str: "txt", bulk: b.String()}
+}
+
+// serverInfo returns the lines of the server section.
+func serverInfo() []string {
+	uptime := time.Since(serverStartTime)
+	executable, _ := os.Executable()
+
+	return []string{
+		"redis_version:" + redisVersion,
+		"redis_mode:" + serverMode(),
+		"os:" + runtime.GOOS,
+		"arch_bits:" + strconv.Itoa(strconv.IntSize),
+		"go_version:" + runtime.Version(),
+		"process_id:" + strconv.Itoa(os.Getpid()),
+		"run_id:" + serverRunID,
+		"tcp_port:" + strconv.Itoa(config.port),
+		"uptime_in_seconds:" + strconv.Itoa(int(uptime.Seconds())),
+		"uptime_in_days:" + strconv.Itoa(int(uptime.Hours()/24)),
+		"executable:" + executable,
+		"config_file:" + configFile,
+	}
+}
+
+// clientsInfo returns the lines of the clients section.
+func clientsInfo() []string {
+	clientsMu.RLock()
+	connected := len(clients)
+	clientsMu.RUnlock()
+
+	return []string{
+		"connected_clients:" + strconv.Itoa(connected),
+	}
+}
+
+// keyspaceInfo returns the lines of the keyspace section, one per database
+// that has keys.
+func keyspaceInfo() []string {
+	lines := []string{}
+	for _, db := range databases {
+		keys := keyCount(db)
+		if keys == 0 {
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=0", db.id, keys, expireCount(db)))
+	}
+	return lines
+}
@@ -0,0 +1,384 @@
+/*
+This file contains the entries of the keyspace and helpers that work across all
+the data types. Every key maps to a single entry that holds its type, its value,
+its expiration time and how recently and how often it was accessed, for eviction
+and introspection commands such as OBJECT IDLETIME. A key therefore has exactly
+one type, and commands against a key of another type fail with WRONGTYPE. DEL
+deletes keys of any type. For a detailed description of the command, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/commands/del/
+*/
+
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Key types as reported to clients
+const (
+	KeyTypNone   = "none"
+	KeyTypString = "string"
+	KeyTypHash   = "hash"
+	KeyTypList   = "list"
+	KeyTypSet    = "set"
+	KeyTypZSet   = "zset"
+	KeyTypStream = "stream"
+)
+
+// Object holds a value of any data type, for commands that move whole values
+// around without caring about their type. Only the field matching typ is set.
+type Object struct {
+	typ    string
+	str    string
+	hash   *Hash
+	list   *List
+	set    *Set
+	zset   *SortedSet
+	stream *Stream
+}
+
+// keyEntry is a key of any data type, along with its metadata.
+type keyEntry struct {
+	Object
+
+	// expireAt is when the key expires, zero if it doesn't.
+	expireAt time.Time
+
+	// lastAccess is the time of the last read or write by the LRU clock, and
+	// lfu the access frequency counter along with the time it was last
+	// decremented, see lru.go. They're atomic so commands holding the lock of
+	// the shard for reading record accesses too.
+	lastAccess atomic.Int64
+	lfu        atomic.Uint32
+
+	// size is the memory the key takes as last accounted in datasetBytes.
+	size int64
+}
+
+// datasetBytes is the memory taken by the keys of every database and their
+// values, kept up to date as they're added, modified and deleted.
+var datasetBytes atomic.Int64
+
+// touch records an access to the key.
+func (e *keyEntry) touch() {
+	e.lastAccess.Store(lruClock.Load())
+
+	// An access recorded at the same time by another command may be lost,
+	// which an approximate counter can afford
+	lfu := e.lfu.Load()
+	e.lfu.CompareAndSwap(lfu, lfuPack(lfuMinutes(), lfuIncrement(lfuDecay(lfu))))
+}
+
+// idleTime returns how long ago the key was last accessed.
+func (e *keyEntry) idleTime() time.Duration {
+	return time.Duration(max(lruClock.Load()-e.lastAccess.Load(), 0)) * time.Millisecond
+}
+
+// wrongTypeError is the reply to a command against a key holding another type.
+var wrongTypeError = Value{typ: ValueTypSimpleError, str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+
+// lookup returns the entry of key, nil if it doesn't exist, or an error if it
+// holds another type than typ. The caller must hold s.mu.
+func (s *dbShard) lookup(key, typ string) (*keyEntry, *Value) {
+	e, ok := s.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	if e.typ != typ {
+		return nil, &wrongTypeError
+	}
+	return e, nil
+}
+
+// add stores obj at key, replacing any existing value and expiration time, and
+// returns its entry. Small integer strings share one backing string. The caller
+// must hold s.mu for writing.
+func (s *dbShard) add(key string, obj Object) *keyEntry {
+	if obj.typ == KeyTypString {
+		obj.str = sharedString(obj.str)
+	}
+	e := &keyEntry{Object: obj}
+	e.lastAccess.Store(lruClock.Load())
+	e.setFreq(lfuInitVal)
+	if old, ok := s.keys[key]; ok {
+		releaseEntry(old, config.lazyfreeLazyServerDel)
+	}
+	s.keys[key] = e
+	s.keysPeak = max(s.keysPeak, len(s.keys))
+	delete(s.expires, key)
+	s.account(key, e)
+	return e
+}
+
+// remove deletes key, reporting whether it existed. Its value is released in
+// the background if lazy is set and it's big, see lazyfree.go. The caller must
+// hold s.mu for writing.
+func (s *dbShard) remove(key string, lazy bool) bool {
+	e, ok := s.keys[key]
+	if ok {
+		releaseEntry(e, lazy)
+	}
+	delete(s.keys, key)
+	delete(s.expires, key)
+	return ok
+}
+
+// account measures the memory the entry of key takes again, and updates
+// datasetBytes by how much it changed. Big collections are sampled like MEMORY
+// USAGE does, so their size is an estimate. It also notes whether the maps of
+// the value became sparse, for compaction. The caller must hold s.mu for
+// writing.
+func (s *dbShard) account(key string, e *keyEntry) {
+	size := int64(keyOverhead(key) + objectSize(e.Object, memoryUsageSamples))
+	if !e.expireAt.IsZero() {
+		size += stringHeaderSize + mapEntryOverhead + pointerSize
+	}
+	datasetBytes.Add(size - e.size)
+	e.size = size
+	s.noteSparse(key, e)
+}
+
+// setExpire sets the expiration time of the entry of key, or removes it when at
+// is zero. The caller must hold s.mu for writing.
+func (s *dbShard) setExpire(key string, e *keyEntry, at time.Time) {
+	e.expireAt = at
+	if at.IsZero() {
+		delete(s.expires, key)
+	} else {
+		s.expires[key] = e
+		s.expiresPeak = max(s.expiresPeak, len(s.expires))
+	}
+	s.account(key, e)
+}
+
+// touchKey records an access to key.
+func touchKey(db *DB, key string) {
+	s := db.shard(key)
+	s.mu.RLock()
+	if e, ok := s.keys[key]; ok {
+		e.touch()
+	}
+	s.mu.RUnlock()
+}
+
+// keyIdleTime returns how long ago key was last accessed.
+func keyIdleTime(db *DB, key string) time.Duration {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.keys[key]
+	if !ok {
+		return 0
+	}
+	return e.idleTime()
+}
+
+// setKeyIdleTime backdates the last access of key so it appears idle for d.
+func setKeyIdleTime(db *DB, key string, d time.Duration) {
+	s := db.shard(key)
+	s.mu.RLock()
+	if e, ok := s.keys[key]; ok {
+		e.lastAccess.Store(lruClock.Load() - d.Milliseconds())
+	}
+	s.mu.RUnlock()
+}
+
+// keyFreq returns the access frequency counter of key.
+func keyFreq(db *DB, key string) uint8 {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.keys[key]
+	if !ok {
+		return 0
+	}
+	return e.freq()
+}
+
+// setKeyFreq sets the access frequency counter of key.
+func setKeyFreq(db *DB, key string, counter uint8) {
+	s := db.shard(key)
+	s.mu.RLock()
+	if e, ok := s.keys[key]; ok {
+		e.setFreq(counter)
+	}
+	s.mu.RUnlock()
+}
+
+// sampleKeys calls fn for up to n keys of db, among those with an expiration
+// time if volatile is set, and returns how many it called it for. It takes one
+// key from each shard starting from a random one: the key iterating the map of
+// the shard starts at, which keeps the sample spread over the keys. fn runs
+// with the lock of the shard held for reading.
+func sampleKeys(db *DB, n int, volatile bool, fn func(key string, e *keyEntry)) int {
+	sampled := 0
+	start := rand.Intn(dbShards)
+	for i := 0; i < dbShards && sampled < n; i++ {
+		s := &db.shards[(start+i)%dbShards]
+		s.mu.RLock()
+		keys := s.keys
+		if volatile {
+			keys = s.expires
+		}
+		for key, e := range keys {
+			fn(key, e)
+			sampled++
+			break
+		}
+		s.mu.RUnlock()
+	}
+	return sampled
+}
+
+// deleteKey removes key along with its metadata, reporting whether it existed.
+// Its value is released as lazyfree-lazy-server-del says.
+func deleteKey(db *DB, key string) bool {
+	return unlinkKey(db, key, config.lazyfreeLazyServerDel)
+}
+
+// unlinkKey removes key like deleteKey, releasing its value in the background
+// if lazy is set and it's big.
+func unlinkKey(db *DB, key string, lazy bool) bool {
+	s := db.shard(key)
+	s.mu.Lock()
+	existed := s.remove(key, lazy)
+	s.mu.Unlock()
+
+	if existed {
+		signalModifiedKey(db, key)
+	}
+
+	return existed
+}
+
+// del handles the DEL command.
+func del(c *Client, args []Value) Value {
+	return deleteKeys(c, args, config.lazyfreeLazyUserDel)
+}
+
+// unlink handles the UNLINK command, which always releases big values in the
+// background.
+func unlink(c *Client, args []Value) Value {
+	return deleteKeys(c, args, true)
+}
+
+// deleteKeys deletes the keys of DEL or UNLINK, releasing their values lazily
+// if lazy is set.
+func deleteKeys(c *Client, args []Value, lazy bool) Value {
+	deleted := 0
+	for _, arg := range args {
+		if unlinkKey(c.db, arg.bulk, lazy) {
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		c.unchanged()
+	}
+	return Value{typ: ValueTypInteger, num: deleted}
+}
+
+// emptyDB deletes every key of db.
+func emptyDB(db *DB) {
+	for _, key := range dbKeys(db) {
+		unlinkKey(db, key, false)
+	}
+
+	db.hiddenKeysMu.Lock()
+	clear(db.hiddenKeys)
+	db.hiddenKeysMu.Unlock()
+}
+
+// dbKeys returns every key of db, whatever its type.
+func dbKeys(db *DB) []string {
+	keys := []string{}
+	for i := range db.shards {
+		s := &db.shards[i]
+		s.mu.RLock()
+		for key := range s.keys {
+			keys = append(keys, key)
+		}
+		s.mu.RUnlock()
+	}
+	return keys
+}
+
+// lookupKeyType returns the type of the value stored at key.
+func lookupKeyType(db *DB, key string) string {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.keys[key]
+	if !ok {
+		return KeyTypNone
+	}
+	return e.typ
+}
+
+// viewObject calls fn with the value stored at key, whatever its type, while
+// holding the read lock of its shard. It reports whether the key exists.
+func viewObject(db *DB, key string, fn func(obj Object)) bool {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.keys[key]
+	if ok {
+		fn(e.Object)
+	}
+	return ok
+}
+
+// storeObject stores obj at key, replacing any existing value and expiration.
+func storeObject(db *DB, key string, obj Object) {
+	s := db.shard(key)
+	s.mu.Lock()
+	_, existed := s.keys[key]
+	s.add(key, obj)
+	s.mu.Unlock()
+
+	if existed {
+		signalModifiedKey(db, key)
+	}
+}
+
+// accountKey measures the memory key takes again after a command modified its
+// value in place, and notes whether its maps became sparse.
+func accountKey(db *DB, key string) {
+	s := db.shard(key)
+	s.mu.Lock()
+	if e, ok := s.keys[key]; ok {
+		s.account(key, e)
+	}
+	s.mu.Unlock()
+}
+
+// keySize returns the memory key takes as last accounted, if it exists.
+func keySize(db *DB, key string) (int64, bool) {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.keys[key]
+	if !ok {
+		return 0, false
+	}
+	return e.size, true
+}
+
+// keyCount returns the number of keys in db.
+func keyCount(db *DB) int {
+	n := 0
+	for i := range db.shards {
+		s := &db.shards[i]
+		s.mu.RLock()
+		n += len(s.keys)
+		s.mu.RUnlock()
+	}
+	return n
+}
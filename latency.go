@@ -0,0 +1,229 @@
+/*
+This file contains the latency monitor. Operations that may take long, such as
+running a command or syncing the AOF to disk, report how long they took, and the
+ones at or above latency-monitor-threshold milliseconds are recorded as samples
+of their event. The LATENCY command reports the latest and worst sample of every
+event and the recent history of each, one sample per second. For a detailed
+description of the latency monitor, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/optimization/latency-monitor/
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistoryLen is the number of samples kept per event.
+const latencyHistoryLen = 160
+
+// latencyThreshold is the latency-monitor-threshold parameter in milliseconds,
+// 0 disables the monitor. It's read outside of execMu, so it's atomic.
+var latencyThreshold atomic.Int64
+
+// latencySample is the worst latency of an event within a second.
+type latencySample struct {
+	time    int64 // Unix time in seconds
+	latency int64 // Milliseconds
+}
+
+// latencyEvent holds the samples of an event.
+type latencyEvent struct {
+	history []latencySample // Oldest first
+	max     int64
+}
+
+// latencyEvents maps an event name to its samples.
+var latencyEvents = map[string]*latencyEvent{}
+var latencyEventsMu = sync.Mutex{}
+
+// latencyAddSampleIfNeeded records d as a sample of event if it reaches the
+// threshold.
+func latencyAddSampleIfNeeded(event string, d time.Duration) {
+	threshold := latencyThreshold.Load()
+	ms := d.Milliseconds()
+	if threshold == 0 || ms < threshold {
+		return
+	}
+
+	latencyEventsMu.Lock()
+	defer latencyEventsMu.Unlock()
+
+	e, ok := latencyEvents[event]
+	if !ok {
+		e = &latencyEvent{}
+		latencyEvents[event] = e
+	}
+
+	now := time.Now().Unix()
+	if ms > e.max {
+		e.max = ms
+	}
+
+	// Samples within the same second are merged, keeping the worst
+	if n := len(e.history); n > 0 && e.history[n-1].time == now {
+		if ms > e.history[n-1].latency {
+			e.history[n-1].latency = ms
+		}
+		return
+	}
+
+	e.history = append(e.history, latencySample{time: now, latency: ms})
+	if len(e.history) > latencyHistoryLen {
+		e.history = e.history[1:]
+	}
+}
+
+// latencyCommandEvent returns the event the execution of cmd is recorded as.
+func latencyCommandEvent(cmd *Command) string {
+	if cmd.hasFlag("fast") {
+		return "fast-command"
+	}
+	return "command"
+}
+
+// latency handles the LATENCY command.
+func latency(c *Client, args []Value) Value {
+	latencyEventsMu.Lock()
+	defer latencyEventsMu.Unlock()
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "LATEST":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'latency|latest' command"}
+		}
+
+		result := []Value{}
+		for _, name := range latencyEventNames() {
+			e := latencyEvents[name]
+			last := e.history[len(e.history)-1]
+			result = append(result, Value{typ: ValueTypArray, array: []Value{
+				bulkValue(name),
+				{typ: ValueTypInteger, num: int(last.time)},
+				{typ: ValueTypInteger, num: int(last.latency)},
+				{typ: ValueTypInteger, num: int(e.max)},
+			}})
+		}
+		return Value{typ: ValueTypArray, array: result}
+
+	case "HISTORY":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'latency|history' command"}
+		}
+
+		result := []Value{}
+		if e, ok := latencyEvents[args[1].bulk]; ok {
+			for _, sample := range e.history {
+				result = append(result, Value{typ: ValueTypArray, array: []Value{
+					{typ: ValueTypInteger, num: int(sample.time)},
+					{typ: ValueTypInteger, num: int(sample.latency)},
+				}})
+			}
+		}
+		return Value{typ: ValueTypArray, array: result}
+
+	case "RESET":
+		// Without arguments every event is reset
+		if len(args) == 1 {
+			n := len(latencyEvents)
+			latencyEvents = map[string]*latencyEvent{}
+			return Value{typ: ValueTypInteger, num: n}
+		}
+
+		n := 0
+		for _, arg := range args[1:] {
+			if _, ok := latencyEvents[arg.bulk]; ok {
+				delete(latencyEvents, arg.bulk)
+				n++
+			}
+		}
+		return Value{typ: ValueTypInteger, num: n}
+
+	case "HISTOGRAM":
+		return latencyHistogramCommand(args[1:])
+
+	case "DOCTOR":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'latency|doctor' command"}
+		}
+		return Value{typ: ValueTypVerbatimString, str: "txt", bulk: latencyDoctor()}
+
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try LATENCY HELP.", args[0].bulk)}
+	}
+}
+
+// latencyEventNames returns the names of the recorded events in order. The
+// caller must hold latencyEventsMu.
+func latencyEventNames() []string {
+	names := make([]string, 0, len(latencyEvents))
+	for name := range latencyEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// latencyDoctor returns a human readable analysis of the recorded events. The
+// caller must hold latencyEventsMu.
+func latencyDoctor() string {
+	if latencyThreshold.Load() == 0 && len(latencyEvents) == 0 {
+		return "I'm sorry, Dave, I can't do that. Latency monitoring is disabled in this Redis instance. " +
+			"You may use \"CONFIG SET latency-monitor-threshold <milliseconds>.\" in order to enable it.\n"
+	}
+	if len(latencyEvents) == 0 {
+		return "Dave, no latency spike was observed during the lifetime of this Redis instance, not in the slightest bit. " +
+			"I honestly think you ought to sleep tonight.\n"
+	}
+
+	b := strings.Builder{}
+	b.WriteString("Dave, I have observed latency spikes in this Redis instance. You don't mind talking about it, do you Dave?\n\n")
+
+	advice := map[string]bool{}
+	for i, name := range latencyEventNames() {
+		e := latencyEvents[name]
+
+		sum := int64(0)
+		for _, sample := range e.history {
+			sum += sample.latency
+		}
+		avg := float64(sum) / float64(len(e.history))
+
+		deviation := 0.0
+		for _, sample := range e.history {
+			deviation += math.Abs(float64(sample.latency) - avg)
+		}
+		deviation /= float64(len(e.history))
+
+		period := float64(e.history[len(e.history)-1].time-e.history[0].time) / float64(len(e.history))
+
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %.0fms, mean deviation %.0fms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, name, len(e.history), avg, deviation, period, e.max)
+
+		if strings.HasSuffix(name, "command") {
+			advice["command"] = true
+		} else if strings.HasPrefix(name, "aof") {
+			advice["aof"] = true
+		}
+	}
+
+	b.WriteString("\nI have a few advices for you:\n\n")
+	if advice["command"] {
+		b.WriteString("- Commands on big values, such as SORT, BITOP or XRANGE over large ranges, take time proportional to their size. " +
+			"Use INFO commandstats to find the commands with the highest time per call.\n")
+	}
+	if advice["aof"] {
+		b.WriteString("- The disk is slow to sync the AOF. Consider a faster disk, or an appendfsync policy that syncs less often.\n")
+	}
+	b.WriteString("- Every sample at or above the threshold is recorded, if the spikes are expected you can raise latency-monitor-threshold.\n")
+
+	return b.String()
+}
@@ -0,0 +1,221 @@
+/*
+This file contains the latency histograms of the commands, enabled with
+latency-tracking. Every call of a command records how long it ran in a histogram
+of the command, which like an HDR histogram has buckets of exponentially growing
+width, each power of two split into latencyHistogramSubBuckets buckets, so any
+latency is known to within about 3% in a few kilobytes. LATENCY HISTOGRAM
+reports the cumulative distribution of the calls of each command, and the
+latencystats section of INFO the percentiles listed in
+latency-tracking-info-percentiles. For a detailed description of both, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/commands/latency-histogram/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencyHistogramSubBits is the log2 of the number of buckets every power
+	// of two is split into.
+	latencyHistogramSubBits    = 5
+	latencyHistogramSubBuckets = 1 << latencyHistogramSubBits
+
+	// latencyHistogramMaxBits is the log2 of the largest latency recorded in
+	// nanoseconds, about 18 minutes, longer ones count as that.
+	latencyHistogramMaxBits = 40
+
+	latencyHistogramBuckets = (latencyHistogramMaxBits - latencyHistogramSubBits + 1) * latencyHistogramSubBuckets
+)
+
+// latencyHistogram counts the calls of a command by how long they ran.
+type latencyHistogram struct {
+	counts [latencyHistogramBuckets]atomic.Int64
+}
+
+// latencyHistogramBucket returns the bucket a latency of ns nanoseconds counts
+// in. The ones under latencyHistogramSubBuckets nanoseconds have a bucket each.
+func latencyHistogramBucket(ns int64) int {
+	v := uint64(max(min(ns, 1<<latencyHistogramMaxBits-1), 0))
+	if v < latencyHistogramSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 1 - latencyHistogramSubBits
+	return (shift+1)*latencyHistogramSubBuckets + int(v>>shift) - latencyHistogramSubBuckets
+}
+
+// latencyHistogramBucketMax returns the largest latency in nanoseconds counted
+// in bucket i.
+func latencyHistogramBucketMax(i int) int64 {
+	if i < latencyHistogramSubBuckets {
+		return int64(i)
+	}
+	shift := i/latencyHistogramSubBuckets - 1
+	sub := int64(i%latencyHistogramSubBuckets + latencyHistogramSubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+// record counts a call that ran for d.
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[latencyHistogramBucket(d.Nanoseconds())].Add(1)
+}
+
+// snapshot returns the counts of every bucket and their total.
+func (h *latencyHistogram) snapshot() ([]int64, int64) {
+	counts := make([]int64, latencyHistogramBuckets)
+	total := int64(0)
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	return counts, total
+}
+
+// latencyPercentile returns the latency in nanoseconds under which p percent of
+// the calls in counts ran, to the precision of the buckets.
+func latencyPercentile(counts []int64, total int64, p float64) int64 {
+	rank := int64(float64(total)*p/100 + 0.5)
+	seen := int64(0)
+	for i, n := range counts {
+		seen += n
+		if n > 0 && seen >= max(rank, 1) {
+			return latencyHistogramBucketMax(i)
+		}
+	}
+	return 0
+}
+
+// recordCommandLatency records that cmd ran for d, if latency-tracking is
+// enabled. The histogram of a command is only allocated once it's called.
+// The caller must hold execMu.
+func recordCommandLatency(cmd *Command, d time.Duration) {
+	if !config.latencyTracking {
+		return
+	}
+	h := cmd.stats.histogram.Load()
+	if h == nil {
+		cmd.stats.histogram.CompareAndSwap(nil, &latencyHistogram{})
+		h = cmd.stats.histogram.Load()
+	}
+	h.record(d)
+}
+
+// latencyHistogramCommand handles the LATENCY HISTOGRAM subcommand, which
+// replies with the calls of every command, or of the given ones, counted by
+// how many ran within each power of two microseconds.
+func latencyHistogramCommand(args []Value) Value {
+	names := []string{}
+	if len(args) == 0 {
+		for name := range originalCommands {
+			names = append(names, name)
+		}
+	} else {
+		for _, arg := range args {
+			names = append(names, strings.ToUpper(arg.bulk))
+		}
+	}
+	sort.Strings(names)
+
+	result := []Value{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		cmd, ok := originalCommands[name]
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		h := cmd.stats.histogram.Load()
+		if h == nil {
+			continue
+		}
+		counts, total := h.snapshot()
+		if total == 0 {
+			continue
+		}
+
+		// The calls that ran within 1, 2, 4 and so on microseconds, for the
+		// powers of two some calls ran within but not the previous one
+		buckets := []Value{}
+		calls, i := int64(0), 0
+		for usec := int64(1); calls < total; usec *= 2 {
+			previous := calls
+			for ; i < len(counts) && latencyHistogramBucketMax(i) <= usec*1000; i++ {
+				calls += counts[i]
+			}
+			if calls > previous {
+				buckets = append(buckets, Value{typ: ValueTypInteger, num: int(usec)}, Value{typ: ValueTypInteger, num: int(calls)})
+			}
+		}
+
+		result = append(result, bulkValue(cmd.name), Value{typ: ValueTypMap, array: []Value{
+			bulkValue("calls"), {typ: ValueTypInteger, num: int(total)},
+			bulkValue("histogram_usec"), {typ: ValueTypMap, array: buckets},
+		}})
+	}
+	return Value{typ: ValueTypMap, array: result}
+}
+
+// latencyStatsInfo returns the lines of the latencystats section of INFO, with
+// the latency-tracking-info-percentiles of every command that was called.
+func latencyStatsInfo() []string {
+	lines := []string{}
+	for _, cmd := range originalCommands {
+		h := cmd.stats.histogram.Load()
+		if h == nil {
+			continue
+		}
+		counts, total := h.snapshot()
+		if total == 0 {
+			continue
+		}
+
+		fields := []string{}
+		for _, p := range config.latencyPercentiles {
+			usec := float64(latencyPercentile(counts, total, p)) / 1000
+			fields = append(fields, fmt.Sprintf("p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64), usec))
+		}
+		lines = append(lines, "latency_percentiles_usec_"+cmd.name+":"+strings.Join(fields, ","))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// latencyTrackingPercentilesParam defines latency-tracking-info-percentiles,
+// the percentiles reported by INFO latencystats.
+func latencyTrackingPercentilesParam() *configParam {
+	return &configParam{
+		name:         "latency-tracking-info-percentiles",
+		mutable:      true,
+		list:         true,
+		defaultValue: "50 99 99.9",
+		get: func() string {
+			fields := []string{}
+			for _, p := range config.latencyPercentiles {
+				fields = append(fields, strconv.FormatFloat(p, 'f', -1, 64))
+			}
+			return strings.Join(fields, " ")
+		},
+		set: func(value string) error {
+			percentiles := []float64{}
+			for _, field := range strings.Fields(value) {
+				p, err := strconv.ParseFloat(field, 64)
+				if err != nil || p < 0 || p > 100 {
+					return errors.New("argument(s) must be percentiles between 0 and 100")
+				}
+				percentiles = append(percentiles, p)
+			}
+			config.latencyPercentiles = percentiles
+			return nil
+		},
+	}
+}
@@ -0,0 +1,120 @@
+/*
+This file contains lazy freeing, which releases deleted values on a background
+goroutine instead of in the command deleting them. FLUSHDB and FLUSHALL with
+ASYNC, or without a mode when lazyfree-lazy-user-flush is set, swap the maps of
+the shards for empty ones, which takes the same time however many keys they
+hold, and the keys are released in the background: their memory is taken out of
+the dataset and the clients caching them are told they changed. Single keys with
+more than lazyfreeThreshold elements are released in the background too when
+they're deleted by UNLINK, or by DEL with lazyfree-lazy-user-del, when they
+expire with lazyfree-lazy-expire, when they're evicted with
+lazyfree-lazy-eviction, and when the server deletes them otherwise, like a key
+overwritten by SET, with lazyfree-lazy-server-del. Until they're released, the
+values are counted in lazyfree_pending_objects. For a detailed description of
+lazy freeing, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/unlink/
+*/
+
+package main
+
+import "sync/atomic"
+
+// lazyfreeThreshold is the number of elements a value must have for deleting it
+// lazily to release it in the background, as in Redis. Handing smaller values
+// over would cost more than releasing them right away.
+const lazyfreeThreshold = 64
+
+// lazyfreePendingObjects is the number of keys and values deleted lazily that
+// weren't released yet, and lazyfreedObjects the number released since startup.
+// lazyfreePendingBytes is the memory of the single values among them, which
+// eviction counts as freed already.
+var lazyfreePendingObjects atomic.Int64
+var lazyfreedObjects atomic.Int64
+var lazyfreePendingBytes atomic.Int64
+
+// freeEffort returns the number of elements of obj, which releasing it takes
+// time in proportion to.
+func freeEffort(obj Object) int {
+	switch obj.typ {
+	case KeyTypHash:
+		return obj.hash.Len()
+	case KeyTypList:
+		return obj.list.Len()
+	case KeyTypSet:
+		return obj.set.Len()
+	case KeyTypZSet:
+		return obj.zset.Len()
+	case KeyTypStream:
+		return len(obj.stream.entries) + len(obj.stream.groups)
+	}
+	return 1
+}
+
+// releaseEntry releases the entry of a deleted key, taking its memory out of
+// the dataset. If lazy is set and its value is big, it's released on a
+// background goroutine.
+func releaseEntry(e *keyEntry, lazy bool) {
+	if !lazy || freeEffort(e.Object) <= lazyfreeThreshold {
+		datasetBytes.Add(-e.size)
+		return
+	}
+
+	lazyfreePendingObjects.Add(1)
+	lazyfreePendingBytes.Add(e.size)
+	go func() {
+		datasetBytes.Add(-e.size)
+		lazyfreePendingBytes.Add(-e.size)
+		lazyfreePendingObjects.Add(-1)
+		lazyfreedObjects.Add(1)
+	}()
+}
+
+// emptyDBAsync deletes every key of db, leaving the keys to be released on a
+// background goroutine. The transactions watching them are flagged right away,
+// so EXEC fails as it would after emptyDB.
+func emptyDBAsync(db *DB) {
+	var detached [dbShards]map[string]*keyEntry
+	pending := 0
+	for i := range db.shards {
+		s := &db.shards[i]
+		s.mu.Lock()
+		detached[i] = s.keys
+		pending += len(s.keys)
+		s.keys = map[string]*keyEntry{}
+		s.expires = map[string]*keyEntry{}
+		s.keysPeak, s.expiresPeak = 0, 0
+		s.sparseKeys = nil
+		s.mu.Unlock()
+	}
+
+	db.hiddenKeysMu.Lock()
+	clear(db.hiddenKeys)
+	db.hiddenKeysMu.Unlock()
+
+	db.watchedKeysMu.Lock()
+	for key, txs := range db.watchedKeys {
+		if _, ok := detached[shardIndex(key)][key]; !ok {
+			continue
+		}
+		for tx := range txs {
+			tx.casDirty.Store(true)
+		}
+	}
+	db.watchedKeysMu.Unlock()
+
+	if pending == 0 {
+		return
+	}
+	lazyfreePendingObjects.Add(int64(pending))
+	go func() {
+		for _, keys := range detached {
+			for key, e := range keys {
+				datasetBytes.Add(-e.size)
+				trackingInvalidateKey(key)
+				lazyfreePendingObjects.Add(-1)
+				lazyfreedObjects.Add(1)
+			}
+		}
+	}()
+}
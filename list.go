@@ -0,0 +1,709 @@
+/*
+This file contains the list data type, a sequence of strings ordered by
+insertion, which elements can be pushed to and popped from at both ends, and
+the commands reading and modifying it by index or by value. Negative indexes
+count from the end, -1 being the last element. Like Redis, a small list is
+stored packed: its elements follow each other in a single byte slice, each
+prefixed by its length, as hashes are. Once it outgrows list-max-listpack-size
+it's converted to a slice of strings for good. Like every aggregate type, a
+list that's left empty is deleted. The blocking pops, BLPOP and BRPOP, aren't
+supported. For a detailed description of lists and their encodings, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/lists/
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// List holds the elements of a list, from head to tail, packed or in a slice.
+type List struct {
+	packed []byte   // Elements, each after its length as a uvarint
+	count  int      // Number of elements in packed
+	elems  []string // Set once the list outgrew the packed encoding
+}
+
+// newList creates an empty list.
+func newList() *List {
+	return &List{}
+}
+
+// listFromElements creates a list holding elems, from head to tail, packed if
+// it's small enough.
+func listFromElements(elems []string) *List {
+	list := newList()
+	for _, elem := range elems {
+		list.Push(elem, false)
+	}
+	return list
+}
+
+// listpackFits reports whether a list of n elements taking size bytes packed
+// may stay packed. A positive list-max-listpack-size limits the elements, a
+// negative one the bytes: 4 KB for -1, doubling down to 64 KB for -5.
+func listpackFits(n, size int) bool {
+	if config.listMaxListpackSize >= 0 {
+		return n <= config.listMaxListpackSize
+	}
+	return size <= 4096<<(-config.listMaxListpackSize-1)
+}
+
+// Len returns the number of elements.
+func (list *List) Len() int {
+	if list.elems != nil {
+		return len(list.elems)
+	}
+	return list.count
+}
+
+// Index returns the element at index i, counting from the head.
+func (list *List) Index(i int) (string, bool) {
+	if i < 0 || i >= list.Len() {
+		return "", false
+	}
+	if list.elems != nil {
+		return list.elems[i], true
+	}
+	elem := ""
+	list.Range(i, i, func(e string) bool {
+		elem = e
+		return false
+	})
+	return elem, true
+}
+
+// Set replaces the element at index i, reporting whether it exists.
+func (list *List) Set(i int, elem string) bool {
+	if i < 0 || i >= list.Len() {
+		return false
+	}
+	list.edit(func(elems []string) []string {
+		elems[i] = elem
+		return elems
+	})
+	return true
+}
+
+// Push adds elem at the head of the list if front is set, or else at its tail.
+func (list *List) Push(elem string, front bool) {
+	if list.elems == nil && !listpackFits(list.count+1, len(list.packed)+packedElemSize(elem)) {
+		list.convert()
+	}
+
+	if list.elems != nil {
+		if front {
+			list.elems = slices.Insert(list.elems, 0, elem)
+			return
+		}
+		list.elems = append(list.elems, elem)
+		return
+	}
+
+	if front {
+		list.packed = append(appendPackedElem(nil, elem), list.packed...)
+	} else {
+		list.packed = appendPackedElem(list.packed, elem)
+	}
+	list.count++
+}
+
+// Pop removes and returns the element at the head of the list if front is
+// set, or else at its tail.
+func (list *List) Pop(front bool) (string, bool) {
+	if list.elems != nil {
+		n := len(list.elems)
+		if n == 0 {
+			return "", false
+		}
+		if front {
+			elem := list.elems[0]
+			list.elems = slices.Delete(list.elems, 0, 1)
+			return elem, true
+		}
+		elem := list.elems[n-1]
+		list.elems = slices.Delete(list.elems, n-1, n)
+		return elem, true
+	}
+
+	if list.count == 0 {
+		return "", false
+	}
+	if front {
+		elem, rest := nextPackedElem(list.packed)
+		list.packed = rest
+		list.count--
+		return string(elem), true
+	}
+
+	// The last element is found walking from the head, as packed elements
+	// only record their length before them
+	p := list.packed
+	for i := 1; i < list.count; i++ {
+		_, p = nextPackedElem(p)
+	}
+	elem, _ := nextPackedElem(p)
+	list.packed = list.packed[:len(list.packed)-len(p)]
+	list.count--
+	return string(elem), true
+}
+
+// Insert adds elem before the first occurrence of pivot, or after it if after
+// is set, reporting whether pivot was found.
+func (list *List) Insert(pivot, elem string, after bool) bool {
+	found := false
+	list.edit(func(elems []string) []string {
+		i := slices.Index(elems, pivot)
+		if i == -1 {
+			return elems
+		}
+		found = true
+		if after {
+			i++
+		}
+		return slices.Insert(elems, i, elem)
+	})
+	return found
+}
+
+// Remove removes the first count occurrences of elem, the last ones if count
+// is negative or all of them if it's zero, and returns how many it removed.
+func (list *List) Remove(elem string, count int) int {
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+
+	removed := 0
+	list.edit(func(elems []string) []string {
+		kept := make([]string, 0, len(elems))
+		if count >= 0 {
+			for _, e := range elems {
+				if e == elem && (limit == 0 || removed < limit) {
+					removed++
+					continue
+				}
+				kept = append(kept, e)
+			}
+			return kept
+		}
+		for i := len(elems) - 1; i >= 0; i-- {
+			e := elems[i]
+			if e == elem && removed < limit {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		slices.Reverse(kept)
+		return kept
+	})
+	return removed
+}
+
+// Trim keeps the elements from index start to stop, both included.
+func (list *List) Trim(start, stop int) {
+	list.edit(func(elems []string) []string {
+		if start > stop || start >= len(elems) {
+			return elems[:0]
+		}
+		return slices.Clone(elems[start : stop+1])
+	})
+}
+
+// Range calls fn for the elements from index start to stop, both included,
+// until it returns false.
+func (list *List) Range(start, stop int, fn func(elem string) bool) {
+	if list.elems != nil {
+		for i := start; i <= stop && i < len(list.elems); i++ {
+			if !fn(list.elems[i]) {
+				return
+			}
+		}
+		return
+	}
+	i := 0
+	for p := list.packed; len(p) > 0 && i <= stop; i++ {
+		var elem []byte
+		elem, p = nextPackedElem(p)
+		if i >= start && !fn(string(elem)) {
+			return
+		}
+	}
+}
+
+// Elements returns the elements of the list in a new slice.
+func (list *List) Elements() []string {
+	if list.elems != nil {
+		return slices.Clone(list.elems)
+	}
+	elems := make([]string, 0, list.count)
+	list.Range(0, list.count-1, func(elem string) bool {
+		elems = append(elems, elem)
+		return true
+	})
+	return elems
+}
+
+// Clone returns a copy of the list.
+func (list *List) Clone() *List {
+	if list.elems != nil {
+		return &List{elems: slices.Clone(list.elems)}
+	}
+	return &List{packed: append([]byte(nil), list.packed...), count: list.count}
+}
+
+// encoding returns the name Redis gives to the encoding of the list.
+func (list *List) encoding() string {
+	if list.elems != nil {
+		return "quicklist"
+	}
+	return "listpack"
+}
+
+// edit replaces the elements of the list with what fn returns for them. A
+// packed list is unpacked for fn, and packed again if the result still fits.
+func (list *List) edit(fn func(elems []string) []string) {
+	if list.elems != nil {
+		list.elems = fn(list.elems)
+		return
+	}
+
+	elems := fn(list.Elements())
+	size := 0
+	for _, elem := range elems {
+		size += packedElemSize(elem)
+	}
+	if !listpackFits(len(elems), size) {
+		list.elems, list.packed, list.count = elems, nil, 0
+		return
+	}
+	packed := make([]byte, 0, size)
+	for _, elem := range elems {
+		packed = appendPackedElem(packed, elem)
+	}
+	list.packed, list.count = packed, len(elems)
+}
+
+// convert moves the elements of a packed list to a slice.
+func (list *List) convert() {
+	list.elems, list.packed, list.count = list.Elements(), nil, 0
+}
+
+// packedElemSize returns the bytes elem takes packed.
+func packedElemSize(elem string) int {
+	return uvarintSize(uint64(len(elem))) + len(elem)
+}
+
+// uvarintSize returns the bytes n takes as a uvarint.
+func uvarintSize(n uint64) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+// appendPackedElem appends elem to p, after its length.
+func appendPackedElem(p []byte, elem string) []byte {
+	p = binary.AppendUvarint(p, uint64(len(elem)))
+	return append(p, elem...)
+}
+
+// nextPackedElem returns the element at the start of p, and what follows it.
+func nextPackedElem(p []byte) (elem, rest []byte) {
+	n, size := binary.Uvarint(p)
+	return p[size : size+int(n)], p[size+int(n):]
+}
+
+// listRangeIndexes turns the start and stop indexes of LRANGE and LTRIM,
+// which may count from the end, into indexes of a list of n elements. It
+// reports false if the range holds no element.
+func listRangeIndexes(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// listIndex turns an index that may count from the end into an index of a
+// list of n elements.
+func listIndex(i, n int) int {
+	if i < 0 {
+		return i + n
+	}
+	return i
+}
+
+// lpush handles the LPUSH command.
+func lpush(c *Client, args []Value) Value {
+	return pushGeneric(c, "lpush", args, true, false)
+}
+
+// rpush handles the RPUSH command.
+func rpush(c *Client, args []Value) Value {
+	return pushGeneric(c, "rpush", args, false, false)
+}
+
+// lpushx handles the LPUSHX command.
+func lpushx(c *Client, args []Value) Value {
+	return pushGeneric(c, "lpushx", args, true, true)
+}
+
+// rpushx handles the RPUSHX command.
+func rpushx(c *Client, args []Value) Value {
+	return pushGeneric(c, "rpushx", args, false, true)
+}
+
+// pushGeneric implements the push commands, pushing at the head if front is
+// set, and only to an existing list if existing is set.
+func pushGeneric(c *Client, name string, args []Value, front, existing bool) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		if existing {
+			c.unchanged()
+			return Value{typ: ValueTypInteger, num: 0}
+		}
+		e = s.add(key, Object{typ: KeyTypList, list: newList()})
+	}
+	for _, arg := range args[1:] {
+		e.list.Push(arg.bulk, front)
+	}
+	e.touch()
+
+	return Value{typ: ValueTypInteger, num: e.list.Len()}
+}
+
+// lpop handles the LPOP command.
+func lpop(c *Client, args []Value) Value {
+	return popGeneric(c, "lpop", args, true)
+}
+
+// rpop handles the RPOP command.
+func rpop(c *Client, args []Value) Value {
+	return popGeneric(c, "rpop", args, false)
+}
+
+// popGeneric implements LPOP and RPOP, popping from the head if front is set.
+// With a count it replies with an array of up to count elements.
+func popGeneric(c *Client, name string, args []Value, front bool) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+
+	count, hasCount := 1, len(args) == 2
+	if hasCount {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil || count == 0 {
+		c.unchanged()
+		if !hasCount {
+			return Value{typ: ValueTypNull}
+		}
+		if e == nil {
+			return Value{typ: ValueTypNullArray}
+		}
+		return Value{typ: ValueTypArray, array: []Value{}}
+	}
+
+	values := []Value{}
+	for len(values) < count {
+		elem, ok := e.list.Pop(front)
+		if !ok {
+			break
+		}
+		values = append(values, bulkValue(elem))
+	}
+	e.touch()
+
+	if e.list.Len() == 0 {
+		s.remove(key, false)
+	}
+
+	if !hasCount {
+		return values[0]
+	}
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// llen handles the LLEN command.
+func llen(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'llen' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+
+	return Value{typ: ValueTypInteger, num: e.list.Len()}
+}
+
+// lrange handles the LRANGE command.
+func lrange(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'lrange' command"}
+	}
+
+	key := args[0].bulk
+	start, err1 := strconv.Atoi(args[1].bulk)
+	stop, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypArray, array: []Value{}}
+	}
+	e.touch()
+
+	values := []Value{}
+	if start, stop, ok := listRangeIndexes(start, stop, e.list.Len()); ok {
+		e.list.Range(start, stop, func(elem string) bool {
+			values = append(values, bulkValue(elem))
+			return true
+		})
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// lindex handles the LINDEX command.
+func lindex(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'lindex' command"}
+	}
+
+	key := args[0].bulk
+	index, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypNull}
+	}
+	e.touch()
+
+	elem, ok := e.list.Index(listIndex(index, e.list.Len()))
+	if !ok {
+		return Value{typ: ValueTypNull}
+	}
+
+	return bulkValue(elem)
+}
+
+// lset handles the LSET command.
+func lset(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'lset' command"}
+	}
+
+	key := args[0].bulk
+	index, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR no such key"}
+	}
+	if !e.list.Set(listIndex(index, e.list.Len()), args[2].bulk) {
+		return Value{typ: ValueTypSimpleError, str: "ERR index out of range"}
+	}
+	e.touch()
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// lrem handles the LREM command.
+func lrem(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'lrem' command"}
+	}
+
+	key := args[0].bulk
+	count, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	removed := e.list.Remove(args[2].bulk, count)
+	e.touch()
+
+	if e.list.Len() == 0 {
+		s.remove(key, false)
+	}
+	if removed == 0 {
+		c.unchanged()
+	}
+
+	return Value{typ: ValueTypInteger, num: removed}
+}
+
+// ltrim handles the LTRIM command.
+func ltrim(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'ltrim' command"}
+	}
+
+	key := args[0].bulk
+	start, err1 := strconv.Atoi(args[1].bulk)
+	stop, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		c.unchanged()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+
+	start, stop, ok := listRangeIndexes(start, stop, e.list.Len())
+	if !ok {
+		start, stop = 1, 0
+	}
+	e.list.Trim(start, stop)
+	e.touch()
+
+	if e.list.Len() == 0 {
+		s.remove(key, false)
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// linsert handles the LINSERT command.
+func linsert(c *Client, args []Value) Value {
+	if len(args) != 4 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'linsert' command"}
+	}
+
+	key := args[0].bulk
+
+	after := false
+	switch strings.ToUpper(args[1].bulk) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypList)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+
+	if !e.list.Insert(args[2].bulk, args[3].bulk, after) {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: -1}
+	}
+
+	return Value{typ: ValueTypInteger, num: e.list.Len()}
+}
@@ -0,0 +1,420 @@
+/*
+This file contains the listpack and ziplist encodings, the compact serialized
+lists Redis uses for small collections and for the nodes of streams. They only
+appear in RDB files here: streams are always written as listpacks, and the
+collections written as listpacks or ziplists by Redis are decoded when loading.
+Both encodings store each element as either an integer or a string, along with
+the length needed to walk the list. The intsets that sets of integers are
+written as, and the zipmaps of hashes in old files, are handled here too. For a
+detailed description of the encodings, refer to the Redis source:
+
+https://github.com/redis/redis/blob/unstable/src/listpack.c
+https://github.com/redis/redis/blob/unstable/src/ziplist.c
+https://github.com/redis/redis/blob/unstable/src/intset.c
+https://github.com/redis/redis/blob/2.4/src/zipmap.c
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// listpackHeaderLen is the size of the total bytes and element count header.
+const listpackHeaderLen = 6
+
+// listpackEnd terminates listpacks and ziplists.
+const listpackEnd = 0xFF
+
+var errBadListpack = errors.New("corrupt listpack")
+var errBadZiplist = errors.New("corrupt ziplist")
+var errBadIntset = errors.New("corrupt intset")
+var errBadZipmap = errors.New("corrupt zipmap")
+
+// listpackWriter builds a listpack.
+type listpackWriter struct {
+	buf   []byte
+	count int
+}
+
+// newListpackWriter creates an empty listpack, leaving room for the header.
+func newListpackWriter() *listpackWriter {
+	return &listpackWriter{buf: make([]byte, listpackHeaderLen, 256)}
+}
+
+// appendString appends s, encoded as an integer if it's one in canonical form,
+// as Redis does.
+func (lp *listpackWriter) appendString(s string) {
+	if v, ok := canonicalInt(s); ok {
+		lp.appendInt(v)
+		return
+	}
+
+	start := len(lp.buf)
+	switch n := len(s); {
+	case n < 1<<6:
+		lp.buf = append(lp.buf, 0x80|byte(n))
+	case n < 1<<12:
+		lp.buf = append(lp.buf, 0xE0|byte(n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, 0xF0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+// appendInt appends v using the smallest integer encoding that holds it.
+func (lp *listpackWriter) appendInt(v int64) {
+	start := len(lp.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.buf = append(lp.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint16(v) & 0x1FFF
+		lp.buf = append(lp.buf, 0xC0|byte(u>>8), byte(u))
+	case v >= -1<<15 && v < 1<<15:
+		lp.buf = append(lp.buf, 0xF1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		lp.buf = append(lp.buf, 0xF2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= -1<<31 && v < 1<<31:
+		lp.buf = append(lp.buf, 0xF3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(v))
+	default:
+		lp.buf = append(lp.buf, 0xF4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(v))
+	}
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+// appendBacklen appends the length of the element just written, encoded so it
+// can be read from right to left.
+func (lp *listpackWriter) appendBacklen(n int) {
+	size := listpackBacklenSize(n)
+	for i := size - 1; i >= 0; i-- {
+		b := byte(n>>(7*i)) & 0x7F
+		if i != size-1 {
+			b |= 0x80
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.count++
+}
+
+// bytes completes the listpack and returns it.
+func (lp *listpackWriter) bytes() []byte {
+	lp.buf = append(lp.buf, listpackEnd)
+	binary.LittleEndian.PutUint32(lp.buf, uint32(len(lp.buf)))
+
+	// The count saturates, readers then have to walk the whole listpack
+	binary.LittleEndian.PutUint16(lp.buf[4:], uint16(min(lp.count, 0xFFFF)))
+	return lp.buf
+}
+
+// listpackBacklenSize returns how many bytes the back length of an element of
+// n bytes takes.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// decodeListpack returns the elements of a listpack, with integers formatted
+// as strings.
+func decodeListpack(p []byte) ([]string, error) {
+	if len(p) < listpackHeaderLen+1 || int(binary.LittleEndian.Uint32(p)) != len(p) {
+		return nil, errBadListpack
+	}
+	p = p[listpackHeaderLen:]
+
+	elements := []string{}
+	for len(p) > 0 && p[0] != listpackEnd {
+		var value string
+		var size int
+		b := p[0]
+
+		switch {
+		case b&0x80 == 0:
+			value, size = strconv.Itoa(int(b)), 1
+		case b&0xC0 == 0x80:
+			size = 1 + int(b&0x3F)
+			if size > len(p) {
+				return nil, errBadListpack
+			}
+			value = string(p[1:size])
+		case b&0xE0 == 0xC0:
+			if len(p) < 2 {
+				return nil, errBadListpack
+			}
+			v := int(b&0x1F)<<8 | int(p[1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			value, size = strconv.Itoa(v), 2
+		case b&0xF0 == 0xE0:
+			if len(p) < 2 {
+				return nil, errBadListpack
+			}
+			size = 2 + (int(b&0x0F)<<8 | int(p[1]))
+			if size > len(p) {
+				return nil, errBadListpack
+			}
+			value = string(p[2:size])
+		case b == 0xF0:
+			if len(p) < 5 {
+				return nil, errBadListpack
+			}
+			n := binary.LittleEndian.Uint32(p[1:])
+			if uint64(n) > uint64(len(p)-5) {
+				return nil, errBadListpack
+			}
+			size = 5 + int(n)
+			value = string(p[5:size])
+		case b >= 0xF1 && b <= 0xF4:
+			width := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[b]
+			if len(p) < 1+width {
+				return nil, errBadListpack
+			}
+			value, size = strconv.FormatInt(littleEndianInt(p[1:1+width]), 10), 1+width
+		default:
+			return nil, errBadListpack
+		}
+
+		size += listpackBacklenSize(size)
+		if size > len(p) {
+			return nil, errBadListpack
+		}
+		elements = append(elements, value)
+		p = p[size:]
+	}
+	if len(p) != 1 {
+		return nil, errBadListpack
+	}
+
+	return elements, nil
+}
+
+// decodeZiplist returns the elements of a ziplist, the encoding listpacks
+// replaced in Redis 7, with integers formatted as strings.
+func decodeZiplist(p []byte) ([]string, error) {
+	const headerLen = 10
+	if len(p) < headerLen+1 || int(binary.LittleEndian.Uint32(p)) != len(p) {
+		return nil, errBadZiplist
+	}
+	p = p[headerLen:]
+
+	elements := []string{}
+	for len(p) > 0 && p[0] != listpackEnd {
+		// Each entry starts with the length of the previous one
+		if p[0] < 0xFE {
+			p = p[1:]
+		} else if len(p) >= 5 {
+			p = p[5:]
+		} else {
+			return nil, errBadZiplist
+		}
+		if len(p) == 0 {
+			return nil, errBadZiplist
+		}
+
+		b := p[0]
+		var header, n int
+		isString := true
+		switch {
+		case b>>6 == 0:
+			header, n = 1, int(b&0x3F)
+		case b>>6 == 1:
+			if len(p) < 2 {
+				return nil, errBadZiplist
+			}
+			header, n = 2, int(b&0x3F)<<8|int(p[1])
+		case b == 0x80:
+			if len(p) < 5 {
+				return nil, errBadZiplist
+			}
+			header, n = 5, int(binary.BigEndian.Uint32(p[1:]))
+		default:
+			isString = false
+		}
+
+		if isString {
+			if n < 0 || header+n > len(p) {
+				return nil, errBadZiplist
+			}
+			elements = append(elements, string(p[header:header+n]))
+			p = p[header+n:]
+			continue
+		}
+
+		var width int
+		switch b {
+		case 0xFE:
+			width = 1
+		case 0xC0:
+			width = 2
+		case 0xF0:
+			width = 3
+		case 0xD0:
+			width = 4
+		case 0xE0:
+			width = 8
+		default:
+			// Small integers are stored in the encoding byte itself
+			if b < 0xF1 || b > 0xFD {
+				return nil, errBadZiplist
+			}
+			elements = append(elements, strconv.Itoa(int(b&0x0F)-1))
+			p = p[1:]
+			continue
+		}
+		if len(p) < 1+width {
+			return nil, errBadZiplist
+		}
+		elements = append(elements, strconv.FormatInt(littleEndianInt(p[1:1+width]), 10))
+		p = p[1+width:]
+	}
+	if len(p) != 1 {
+		return nil, errBadZiplist
+	}
+
+	return elements, nil
+}
+
+// decodeIntset returns the integers of an intset, a sorted array of integers of
+// the width given in its header, formatted as strings.
+func decodeIntset(p []byte) ([]string, error) {
+	const headerLen = 8
+	if len(p) < headerLen {
+		return nil, errBadIntset
+	}
+	width := int(binary.LittleEndian.Uint32(p))
+	n := int(binary.LittleEndian.Uint32(p[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(p)-headerLen != n*width {
+		return nil, errBadIntset
+	}
+	p = p[headerLen:]
+
+	elements := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		elements = append(elements, strconv.FormatInt(littleEndianInt(p[i*width:(i+1)*width]), 10))
+	}
+	return elements, nil
+}
+
+// encodeIntset returns ints, which must be sorted, as an intset of the
+// smallest width holding all of them.
+func encodeIntset(ints []int64) []byte {
+	width := 2
+	for _, n := range ints {
+		switch {
+		case n < math.MinInt32 || n > math.MaxInt32:
+			width = 8
+		case (n < math.MinInt16 || n > math.MaxInt16) && width < 4:
+			width = 4
+		}
+	}
+
+	p := binary.LittleEndian.AppendUint32(nil, uint32(width))
+	p = binary.LittleEndian.AppendUint32(p, uint32(len(ints)))
+	for _, n := range ints {
+		switch width {
+		case 2:
+			p = binary.LittleEndian.AppendUint16(p, uint16(n))
+		case 4:
+			p = binary.LittleEndian.AppendUint32(p, uint32(n))
+		default:
+			p = binary.LittleEndian.AppendUint64(p, uint64(n))
+		}
+	}
+	return p
+}
+
+// decodeZipmap returns the fields and values of a zipmap, the encoding of small
+// hashes before Redis 2.6, in turn.
+func decodeZipmap(p []byte) ([]string, error) {
+	// A zipmap starts with its length, which is only a hint past 253
+	if len(p) < 2 {
+		return nil, errBadZipmap
+	}
+	p = p[1:]
+
+	// readLen reads a length of one byte, or of four after the 254 marker
+	readLen := func() (int, bool) {
+		if len(p) == 0 {
+			return 0, false
+		}
+		if p[0] < 254 {
+			n := int(p[0])
+			p = p[1:]
+			return n, true
+		}
+		if p[0] != 254 || len(p) < 5 {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(p[1:]))
+		p = p[5:]
+		return n, true
+	}
+
+	elements := []string{}
+	for len(p) > 0 && p[0] != listpackEnd {
+		n, ok := readLen()
+		if !ok || n > len(p) {
+			return nil, errBadZipmap
+		}
+		field := string(p[:n])
+		p = p[n:]
+
+		// Values are followed by unused bytes, counted after their length
+		n, ok = readLen()
+		if !ok || len(p) < 1 || 1+n+int(p[0]) > len(p) {
+			return nil, errBadZipmap
+		}
+		free := int(p[0])
+		elements = append(elements, field, string(p[1:1+n]))
+		p = p[1+n+free:]
+	}
+	if len(p) != 1 {
+		return nil, errBadZipmap
+	}
+
+	return elements, nil
+}
+
+// littleEndianInt decodes a signed little endian integer of up to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+
+	// Sign extend from the width of b
+	shift := 64 - 8*len(b)
+	return int64(u<<shift) >> shift
+}
+
+// canonicalInt parses s as an integer if formatting the integer gives s back,
+// so encoding s as an integer loses nothing.
+func canonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != s {
+		return 0, false
+	}
+	return v, true
+}
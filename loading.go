@@ -0,0 +1,228 @@
+/*
+This file contains the loading of the dataset at startup. The AOF, or the RDB
+snapshot when the AOF is disabled, is loaded by a background goroutine while the
+server already accepts connections, so a large dataset doesn't leave clients
+unable to connect. Until it's loaded, the commands that need the dataset are
+answered with a LOADING error, while the ones flagged with loading, such as
+PING, INFO and CONFIG, run as usual. The progress is logged every few seconds and
+reported by the loading_* fields of INFO, so a slow start can be told from a hung
+one. For a detailed description of the loading state reported by INFO, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/commands/info/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loadingError answers the commands that need the dataset while it's loading.
+const loadingError = "LOADING Redis is loading the dataset in memory"
+
+// loadingLogInterval is how often the progress of the load is logged.
+const loadingLogInterval = 2 * time.Second
+
+// loading is set until the dataset is loaded at startup.
+var loading atomic.Bool
+
+// loadingProgress tracks how much of the files was loaded, for INFO and the
+// log. It's updated by the loading goroutine while INFO reads it, so it's
+// atomic.
+var loadingProgress struct {
+	start      atomic.Int64 // Unix time in milliseconds the load started
+	totalBytes atomic.Int64
+	doneBytes  atomic.Int64 // Size of the files already loaded
+	fileBytes  atomic.Int64 // Bytes loaded of the file being loaded
+}
+
+// loadingReader counts the bytes read through it as loaded.
+type loadingReader struct {
+	r io.Reader
+}
+
+func (lr *loadingReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	loadingProgress.fileBytes.Add(int64(n))
+	return n, err
+}
+
+// loadingNextFile accounts for the file loaded so far as done, before the next
+// one starts.
+func loadingNextFile() {
+	loadingProgress.doneBytes.Add(loadingProgress.fileBytes.Swap(0))
+}
+
+// loadingStats returns the bytes loaded so far, the percentage of the total
+// and the estimated number of seconds until the load completes.
+func loadingStats() (int64, float64, int64) {
+	loaded := loadingProgress.doneBytes.Load() + loadingProgress.fileBytes.Load()
+	total := loadingProgress.totalBytes.Load()
+	elapsed := time.Since(time.UnixMilli(loadingProgress.start.Load()))
+
+	perc := 100.0
+	if total > 0 {
+		perc = float64(loaded) * 100 / float64(total)
+	}
+	eta := int64(1)
+	if loaded > 0 {
+		eta = int64(elapsed.Seconds()*float64(total-loaded)/float64(loaded)) + 1
+	}
+	return loaded, perc, max(eta, 0)
+}
+
+// loadingInfo returns the lines of the persistence section of INFO about the
+// load.
+func loadingInfo() []string {
+	if !loading.Load() {
+		return []string{"loading:0"}
+	}
+
+	loaded, perc, eta := loadingStats()
+	return []string{
+		"loading:1",
+		"async_loading:0",
+		fmt.Sprintf("loading_start_time:%d", loadingProgress.start.Load()/1000),
+		fmt.Sprintf("loading_total_bytes:%d", loadingProgress.totalBytes.Load()),
+		fmt.Sprintf("loading_loaded_bytes:%d", loaded),
+		fmt.Sprintf("loading_loaded_perc:%.2f", perc),
+		fmt.Sprintf("loading_eta_seconds:%d", eta),
+	}
+}
+
+// logLoadingProgress logs the progress of the load every loadingLogInterval
+// until done is closed.
+func logLoadingProgress(done chan struct{}) {
+	ticker := time.NewTicker(loadingLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			loaded, perc, eta := loadingStats()
+			fmt.Printf("Loading the dataset: %d of %d bytes (%.2f%%), %d keys loaded, ETA %d seconds\n",
+				loaded, loadingProgress.totalBytes.Load(), perc, loadedKeys(), eta)
+		}
+	}
+}
+
+// loadedKeys returns the number of keys in all the databases.
+func loadedKeys() int {
+	keys := 0
+	for _, db := range databases {
+		keys += keyCount(db)
+	}
+	return keys
+}
+
+// loadDataset loads the dataset, then starts the jobs that need it.
+func loadDataset() {
+	start := time.Now()
+	loadingProgress.start.Store(start.UnixMilli())
+	done := make(chan struct{})
+	go logLoadingProgress(done)
+
+	// The AOF is more complete than the snapshot, so it's preferred when enabled
+	if config.appendonly {
+		loadAof()
+	} else if err := loadRdb(config.dbfilename); err != nil {
+		fmt.Println("Error loading the snapshot:", err)
+		os.Exit(1)
+	}
+
+	close(done)
+	loading.Store(false)
+	fmt.Printf("DB loaded from disk: %.3f seconds, %d keys loaded\n", time.Since(start).Seconds(), loadedKeys())
+
+	// Start deleting keys as their time to live runs out
+	go expireCycle()
+
+	// Rebuild the maps that became sparse, when enabled
+	go activeDefragCycle()
+
+	// Take snapshots and rewrite the AOF as they become due
+	go persistenceCron()
+
+	// Replicate from the configured master, now that there's a dataset to
+	// replace
+	startReplication()
+
+	// Copy the dataset to the mirror target and send it the writes from now on
+	startMirror()
+}
+
+// loadAof opens the AOF (Append Only File) for persistence and replays it.
+func loadAof() {
+	aof, err := NewAof(config.appenddirname, config.appendfilename)
+	if err != nil {
+		fmt.Println("Error initializing AOF:", err)
+		os.Exit(1)
+	}
+	loadingProgress.totalBytes.Store(aof.size)
+
+	// Replay the AOF with blocking disabled, a blocking read that timed out when
+	// it was first run must not wait again. The fake client keeps track of the
+	// database selected by the SELECT commands in the file. execMu is only held
+	// for each command, so the commands allowed while loading can run.
+	noBlocking.Store(true)
+	replay := newFakeClient(0)
+	file, valid, err := aof.Read(func(value Value) {
+		command := strings.ToUpper(value.array[0].bulk)
+
+		cmd, ok := Commands[command]
+		if !ok {
+			fmt.Println("Invalid command: ", command)
+			return
+		}
+
+		execMu.Lock()
+		replay.db = databases[replay.dbIndex]
+		cmd.handler(replay, value.array[1:])
+		if cmd.isWrite(value.array[1:]) {
+			for _, pos := range cmd.keyPositions(value.array) {
+				accountKey(replay.db, value.array[pos].bulk)
+			}
+		}
+		execMu.Unlock()
+	})
+	noBlocking.Store(false)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, io.ErrUnexpectedEOF) && config.aofLoadTruncated:
+		fmt.Printf("!!! Warning: short read while loading the AOF file %s!!!\n", file)
+		fmt.Printf("!!! Truncating the AOF %s at offset %d !!!\n", file, valid)
+		if err := aof.Truncate(file, valid); err != nil {
+			fmt.Println("Error truncating the AOF:", err)
+			os.Exit(1)
+		}
+		fmt.Println("AOF loaded anyway because aof-load-truncated is enabled")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		fmt.Println("Unexpected end of file reading the append only file. You can: " +
+			"1) Make a backup of your AOF file, then use --check-aof --fix <filename.manifest>. " +
+			"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.")
+		os.Exit(1)
+	default:
+		fmt.Printf("Bad file format reading the append only file %s at offset %d (%s): "+
+			"make a backup of your AOF file, then use --check-aof --fix <filename.manifest>\n", file, valid, err)
+		os.Exit(1)
+	}
+
+	if err := aof.Open(); err != nil {
+		fmt.Println("Error opening the AOF:", err)
+		os.Exit(1)
+	}
+
+	execMu.Lock()
+	serverAof = aof
+	execMu.Unlock()
+}
@@ -0,0 +1,104 @@
+/*
+This file contains the access metadata every key carries, for eviction and for
+OBJECT IDLETIME and OBJECT FREQ. The last access is recorded from a clock that a
+goroutine advances periodically, so accessing a key doesn't read the time. The
+access frequency is a logarithmic counter of 8 bits, as in Redis: each access
+increments it with a probability that falls as it grows, depending on
+lfu-log-factor, and it's decremented by one for every lfu-decay-time minutes the
+key goes without being accessed, so keys that stop being used lose their rank.
+For a detailed description of both, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/reference/eviction/#the-new-lfu-mode
+*/
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// lruClockResolution is how often the clock keys record their last access
+	// from advances.
+	lruClockResolution = 100 * time.Millisecond
+
+	// lfuInitVal is the access frequency counter of a new key, so it isn't
+	// evicted before it had a chance to be accessed again.
+	lfuInitVal = 5
+)
+
+// lruClock is the Unix time in milliseconds, advanced every lruClockResolution.
+var lruClock atomic.Int64
+
+func init() {
+	lruClock.Store(time.Now().UnixMilli())
+}
+
+// lruClockCron advances the clock keys record their last access from.
+func lruClockCron() {
+	for {
+		time.Sleep(lruClockResolution)
+		lruClock.Store(time.Now().UnixMilli())
+	}
+}
+
+// lfuPolicy reports whether maxmemory-policy evicts by access frequency.
+func lfuPolicy() bool {
+	return strings.HasSuffix(config.maxmemoryPolicy, "-lfu")
+}
+
+// lfuMinutes returns the current time in minutes, wrapped to 16 bits as it's
+// stored next to the access frequency counter.
+func lfuMinutes() uint32 {
+	return uint32(lruClock.Load()/60000) & 0xffff
+}
+
+// lfuPack returns the access frequency state made of the time of the last
+// decrement, in minutes, and the counter.
+func lfuPack(minutes uint32, counter uint8) uint32 {
+	return minutes<<8 | uint32(counter)
+}
+
+// lfuDecay returns the counter of the access frequency state lfu, decremented
+// once for every lfu-decay-time minutes since its last decrement.
+func lfuDecay(lfu uint32) uint8 {
+	counter := uint8(lfu & 0xff)
+	if config.lfuDecayTime == 0 {
+		return counter
+	}
+
+	// The time wraps around every 2^16 minutes, about 45 days
+	elapsed := (lfuMinutes() - lfu>>8) & 0xffff
+	periods := elapsed / uint32(config.lfuDecayTime)
+	if periods >= uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// lfuIncrement increments counter with a probability that falls as it grows,
+// so it takes about a million accesses to saturate it with the default
+// lfu-log-factor.
+func lfuIncrement(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	base := max(float64(counter)-lfuInitVal, 0)
+	if rand.Float64() < 1/(base*float64(config.lfuLogFactor)+1) {
+		counter++
+	}
+	return counter
+}
+
+// freq returns the access frequency counter of the key, decayed to now.
+func (e *keyEntry) freq() uint8 {
+	return lfuDecay(e.lfu.Load())
+}
+
+// setFreq sets the access frequency counter of the key.
+func (e *keyEntry) setFreq(counter uint8) {
+	e.lfu.Store(lfuPack(lfuMinutes(), counter))
+}
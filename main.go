@@ -1,108 +1,450 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("Listening on port :6379")
+	// Validate or repair an AOF instead of running the server
+	if len(os.Args) > 1 && os.Args[1] == "--check-aof" {
+		os.Exit(checkAof(os.Args[2:]))
+	}
 
-	// Create a TCP listener on port 6379
-	l, err := net.Listen("tcp", ":6379")
-	if err != nil {
-		fmt.Println("Error starting TCP listener:", err)
-		return
+	// Convert a snapshot to or from a human-readable format
+	if len(os.Args) > 1 && os.Args[1] == "--export" {
+		os.Exit(exportDataset(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--import" {
+		os.Exit(importDataset(os.Args[2:]))
 	}
-	defer l.Close()
 
-	// Initialize the AOF (Append Only File) for persistence
-	aof, err := NewAof("database.aof")
-	if err != nil {
-		fmt.Println("Error initializing AOF:", err)
-		return
+	// Measure the performance of a running server
+	if len(os.Args) > 1 && os.Args[1] == "--benchmark" {
+		os.Exit(runBenchmark(os.Args[2:]))
 	}
-	defer aof.Close()
 
-	aof.Read(func(value Value) {
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+	// Run as a sentinel, which monitors masters instead of serving a dataset
+	args := os.Args[1:]
+	if i := slices.Index(args, "--sentinel"); i >= 0 {
+		sentinelMode = true
+		args = slices.Delete(slices.Clone(args), i, i+1)
+		configParamsByName["port"].set(strconv.Itoa(sentinelDefaultPort))
+	}
 
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
-			return
-		}
+	if err := loadConfig(args); err != nil {
+		fmt.Println("Error loading configuration:", err)
+		os.Exit(1)
+	}
 
-		handler(args)
-	})
+	if sentinelMode {
+		if err := initSentinel(); err != nil {
+			fmt.Println("Error starting sentinel:", err)
+			os.Exit(1)
+		}
+	}
+	if config.clusterEnabled {
+		if err := initCluster(); err != nil {
+			fmt.Println("Error starting cluster:", err)
+			os.Exit(1)
+		}
+	}
 
-	// Accept connections in a loop
-	for {
-		conn, err := l.Accept()
+	// Log to the configured file instead of the standard output
+	if config.logfile != "" {
+		f, err := os.OpenFile(config.logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			fmt.Println("Error accepting connection:", err)
-			continue
+			fmt.Println("Error opening log file:", err)
+			os.Exit(1)
 		}
+		defer f.Close()
+		os.Stdout = f
+	}
+
+	initDatabases(config.databases)
+
+	// Create a TCP listener on every bind address
+	listeners, err := listen()
+	if err != nil {
+		fmt.Println("Error starting TCP listener:", err)
+		return
+	}
+	serverListeners = listeners
+
+	// Load the dataset in the background, answering the commands that need it
+	// with a LOADING error meanwhile. A sentinel has none, it starts monitoring.
+	if sentinelMode {
+		go sentinelTimer()
+	} else {
+		loading.Store(true)
+		recordStartupMemory()
+		go loadDataset()
+	}
+	if config.clusterEnabled {
+		go clusterCron()
+	}
 
-		// Handle each connection in a separate goroutine
-		go handleConnection(conn, aof)
+	go handleShutdownSignals()
+	go lruClockCron()
+	if config.singleThreadedExecution {
+		go executorLoop()
 	}
+	go clientsCron()
+
+	// Accept connections on every listener, the last one in this goroutine
+	for _, l := range listeners[1:] {
+		go acceptConnections(l)
+	}
+	acceptConnections(listeners[0])
 }
 
 // handleConnection handles RESP commands from a single client connection.
-func handleConnection(conn net.Conn, aof *Aof) {
+func handleConnection(conn net.Conn) {
 	defer conn.Close() // Ensure the connection is closed when the function returns
 
-	resp := NewResp(conn)
-	writer := NewWriter(conn)
+	// A busy script can't change the configuration, so connections are
+	// accepted without waiting for it
+	unlock, busy := lockExec(false)
+	refused := protectedModeRefuses(conn.RemoteAddr())
+	setTCPOptions(conn)
+	if busy == nil {
+		unlock()
+	}
+	if refused {
+		conn.Write(Value{typ: ValueTypSimpleError, str: protectedModeError}.Marshal())
+		return
+	}
+
+	c := newClient(conn)
+	defer c.close()
+	resp := NewClientResp(flushingReader{conn: conn, writer: c.writer})
 
 	for {
 		// Read the next RESP value from the connection
 		value, err := resp.Read()
 		if err != nil {
-			fmt.Println("Error reading from connection:", err)
+			// As in Redis, a malformed request is answered before hanging up
+			if errors.Is(err, errProtocol) {
+				c.writer.Write(Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()})
+			}
+
+			// A client hanging up is the normal end of a connection
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, syscall.ECONNRESET) {
+				fmt.Println("Error reading from connection:", err)
+			}
 			return
 		}
 
+		// The replies to a pipeline are written together, before reading more
+		// commands waits on the connection. The ones before its last command
+		// are written before it runs, as it may block.
+		if resp.Buffered() == 0 {
+			c.writer.Flush()
+		}
+
+		switch {
 		// Validate that the value is an array
-		if value.typ != ValueTypArray {
+		case value.typ != ValueTypArray:
 			fmt.Println("Invalid request, expected array")
-			writer.Write(Value{typ: ValueTypSimpleError, str: "ERR invalid request, expected array"})
-			continue
-		}
+			c.reply(Value{typ: ValueTypSimpleError, str: "ERR invalid request, expected array"})
 
 		// Ensure the array has at least one element (the command)
-		if len(value.array) == 0 {
+		case len(value.array) == 0:
 			fmt.Println("Invalid request, expected array length > 0")
-			writer.Write(Value{typ: ValueTypSimpleError, str: "ERR invalid request, expected array length > 0"})
-			continue
+			c.reply(Value{typ: ValueTypSimpleError, str: "ERR invalid request, expected array length > 0"})
+
+		default:
+			c.running.Store(true)
+			c.reply(runCommand(c, value))
+			c.lastInteraction.Store(time.Now().UnixMilli())
+			c.running.Store(false)
 		}
 
-		// Extract the command and arguments from the array
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+		// QUIT closes the connection once its reply is written
+		if c.quitting {
+			c.writer.Flush()
+			return
+		}
+	}
+}
 
-		// Find the handler for the command
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command:", command)
-			writer.Write(Value{typ: ValueTypSimpleError, str: "ERR unknown command"})
-			continue
+// flushingReader reads the commands of a client from its connection, writing
+// the replies buffered so far before it waits for more.
+type flushingReader struct {
+	conn   net.Conn
+	writer *Writer
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	r.writer.Flush()
+	return r.conn.Read(p)
+}
+
+// processCommand looks up and runs a single command sent by c, returning its
+// reply. owned is set on the executor, which holds execMu already.
+func processCommand(c *Client, value Value, owned bool) Value {
+	// Find the command in the command table, the name sent may be the one it
+	// was renamed to
+	cmd, ok := Commands[strings.ToUpper(value.array[0].bulk)]
+	if !ok {
+		fmt.Println("Invalid command:", value.array[0].bulk)
+		c.tx.fail()
+		return recordRejected(nil, Value{typ: ValueTypSimpleError, str: "ERR unknown command"})
+	}
+	command := strings.ToUpper(cmd.name)
+
+	// ASKING applies to the next command only, or to a whole transaction
+	defer func() {
+		if command != "ASKING" && !c.tx.active {
+			c.asking = false
 		}
+	}()
+
+	// Reject calls with the wrong number of arguments before running anything
+	if !cmd.checkArity(len(value.array)) {
+		c.tx.fail()
+		return recordRejected(cmd, Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd.name)})
+	}
 
-		// Write the command to the AOF for persistence if it is a modifying command
-		if command == "SET" || command == "HSET" {
-			if err := aof.Write(value); err != nil {
-				fmt.Println("Error writing to AOF:", err)
-				writer.Write(Value{typ: ValueTypSimpleError, str: "ERR failed to persist data"})
-				continue
+	// Commands like DEBUG can be disabled, or limited to local connections
+	if cmd.hasFlag("protected") && !protectedCommandAllowed(c) {
+		c.tx.fail()
+		return recordRejected(cmd, Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR %s command not allowed. "+
+			"If the enable-%s-command option is set to \"local\", you can run it from a local connection, "+
+			"otherwise you need to set this option in the configuration file, and then restart the server.", command, cmd.name)})
+	}
+
+	// Until the connection authenticates only commands like AUTH may run
+	if !c.authenticated && !cmd.hasFlag("no_auth") {
+		c.tx.fail()
+		return recordRejected(cmd, Value{typ: ValueTypSimpleError, str: "NOAUTH Authentication required."})
+	}
+
+	// Only the commands that don't need the dataset run until it's loaded
+	if loading.Load() && !cmd.hasFlag("loading") {
+		c.tx.fail()
+		return recordRejected(cmd, Value{typ: ValueTypSimpleError, str: loadingError})
+	}
+
+	// A subscribed RESP2 connection only accepts the commands that manage
+	// subscriptions. RESP3 tells messages and replies apart by their type.
+	if c.sub.count() > 0 && c.writer.Protocol() == ProtocolResp2 && !subscribeModeAllowed(command) {
+		return recordRejected(cmd, subscribeModeError(cmd.name))
+	}
+
+	// Every command is queued while a transaction is open, except the ones
+	// that control the transaction and the subscriptions, whose replies can't
+	// be part of the EXEC reply
+	if c.tx.active && !runsInsideMulti(command) {
+		// Commands the user may not run are rejected right away, failing EXEC
+		unlock, busy := lockCommand(false, owned)
+		if busy != nil {
+			c.tx.fail()
+			return recordRejected(cmd, busyError(busy))
+		}
+		denied := clusterRedirect(c, cmd, value.array)
+		if denied == nil {
+			denied = aclCheck(c, cmd, value.array)
+		}
+		if denied == nil {
+			denied = readOnlyCheck(c, cmd, value.array)
+		}
+		if denied == nil {
+			denied = minReplicasCheck(c, cmd, value.array)
+		}
+		if denied == nil {
+			denied = oomCheck(c, cmd)
+		}
+		unlock()
+		if denied != nil {
+			c.tx.fail()
+			return recordRejected(cmd, *denied)
+		}
+		return c.tx.enqueue(cmd, value)
+	}
+
+	// Writes wait while a failover pauses them. The executor hands them back
+	// to their connection instead, see executor.go.
+	if !owned && cmd.isWrite(value.array[1:]) {
+		waitWritesResumed()
+	}
+
+	// Execute the command, unless a script runs for so long that it's answered
+	// with BUSY instead, see script_busy.go
+	unlock, busy := lockCommand(cmd.exclusive, owned)
+	if busy != nil {
+		if !runsWhileBusy(cmd, value.array[1:]) {
+			return recordRejected(cmd, busyError(busy))
+		}
+		if denied := aclCheck(c, cmd, value.array); denied != nil {
+			return recordRejected(cmd, *denied)
+		}
+		return cmd.handler(c, value.array[1:])
+	}
+	defer unlock()
+
+	// In cluster mode the keys must be in slots this node serves. Whether they
+	// exist is checked with execMu held, which the executor needs.
+	if redirect := clusterRedirect(c, cmd, value.array); redirect != nil {
+		c.tx.fail()
+		return recordRejected(cmd, *redirect)
+	}
+
+	return execute(c, cmd, value)
+}
+
+// lockCommand takes execMu for a command like lockExec, unless owned is set,
+// as the executor holds it already.
+func lockCommand(exclusive, owned bool) (func(), *runningScript) {
+	if owned {
+		return func() {}, nil
+	}
+	return lockExec(exclusive)
+}
+
+// runsInsideMulti reports whether command runs right away inside MULTI.
+func runsInsideMulti(command string) bool {
+	switch command {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "RESET", "QUIT",
+		"SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE":
+		return true
+	}
+	return false
+}
+
+// execute runs a command against the database selected by c, first writing it
+// to the AOF if it modifies data. The caller must hold execMu.
+func execute(c *Client, cmd *Command, value Value) Value {
+	c.db = databases[c.dbIndex]
+
+	// Check the command against the ACL of the user, which may have changed
+	// since a queued command was accepted
+	if denied := aclCheck(c, cmd, value.array); denied != nil {
+		return recordRejected(cmd, *denied)
+	}
+
+	// A read-only replica only takes writes from its master
+	if denied := readOnlyCheck(c, cmd, value.array); denied != nil {
+		return recordRejected(cmd, *denied)
+	}
+
+	// A master may need replicas in sync with it to take writes
+	if denied := minReplicasCheck(c, cmd, value.array); denied != nil {
+		return recordRejected(cmd, *denied)
+	}
+
+	// Keys are evicted to make room, and commands adding data refused if
+	// that's not enough
+	if denied := oomCheck(c, cmd); denied != nil {
+		return recordRejected(cmd, *denied)
+	}
+
+	// Keys whose time has passed expire before the command sees them. The
+	// master decides when the keys of a replica expire, so its commands see
+	// the hidden ones, and fake clients like the one replaying the AOF see
+	// the keys as they are.
+	for _, pos := range cmd.keyPositions(value.array) {
+		if c.master {
+			unhideKey(c.db, value.array[pos].bulk)
+		} else if c.user != nil {
+			expireIfNeeded(c.db, value.array[pos].bulk)
+		}
+	}
+
+	// Writes are refused once the AOF can't be written, so the dataset doesn't
+	// move ahead of what would be loaded back
+	write := cmd.isWrite(value.array[1:])
+	if serverAof != nil && write && !serverAof.WriteOK() {
+		return recordRejected(cmd, Value{typ: ValueTypSimpleError, str: "ERR failed to persist data"})
+	}
+
+	c.propagated = nil
+
+	// Remember the keys a tracking client reads so it can be told when they
+	// change
+	readonly := cmd.hasFlag("readonly")
+	if readonly && c.tracking && !c.trackingBcast {
+		keys := []string{}
+		for _, pos := range cmd.keyPositions(value.array) {
+			keys = append(keys, value.array[pos].bulk)
+		}
+		trackKeys(c, keys)
+	}
+
+	start := time.Now()
+	result := cmd.handler(c, value.array[1:])
+	duration := time.Since(start)
+	recordCall(cmd, duration, result)
+
+	// Blocking commands may take long because they waited for data, not because
+	// they were slow
+	if !cmd.hasFlag("blocking") {
+		latencyAddSampleIfNeeded(latencyCommandEvent(cmd), duration)
+	}
+
+	if readonly {
+		for _, pos := range cmd.keyPositions(value.array) {
+			recordKeyspaceLookup(c.db, value.array[pos].bulk)
+		}
+	}
+
+	// Write the command to the AOF for persistence and send it to the
+	// replicas, as typed or as its handler rewrote it, and count it in the
+	// changes since the last snapshot
+	modified := false
+	if write && result.typ != ValueTypSimpleError {
+		commands := c.propagated
+		if commands == nil {
+			commands = []Value{aofAbsoluteExpire(value)}
+		}
+		for _, command := range commands {
+			// A write the AOF refused is neither acknowledged nor sent to the
+			// replicas, which would move ahead of what the AOF loads back. The
+			// AOF only refuses writes once one failed, so WriteOK refuses the
+			// commands that follow.
+			if serverAof != nil {
+				off, err := serverAof.Write(c.db.id, command)
+				if err != nil {
+					fmt.Println("Error writing to AOF:", err)
+					result = Value{typ: ValueTypSimpleError, str: "ERR failed to persist data"}
+					cmd.stats.failedCalls.Add(1)
+					recordError(result)
+					break
+				}
+				c.aofOff.Store(off)
+			}
+
+			// Writes on a replica that didn't come from its master stay there,
+			// the offsets must match those of the master
+			if !c.master && replicaOf == nil {
+				c.woff = propagate(c.db.id, command)
 			}
 		}
+		if len(commands) > 0 {
+			dirty.Add(1)
+			modified = true
+		}
+	}
 
-		// Execute the command handler and write the result to the client
-		result := handler(args)
-		writer.Write(result)
+	// Account for the memory the values of the keys take now, and let
+	// transactions watching the keys know they were modified, unless the
+	// command failed or changed nothing
+	if write {
+		for _, pos := range cmd.keyPositions(value.array) {
+			accountKey(c.db, value.array[pos].bulk)
+			if modified {
+				signalModifiedKey(c.db, value.array[pos].bulk)
+			}
+		}
 	}
+
+	return result
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// newTestClient returns a client connected through an in-memory pipe, whose
+// far end discards what the server writes, after emptying the databases.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	resetDatabases()
+	return connectTestClient(t)
+}
+
+// connectTestClient returns another client of the databases in use, for tests
+// with several connections.
+func connectTestClient(t *testing.T) *Client {
+	t.Helper()
+	server, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+
+	c := newClient(server)
+	t.Cleanup(func() {
+		c.close()
+		peer.Close()
+	})
+	return c
+}
+
+// resetDatabases empties every database and deletes the function libraries,
+// for tests starting from scratch.
+func resetDatabases() {
+	initDatabases(config.databases)
+	flushLibraries()
+}
+
+// run runs a command as c sent it, returning the reply in RESP2.
+func run(c *Client, args ...string) string {
+	return string(runCommand(c, requestValue(args...)).Marshal())
+}
+
+// runAll runs the steps in turn, each sent by the client it names, failing
+// the test if a reply isn't the one wanted.
+func runAll(t *testing.T, steps []step, clients ...*Client) {
+	t.Helper()
+	for i, s := range steps {
+		if got := run(clients[s.client], s.args...); got != s.want {
+			t.Fatalf("step %d %q: got %q, want %q", i, s.args, got, s.want)
+		}
+	}
+}
+
+// step is a command, the index of the client sending it, and the reply it
+// should get.
+type step struct {
+	client int
+	args   []string
+	want   string
+}
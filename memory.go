@@ -0,0 +1,442 @@
+/*
+This file contains the MEMORY command, which reports how much memory the server
+uses. Go doesn't tell how much memory a single value takes, so the usage of a key
+is estimated by walking the structures that hold its value and adding up the
+sizes of their parts, using the sizes of the Go headers involved and an average
+overhead per map entry. Big collections are sampled rather than walked fully.
+Every key is measured this way whenever it's written, and the total kept in
+datasetBytes, which is the size of the dataset MEMORY STATS reports. The other
+totals come from the Go runtime, and the overhead of the databases, clients and
+caches is estimated the same way as keys. For a detailed description of the
+command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/memory-usage/
+*/
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sizes used to estimate memory usage, in bytes, for a 64-bit platform.
+const (
+	stringHeaderSize = 16 // Pointer and length
+	sliceHeaderSize  = 24 // Pointer, length and capacity
+	pointerSize      = 8
+	mapEntryOverhead = 16 // Hash byte, bucket and overflow share, free slots
+	mapHeaderSize    = 48
+	float64Size      = 8
+	int64Size        = 8
+	streamIDSize     = 16
+	timeSize         = 24
+	hashHeaderSize   = 40  // Packed slice, count and map pointer
+	listHeaderSize   = 56  // Packed slice, count and elements slice
+	setHeaderSize    = 32  // Intset slice and map pointer
+	keyEntrySize     = 112 // Type, value fields, expiration, access time and frequency
+)
+
+// memoryUsageSamples is the number of elements sampled by default.
+const memoryUsageSamples = 5
+
+// clientReadBufferSize is the size of the buffer each connection reads into,
+// and clientWriteBufferSize the size of the one its replies are buffered in.
+const clientReadBufferSize = 4096
+const clientWriteBufferSize = 4096
+
+// startupAllocated is the memory allocated once the server finished starting,
+// and peakAllocated the most memory seen allocated.
+var startupAllocated uint64
+var peakAllocated uint64
+var peakAllocatedMu = sync.Mutex{}
+
+// stringSize returns the memory used by a string.
+func stringSize(s string) int {
+	return stringHeaderSize + len(s)
+}
+
+// keyOverhead returns the memory a key takes besides its value: its name in the
+// keys of its shard and its entry.
+func keyOverhead(key string) int {
+	return stringSize(key) + mapEntryOverhead + pointerSize + keyEntrySize
+}
+
+// objectSize estimates the memory used by the value of obj, sampling up to
+// samples elements of collections. A samples of 0 walks every element.
+func objectSize(obj Object, samples int) int {
+	switch obj.typ {
+	case KeyTypString:
+		return valueSize(obj.str)
+
+	case KeyTypHash:
+		h := obj.hash
+		if h.dict == nil {
+			return hashHeaderSize + cap(h.packed)
+		}
+		size, n := 0, 0
+		for field, value := range h.dict {
+			if samples > 0 && n == samples {
+				break
+			}
+			size += stringSize(field) + valueSize(value) + mapEntryOverhead
+			n++
+		}
+		return hashHeaderSize + mapHeaderSize + sampledSize(size, n, len(h.dict))
+
+	case KeyTypList:
+		if obj.list.elems == nil {
+			return listHeaderSize + cap(obj.list.packed)
+		}
+		size, n := 0, 0
+		obj.list.Range(0, obj.list.Len()-1, func(elem string) bool {
+			if samples > 0 && n == samples {
+				return false
+			}
+			size += stringSize(elem)
+			n++
+			return true
+		})
+		return listHeaderSize + sampledSize(size, n, obj.list.Len())
+
+	case KeyTypSet:
+		set := obj.set
+		if set.dict == nil {
+			return setHeaderSize + cap(set.ints)*int64Size
+		}
+		size, n := 0, 0
+		for member := range set.dict {
+			if samples > 0 && n == samples {
+				break
+			}
+			size += stringSize(member) + mapEntryOverhead
+			n++
+		}
+		return setHeaderSize + mapHeaderSize + sampledSize(size, n, len(set.dict))
+
+	case KeyTypZSet:
+		// Every member is in the dict and in the sorted slice
+		size, n := 0, 0
+		for _, m := range obj.zset.sorted {
+			if samples > 0 && n == samples {
+				break
+			}
+			size += 2*stringSize(m.member) + 2*float64Size + mapEntryOverhead
+			n++
+		}
+		return pointerSize + mapHeaderSize + sliceHeaderSize + sampledSize(size, n, obj.zset.Len())
+
+	default:
+		return streamSize(obj.stream, samples)
+	}
+}
+
+// streamSize estimates the memory used by a stream, including its groups.
+func streamSize(s *Stream, samples int) int {
+	size, n := 0, 0
+	for _, entry := range s.entries {
+		if samples > 0 && n == samples {
+			break
+		}
+		size += streamIDSize + sliceHeaderSize
+		for _, field := range entry.fields {
+			size += stringSize(field)
+		}
+		n++
+	}
+	total := pointerSize + sliceHeaderSize + 3*streamIDSize + int64Size + mapHeaderSize + sampledSize(size, n, len(s.entries))
+
+	for name, g := range s.groups {
+		total += stringSize(name) + mapEntryOverhead + pointerSize
+		total += stringSize(g.name) + streamIDSize + int64Size + 2*mapHeaderSize
+
+		// Pending entries and consumers are small and fixed, so they're counted in full
+		pendingEntrySize := stringHeaderSize + timeSize + int64Size
+		total += len(g.pending) * (streamIDSize + mapEntryOverhead + pointerSize + pendingEntrySize)
+		for _, consumer := range g.consumers {
+			total += 2*stringSize(consumer.name) + mapEntryOverhead + pointerSize + 2*timeSize + mapHeaderSize
+			total += len(consumer.pending) * (streamIDSize + mapEntryOverhead)
+		}
+	}
+
+	return total
+}
+
+// sampledSize scales the size of n sampled elements to total elements.
+func sampledSize(size, n, total int) int {
+	if n == 0 || n == total {
+		return size
+	}
+	return int(float64(size) / float64(n) * float64(total))
+}
+
+// memoryCommand handles the MEMORY command.
+func memoryCommand(c *Client, args []Value) Value {
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "USAGE":
+		return memoryUsage(c, args[1:])
+	case "STATS":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'memory|stats' command"}
+		}
+		return readMemoryStats().value()
+	case "DOCTOR":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'memory|doctor' command"}
+		}
+		return Value{typ: ValueTypVerbatimString, str: "txt", bulk: memoryDoctor(readMemoryStats())}
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", args[0].bulk)}
+	}
+}
+
+// memoryUsage handles the MEMORY USAGE subcommand.
+func memoryUsage(c *Client, args []Value) Value {
+	if len(args) != 1 && len(args) != 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'memory|usage' command"}
+	}
+
+	key := args[0].bulk
+
+	samples := memoryUsageSamples
+	if len(args) == 3 {
+		if strings.ToUpper(args[1].bulk) != "SAMPLES" {
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+		n, err := strconv.Atoi(args[2].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is out of range, must be positive"}
+		}
+		samples = n
+	}
+
+	expireIfNeeded(c.db, key)
+
+	// The size accounted when the key was last written is as good an estimate
+	// as sampling it again
+	if len(args) == 1 {
+		size, ok := keySize(c.db, key)
+		if !ok {
+			return Value{typ: ValueTypNull}
+		}
+		return Value{typ: ValueTypInteger, num: int(size)}
+	}
+
+	size := 0
+	if !viewObject(c.db, key, func(obj Object) { size = objectSize(obj, samples) }) {
+		return Value{typ: ValueTypNull}
+	}
+	size += keyOverhead(key)
+
+	if _, ok := keyExpireTime(c.db, key); ok {
+		size += stringHeaderSize + mapEntryOverhead + pointerSize
+	}
+
+	return Value{typ: ValueTypInteger, num: size}
+}
+
+// dbMemoryStats holds the overhead of a database.
+type dbMemoryStats struct {
+	id      int
+	keys    int
+	main    int // Overhead of the maps holding the keys
+	expires int // Overhead of the map holding the expiration times
+}
+
+// memoryStats holds the figures reported by MEMORY STATS.
+type memoryStats struct {
+	peakAllocated    uint64
+	totalAllocated   uint64
+	startupAllocated uint64
+	clientsNormal    int
+	replBacklog      int
+	luaCaches        int
+	functionsCaches  int
+	overheadTotal    int
+	dbs              []dbMemoryStats
+	keysCount        int
+	datasetBytes     int
+	heapInuse        uint64
+	heapReleased     uint64
+	sys              uint64
+	clients          int
+}
+
+// recordStartupMemory records the memory allocated once the server started.
+func recordStartupMemory() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	startupAllocated = m.HeapAlloc
+}
+
+// readMemoryStats gathers the memory figures of the server. The caller must
+// hold execMu.
+func readMemoryStats() memoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	peakAllocatedMu.Lock()
+	if m.HeapAlloc > peakAllocated {
+		peakAllocated = m.HeapAlloc
+	}
+	peak := peakAllocated
+	peakAllocatedMu.Unlock()
+
+	stats := memoryStats{
+		peakAllocated:    peak,
+		totalAllocated:   m.HeapAlloc,
+		startupAllocated: startupAllocated,
+		heapInuse:        m.HeapInuse,
+		heapReleased:     m.HeapReleased,
+		sys:              m.Sys,
+	}
+
+	clientsMu.RLock()
+	stats.clients = len(clients)
+	clientsMu.RUnlock()
+	stats.clientsNormal = stats.clients * (clientReadBufferSize + clientWriteBufferSize)
+
+	scriptsMu.RLock()
+	for sha, body := range scripts {
+		stats.luaCaches += stringSize(sha) + stringSize(body) + mapEntryOverhead
+	}
+	scriptsMu.RUnlock()
+
+	replMu.Lock()
+	if replBacklogBuf != nil {
+		stats.replBacklog = len(replBacklogBuf.buf)
+	}
+	replMu.Unlock()
+
+	functionsMu.RLock()
+	for name, lib := range functionLibraries {
+		stats.functionsCaches += stringSize(name) + stringSize(lib.code) + mapEntryOverhead
+	}
+	functionsMu.RUnlock()
+
+	stats.overheadTotal = int(startupAllocated) + stats.replBacklog + stats.clientsNormal + stats.luaCaches + stats.functionsCaches
+
+	// The accounted size of the keys includes their entries, which are part of
+	// the overhead rather than the dataset
+	stats.datasetBytes = int(datasetBytes.Load())
+
+	for _, db := range databases {
+		keys := keyCount(db)
+		expires := expireCount(db)
+		if keys == 0 {
+			continue
+		}
+
+		// Every key has an entry in the keys of its shard, and another in the
+		// expires if it has an expiration time
+		dbStats := dbMemoryStats{
+			id:      db.id,
+			keys:    keys,
+			main:    dbShards*mapHeaderSize + keys*(stringHeaderSize+mapEntryOverhead+pointerSize+keyEntrySize),
+			expires: dbShards*mapHeaderSize + expires*(stringHeaderSize+mapEntryOverhead+pointerSize),
+		}
+		stats.dbs = append(stats.dbs, dbStats)
+		stats.keysCount += keys
+		stats.overheadTotal += dbStats.main + dbStats.expires
+		stats.datasetBytes -= dbStats.main + dbStats.expires - 2*dbShards*mapHeaderSize
+	}
+	stats.datasetBytes = max(stats.datasetBytes, 0)
+
+	return stats
+}
+
+// fragmentation returns the ratio of the memory obtained from the operating
+// system to the memory allocated.
+func (s memoryStats) fragmentation() float64 {
+	if s.totalAllocated == 0 {
+		return 0
+	}
+	return float64(s.sys-s.heapReleased) / float64(s.totalAllocated)
+}
+
+// value builds the MEMORY STATS reply.
+func (s memoryStats) value() Value {
+	integer := func(n int) Value { return Value{typ: ValueTypInteger, num: n} }
+	percentage := func(part, whole float64) Value {
+		if whole == 0 {
+			return bulkValue("0")
+		}
+		return bulkValue(strconv.FormatFloat(part*100/whole, 'f', -1, 64))
+	}
+
+	result := []Value{
+		bulkValue("peak.allocated"), integer(int(s.peakAllocated)),
+		bulkValue("total.allocated"), integer(int(s.totalAllocated)),
+		bulkValue("startup.allocated"), integer(int(s.startupAllocated)),
+		bulkValue("replication.backlog"), integer(s.replBacklog),
+		bulkValue("clients.slaves"), integer(0),
+		bulkValue("clients.normal"), integer(s.clientsNormal),
+		bulkValue("aof.buffer"), integer(0),
+		bulkValue("lua.caches"), integer(s.luaCaches),
+		bulkValue("functions.caches"), integer(s.functionsCaches),
+		bulkValue("overhead.total"), integer(s.overheadTotal),
+	}
+
+	for _, db := range s.dbs {
+		result = append(result, bulkValue(fmt.Sprintf("db.%d", db.id)), Value{typ: ValueTypMap, array: []Value{
+			bulkValue("overhead.hashtable.main"), integer(db.main),
+			bulkValue("overhead.hashtable.expires"), integer(db.expires),
+		}})
+	}
+
+	bytesPerKey := 0
+	if s.keysCount > 0 {
+		bytesPerKey = (int(s.totalAllocated) - int(s.startupAllocated)) / s.keysCount
+	}
+
+	result = append(result,
+		bulkValue("keys.count"), integer(s.keysCount),
+		bulkValue("keys.bytes-per-key"), integer(bytesPerKey),
+		bulkValue("dataset.bytes"), integer(s.datasetBytes),
+		bulkValue("dataset.percentage"), percentage(float64(s.datasetBytes), float64(s.totalAllocated-s.startupAllocated)),
+		bulkValue("peak.percentage"), percentage(float64(s.totalAllocated), float64(s.peakAllocated)),
+		bulkValue("allocator.allocated"), integer(int(s.totalAllocated)),
+		bulkValue("allocator.active"), integer(int(s.heapInuse)),
+		bulkValue("allocator.resident"), integer(int(s.sys-s.heapReleased)),
+		bulkValue("fragmentation"), bulkValue(strconv.FormatFloat(s.fragmentation(), 'f', -1, 64)),
+		bulkValue("fragmentation.bytes"), integer(int(s.sys-s.heapReleased)-int(s.totalAllocated)),
+	)
+
+	return Value{typ: ValueTypMap, array: result}
+}
+
+// memoryDoctor returns a human readable analysis of the memory figures.
+func memoryDoctor(s memoryStats) string {
+	// Below this much memory the figures are dominated by the runtime itself
+	if s.totalAllocated < 5*1024*1024 {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I finished rebooting.\n"
+	}
+
+	issues := []string{}
+	if float64(s.peakAllocated) > float64(s.totalAllocated)*1.5 {
+		issues = append(issues, fmt.Sprintf(" * Peak memory: In the past this instance used more than 150%% the memory that is currently using. "+
+			"The Go runtime returns freed memory to the operating system gradually, so the resident size may stay close to the peak "+
+			"of %d bytes for a while.\n", s.peakAllocated))
+	}
+	if s.fragmentation() > 1.4 {
+		issues = append(issues, fmt.Sprintf(" * High fragmentation: This instance has a memory fragmentation greater than 1.4 (this means that "+
+			"the process holds %.2f times the memory it has allocated). This is usually caused by a peak in memory usage "+
+			"or by many short-lived allocations.\n", s.fragmentation()))
+	}
+	if s.clients > 0 && s.clientsNormal/s.clients > 200*1024 {
+		issues = append(issues, " * Big client buffers: The clients use on average more than 200KB of memory each. "+
+			"This may happen with clients that don't read their replies fast enough.\n")
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base.\n"
+	}
+	return "Sam, I detected a few issues in this Redis instance memory implants:\n\n" + strings.Join(issues, "\n") +
+		"\nI'm here to keep you safe, Sam. I want to help you.\n"
+}
@@ -0,0 +1,336 @@
+/*
+This file contains the MIGRATE command, which moves keys to another server. Every
+key is serialized in the format of DUMP and sent to the target with RESTORE, along
+with its time to live, and deleted locally once the target accepted it, unless
+COPY is given. Moving keys between the nodes of a cluster, one slot at a time,
+is done with the KEYS option, that sends many keys in one call.
+
+The connections to the targets are kept for a while, so moving many keys to the
+same server doesn't connect for every call. For a detailed description of the
+command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/migrate/
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// migrateConnIdleTime is how long an unused connection to a target is kept.
+	migrateConnIdleTime = 10 * time.Second
+
+	// migrateMaxConns bounds the connections kept, the oldest one is closed to
+	// make room for another.
+	migrateMaxConns = 64
+
+	// migrateDefaultTimeout is used when MIGRATE is given no timeout.
+	migrateDefaultTimeout = time.Second
+)
+
+// migrateConn is a connection to the target of MIGRATE, kept between calls.
+type migrateConn struct {
+	conn    net.Conn
+	resp    *Resp
+	db      int // Database selected on the target, -1 if none was
+	lastUse time.Time
+}
+
+// migrateConns maps the address of a target to the connection kept for it.
+var migrateConns = map[string]*migrateConn{}
+var migrateConnsMu = sync.Mutex{}
+
+// getMigrateConn returns the connection kept for addr, connecting if there's
+// none. It reports whether the connection was kept from an earlier call.
+func getMigrateConn(addr string, timeout time.Duration) (*migrateConn, bool, error) {
+	migrateConnsMu.Lock()
+	defer migrateConnsMu.Unlock()
+
+	closeIdleMigrateConns()
+	if mc, ok := migrateConns[addr]; ok {
+		mc.lastUse = time.Now()
+		return mc, true, nil
+	}
+
+	if len(migrateConns) >= migrateMaxConns {
+		oldest := ""
+		for a, mc := range migrateConns {
+			if oldest == "" || mc.lastUse.Before(migrateConns[oldest].lastUse) {
+				oldest = a
+			}
+		}
+		migrateConns[oldest].conn.Close()
+		delete(migrateConns, oldest)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	mc := &migrateConn{conn: conn, resp: NewResp(conn), db: -1, lastUse: time.Now()}
+	migrateConns[addr] = mc
+	return mc, false, nil
+}
+
+// closeMigrateConn closes the connection kept for addr, after an error left it
+// in an unknown state.
+func closeMigrateConn(addr string) {
+	migrateConnsMu.Lock()
+	defer migrateConnsMu.Unlock()
+
+	if mc, ok := migrateConns[addr]; ok {
+		mc.conn.Close()
+		delete(migrateConns, addr)
+	}
+}
+
+// closeIdleMigrateConns closes the connections unused for too long. The caller
+// must hold migrateConnsMu.
+func closeIdleMigrateConns() {
+	for addr, mc := range migrateConns {
+		if time.Since(mc.lastUse) > migrateConnIdleTime {
+			mc.conn.Close()
+			delete(migrateConns, addr)
+		}
+	}
+}
+
+// migrateKeys returns the key positions of MIGRATE, which are the key argument,
+// or the keys after KEYS when it's empty.
+func migrateKeys(argv []Value) []int {
+	if len(argv) > 3 && argv[3].bulk != "" {
+		return []int{3}
+	}
+
+	for i := 6; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i].bulk) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			positions := []int{}
+			for j := i + 1; j < len(argv); j++ {
+				positions = append(positions, j)
+			}
+			return positions
+		}
+	}
+	return nil
+}
+
+// migrateOptions holds the arguments of a MIGRATE call.
+type migrateOptions struct {
+	addr    string
+	db      int
+	timeout time.Duration
+	copy    bool
+	replace bool
+	auth    []string // Arguments of the AUTH sent first, if any
+	keys    []string
+}
+
+// parseMigrateOptions parses the arguments of MIGRATE.
+func parseMigrateOptions(args []Value) (migrateOptions, *Value) {
+	opts := migrateOptions{}
+
+	port, err := strconv.Atoi(args[1].bulk)
+	if err != nil || port <= 0 || port > 65535 {
+		return opts, &Value{typ: ValueTypSimpleError, str: "ERR Invalid port"}
+	}
+	opts.addr = net.JoinHostPort(args[0].bulk, strconv.Itoa(port))
+
+	db, err1 := strconv.Atoi(args[3].bulk)
+	timeout, err2 := strconv.ParseInt(args[4].bulk, 10, 64)
+	if err1 != nil || err2 != nil {
+		return opts, &Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	opts.db = db
+	opts.timeout = time.Duration(timeout) * time.Millisecond
+	if opts.timeout <= 0 {
+		opts.timeout = migrateDefaultTimeout
+	}
+
+	for i := 5; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i].bulk); {
+		case opt == "COPY":
+			opts.copy = true
+		case opt == "REPLACE":
+			opts.replace = true
+		case opt == "AUTH" && i+1 < len(args):
+			opts.auth = []string{args[i+1].bulk}
+			i++
+		case opt == "AUTH2" && i+2 < len(args):
+			opts.auth = []string{args[i+1].bulk, args[i+2].bulk}
+			i += 2
+		case opt == "KEYS":
+			if args[2].bulk != "" {
+				return opts, &Value{typ: ValueTypSimpleError, str: "ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"}
+			}
+			for _, arg := range args[i+1:] {
+				opts.keys = append(opts.keys, arg.bulk)
+			}
+			i = len(args)
+		default:
+			return opts, &Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+	if args[2].bulk != "" {
+		opts.keys = []string{args[2].bulk}
+	}
+	return opts, nil
+}
+
+// migrate handles the MIGRATE command.
+func migrate(c *Client, args []Value) Value {
+	opts, errValue := parseMigrateOptions(args)
+	if errValue != nil {
+		return *errValue
+	}
+
+	// Moving the keys deletes them, which a read-only replica can't do
+	if !opts.copy && replicaOf != nil && config.replicaReadOnly && c.user != nil {
+		return Value{typ: ValueTypSimpleError, str: "READONLY You can't write against a read only replica."}
+	}
+
+	// Serialize the keys that exist, with the time they have left to live
+	commands := []Value{}
+	keys := []string{}
+	for _, key := range opts.keys {
+		var payload []byte
+		if !viewObject(c.db, key, func(obj Object) { payload = serializeObject(obj) }) {
+			continue
+		}
+
+		ttl := int64(0)
+		if at, ok := keyExpireTime(c.db, key); ok {
+			ttl = max(time.Until(at).Milliseconds(), 1)
+		}
+
+		// The target of a slot being moved only serves it after ASKING
+		restoreCommand := "RESTORE"
+		if config.clusterEnabled {
+			restoreCommand = "RESTORE-ASKING"
+		}
+		argv := []string{restoreCommand, key, strconv.FormatInt(ttl, 10), string(payload)}
+		if opts.replace {
+			argv = append(argv, "REPLACE")
+		}
+		commands = append(commands, commandValue(argv...))
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return Value{typ: ValueTypSimpleString, str: "NOKEY"}
+	}
+
+	// A kept connection may have been closed by the target meanwhile, so a
+	// failure to use it is retried once on a new one
+	replies, err := migrateSend(opts, commands)
+	if errors.Is(err, errMigrateStaleConn) {
+		replies, err = migrateSend(opts, commands)
+	}
+	var target *migrateTargetError
+	if errors.As(err, &target) {
+		return Value{typ: ValueTypSimpleError, str: "ERR Target instance replied with error: " + target.msg}
+	}
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "IOERR error or timeout reading to target instance"}
+	}
+
+	// The keys the target took are deleted, the first error is reported
+	moved := []string{}
+	var replyErr string
+	for i, reply := range replies {
+		if reply.typ == ValueTypSimpleError {
+			if replyErr == "" {
+				replyErr = reply.str
+			}
+			continue
+		}
+		if !opts.copy {
+			deleteKey(c.db, keys[i])
+			signalModifiedKey(c.db, keys[i])
+			moved = append(moved, keys[i])
+		}
+	}
+	if len(moved) > 0 && replicaOf == nil {
+		c.woff = propagateDel(c.db, moved...)
+	}
+
+	if replyErr != "" {
+		return Value{typ: ValueTypSimpleError, str: "ERR Target instance replied with error: " + replyErr}
+	}
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// errMigrateStaleConn is returned when a kept connection failed before it got
+// any reply, so sending again on a new one is safe.
+var errMigrateStaleConn = errors.New("stale connection")
+
+// migrateTargetError is an error reply of the target to AUTH or SELECT.
+type migrateTargetError struct {
+	msg string
+}
+
+func (e *migrateTargetError) Error() string {
+	return e.msg
+}
+
+// migrateSend sends commands to the target of MIGRATE after selecting the
+// database, and returns the replies to them.
+func migrateSend(opts migrateOptions, commands []Value) ([]Value, error) {
+	mc, reused, err := getMigrateConn(opts.addr, opts.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticate and select the database in the same write as the commands
+	prefix := []Value{}
+	if len(opts.auth) > 0 {
+		prefix = append(prefix, commandValue(append([]string{"AUTH"}, opts.auth...)...))
+	}
+	if mc.db != opts.db {
+		prefix = append(prefix, commandValue("SELECT", strconv.Itoa(opts.db)))
+	}
+
+	p := []byte{}
+	for _, v := range append(prefix, commands...) {
+		p = v.MarshalTo(p)
+	}
+
+	mc.conn.SetDeadline(time.Now().Add(opts.timeout))
+	_, err = mc.conn.Write(p)
+
+	replies := []Value{}
+	for err == nil && len(replies) < len(prefix)+len(commands) {
+		var reply Value
+		reply, err = mc.resp.ReadReply()
+		if err == nil {
+			replies = append(replies, reply)
+		}
+	}
+	if err != nil {
+		closeMigrateConn(opts.addr)
+		if reused && len(replies) == 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errMigrateStaleConn
+		}
+		return nil, err
+	}
+
+	for _, reply := range replies[:len(prefix)] {
+		if reply.typ == ValueTypSimpleError {
+			closeMigrateConn(opts.addr)
+			return nil, &migrateTargetError{msg: reply.str}
+		}
+	}
+	mc.db = opts.db
+	return replies[len(prefix):], nil
+}
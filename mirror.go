@@ -0,0 +1,445 @@
+/*
+This file contains mirroring, which sends every write of this server on to a Redis
+server, so it keeps the same dataset: a hot standby outside this process, and a
+way back to Redis. mirror-target names the server, which stays a master and takes
+the writes as from any client, authenticated with mirror-user and
+mirror-password. The link first empties it and copies the dataset with RESTORE,
+in the DUMP format of Redis, then sends the write commands as they're replicated,
+the values of RESTORE converted to that format too. When the link breaks, or the
+target falls too far behind, the copy starts over. For a detailed description of
+the commands used, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/restore/
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mirrorRetryInterval is how long the link waits to connect again after an
+	// error.
+	mirrorRetryInterval = time.Second
+
+	// mirrorTimeout bounds connecting to the target and every write to it.
+	mirrorTimeout = 10 * time.Second
+
+	// mirrorMaxPending is how many bytes of commands may wait for the target
+	// before the link gives up and copies the dataset again.
+	mirrorMaxPending = 64 * 1024 * 1024
+)
+
+// mirrorLink is the link to the server the writes are mirrored to.
+type mirrorLink struct {
+	host string
+	port int
+
+	mu           sync.Mutex
+	conn         net.Conn
+	live         bool    // Whether writes are queued, which starts with the copy of the dataset
+	pending      []Value // Commands not sent yet
+	pendingBytes int
+	db           int // Database of the last command queued, -1 to select it again
+	wake         chan struct{}
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	errorReplies atomic.Int64 // Commands the target replied to with an error
+}
+
+// mirror is the link to the mirror target, nil if there's none. mirrorStarted
+// is set once the dataset is loaded, so the link can copy it, and is guarded
+// by execMu.
+var mirror atomic.Pointer[mirrorLink]
+var mirrorStarted bool
+
+// setMirrorTarget replaces the mirror target with the server in value, given as
+// host and port, or none if it's empty. The caller must hold execMu for writing.
+func setMirrorTarget(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 0 && len(fields) != 2 {
+		return errors.New("wrong number of arguments")
+	}
+
+	var l *mirrorLink
+	if len(fields) == 2 {
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port <= 0 || port > 65535 {
+			return errors.New("Invalid mirror port")
+		}
+		if cur := mirror.Load(); cur != nil && cur.host == fields[0] && cur.port == port {
+			return nil
+		}
+		l = &mirrorLink{host: fields[0], port: port, db: -1, wake: make(chan struct{}, 1), stopped: make(chan struct{})}
+	}
+
+	if old := mirror.Swap(l); old != nil {
+		old.stop()
+	}
+	if l != nil && mirrorStarted {
+		go l.run()
+	}
+	return nil
+}
+
+// mirrorTarget returns the mirror target as host and port, empty if there's
+// none.
+func mirrorTarget() string {
+	l := mirror.Load()
+	if l == nil {
+		return ""
+	}
+	return l.host + " " + strconv.Itoa(l.port)
+}
+
+// startMirror starts mirroring to the target set in the configuration, once
+// the dataset is loaded.
+func startMirror() {
+	execMu.Lock()
+	defer execMu.Unlock()
+
+	mirrorStarted = true
+	if l := mirror.Load(); l != nil {
+		go l.run()
+	}
+}
+
+// mirrorFeed queues a write command that ran against database db for the
+// mirror target, db being -1 for commands of the stream of a master, which
+// select their databases themselves. The caller must hold replMu.
+func mirrorFeed(db int, value Value) {
+	if l := mirror.Load(); l != nil {
+		l.feed(db, value)
+	}
+}
+
+// mirrorFeedRaw queues the commands encoded in p, as received from the master,
+// for the mirror target. The caller must hold replMu.
+func mirrorFeedRaw(p []byte) {
+	l := mirror.Load()
+	if l == nil {
+		return
+	}
+
+	resp := NewResp(bytes.NewReader(p))
+	for {
+		value, err := resp.Read()
+		if err != nil {
+			return
+		}
+		l.feed(-1, value)
+	}
+}
+
+// addr returns the address of the target.
+func (l *mirrorLink) addr() string {
+	return net.JoinHostPort(l.host, strconv.Itoa(l.port))
+}
+
+// stop closes the link for good.
+func (l *mirrorLink) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopped)
+		l.mu.Lock()
+		if l.conn != nil {
+			l.conn.Close()
+		}
+		l.mu.Unlock()
+	})
+}
+
+// isStopped reports whether the link was stopped.
+func (l *mirrorLink) isStopped() bool {
+	select {
+	case <-l.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// feed queues value, run against database db, to be sent to the target.
+func (l *mirrorLink) feed(db int, value Value) {
+	if value.typ != ValueTypArray || len(value.array) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.live {
+		return
+	}
+
+	switch strings.ToUpper(value.array[0].bulk) {
+	case "REPLCONF", "PING":
+		// Meant for replicas, not for a server taking writes
+		return
+	case "SELECT":
+		if len(value.array) == 2 {
+			if n, err := strconv.Atoi(value.array[1].bulk); err == nil {
+				db, l.db = -1, n
+			}
+		}
+	}
+
+	if db >= 0 && db != l.db {
+		l.queue(commandValue("SELECT", strconv.Itoa(db)))
+		l.db = db
+	}
+	l.queue(value)
+
+	// A target that can't keep up is copied to again once it can
+	if l.pendingBytes > mirrorMaxPending {
+		fmt.Printf("Mirror target %s is too far behind, copying the dataset again\n", l.addr())
+		l.live, l.pending, l.pendingBytes = false, nil, 0
+		if l.conn != nil {
+			l.conn.Close()
+		}
+		return
+	}
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queue appends value to the pending commands. The caller must hold l.mu.
+func (l *mirrorLink) queue(value Value) {
+	l.pending = append(l.pending, value)
+	for _, arg := range value.array {
+		l.pendingBytes += len(arg.bulk)
+	}
+}
+
+// run mirrors to the target until the link is stopped, copying the dataset
+// again whenever the connection is lost.
+func (l *mirrorLink) run() {
+	for !l.isStopped() {
+		err := l.mirror()
+		if l.isStopped() {
+			return
+		}
+		fmt.Printf("Error mirroring to %s: %s\n", l.addr(), err)
+
+		select {
+		case <-l.stopped:
+		case <-time.After(mirrorRetryInterval):
+		}
+	}
+}
+
+// mirror connects to the target, copies the dataset to it and then sends the
+// writes until the connection breaks.
+func (l *mirrorLink) mirror() error {
+	conn, err := net.DialTimeout("tcp", l.addr(), mirrorTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// A stop in the meantime must be able to close the connection
+	l.mu.Lock()
+	if l.isStopped() {
+		l.mu.Unlock()
+		return nil
+	}
+	l.conn = conn
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.conn, l.live, l.pending, l.pendingBytes = nil, false, nil, 0
+		l.mu.Unlock()
+	}()
+
+	resp := NewResp(conn)
+	conn.SetDeadline(time.Now().Add(mirrorTimeout))
+	execMu.RLock()
+	user, pass := config.mirrorUser, config.mirrorPassword
+	execMu.RUnlock()
+	if pass != "" {
+		args := []string{"AUTH", pass}
+		if user != "" {
+			args = []string{"AUTH", user, pass}
+		}
+		if err := mirrorCall(conn, resp, args...); err != nil {
+			return fmt.Errorf("unable to AUTH to the mirror target: %w", err)
+		}
+	}
+	if err := mirrorCall(conn, resp, "PING"); err != nil {
+		return fmt.Errorf("mirror target replied to PING: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The writes that follow the copy are queued from the moment it's taken
+	execMu.Lock()
+	snap := takeSnapshot()
+	l.mu.Lock()
+	l.live, l.pending, l.pendingBytes, l.db = true, nil, 0, -1
+	l.mu.Unlock()
+	execMu.Unlock()
+
+	// The replies are only read to notice errors
+	readErr := make(chan error, 1)
+	go func() {
+		logged := false
+		for {
+			reply, err := resp.ReadReply()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if reply.typ == ValueTypSimpleError {
+				l.errorReplies.Add(1)
+				if !logged {
+					fmt.Printf("Mirror target %s replied with an error: %s\n", l.addr(), reply.str)
+					logged = true
+				}
+			}
+		}
+	}()
+
+	fmt.Printf("Copying the dataset to mirror target %s\n", l.addr())
+	w := bufio.NewWriter(conn)
+	send := func(value Value) error {
+		conn.SetWriteDeadline(time.Now().Add(mirrorTimeout))
+		return writeValue(w, mirrorCommand(value), false)
+	}
+	if err := mirrorSnapshot(snap, send); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Mirror target %s is in sync\n", l.addr())
+
+	for {
+		select {
+		case <-l.stopped:
+			return nil
+		case err := <-readErr:
+			return err
+		case <-l.wake:
+		}
+
+		l.mu.Lock()
+		pending, live := l.pending, l.live
+		l.pending, l.pendingBytes = nil, 0
+		l.mu.Unlock()
+		if !live {
+			return errors.New("link reset")
+		}
+
+		for _, value := range pending {
+			if err := send(value); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// mirrorSnapshot sends the commands that make the target hold the dataset of
+// snap, and nothing else, to send.
+func mirrorSnapshot(snap *rdbSnapshot, send func(Value) error) error {
+	if err := send(commandValue("FLUSHALL")); err != nil {
+		return err
+	}
+	for _, code := range snap.functions {
+		if err := send(commandValue("FUNCTION", "LOAD", "REPLACE", code)); err != nil {
+			return err
+		}
+	}
+
+	for id, entries := range snap.dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		if err := send(commandValue("SELECT", strconv.Itoa(id))); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			args := []string{"RESTORE", e.key, "0", string(redisDumpPayload(e.obj)), "REPLACE"}
+			if !e.expire.IsZero() {
+				args[2] = strconv.FormatInt(e.expire.UnixMilli(), 10)
+				args = append(args, "ABSTTL")
+			}
+			if err := send(commandValue(args...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mirrorCommand returns value as the target takes it. The values given to
+// RESTORE are in the DUMP format of this server, which is converted to the one
+// of Redis, and the RESTORE-ASKING of MIGRATE becomes a plain RESTORE.
+func mirrorCommand(value Value) Value {
+	name := strings.ToUpper(value.array[0].bulk)
+	if name != "RESTORE" && name != "RESTORE-ASKING" || len(value.array) < 4 {
+		return value
+	}
+
+	obj, err := deserializeObject([]byte(value.array[3].bulk))
+	if err != nil {
+		return value
+	}
+	translated := append([]Value{bulkValue("RESTORE")}, value.array[1:]...)
+	translated[3] = bulkValue(string(redisDumpPayload(obj)))
+	return Value{typ: ValueTypArray, array: translated}
+}
+
+// mirrorCall sends a command to the target during the handshake and returns
+// the error it replied with, if any.
+func mirrorCall(conn net.Conn, resp *Resp, args ...string) error {
+	if _, err := conn.Write(commandValue(args...).Marshal()); err != nil {
+		return err
+	}
+	reply, err := resp.ReadReply()
+	if err != nil {
+		return err
+	}
+	if reply.typ == ValueTypSimpleError {
+		return errors.New(reply.str)
+	}
+	return nil
+}
+
+// mirrorInfo returns the lines of the replication section of INFO about the
+// mirror target.
+func mirrorInfo() []string {
+	l := mirror.Load()
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	status, pending := "down", l.pendingBytes
+	if l.live {
+		status = "up"
+	}
+	l.mu.Unlock()
+
+	return []string{
+		"mirror_host:" + l.host,
+		"mirror_port:" + strconv.Itoa(l.port),
+		"mirror_link_status:" + status,
+		"mirror_pending_bytes:" + strconv.Itoa(pending),
+		"mirror_error_replies:" + strconv.FormatInt(l.errorReplies.Load(), 10),
+	}
+}
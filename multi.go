@@ -0,0 +1,125 @@
+/*
+This file contains transactions. MULTI switches a connection into queuing mode,
+where commands are checked and queued instead of executed, and EXEC runs the
+queued commands one after the other without any command from another client
+running in between. Every command holds the read side of a lock while it runs
+and EXEC holds the write side for the whole batch, which is what makes it atomic.
+For a detailed description of transactions, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/interact/transactions/
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// execMu is held for reading by every command and for writing by EXEC and the
+// other exclusive commands.
+var execMu = sync.RWMutex{}
+
+// noBlocking is set while commands run that must not wait for data, such as the
+// commands of a transaction, which hold execMu exclusively.
+var noBlocking atomic.Bool
+
+// Transaction holds the MULTI state of a connection.
+type Transaction struct {
+	active bool
+	dirty  bool // A command failed to queue, so EXEC must abort
+	queue  []queuedCommand
+
+	watched  []watchedKey
+	casDirty atomic.Bool // A watched key was modified, so EXEC must fail
+}
+
+// queuedCommand is a command waiting for EXEC.
+type queuedCommand struct {
+	cmd   *Command
+	value Value
+}
+
+// fail marks the transaction as aborted if one is being queued.
+func (tx *Transaction) fail() {
+	if tx.active {
+		tx.dirty = true
+	}
+}
+
+// reset discards the queued commands, leaves queuing mode and unwatches all keys.
+func (tx *Transaction) reset() {
+	tx.active = false
+	tx.dirty = false
+	tx.queue = nil
+	tx.unwatch()
+}
+
+// multi handles the MULTI command.
+func (tx *Transaction) multi() Value {
+	if tx.active {
+		return Value{typ: ValueTypSimpleError, str: "ERR MULTI calls can not be nested"}
+	}
+
+	tx.active = true
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// discard handles the DISCARD command.
+func (tx *Transaction) discard() Value {
+	if !tx.active {
+		return Value{typ: ValueTypSimpleError, str: "ERR DISCARD without MULTI"}
+	}
+
+	tx.reset()
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// enqueue adds a command to the transaction.
+func (tx *Transaction) enqueue(cmd *Command, value Value) Value {
+	tx.queue = append(tx.queue, queuedCommand{cmd: cmd, value: value})
+	return Value{typ: ValueTypSimpleString, str: "QUEUED"}
+}
+
+// exec handles the EXEC command, running every queued command atomically. The
+// caller must hold execMu exclusively.
+func (tx *Transaction) exec(c *Client) Value {
+	if !tx.active {
+		return Value{typ: ValueTypSimpleError, str: "ERR EXEC without MULTI"}
+	}
+	defer tx.reset()
+
+	if tx.dirty {
+		return Value{typ: ValueTypSimpleError, str: "EXECABORT Transaction discarded because of previous errors."}
+	}
+
+	// Checked under the lock so no write can slip in before the commands run
+	if tx.casDirty.Load() {
+		return Value{typ: ValueTypNullArray}
+	}
+
+	noBlocking.Store(true)
+	defer noBlocking.Store(false)
+
+	results := make([]Value, 0, len(tx.queue))
+	for _, queued := range tx.queue {
+		results = append(results, execute(c, queued.cmd, queued.value))
+	}
+
+	return Value{typ: ValueTypArray, array: results}
+}
+
+// multiCommand handles the MULTI command.
+func multiCommand(c *Client, args []Value) Value {
+	return c.tx.multi()
+}
+
+// execCommand handles the EXEC command.
+func execCommand(c *Client, args []Value) Value {
+	return c.tx.exec(c)
+}
+
+// discardCommand handles the DISCARD command.
+func discardCommand(c *Client, args []Value) Value {
+	return c.tx.discard()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMulti(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"exec", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "1"}, "+QUEUED\r\n"},
+			{0, []string{"GET", "a"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*2\r\n+OK\r\n$1\r\n1\r\n"},
+			{0, []string{"GET", "a"}, "$1\r\n1\r\n"},
+		}},
+		{"empty", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"EXEC"}, "*0\r\n"},
+		}},
+		{"discard", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "1"}, "+QUEUED\r\n"},
+			{0, []string{"DISCARD"}, "+OK\r\n"},
+			{0, []string{"GET", "a"}, "$-1\r\n"},
+			{0, []string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		}},
+		{"without multi", []step{
+			{0, []string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+			{0, []string{"DISCARD"}, "-ERR DISCARD without MULTI\r\n"},
+		}},
+		{"nested", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "-ERR MULTI calls can not be nested\r\n"},
+			{0, []string{"SET", "a", "1"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+OK\r\n"},
+		}},
+		{"wrong arity aborts", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "1"}, "+QUEUED\r\n"},
+			{0, []string{"SET", "b"}, "-ERR wrong number of arguments for 'set' command\r\n"},
+			{0, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+			{0, []string{"GET", "a"}, "$-1\r\n"},
+		}},
+		{"unknown command aborts", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"NOSUCHCOMMAND"}, "-ERR unknown command\r\n"},
+			{0, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		}},
+		{"runtime error runs the rest", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "x"}, "+QUEUED\r\n"},
+			{0, []string{"LPUSH", "a", "y"}, "+QUEUED\r\n"},
+			{0, []string{"GET", "a"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*3\r\n+OK\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n$1\r\nx\r\n"},
+		}},
+		{"isolated from other clients", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"RPUSH", "l", "a"}, "+QUEUED\r\n"},
+			{1, []string{"LLEN", "l"}, ":0\r\n"},
+			{1, []string{"RPUSH", "l", "b"}, ":1\r\n"},
+			{0, []string{"LRANGE", "l", "0", "-1"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*2\r\n:2\r\n*2\r\n$1\r\nb\r\n$1\r\na\r\n"},
+		}},
+		{"select inside", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SELECT", "1"}, "+QUEUED\r\n"},
+			{0, []string{"SET", "a", "1"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*2\r\n+OK\r\n+OK\r\n"},
+			{0, []string{"GET", "a"}, "$1\r\n1\r\n"},
+			{1, []string{"GET", "a"}, "$-1\r\n"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runAll(t, tt.steps, newTestClient(t), connectTestClient(t))
+		})
+	}
+}
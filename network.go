@@ -0,0 +1,140 @@
+/*
+This file contains the listeners the server accepts connections on. The bind
+parameter lists the addresses of the interfaces to listen on, where * stands for
+every IPv4 interface, ::* for every IPv6 interface and a leading - marks an
+address that may be unavailable. Without a bind address the server listens on
+every interface, and protected mode keeps it from being open to the network by
+accident: while the default user has no password, only clients connecting over
+the loopback interface are served. Connections idle for longer than the timeout
+parameter are closed, and TCP keepalive probes notice the peers that went away
+without closing theirs. For a detailed description of the security model, refer
+to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/security/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// protectedModeError is the error a client gets when protected mode refuses it.
+const protectedModeError = "DENIED Redis is running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+	"1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback interface by connecting to Redis from the same host the server is running, " +
+	"however MAKE SURE Redis is not publicly accessible from internet if you do so. Use CONFIG REWRITE to make this change permanent. " +
+	"2) Alternatively you can just disable the protected mode by editing the Redis configuration file, and setting the protected mode option to 'no', and then restarting the server. " +
+	"3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. " +
+	"4) Set up an authentication password for the default user. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside."
+
+// serverListeners accept the connections of the clients, one per bind address.
+var serverListeners []net.Listener
+
+// listen opens a listener on every bind address.
+func listen() ([]net.Listener, error) {
+	addresses := strings.Fields(config.bind)
+	if len(addresses) == 0 {
+		addresses = []string{""}
+	}
+
+	listeners := []net.Listener{}
+	for _, address := range addresses {
+		optional := strings.HasPrefix(address, "-")
+		host := strings.TrimPrefix(address, "-")
+		switch host {
+		case "*":
+			host = "0.0.0.0"
+		case "::*":
+			host = "::"
+		}
+
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(config.port)))
+		if err != nil {
+			if optional {
+				fmt.Printf("Skipping unavailable bind address %s: %s\n", host, err)
+				continue
+			}
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		fmt.Println("Listening on", l.Addr())
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no bind address is available")
+	}
+	return listeners, nil
+}
+
+// acceptConnections serves every connection l accepts, each in its own goroutine.
+func acceptConnections(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// The listeners are closed on shutdown, which exits the process
+			if shuttingDown.Load() {
+				select {}
+			}
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+
+		go handleConnection(conn)
+	}
+}
+
+// setTCPOptions sends the replies on conn without delay, and probes its peer
+// every tcp-keepalive seconds when it's idle, so a connection to a client that
+// vanished is noticed. The caller must hold execMu.
+func setTCPOptions(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	tcpConn.SetNoDelay(true)
+	if config.tcpKeepalive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(time.Duration(config.tcpKeepalive) * time.Second)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+}
+
+// protectedModeRefuses reports whether protected mode refuses a client
+// connecting from addr. The caller must hold execMu.
+func protectedModeRefuses(addr net.Addr) bool {
+	if !config.protectedMode || config.bind != "" || !defaultUser().nopass {
+		return false
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && !tcpAddr.IP.IsLoopback()
+}
+
+// protectedCommandAllowed reports whether c may run commands flagged protected,
+// which enable-debug-command allows for every connection, for local ones or
+// for none.
+func protectedCommandAllowed(c *Client) bool {
+	switch config.enableDebugCmd {
+	case "yes":
+		return true
+	case "local":
+		tcpAddr, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+		return ok && tcpAddr.IP.IsLoopback()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,106 @@
+/*
+This file contains the OBJECT command, which lets operators inspect how a key is
+stored internally. The encoding names follow the ones Redis reports, so tooling
+written against Redis keeps working. For a detailed description of the command,
+refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/object-encoding/
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// embstrMaxLen is the longest string Redis stores with the embstr encoding.
+const embstrMaxLen = 44
+
+// object handles the OBJECT command.
+func object(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'object' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "ENCODING", "REFCOUNT", "IDLETIME", "FREQ":
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", args[0].bulk)}
+	}
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'object|" + strings.ToLower(sub) + "' command"}
+	}
+
+	key := args[1].bulk
+
+	typ := lookupKeyType(c.db, key)
+	if typ == KeyTypNone {
+		return Value{typ: ValueTypNull}
+	}
+
+	switch sub {
+	case "ENCODING":
+		return Value{typ: ValueTypBulkString, bulk: objectEncoding(c.db, key, typ)}
+	case "REFCOUNT":
+		// Only small integers are shared between keys
+		if typ == KeyTypString {
+			value := ""
+			viewObject(c.db, key, func(obj Object) { value = obj.str })
+			if _, ok := sharedInteger(value); ok {
+				return Value{typ: ValueTypInteger, num: sharedRefcount}
+			}
+		}
+		return Value{typ: ValueTypInteger, num: 1}
+	case "IDLETIME":
+		if lfuPolicy() {
+			return Value{typ: ValueTypSimpleError, str: "ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."}
+		}
+		return Value{typ: ValueTypInteger, num: int(keyIdleTime(c.db, key).Seconds())}
+	default:
+		if lfuPolicy() {
+			return Value{typ: ValueTypInteger, num: int(keyFreq(c.db, key))}
+		}
+		return Value{typ: ValueTypSimpleError, str: "ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."}
+	}
+}
+
+// objectEncoding returns the encoding name of the value stored at key.
+func objectEncoding(db *DB, key, typ string) string {
+	switch typ {
+	case KeyTypString:
+		value := ""
+		viewObject(db, key, func(obj Object) { value = obj.str })
+		return stringEncoding(value)
+	case KeyTypHash:
+		encoding := ""
+		viewObject(db, key, func(obj Object) { encoding = obj.hash.encoding() })
+		return encoding
+	case KeyTypList:
+		encoding := ""
+		viewObject(db, key, func(obj Object) { encoding = obj.list.encoding() })
+		return encoding
+	case KeyTypSet:
+		encoding := ""
+		viewObject(db, key, func(obj Object) { encoding = obj.set.encoding() })
+		return encoding
+	case KeyTypZSet:
+		return "skiplist"
+	default:
+		return "stream"
+	}
+}
+
+// stringEncoding returns the encoding Redis would pick for a string value.
+func stringEncoding(value string) string {
+	// Only canonical integers, without leading zeros or a plus sign, are stored as int
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(n, 10) == value {
+		return "int"
+	}
+	if len(value) <= embstrMaxLen {
+		return "embstr"
+	}
+	return "raw"
+}
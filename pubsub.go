@@ -0,0 +1,420 @@
+/*
+This file contains the publish/subscribe broker. Clients subscribe to channels, or
+to glob-style patterns matching channel names, and receive every message published
+to them afterwards. Shard channels, added in Redis 7 for clusters, are a separate
+namespace with their own commands; this server is a single shard so they behave
+like plain channels. Messages aren't stored, a message published to a channel nobody
+is subscribed to is simply dropped. Messages are queued for subscribers rather
+than written while the subscriptions are locked, and a subscriber that doesn't read
+them is disconnected once they go over client-output-buffer-limit pubsub. While a
+connection has subscriptions it's in subscribe mode, where only the commands that
+manage subscriptions are allowed. For a detailed description of pub/sub, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/develop/interact/pubsub/
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Subscriber holds the subscriptions of a connection.
+type Subscriber struct {
+	client   *Client
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	shard    map[string]struct{}
+}
+
+// pubsubChannels maps a channel to its subscribers, pubsubPatterns maps a
+// pattern to the subscribers of channels matching it, and pubsubShardChannels
+// maps a shard channel to its subscribers.
+var pubsubChannels = map[string]map[*Subscriber]struct{}{}
+var pubsubPatterns = map[string]map[*Subscriber]struct{}{}
+var pubsubShardChannels = map[string]map[*Subscriber]struct{}{}
+var pubsubMu = sync.RWMutex{}
+
+// subscriptionType describes one kind of subscription.
+type subscriptionType struct {
+	subscribe   string // Kind of the subscribe confirmations
+	unsubscribe string // Kind of the unsubscribe confirmations
+	registry    map[string]map[*Subscriber]struct{}
+	own         func(s *Subscriber) map[string]struct{}
+	count       func(s *Subscriber) int // Count reported in confirmations
+}
+
+var channelSubscriptions = subscriptionType{
+	subscribe:   "subscribe",
+	unsubscribe: "unsubscribe",
+	registry:    pubsubChannels,
+	own:         func(s *Subscriber) map[string]struct{} { return s.channels },
+	count:       func(s *Subscriber) int { return len(s.channels) + len(s.patterns) },
+}
+
+var patternSubscriptions = subscriptionType{
+	subscribe:   "psubscribe",
+	unsubscribe: "punsubscribe",
+	registry:    pubsubPatterns,
+	own:         func(s *Subscriber) map[string]struct{} { return s.patterns },
+	count:       func(s *Subscriber) int { return len(s.channels) + len(s.patterns) },
+}
+
+// Shard channels are counted on their own
+var shardSubscriptions = subscriptionType{
+	subscribe:   "ssubscribe",
+	unsubscribe: "sunsubscribe",
+	registry:    pubsubShardChannels,
+	own:         func(s *Subscriber) map[string]struct{} { return s.shard },
+	count:       func(s *Subscriber) int { return len(s.shard) },
+}
+
+// newSubscriber creates a subscriber that delivers messages to client.
+func newSubscriber(client *Client) *Subscriber {
+	return &Subscriber{
+		client:   client,
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+		shard:    map[string]struct{}{},
+	}
+}
+
+// count returns the number of subscriptions.
+func (s *Subscriber) count() int {
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	return len(s.channels) + len(s.patterns) + len(s.shard)
+}
+
+// subscribeModeAllowed reports whether command can run while the connection is
+// in subscribe mode.
+func subscribeModeAllowed(command string) bool {
+	switch command {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE",
+		"PING", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+// subscribeModeError is the error for a command that isn't allowed in subscribe mode.
+func subscribeModeError(name string) Value {
+	return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(name))}
+}
+
+// subscribedPing handles PING in subscribe mode, where the reply has to be
+// distinguishable from a message.
+func subscribedPing(args []Value) Value {
+	msg := ""
+	if len(args) > 0 {
+		msg = args[0].bulk
+	}
+	return Value{typ: ValueTypArray, array: []Value{bulkValue("pong"), bulkValue(msg)}}
+}
+
+// subscriptionReply builds a subscribe or unsubscribe confirmation.
+func subscriptionReply(kind string, channel *string, count int) Value {
+	ch := Value{typ: ValueTypNull}
+	if channel != nil {
+		ch = bulkValue(*channel)
+	}
+
+	return Value{typ: ValueTypPush, array: []Value{
+		bulkValue(kind),
+		ch,
+		{typ: ValueTypInteger, num: count},
+	}}
+}
+
+// addSubscription adds a subscription of type t to the subscriber and the
+// registry. The caller must hold pubsubMu.
+func (s *Subscriber) addSubscription(t subscriptionType, name string) {
+	own := t.own(s)
+	if _, ok := own[name]; ok {
+		return
+	}
+
+	own[name] = struct{}{}
+	if _, ok := t.registry[name]; !ok {
+		t.registry[name] = map[*Subscriber]struct{}{}
+	}
+	t.registry[name][s] = struct{}{}
+}
+
+// removeSubscription removes a subscription of type t from the subscriber and
+// the registry. The caller must hold pubsubMu.
+func (s *Subscriber) removeSubscription(t subscriptionType, name string) {
+	delete(t.own(s), name)
+	delete(t.registry[name], s)
+	if len(t.registry[name]) == 0 {
+		delete(t.registry, name)
+	}
+}
+
+// subscribeTo subscribes to each of args, writing a confirmation per subscription.
+func (s *Subscriber) subscribeTo(t subscriptionType, args []Value) {
+	for _, arg := range args {
+		name := arg.bulk
+
+		pubsubMu.Lock()
+		s.addSubscription(t, name)
+		count := t.count(s)
+		pubsubMu.Unlock()
+
+		s.client.writer.Write(subscriptionReply(t.subscribe, &name, count))
+	}
+}
+
+// unsubscribeFrom unsubscribes from each of args, or from every subscription of
+// type t when there are no arguments, writing a confirmation per subscription.
+func (s *Subscriber) unsubscribeFrom(t subscriptionType, args []Value) {
+	names := []string{}
+	for _, arg := range args {
+		names = append(names, arg.bulk)
+	}
+
+	if len(args) == 0 {
+		pubsubMu.RLock()
+		for name := range t.own(s) {
+			names = append(names, name)
+		}
+		count := t.count(s)
+		pubsubMu.RUnlock()
+
+		if len(names) == 0 {
+			s.client.writer.Write(subscriptionReply(t.unsubscribe, nil, count))
+			return
+		}
+	}
+
+	for _, name := range names {
+		pubsubMu.Lock()
+		s.removeSubscription(t, name)
+		count := t.count(s)
+		pubsubMu.Unlock()
+
+		s.client.writer.Write(subscriptionReply(t.unsubscribe, &name, count))
+	}
+}
+
+// subscribe handles the SUBSCRIBE command, writing a confirmation per channel.
+func (s *Subscriber) subscribe(args []Value) {
+	s.subscribeTo(channelSubscriptions, args)
+}
+
+// unsubscribe handles the UNSUBSCRIBE command. Without arguments it
+// unsubscribes from every channel.
+func (s *Subscriber) unsubscribe(args []Value) {
+	s.unsubscribeFrom(channelSubscriptions, args)
+}
+
+// psubscribe handles the PSUBSCRIBE command, writing a confirmation per pattern.
+func (s *Subscriber) psubscribe(args []Value) {
+	s.subscribeTo(patternSubscriptions, args)
+}
+
+// punsubscribe handles the PUNSUBSCRIBE command. Without arguments it
+// unsubscribes from every pattern.
+func (s *Subscriber) punsubscribe(args []Value) {
+	s.unsubscribeFrom(patternSubscriptions, args)
+}
+
+// ssubscribe handles the SSUBSCRIBE command, writing a confirmation per shard channel.
+func (s *Subscriber) ssubscribe(args []Value) {
+	s.subscribeTo(shardSubscriptions, args)
+}
+
+// sunsubscribe handles the SUNSUBSCRIBE command. Without arguments it
+// unsubscribes from every shard channel.
+func (s *Subscriber) sunsubscribe(args []Value) {
+	s.unsubscribeFrom(shardSubscriptions, args)
+}
+
+// unsubscribeAll removes every subscription without writing confirmations,
+// which is used when the connection closes or is reset.
+func (s *Subscriber) unsubscribeAll() {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	for _, t := range []subscriptionType{channelSubscriptions, patternSubscriptions, shardSubscriptions} {
+		for name := range t.own(s) {
+			s.removeSubscription(t, name)
+		}
+	}
+}
+
+// publish handles the PUBLISH command.
+func publish(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'publish' command"}
+	}
+
+	channel := args[0].bulk
+	message := args[1].bulk
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	receivers := 0
+
+	msg := Value{typ: ValueTypPush, array: []Value{
+		bulkValue("message"),
+		bulkValue(channel),
+		bulkValue(message),
+	}}
+	for s := range pubsubChannels[channel] {
+		s.client.push(msg, "pubsub")
+		receivers++
+	}
+
+	// A client subscribed through several matching patterns gets one message each
+	for pattern, subscribers := range pubsubPatterns {
+		if !stringMatch(pattern, channel) {
+			continue
+		}
+
+		pmsg := Value{typ: ValueTypPush, array: []Value{
+			bulkValue("pmessage"),
+			bulkValue(pattern),
+			bulkValue(channel),
+			bulkValue(message),
+		}}
+		for s := range subscribers {
+			s.client.push(pmsg, "pubsub")
+			receivers++
+		}
+	}
+
+	return Value{typ: ValueTypInteger, num: receivers}
+}
+
+// spublish handles the SPUBLISH command. Only shard channel subscribers
+// receive the message, patterns don't apply to shard channels.
+func spublish(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'spublish' command"}
+	}
+
+	channel := args[0].bulk
+	message := args[1].bulk
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	msg := Value{typ: ValueTypPush, array: []Value{
+		bulkValue("smessage"),
+		bulkValue(channel),
+		bulkValue(message),
+	}}
+
+	receivers := 0
+	for s := range pubsubShardChannels[channel] {
+		s.client.push(msg, "pubsub")
+		receivers++
+	}
+
+	return Value{typ: ValueTypInteger, num: receivers}
+}
+
+// pubsubCommand handles the PUBSUB command.
+func pubsubCommand(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'pubsub' command"}
+	}
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch {
+	case (sub == "CHANNELS" || sub == "SHARDCHANNELS") && len(args) <= 2:
+		registry := pubsubChannels
+		if sub == "SHARDCHANNELS" {
+			registry = pubsubShardChannels
+		}
+
+		pattern := "*"
+		if len(args) == 2 {
+			pattern = args[1].bulk
+		}
+
+		names := []string{}
+		for name := range registry {
+			if stringMatch(pattern, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		values := make([]Value, 0, len(names))
+		for _, name := range names {
+			values = append(values, bulkValue(name))
+		}
+		return Value{typ: ValueTypArray, array: values}
+
+	case sub == "NUMSUB" || sub == "SHARDNUMSUB":
+		registry := pubsubChannels
+		if sub == "SHARDNUMSUB" {
+			registry = pubsubShardChannels
+		}
+
+		values := make([]Value, 0, (len(args)-1)*2)
+		for _, arg := range args[1:] {
+			values = append(values, bulkValue(arg.bulk), Value{typ: ValueTypInteger, num: len(registry[arg.bulk])})
+		}
+		return Value{typ: ValueTypMap, array: values}
+
+	case sub == "NUMPAT" && len(args) == 1:
+		return Value{typ: ValueTypInteger, num: len(pubsubPatterns)}
+
+	case sub == "CHANNELS" || sub == "SHARDCHANNELS" || sub == "NUMPAT":
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'pubsub|" + strings.ToLower(sub) + "' command"}
+
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0].bulk)}
+	}
+}
+
+// The subscription commands write their confirmations directly to the
+// connection, one per channel, so there's nothing left to reply afterwards.
+
+// subscribeCommand handles the SUBSCRIBE command.
+func subscribeCommand(c *Client, args []Value) Value {
+	c.sub.subscribe(args)
+	return Value{typ: ValueTypNoReply}
+}
+
+// unsubscribeCommand handles the UNSUBSCRIBE command.
+func unsubscribeCommand(c *Client, args []Value) Value {
+	c.sub.unsubscribe(args)
+	return Value{typ: ValueTypNoReply}
+}
+
+// psubscribeCommand handles the PSUBSCRIBE command.
+func psubscribeCommand(c *Client, args []Value) Value {
+	c.sub.psubscribe(args)
+	return Value{typ: ValueTypNoReply}
+}
+
+// punsubscribeCommand handles the PUNSUBSCRIBE command.
+func punsubscribeCommand(c *Client, args []Value) Value {
+	c.sub.punsubscribe(args)
+	return Value{typ: ValueTypNoReply}
+}
+
+// ssubscribeCommand handles the SSUBSCRIBE command.
+func ssubscribeCommand(c *Client, args []Value) Value {
+	c.sub.ssubscribe(args)
+	return Value{typ: ValueTypNoReply}
+}
+
+// sunsubscribeCommand handles the SUNSUBSCRIBE command.
+func sunsubscribeCommand(c *Client, args []Value) Value {
+	c.sub.sunsubscribe(args)
+	return Value{typ: ValueTypNoReply}
+}
@@ -0,0 +1,540 @@
+/*
+This file contains snapshot persistence. A snapshot is a file holding every key of
+every database and the function libraries at a point in time, written by SAVE
+while no command runs or by BGSAVE in the background. BGSAVE first takes a copy
+of the databases, which is cheap since strings are shared and only mutable values
+are copied, and then encodes and writes the copy while clients keep changing the
+originals. Snapshots are in the RDB format of Redis, so they can be exchanged with
+it. The file is written under a temporary name and renamed when complete, so a
+crash never leaves a half written snapshot behind. For a detailed description of
+snapshots, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/persistence/
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rdbEntry is a key in a snapshot.
+type rdbEntry struct {
+	key    string
+	obj    Object
+	expire time.Time // Zero if the key doesn't expire
+}
+
+// rdbSnapshot is a point-in-time copy of every database.
+type rdbSnapshot struct {
+	dbs       [][]rdbEntry // Entries of each database, by number
+	functions []string     // Code of the function libraries
+	aofBase   bool         // Whether it's written as the preamble of an AOF
+}
+
+// bgsaveRetryDelay is how long the save points wait after a failed background
+// save before trying again.
+const bgsaveRetryDelay = 5 * time.Second
+
+// dirty counts the changes to the dataset since the last successful snapshot.
+var dirty atomic.Int64
+
+// rdbState tracks the snapshots written so far. It's guarded by rdbMu, which
+// is held for reading by INFO while a background save updates it.
+var rdbState struct {
+	bgsaveInProgress bool
+	bgsaveStart      time.Time
+	lastBgsaveTry    time.Time
+	lastBgsaveOK     bool
+	lastBgsaveTime   time.Duration // -1 before the first background save
+	lastSave         time.Time     // Time of the last successful snapshot
+	saves            int
+}
+var rdbMu = sync.RWMutex{}
+
+func init() {
+	rdbState.lastBgsaveOK = true
+	rdbState.lastBgsaveTime = -1
+	rdbState.lastSave = time.Now()
+}
+
+// takeSnapshot copies every database. Strings can be shared since they never
+// change, but hashes, sorted sets and streams are modified in place, so they
+// are copied. The caller must hold execMu for writing.
+func takeSnapshot() *rdbSnapshot {
+	start := time.Now()
+	defer func() { latencyAddSampleIfNeeded("fork", time.Since(start)) }()
+
+	snap := &rdbSnapshot{dbs: make([][]rdbEntry, len(databases))}
+
+	functionsMu.RLock()
+	for _, lib := range sortedLibraries() {
+		snap.functions = append(snap.functions, lib.code)
+	}
+	functionsMu.RUnlock()
+
+	for i, db := range databases {
+		entries := []rdbEntry{}
+		for j := range db.shards {
+			s := &db.shards[j]
+			s.mu.RLock()
+			for key, e := range s.keys {
+				obj := e.Object
+				switch obj.typ {
+				case KeyTypHash:
+					obj.hash = obj.hash.Clone()
+				case KeyTypList:
+					obj.list = obj.list.Clone()
+				case KeyTypSet:
+					obj.set = obj.set.Clone()
+				case KeyTypZSet, KeyTypStream:
+					obj = copyObject(obj)
+				}
+				entries = append(entries, rdbEntry{key: key, obj: obj, expire: e.expireAt})
+			}
+			s.mu.RUnlock()
+		}
+
+		snap.dbs[i] = entries
+	}
+
+	return snap
+}
+
+// copyObject returns a deep copy of obj, made by serializing it.
+func copyObject(obj Object) Object {
+	copied, err := deserializeObject(serializeObject(obj))
+	if err != nil {
+		panic("copying " + obj.typ + ": " + err.Error())
+	}
+	return copied
+}
+
+// write encodes the snapshot to w in the RDB format.
+func (snap *rdbSnapshot) write(w io.Writer) error {
+	enc := &rdbWriter{w: w}
+	enc.buf = append(enc.buf, fmt.Sprintf("REDIS%04d", rdbVersion)...)
+	enc.writeAux("redis-ver", redisVersion)
+	enc.writeAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	enc.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	enc.writeAux("aof-base", strconv.Itoa(boolToInt(snap.aofBase)))
+
+	for _, code := range snap.functions {
+		enc.writeByte(rdbOpFunction)
+		enc.writeString(code)
+	}
+
+	for id, entries := range snap.dbs {
+		if len(entries) == 0 {
+			continue
+		}
+
+		expires := 0
+		for _, e := range entries {
+			if !e.expire.IsZero() {
+				expires++
+			}
+		}
+		enc.writeByte(rdbOpSelectDB)
+		enc.writeLen(uint64(id))
+		enc.writeByte(rdbOpResizeDB)
+		enc.writeLen(uint64(len(entries)))
+		enc.writeLen(uint64(expires))
+
+		for _, e := range entries {
+			if !e.expire.IsZero() {
+				enc.writeByte(rdbOpExpireMs)
+				enc.buf = binary.LittleEndian.AppendUint64(enc.buf, uint64(e.expire.UnixMilli()))
+			}
+			enc.writeKey(e.key, e.obj)
+			enc.flushIfNeeded()
+		}
+	}
+
+	enc.writeByte(rdbOpEOF)
+	if err := enc.flush(); err != nil {
+		return err
+	}
+
+	// The checksum covers everything before it
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, enc.crc))
+	return err
+}
+
+// saveSnapshot writes snap to path, through a temporary file that replaces
+// path once it's complete and synced to disk.
+func saveSnapshot(snap *rdbSnapshot, path string) error {
+	f, err := os.CreateTemp(".", fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	w := bufio.NewWriter(f)
+	if err := snap.write(w); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// rdbSave writes a snapshot of every database to the dump file. The caller must
+// hold execMu for writing.
+func rdbSave() error {
+	dirtyBefore := dirty.Load()
+	if err := saveSnapshot(takeSnapshot(), config.dbfilename); err != nil {
+		fmt.Println("Error saving DB on disk:", err)
+		return err
+	}
+	fmt.Println("DB saved on disk")
+	dirty.Add(-dirtyBefore)
+
+	rdbMu.Lock()
+	rdbState.lastSave = time.Now()
+	rdbState.saves++
+	rdbMu.Unlock()
+
+	return nil
+}
+
+// rdbSaveBackground starts writing a snapshot of every database to the dump
+// file in the background. The caller must hold execMu for writing.
+func rdbSaveBackground() error {
+	rdbMu.Lock()
+	defer rdbMu.Unlock()
+
+	if rdbState.bgsaveInProgress {
+		return errors.New("Background save already in progress")
+	}
+	rdbState.bgsaveInProgress = true
+	rdbState.bgsaveStart = time.Now()
+	rdbState.lastBgsaveTry = rdbState.bgsaveStart
+
+	// Changes made while the snapshot is written aren't in it
+	dirtyBefore := dirty.Load()
+	snap := takeSnapshot()
+	path := config.dbfilename
+	fmt.Println("Background saving started")
+
+	go func() {
+		err := saveSnapshot(snap, path)
+
+		rdbMu.Lock()
+		defer rdbMu.Unlock()
+
+		rdbState.bgsaveInProgress = false
+		rdbState.lastBgsaveTime = time.Since(rdbState.bgsaveStart)
+		rdbState.lastBgsaveOK = err == nil
+		if err != nil {
+			fmt.Println("Background saving error:", err)
+			return
+		}
+		rdbState.lastSave = time.Now()
+		rdbState.saves++
+		dirty.Add(-dirtyBefore)
+		fmt.Println("Background saving terminated with success")
+	}()
+
+	return nil
+}
+
+// persistenceCron checks every second whether a snapshot or an AOF rewrite is
+// due. A background save starts when a save point is reached, that is when at
+// least changes keys changed in the last seconds. After a failed background
+// save it waits bgsaveRetryDelay before trying again.
+func persistenceCron() {
+	for {
+		time.Sleep(time.Second)
+
+		execMu.Lock()
+		rdbMu.RLock()
+		ready := !rdbState.bgsaveInProgress &&
+			(rdbState.lastBgsaveOK || time.Since(rdbState.lastBgsaveTry) > bgsaveRetryDelay)
+		sinceSave := time.Since(rdbState.lastSave)
+		rdbMu.RUnlock()
+
+		changes := dirty.Load()
+		for _, point := range config.save {
+			if ready && changes >= int64(point.changes) && sinceSave >= time.Duration(point.seconds)*time.Second {
+				fmt.Printf("%d changes in %d seconds. Saving...\n", point.changes, point.seconds)
+				rdbSaveBackground()
+				break
+			}
+		}
+
+		aofRewriteIfNeeded()
+		execMu.Unlock()
+	}
+}
+
+// loadRdb loads the snapshot at path into the databases, skipping keys that
+// expired in the meantime. A missing file leaves the databases empty.
+func loadRdb(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	loadingProgress.totalBytes.Store(int64(len(data)))
+	_, err = loadRdbData(data)
+	return err
+}
+
+// loadRdbData loads the RDB image at the start of data into the databases, and
+// returns its length.
+func loadRdbData(data []byte) (int, error) {
+	now := time.Now()
+	return parseRdb(data, rdbHandler{
+		key: func(id int, key string, obj Object, expire time.Time) error {
+			if id >= len(databases) {
+				return fmt.Errorf("database %d is out of range", id)
+			}
+			if expire.IsZero() || expire.After(now) {
+				storeObject(databases[id], key, obj)
+				if !expire.IsZero() {
+					setExpire(databases[id], key, expire)
+				}
+			}
+			return nil
+		},
+		function: loadRdbFunction,
+		progress: func(offset int) { loadingProgress.fileBytes.Store(int64(offset)) },
+	})
+}
+
+// rdbHandler receives what parseRdb reads.
+type rdbHandler struct {
+	key      func(db int, key string, obj Object, expire time.Time) error
+	function func(code string) error
+	progress func(offset int) // Called with the offset parsed after each key, if not nil
+}
+
+// parseRdb parses the RDB image at the start of data, passing every key and
+// function library to h, and returns the length of the image.
+func parseRdb(data []byte, h rdbHandler) (int, error) {
+	if len(data) < 9 || !strings.HasPrefix(string(data), "REDIS") {
+		return 0, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return 0, fmt.Errorf("can't handle RDB format version %s", data[5:9])
+	}
+
+	r := &rdbReader{buf: data[9:]}
+	db := 0
+	var expire time.Time
+	skipped := map[string]int{}
+	for r.err == nil {
+		op := r.readByte()
+		if r.err != nil {
+			break
+		}
+
+		switch op {
+		case rdbOpSelectDB:
+			db = r.readCount()
+		case rdbOpResizeDB:
+			r.readLen()
+			r.readLen()
+		case rdbOpSlotInfo:
+			r.readLen()
+			r.readLen()
+			r.readLen()
+		case rdbOpAux:
+			r.readString()
+			r.readString()
+		case rdbOpExpireMs:
+			if p := r.readBytes(8); p != nil {
+				expire = time.UnixMilli(int64(binary.LittleEndian.Uint64(p)))
+			}
+		case rdbOpExpireSecs:
+			if p := r.readBytes(4); p != nil {
+				expire = time.Unix(int64(binary.LittleEndian.Uint32(p)), 0)
+			}
+		case rdbOpIdle:
+			r.readLen()
+		case rdbOpFreq:
+			r.readByte()
+		case rdbOpFunction:
+			code := r.readString()
+			if r.err == nil {
+				if err := h.function(code); err != nil {
+					return 0, err
+				}
+			}
+		case rdbOpModuleAux:
+			return 0, errors.New("module data is not supported")
+		case rdbOpEOF:
+			logSkippedKeys(skipped)
+
+			// Since version 5 the image ends with a checksum of everything
+			// before it, which is zero if it was written with checksums disabled
+			end := len(data) - len(r.buf)
+			if version < 5 {
+				return end, nil
+			}
+			p := r.readBytes(8)
+			if p == nil {
+				return 0, r.err
+			}
+			if expected := binary.LittleEndian.Uint64(p); expected != 0 && rdbChecksum(0, data[:end]) != expected {
+				return 0, errors.New("wrong RDB checksum")
+			}
+			return end + 8, nil
+		default:
+			key := r.readString()
+			obj, err := r.readObject(op)
+			var skip rdbSkippedKeyError
+			if errors.As(err, &skip) {
+				skipped[skip.reason]++
+			} else if err != nil {
+				return 0, fmt.Errorf("key '%s': %s", key, err)
+			} else if err := h.key(db, key, obj, expire); err != nil {
+				return 0, err
+			}
+			expire = time.Time{}
+			if h.progress != nil {
+				h.progress(len(data) - len(r.buf))
+			}
+		}
+	}
+
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, errors.New("unexpected end of file")
+}
+
+// logSkippedKeys logs the number of keys left out of a snapshot, by reason.
+func logSkippedKeys(skipped map[string]int) {
+	reasons := make([]string, 0, len(skipped))
+	for reason := range skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Printf("Skipped %d keys of the RDB file: %s\n", skipped[reason], reason)
+	}
+}
+
+// loadRdbFunction loads a function library found in a snapshot.
+func loadRdbFunction(code string) error {
+	lib, err := compileLibrary(code)
+	if err != nil {
+		return err
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+	return addLibrary(lib, false)
+}
+
+// saveCommand handles the SAVE command.
+func saveCommand(c *Client, args []Value) Value {
+	rdbMu.RLock()
+	inProgress := rdbState.bgsaveInProgress
+	rdbMu.RUnlock()
+	if inProgress {
+		return Value{typ: ValueTypSimpleError, str: "ERR Background save already in progress"}
+	}
+
+	if err := rdbSave(); err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+	}
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// bgsave handles the BGSAVE command.
+func bgsave(c *Client, args []Value) Value {
+	if len(args) > 1 || (len(args) == 1 && strings.ToUpper(args[0].bulk) != "SCHEDULE") {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	if err := rdbSaveBackground(); err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+	}
+	return Value{typ: ValueTypSimpleString, str: "Background saving started"}
+}
+
+// lastsave handles the LASTSAVE command.
+func lastsave(c *Client, args []Value) Value {
+	rdbMu.RLock()
+	defer rdbMu.RUnlock()
+
+	return Value{typ: ValueTypInteger, num: int(rdbState.lastSave.Unix())}
+}
+
+// persistenceInfo returns the lines of the persistence section of INFO.
+func persistenceInfo() []string {
+	rdbMu.RLock()
+	defer rdbMu.RUnlock()
+
+	status := "ok"
+	if !rdbState.lastBgsaveOK {
+		status = "err"
+	}
+	current := -1
+	if rdbState.bgsaveInProgress {
+		current = int(time.Since(rdbState.bgsaveStart).Seconds())
+	}
+	last := -1
+	if rdbState.lastBgsaveTime >= 0 {
+		last = int(rdbState.lastBgsaveTime.Seconds())
+	}
+
+	aofStatus := "ok"
+	if serverAof != nil && !serverAof.WriteOK() {
+		aofStatus = "err"
+	}
+
+	lines := append(loadingInfo(),
+		fmt.Sprintf("rdb_changes_since_last_save:%d", dirty.Load()),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(rdbState.bgsaveInProgress)),
+		fmt.Sprintf("rdb_last_save_time:%d", rdbState.lastSave.Unix()),
+		"rdb_last_bgsave_status:"+status,
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", last),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", current),
+		fmt.Sprintf("rdb_saves:%d", rdbState.saves),
+		fmt.Sprintf("aof_enabled:%d", boolToInt(serverAof != nil)),
+		"aof_last_write_status:"+aofStatus,
+	)
+	return append(lines, aofInfo()...)
+}
+
+// boolToInt returns 1 for true and 0 for false, as INFO reports flags.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,1047 @@
+/*
+This file contains the RDB file format, the one Redis writes its snapshots in, so
+dump files can be moved between this server and Redis and inspected with the
+usual tools. A file starts with "REDIS" and a four digit version, followed by
+auxiliary fields, functions and the keys of every database, each introduced by an
+opcode or a type byte, and ends with an EOF opcode and a CRC64 checksum. Lengths
+use a variable size encoding whose special values also encode integers and LZF
+compressed strings. For a detailed description of the format, refer to the Redis
+source:
+
+https://github.com/redis/redis/blob/unstable/src/rdb.c
+https://github.com/redis/redis/blob/unstable/src/rdb.h
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// rdbVersion is the version of the RDB format written, the one of Redis 7.2.
+// Files up to rdbMaxVersion can be loaded.
+const rdbVersion = 11
+const rdbMaxVersion = 12
+
+// Opcodes of the RDB format
+const (
+	rdbOpSlotInfo   = 0xF4 // Key counts of a cluster slot, ignored
+	rdbOpFunction   = 0xF5 // The code of a function library
+	rdbOpModuleAux  = 0xF7 // Module data, not supported
+	rdbOpIdle       = 0xF8 // LRU idle time of the next key
+	rdbOpFreq       = 0xF9 // LFU frequency of the next key
+	rdbOpAux        = 0xFA // An auxiliary field as a name and a value
+	rdbOpResizeDB   = 0xFB // Key and expire counts of the database, as a hint
+	rdbOpExpireMs   = 0xFC // Expiration time of the next key in unix milliseconds
+	rdbOpExpireSecs = 0xFD // Expiration time of the next key in unix seconds
+	rdbOpSelectDB   = 0xFE // The following keys belong to this database
+	rdbOpEOF        = 0xFF // End of the keys, followed by the checksum
+)
+
+// Value types of the RDB format that can be loaded. Hashes lose the expiration
+// times of their fields, which have no equivalent here.
+const (
+	rdbTypeString            = 0
+	rdbTypeList              = 1
+	rdbTypeSet               = 2
+	rdbTypeZSet              = 3 // Scores as strings
+	rdbTypeHash              = 4
+	rdbTypeZSet2             = 5 // Scores as binary doubles
+	rdbTypeHashZipmap        = 9
+	rdbTypeListZiplist       = 10
+	rdbTypeSetIntset         = 11
+	rdbTypeZSetZiplist       = 12
+	rdbTypeHashZiplist       = 13
+	rdbTypeListQuicklist     = 14 // A list of ziplists
+	rdbTypeStreamListpacks   = 15
+	rdbTypeHashListpack      = 16
+	rdbTypeZSetListpack      = 17
+	rdbTypeListQuicklist2    = 18 // A list of listpacks or plain elements
+	rdbTypeStreamListpack2   = 19
+	rdbTypeSetListpack       = 20
+	rdbTypeStreamListpack3   = 21
+	rdbTypeHashMetadataPreGA = 22 // Field expiration times, from Redis 7.4 release candidates
+	rdbTypeHashListpackExPre = 23
+	rdbTypeHashMetadata      = 24 // Field expiration times relative to the earliest
+	rdbTypeHashListpackEx    = 25
+)
+
+// rdbSkippedKeyError is returned when a value was read but has no equivalent
+// here, so the key is left out instead of failing the load.
+type rdbSkippedKeyError struct {
+	reason string
+}
+
+func (e rdbSkippedKeyError) Error() string {
+	return e.reason
+}
+
+// Special encodings, flagged by the two top bits of a length
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// streamNodeMaxEntries is the number of entries written per stream listpack.
+const streamNodeMaxEntries = 100
+
+// listNodeMaxEntries is the number of elements written per list listpack.
+const listNodeMaxEntries = 128
+
+// Containers of the nodes of a quicklist
+const (
+	quicklistNodePlain  = 1 // A single element, stored as is
+	quicklistNodePacked = 2 // A listpack of elements
+)
+
+// Flags of a stream entry in a listpack
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// rdbCRCTable is the table of the CRC64 variant Redis uses, the Jones polynomial
+// in reflected form.
+var rdbCRCTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+var errBadRdb = errors.New("corrupt RDB file")
+
+// rdbChecksum adds p to the running checksum crc. Redis neither inverts the
+// initial value nor the result, unlike the standard library, so the inversions
+// are undone around the update.
+func rdbChecksum(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, rdbCRCTable, p)
+}
+
+// rdbWriter encodes an RDB file to w, buffering the output and keeping the
+// checksum of everything written. The first error sticks.
+type rdbWriter struct {
+	w   io.Writer
+	buf []byte
+	crc uint64
+	err error
+}
+
+// flush writes the buffered output.
+func (w *rdbWriter) flush() error {
+	if w.err == nil {
+		w.crc = rdbChecksum(w.crc, w.buf)
+		_, w.err = w.w.Write(w.buf)
+	}
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+// flushIfNeeded flushes once enough output is buffered, so the whole file is
+// never held in memory.
+func (w *rdbWriter) flushIfNeeded() {
+	if len(w.buf) >= 64*1024 {
+		w.flush()
+	}
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+// writeLen writes n in the length encoding.
+func (w *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.buf = append(w.buf, byte(n))
+	case n < 1<<14:
+		w.buf = append(w.buf, 0x40|byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		w.buf = append(w.buf, 0x80)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	default:
+		w.buf = append(w.buf, 0x81)
+		w.buf = binary.BigEndian.AppendUint64(w.buf, n)
+	}
+}
+
+// writeString writes s, as an integer if it's a small one in canonical form.
+func (w *rdbWriter) writeString(s string) {
+	if v, ok := canonicalInt(s); ok && v >= math.MinInt32 && v <= math.MaxInt32 {
+		switch {
+		case v >= math.MinInt8 && v <= math.MaxInt8:
+			w.buf = append(w.buf, 0xC0|rdbEncInt8, byte(v))
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			w.buf = append(w.buf, 0xC0|rdbEncInt16)
+			w.buf = binary.LittleEndian.AppendUint16(w.buf, uint16(v))
+		default:
+			w.buf = append(w.buf, 0xC0|rdbEncInt32)
+			w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(v))
+		}
+		return
+	}
+
+	w.writeLen(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *rdbWriter) writeDouble(f float64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(f))
+}
+
+// writeMillis writes a unix time in milliseconds as 8 little endian bytes, with
+// -1 meaning unset.
+func (w *rdbWriter) writeMillis(t time.Time) {
+	ms := int64(-1)
+	if !t.IsZero() {
+		ms = t.UnixMilli()
+	}
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(ms))
+}
+
+// writeRawStreamID writes id as 16 big endian bytes, the form used in PELs.
+func (w *rdbWriter) writeRawStreamID(id StreamID) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, id.ms)
+	w.buf = binary.BigEndian.AppendUint64(w.buf, id.seq)
+}
+
+// writeAux writes an auxiliary field.
+func (w *rdbWriter) writeAux(name, value string) {
+	w.writeByte(rdbOpAux)
+	w.writeString(name)
+	w.writeString(value)
+}
+
+// writeKey writes a key, as the type byte of obj followed by the key and the
+// value.
+func (w *rdbWriter) writeKey(key string, obj Object) {
+	w.writeByte(rdbObjectType(obj))
+	w.writeString(key)
+	w.writeValue(obj)
+}
+
+// rdbObjectType returns the type byte obj is written with.
+func rdbObjectType(obj Object) byte {
+	switch obj.typ {
+	case KeyTypHash:
+		if obj.hash.dict == nil {
+			return rdbTypeHashListpack
+		}
+		return rdbTypeHash
+	case KeyTypList:
+		return rdbTypeListQuicklist2
+	case KeyTypSet:
+		if obj.set.dict == nil {
+			return rdbTypeSetIntset
+		}
+		return rdbTypeSet
+	case KeyTypZSet:
+		return rdbTypeZSet2
+	case KeyTypStream:
+		return rdbTypeStreamListpack3
+	default:
+		return rdbTypeString
+	}
+}
+
+// writeValue writes the value of obj, without its type byte.
+func (w *rdbWriter) writeValue(obj Object) {
+	switch obj.typ {
+	case KeyTypString:
+		w.writeString(obj.str)
+	case KeyTypHash:
+		// A packed hash is written as a listpack, as Redis writes small hashes
+		if obj.hash.dict == nil {
+			lp := newListpackWriter()
+			obj.hash.Range(func(k, v string) bool {
+				lp.appendString(k)
+				lp.appendString(v)
+				return true
+			})
+			w.writeString(string(lp.bytes()))
+			return
+		}
+		w.writeLen(uint64(len(obj.hash.dict)))
+		for k, v := range obj.hash.dict {
+			w.writeString(k)
+			w.writeString(v)
+		}
+	case KeyTypList:
+		w.writeList(obj.list)
+	case KeyTypSet:
+		// An intset is written as is, as Redis writes sets of integers
+		if obj.set.dict == nil {
+			w.writeString(string(encodeIntset(obj.set.ints)))
+			return
+		}
+		w.writeLen(uint64(len(obj.set.dict)))
+		for member := range obj.set.dict {
+			w.writeString(member)
+		}
+	case KeyTypZSet:
+		w.writeLen(uint64(obj.zset.Len()))
+		for _, m := range obj.zset.Members() {
+			w.writeString(m.member)
+			w.writeDouble(m.score)
+		}
+	case KeyTypStream:
+		w.writeStream(obj.stream)
+	}
+}
+
+// redisDumpPayload returns obj serialized the way DUMP of Redis does, which
+// RESTORE of Redis takes: the value as in an RDB file, followed by the RDB
+// version and the checksum. The DUMP command of this server uses a format of
+// its own.
+func redisDumpPayload(obj Object) []byte {
+	w := &rdbWriter{}
+	w.writeByte(rdbObjectType(obj))
+	w.writeValue(obj)
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, rdbVersion)
+	return binary.LittleEndian.AppendUint64(w.buf, rdbChecksum(0, w.buf))
+}
+
+// writeList writes the elements of a list as a quicklist of listpacks of up to
+// listNodeMaxEntries elements, as Redis 7 writes lists.
+func (w *rdbWriter) writeList(list *List) {
+	elems := list.Elements()
+	nodes := (len(elems) + listNodeMaxEntries - 1) / listNodeMaxEntries
+	w.writeLen(uint64(nodes))
+	for len(elems) > 0 {
+		n := min(len(elems), listNodeMaxEntries)
+		lp := newListpackWriter()
+		for _, elem := range elems[:n] {
+			lp.appendString(elem)
+		}
+		w.writeLen(quicklistNodePacked)
+		w.writeString(string(lp.bytes()))
+		elems = elems[n:]
+	}
+}
+
+// writeStream writes the entries of a stream as listpacks of up to
+// streamNodeMaxEntries entries, followed by its metadata and consumer groups.
+func (w *rdbWriter) writeStream(s *Stream) {
+	nodes := (len(s.entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	w.writeLen(uint64(nodes))
+	for i := 0; i < len(s.entries); i += streamNodeMaxEntries {
+		entries := s.entries[i:min(i+streamNodeMaxEntries, len(s.entries))]
+		master := entries[0]
+
+		// The key of a node is its master ID in the raw form
+		key := binary.BigEndian.AppendUint64(nil, master.id.ms)
+		w.writeString(string(binary.BigEndian.AppendUint64(key, master.id.seq)))
+		w.writeString(string(encodeStreamNode(master, entries)))
+		w.flushIfNeeded()
+	}
+
+	var firstID StreamID
+	if len(s.entries) > 0 {
+		firstID = s.entries[0].id
+	}
+	w.writeLen(uint64(len(s.entries)))
+	w.writeLen(s.lastID.ms)
+	w.writeLen(s.lastID.seq)
+	w.writeLen(firstID.ms)
+	w.writeLen(firstID.seq)
+	w.writeLen(s.maxDeletedID.ms)
+	w.writeLen(s.maxDeletedID.seq)
+	w.writeLen(s.entriesAdded)
+
+	w.writeLen(uint64(len(s.groups)))
+	for _, g := range s.groups {
+		w.writeString(g.name)
+		w.writeLen(g.lastID.ms)
+		w.writeLen(g.lastID.seq)
+		w.writeLen(uint64(g.entriesRead))
+
+		w.writeLen(uint64(len(g.pending)))
+		for id, pe := range g.pending {
+			w.writeRawStreamID(id)
+			w.writeMillis(pe.deliveryTime)
+			w.writeLen(uint64(pe.deliveryCount))
+		}
+
+		w.writeLen(uint64(len(g.consumers)))
+		for _, c := range g.consumers {
+			w.writeString(c.name)
+			w.writeMillis(c.seenTime)
+			w.writeMillis(c.activeTime)
+			w.writeLen(uint64(len(c.pending)))
+			for id := range c.pending {
+				w.writeRawStreamID(id)
+			}
+		}
+	}
+}
+
+// encodeStreamNode encodes entries as a stream listpack. The master entry holds
+// the field names of the first entry, so entries with the same fields only
+// store their values. IDs are stored as differences to the master ID.
+func encodeStreamNode(master StreamEntry, entries []StreamEntry) []byte {
+	lp := newListpackWriter()
+	masterFields := len(master.fields) / 2
+
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0) // Deleted entries
+	lp.appendInt(int64(masterFields))
+	for i := 0; i < len(master.fields); i += 2 {
+		lp.appendString(master.fields[i])
+	}
+	lp.appendInt(0) // Master entry terminator
+
+	for _, entry := range entries {
+		fields := len(entry.fields) / 2
+		sameFields := fields == masterFields
+		for i := 0; sameFields && i < len(entry.fields); i += 2 {
+			sameFields = entry.fields[i] == master.fields[i]
+		}
+
+		// The differences wrap around like the unsigned arithmetic of Redis
+		flags := int64(0)
+		if sameFields {
+			flags = streamItemSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(entry.id.ms - master.id.ms))
+		lp.appendInt(int64(entry.id.seq - master.id.seq))
+
+		if sameFields {
+			for i := 1; i < len(entry.fields); i += 2 {
+				lp.appendString(entry.fields[i])
+			}
+			lp.appendInt(int64(fields + 3))
+		} else {
+			lp.appendInt(int64(fields))
+			for _, f := range entry.fields {
+				lp.appendString(f)
+			}
+			lp.appendInt(int64(2*fields + 4))
+		}
+	}
+
+	return lp.bytes()
+}
+
+// rdbReader decodes an RDB file held in memory. The first error sticks, so
+// callers can decode a whole structure and check err once at the end.
+type rdbReader struct {
+	buf []byte
+	err error
+}
+
+// fail records err unless an earlier error is already recorded.
+func (r *rdbReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *rdbReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.fail(errBadRdb)
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *rdbReader) readByte() byte {
+	b := r.readBytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// readLen reads a length. If it's a special encoding instead, encoded is set
+// and n is the encoding.
+func (r *rdbReader) readLen() (n uint64, encoded bool) {
+	b := r.readByte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false
+	case 1:
+		return uint64(b&0x3F)<<8 | uint64(r.readByte()), false
+	case 3:
+		return uint64(b & 0x3F), true
+	}
+
+	switch b {
+	case 0x80:
+		if p := r.readBytes(4); p != nil {
+			return uint64(binary.BigEndian.Uint32(p)), false
+		}
+	case 0x81:
+		if p := r.readBytes(8); p != nil {
+			return binary.BigEndian.Uint64(p), false
+		}
+	default:
+		r.fail(errBadRdb)
+	}
+	return 0, false
+}
+
+// readCount reads a collection length, rejecting lengths that can't possibly
+// fit in the rest of the file so a corrupt length can't exhaust memory.
+func (r *rdbReader) readCount() int {
+	n, encoded := r.readLen()
+	if encoded || n > uint64(len(r.buf)) {
+		r.fail(errBadRdb)
+		return 0
+	}
+	return int(n)
+}
+
+// readString reads a string in any of its encodings.
+func (r *rdbReader) readString() string {
+	n, encoded := r.readLen()
+	if r.err != nil {
+		return ""
+	}
+	if !encoded {
+		if n > uint64(len(r.buf)) {
+			r.fail(errBadRdb)
+			return ""
+		}
+		return string(r.readBytes(int(n)))
+	}
+
+	switch n {
+	case rdbEncInt8:
+		return strconv.Itoa(int(int8(r.readByte())))
+	case rdbEncInt16:
+		if p := r.readBytes(2); p != nil {
+			return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p))))
+		}
+	case rdbEncInt32:
+		if p := r.readBytes(4); p != nil {
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p))))
+		}
+	case rdbEncLZF:
+		compressed := r.readCount()
+		length := r.readCount64()
+		data := r.readBytes(compressed)
+		if r.err != nil {
+			return ""
+		}
+		out, err := lzfDecompress(data, length)
+		if err != nil {
+			r.fail(err)
+			return ""
+		}
+		return string(out)
+	default:
+		r.fail(errBadRdb)
+	}
+	return ""
+}
+
+// readCount64 reads the uncompressed length of an LZF string, which unlike other
+// lengths may exceed the rest of the file, within a sanity limit.
+func (r *rdbReader) readCount64() int {
+	n, encoded := r.readLen()
+	if encoded || n > 1<<32 {
+		r.fail(errBadRdb)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *rdbReader) readDouble() float64 {
+	if p := r.readBytes(8); p != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(p))
+	}
+	return 0
+}
+
+// readStringDouble reads a score of the old sorted set encoding, a string with
+// a one byte length where three values stand for NaN and the infinities.
+func (r *rdbReader) readStringDouble() float64 {
+	switch n := r.readByte(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		f, err := strconv.ParseFloat(string(r.readBytes(int(n))), 64)
+		if err != nil {
+			r.fail(errBadRdb)
+		}
+		return f
+	}
+}
+
+// readMillis reads a unix time in milliseconds written by writeMillis.
+func (r *rdbReader) readMillis() time.Time {
+	p := r.readBytes(8)
+	if p == nil {
+		return time.Time{}
+	}
+	ms := int64(binary.LittleEndian.Uint64(p))
+	if ms == -1 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func (r *rdbReader) readRawStreamID() StreamID {
+	p := r.readBytes(16)
+	if p == nil {
+		return StreamID{}
+	}
+	return StreamID{ms: binary.BigEndian.Uint64(p), seq: binary.BigEndian.Uint64(p[8:])}
+}
+
+func (r *rdbReader) readStreamID() StreamID {
+	ms, _ := r.readLen()
+	seq, _ := r.readLen()
+	return StreamID{ms: ms, seq: seq}
+}
+
+// readObject reads a value of type typ.
+func (r *rdbReader) readObject(typ byte) (Object, error) {
+	var obj Object
+	switch typ {
+	case rdbTypeString:
+		obj = Object{typ: KeyTypString, str: r.readString()}
+
+	case rdbTypeHash:
+		hash := map[string]string{}
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			k := r.readString()
+			hash[k] = r.readString()
+		}
+		obj = Object{typ: KeyTypHash, hash: hashFromMap(hash)}
+
+	case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		var elements []string
+		var err error
+		if typ == rdbTypeHashZipmap {
+			elements, err = decodeZipmap([]byte(r.readString()))
+		} else {
+			elements, err = r.readPacked(typ == rdbTypeHashZiplist)
+		}
+		if r.err != nil {
+			return Object{}, r.err
+		}
+		if err != nil || len(elements)%2 != 0 {
+			return Object{}, errBadRdb
+		}
+		hash := map[string]string{}
+		for i := 0; i < len(elements); i += 2 {
+			hash[elements[i]] = elements[i+1]
+		}
+		obj = Object{typ: KeyTypHash, hash: hashFromMap(hash)}
+
+	case rdbTypeHashMetadataPreGA, rdbTypeHashMetadata, rdbTypeHashListpackExPre, rdbTypeHashListpackEx:
+		hash := r.readHashWithTTLs(typ)
+		if r.err != nil {
+			return Object{}, r.err
+		}
+		if len(hash) == 0 {
+			return Object{}, rdbSkippedKeyError{"all the fields of the hash expired"}
+		}
+		obj = Object{typ: KeyTypHash, hash: hashFromMap(hash)}
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		zset := newSortedSet()
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			member := r.readString()
+			if typ == rdbTypeZSet {
+				zset.Add(member, r.readStringDouble())
+			} else {
+				zset.Add(member, r.readDouble())
+			}
+		}
+		obj = Object{typ: KeyTypZSet, zset: zset}
+
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		elements, err := r.readPacked(typ == rdbTypeZSetZiplist)
+		if err != nil || len(elements)%2 != 0 {
+			return Object{}, errBadRdb
+		}
+		zset := newSortedSet()
+		for i := 0; i < len(elements); i += 2 {
+			score, err := strconv.ParseFloat(elements[i+1], 64)
+			if err != nil {
+				return Object{}, errBadRdb
+			}
+			zset.Add(elements[i], score)
+		}
+		obj = Object{typ: KeyTypZSet, zset: zset}
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpack2, rdbTypeStreamListpack3:
+		obj = Object{typ: KeyTypStream, stream: r.readStream(typ)}
+
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		var elems []string
+		switch typ {
+		case rdbTypeList:
+			for n := r.readCount(); n > 0 && r.err == nil; n-- {
+				elems = append(elems, r.readString())
+			}
+		case rdbTypeListZiplist:
+			var err error
+			elems, err = r.readPacked(true)
+			if err != nil {
+				r.fail(errBadRdb)
+			}
+		case rdbTypeListQuicklist:
+			elems = r.readQuicklist()
+		default:
+			elems = r.readQuicklist2()
+		}
+		if r.err != nil {
+			return Object{}, r.err
+		}
+		if len(elems) == 0 {
+			return Object{}, rdbSkippedKeyError{"the list is empty"}
+		}
+		obj = Object{typ: KeyTypList, list: listFromElements(elems)}
+
+	case rdbTypeSet:
+		set := newSet()
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			set.Add(r.readString())
+		}
+		obj = Object{typ: KeyTypSet, set: set}
+
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		var members []string
+		var err error
+		if typ == rdbTypeSetIntset {
+			members, err = decodeIntset([]byte(r.readString()))
+		} else {
+			members, err = r.readPacked(false)
+		}
+		if r.err != nil {
+			return Object{}, r.err
+		}
+		if err != nil {
+			return Object{}, errBadRdb
+		}
+		obj = Object{typ: KeyTypSet, set: setFromMembers(members)}
+
+	default:
+		return Object{}, fmt.Errorf("unsupported value type %d", typ)
+	}
+
+	if r.err != nil {
+		return Object{}, r.err
+	}
+	return obj, nil
+}
+
+// readHashWithTTLs reads a hash whose fields may have expiration times, which
+// have no equivalent here: the fields that already expired are dropped and the
+// others are kept without one.
+func (r *rdbReader) readHashWithTTLs(typ byte) map[string]string {
+	now := time.Now().UnixMilli()
+	hash := map[string]string{}
+
+	// Since Redis 7.4 the earliest expiration time comes first, and the ones
+	// of the fields are relative to it
+	var minExpire int64
+	if typ == rdbTypeHashMetadata || typ == rdbTypeHashListpackEx {
+		if p := r.readBytes(8); p != nil {
+			minExpire = int64(binary.LittleEndian.Uint64(p))
+		}
+	}
+
+	if typ == rdbTypeHashListpackExPre || typ == rdbTypeHashListpackEx {
+		// A listpack of fields, values and expiration times, zero for none
+		elements, err := r.readPacked(false)
+		if err != nil || len(elements)%3 != 0 {
+			r.fail(errBadRdb)
+			return nil
+		}
+		for i := 0; i < len(elements); i += 3 {
+			expireAt, err := strconv.ParseInt(elements[i+2], 10, 64)
+			if err != nil {
+				r.fail(errBadRdb)
+				return nil
+			}
+			if expireAt == 0 || expireAt > now {
+				hash[elements[i]] = elements[i+1]
+			}
+		}
+		return hash
+	}
+
+	for n := r.readCount(); n > 0 && r.err == nil; n-- {
+		ttl, encoded := r.readLen()
+		if encoded {
+			r.fail(errBadRdb)
+		}
+		expireAt := int64(ttl)
+		if typ == rdbTypeHashMetadata && ttl != 0 {
+			expireAt = int64(ttl) + minExpire - 1
+		}
+		field := r.readString()
+		value := r.readString()
+		if expireAt == 0 || expireAt > now {
+			hash[field] = value
+		}
+	}
+	return hash
+}
+
+// readPacked reads a string holding a ziplist or a listpack and decodes it.
+func (r *rdbReader) readPacked(ziplist bool) ([]string, error) {
+	p := []byte(r.readString())
+	if r.err != nil {
+		return nil, r.err
+	}
+	if ziplist {
+		return decodeZiplist(p)
+	}
+	return decodeListpack(p)
+}
+
+// readQuicklist reads the elements of a list written by Redis 3.2 to 6.2, as
+// nodes that are ziplists.
+func (r *rdbReader) readQuicklist() []string {
+	elems := []string{}
+	for nodes := r.readCount(); nodes > 0 && r.err == nil; nodes-- {
+		packed, err := r.readPacked(true)
+		if err != nil {
+			r.fail(errBadRdb)
+			return nil
+		}
+		elems = append(elems, packed...)
+	}
+	return elems
+}
+
+// readQuicklist2 reads the elements of a list written by Redis 7, as nodes
+// that are either listpacks or single big elements.
+func (r *rdbReader) readQuicklist2() []string {
+	elems := []string{}
+	for nodes := r.readCount(); nodes > 0 && r.err == nil; nodes-- {
+		container, _ := r.readLen()
+		switch container {
+		case quicklistNodePlain:
+			elems = append(elems, r.readString())
+		case quicklistNodePacked:
+			packed, err := r.readPacked(false)
+			if err != nil {
+				r.fail(errBadRdb)
+				return nil
+			}
+			elems = append(elems, packed...)
+		default:
+			r.fail(errBadRdb)
+			return nil
+		}
+	}
+	return elems
+}
+
+// readStream reads a stream in any of the three listpack based versions, the
+// later ones adding metadata and consumer activity times.
+func (r *rdbReader) readStream(typ byte) *Stream {
+	s := &Stream{}
+
+	for nodes := r.readCount(); nodes > 0 && r.err == nil; nodes-- {
+		key := r.readString()
+		if r.err != nil {
+			break
+		}
+		if len(key) != 16 {
+			r.fail(errBadRdb)
+			break
+		}
+		masterID := StreamID{ms: binary.BigEndian.Uint64([]byte(key)), seq: binary.BigEndian.Uint64([]byte(key[8:]))}
+
+		elements, err := decodeListpack([]byte(r.readString()))
+		if err != nil {
+			r.fail(err)
+			break
+		}
+		entries, err := decodeStreamNode(masterID, elements)
+		if err != nil {
+			r.fail(err)
+			break
+		}
+		s.entries = append(s.entries, entries...)
+	}
+
+	r.readLen() // Number of entries, known from the nodes
+	s.lastID = r.readStreamID()
+	if typ >= rdbTypeStreamListpack2 {
+		r.readStreamID() // First ID, known from the nodes
+		s.maxDeletedID = r.readStreamID()
+		s.entriesAdded, _ = r.readLen()
+	} else {
+		s.entriesAdded = uint64(len(s.entries))
+	}
+
+	groups := r.readCount()
+	if groups > 0 {
+		s.groups = map[string]*StreamGroup{}
+	}
+	for ; groups > 0 && r.err == nil; groups-- {
+		name := r.readString()
+		lastID := r.readStreamID()
+		entriesRead := int64(-1)
+		if typ >= rdbTypeStreamListpack2 {
+			n, _ := r.readLen()
+			entriesRead = int64(n)
+		}
+		g := newStreamGroup(name, lastID, entriesRead)
+
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			id := r.readRawStreamID()
+			deliveryTime := r.readMillis()
+			count, _ := r.readLen()
+			g.pending[id] = &StreamPendingEntry{deliveryTime: deliveryTime, deliveryCount: int(count)}
+		}
+
+		for n := r.readCount(); n > 0 && r.err == nil; n-- {
+			c := g.consumer(r.readString(), true)
+			c.seenTime = r.readMillis()
+			if typ >= rdbTypeStreamListpack3 {
+				c.activeTime = r.readMillis()
+			} else {
+				c.activeTime = c.seenTime
+			}
+
+			// Every entry a consumer owns is in the PEL of the group
+			for m := r.readCount(); m > 0 && r.err == nil; m-- {
+				id := r.readRawStreamID()
+				pe, ok := g.pending[id]
+				if !ok {
+					r.fail(errBadRdb)
+					break
+				}
+				pe.consumer = c.name
+				c.pending[id] = struct{}{}
+			}
+		}
+
+		s.groups[name] = g
+	}
+
+	return s
+}
+
+// decodeStreamNode decodes the entries of a stream listpack, skipping the ones
+// flagged as deleted.
+func decodeStreamNode(masterID StreamID, elements []string) ([]StreamEntry, error) {
+	ints := func(values ...string) ([]int64, bool) {
+		out := make([]int64, len(values))
+		for i, v := range values {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			out[i] = n
+		}
+		return out, true
+	}
+
+	if len(elements) < 3 {
+		return nil, errBadRdb
+	}
+	header, ok := ints(elements[:3]...)
+	if !ok || header[2] < 0 || int64(len(elements)) < 4+header[2] {
+		return nil, errBadRdb
+	}
+	masterFields := elements[3 : 3+header[2]]
+	p := elements[4+header[2]:] // Past the master entry terminator
+
+	entries := []StreamEntry{}
+	for len(p) > 0 {
+		if len(p) < 3 {
+			return nil, errBadRdb
+		}
+		head, ok := ints(p[:3]...)
+		if !ok {
+			return nil, errBadRdb
+		}
+		flags := head[0]
+		entry := StreamEntry{id: StreamID{ms: masterID.ms + uint64(head[1]), seq: masterID.seq + uint64(head[2])}}
+		p = p[3:]
+
+		if flags&streamItemSameFields != 0 {
+			if len(p) < len(masterFields)+1 {
+				return nil, errBadRdb
+			}
+			for i, field := range masterFields {
+				entry.fields = append(entry.fields, field, p[i])
+			}
+			p = p[len(masterFields):]
+		} else {
+			n, err := strconv.Atoi(p[0])
+			if err != nil || n < 0 || len(p) < 2*n+2 {
+				return nil, errBadRdb
+			}
+			entry.fields = append(entry.fields, p[1:1+2*n]...)
+			p = p[1+2*n:]
+		}
+		p = p[1:] // The element count of the entry, used to walk backwards
+
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// lzfDecompress decompresses LZF data into length bytes.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, min(length, 1<<20))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		// A literal run of ctrl+1 bytes
+		if ctrl < 32 {
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errBadRdb
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// A back reference into the output
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errBadRdb
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errBadRdb
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errBadRdb
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, errBadRdb
+	}
+	return out, nil
+}
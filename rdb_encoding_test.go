@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testZiplist builds a ziplist of elems, encoding the integers from 0 to 12 in
+// the encoding byte as Redis does, and the other elements as short strings.
+func testZiplist(elems ...string) []byte {
+	entries := []byte{}
+	prevLen := 0
+	for _, elem := range elems {
+		entry := []byte{byte(prevLen)}
+		if n, ok := canonicalInt(elem); ok && n >= 0 && n <= 12 {
+			entry = append(entry, 0xF1+byte(n))
+		} else {
+			entry = append(entry, byte(len(elem)))
+			entry = append(entry, elem...)
+		}
+		entries = append(entries, entry...)
+		prevLen = len(entry)
+	}
+
+	p := make([]byte, 10, 10+len(entries)+1)
+	p = append(p, entries...)
+	p = append(p, listpackEnd)
+	binary.LittleEndian.PutUint32(p, uint32(len(p)))
+	binary.LittleEndian.PutUint16(p[8:], uint16(len(elems)))
+	return p
+}
+
+// testListpack builds a listpack of elems.
+func testListpack(elems ...string) string {
+	lp := newListpackWriter()
+	for _, elem := range elems {
+		lp.appendString(elem)
+	}
+	return string(lp.bytes())
+}
+
+func TestReadObjectList(t *testing.T) {
+	defer func(size int) { config.listMaxListpackSize = size }(config.listMaxListpackSize)
+	config.listMaxListpackSize = -2
+
+	big := strings.Repeat("x", 10000)
+	tests := []struct {
+		name  string
+		typ   byte
+		write func(w *rdbWriter)
+		want  []string
+	}{
+		{"linked list", rdbTypeList, func(w *rdbWriter) {
+			w.writeLen(3)
+			w.writeString("a")
+			w.writeString("12")
+			w.writeString("c")
+		}, []string{"a", "12", "c"}},
+		{"ziplist", rdbTypeListZiplist, func(w *rdbWriter) {
+			w.writeString(string(testZiplist("a", "7", "long element")))
+		}, []string{"a", "7", "long element"}},
+		{"quicklist of ziplists", rdbTypeListQuicklist, func(w *rdbWriter) {
+			w.writeLen(2)
+			w.writeString(string(testZiplist("a", "b")))
+			w.writeString(string(testZiplist("0", "c")))
+		}, []string{"a", "b", "0", "c"}},
+		{"quicklist of listpacks", rdbTypeListQuicklist2, func(w *rdbWriter) {
+			w.writeLen(2)
+			w.writeLen(quicklistNodePacked)
+			w.writeString(testListpack("a", "-5"))
+			w.writeLen(quicklistNodePacked)
+			w.writeString(testListpack("1000000", "b"))
+		}, []string{"a", "-5", "1000000", "b"}},
+		{"quicklist with a plain node", rdbTypeListQuicklist2, func(w *rdbWriter) {
+			w.writeLen(3)
+			w.writeLen(quicklistNodePacked)
+			w.writeString(testListpack("a"))
+			w.writeLen(quicklistNodePlain)
+			w.writeString(big)
+			w.writeLen(quicklistNodePacked)
+			w.writeString(testListpack("b"))
+		}, []string{"a", big, "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &rdbWriter{}
+			tt.write(w)
+			r := &rdbReader{buf: w.buf}
+
+			obj, err := r.readObject(tt.typ)
+			if err != nil {
+				t.Fatalf("readObject: %v", err)
+			}
+			if obj.typ != KeyTypList {
+				t.Fatalf("got type %s, want %s", obj.typ, KeyTypList)
+			}
+			if got := obj.list.Elements(); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if len(r.buf) != 0 {
+				t.Fatalf("%d bytes left unread", len(r.buf))
+			}
+		})
+	}
+}
+
+func TestReadObjectListInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		typ   byte
+		write func(w *rdbWriter)
+	}{
+		{"bad ziplist length", rdbTypeListZiplist, func(w *rdbWriter) {
+			zl := testZiplist("a")
+			w.writeString(string(zl[:len(zl)-1]))
+		}},
+		{"quicklist node not a ziplist", rdbTypeListQuicklist, func(w *rdbWriter) {
+			w.writeLen(1)
+			w.writeString("abc")
+		}},
+		{"unknown quicklist container", rdbTypeListQuicklist2, func(w *rdbWriter) {
+			w.writeLen(1)
+			w.writeLen(3)
+			w.writeString(testListpack("a"))
+		}},
+		{"truncated", rdbTypeList, func(w *rdbWriter) {
+			w.writeLen(3)
+			w.writeString("a")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &rdbWriter{}
+			tt.write(w)
+			r := &rdbReader{buf: w.buf}
+
+			if _, err := r.readObject(tt.typ); err == nil {
+				t.Fatal("readObject: got no error")
+			}
+		})
+	}
+}
+
+func TestReadObjectListEmpty(t *testing.T) {
+	w := &rdbWriter{}
+	w.writeLen(0)
+	r := &rdbReader{buf: w.buf}
+
+	_, err := r.readObject(rdbTypeListQuicklist2)
+	if !errors.As(err, &rdbSkippedKeyError{}) {
+		t.Fatalf("got %v, want the key skipped", err)
+	}
+}
+
+func TestWriteListRoundTrip(t *testing.T) {
+	defer func(size int) { config.listMaxListpackSize = size }(config.listMaxListpackSize)
+	config.listMaxListpackSize = -2
+
+	for _, n := range []int{1, listNodeMaxEntries, listNodeMaxEntries + 1, 1000} {
+		elems := []string{}
+		for i := range n {
+			elems = append(elems, strings.Repeat("e", i%20))
+		}
+		obj := Object{typ: KeyTypList, list: listFromElements(elems)}
+
+		w := &rdbWriter{}
+		w.writeValue(obj)
+		r := &rdbReader{buf: w.buf}
+		got, err := r.readObject(rdbObjectType(obj))
+		if err != nil {
+			t.Fatalf("%d elements: readObject: %v", n, err)
+		}
+		if !slices.Equal(got.list.Elements(), elems) {
+			t.Fatalf("%d elements: the list read back differs", n)
+		}
+	}
+}
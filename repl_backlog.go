@@ -0,0 +1,72 @@
+/*
+This file contains the replication backlog, a circular buffer holding the last
+repl-backlog-size bytes of the replication stream. A replica that lost its link
+asks with PSYNC for the stream from the offset it reached, and if the backlog
+still holds it the master sends the missing part instead of a whole snapshot.
+Replicas keep a backlog of the stream of their master too, so their replicas can
+do the same and any of them can take over as master. For a detailed description
+of partial resynchronization, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/replication/#partial-resynchronizations-after-restarts-and-failovers
+*/
+
+package main
+
+// replBacklog is a circular buffer of the latest bytes of the replication stream.
+type replBacklog struct {
+	buf     []byte
+	idx     int   // Position in buf the next byte is written at
+	histlen int   // Number of bytes held
+	end     int64 // Replication offset of the last byte held
+}
+
+// replBacklogBuf is the backlog of this server, nil until a replica connects.
+// It's guarded by replMu.
+var replBacklogBuf *replBacklog
+
+// newReplBacklog creates an empty backlog of size bytes that starts after the
+// replication offset end.
+func newReplBacklog(size int64, end int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, max(size, 1)), end: end}
+}
+
+// write appends p to the backlog, dropping the oldest bytes if it's full.
+func (b *replBacklog) write(p []byte) {
+	b.end += int64(len(p))
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		p = p[n:]
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+	}
+}
+
+// firstOffset returns the replication offset of the first byte held.
+func (b *replBacklog) firstOffset() int64 {
+	return b.end - int64(b.histlen) + 1
+}
+
+// readFrom returns the bytes held from the replication offset from, and whether
+// the backlog covers it. An offset right after the last byte gives no bytes.
+func (b *replBacklog) readFrom(from int64) ([]byte, bool) {
+	if from < b.firstOffset() || from > b.end+1 {
+		return nil, false
+	}
+
+	n := int(b.end - from + 1)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	p := make([]byte, 0, n)
+	if start+n <= len(b.buf) {
+		return append(p, b.buf[start:start+n]...), true
+	}
+	p = append(p, b.buf[start:]...)
+	return append(p, b.buf[:n-len(p)]...), true
+}
+
+// resize returns a backlog of size bytes holding the latest bytes of b.
+func (b *replBacklog) resize(size int64) *replBacklog {
+	held, _ := b.readFrom(b.firstOffset())
+	resized := newReplBacklog(size, b.end-int64(len(held)))
+	resized.write(held)
+	return resized
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReplBacklog(t *testing.T) {
+	// The backlog of 8 bytes starts after offset 100, so the first byte
+	// written is at offset 101
+	tests := []struct {
+		name   string
+		writes []string
+		from   int64
+		want   string
+		ok     bool
+	}{
+		{"empty", nil, 101, "", true},
+		{"before the start", nil, 100, "", false},
+		{"whole", []string{"abc", "de"}, 101, "abcde", true},
+		{"middle", []string{"abc", "de"}, 103, "cde", true},
+		{"after the end", []string{"abc", "de"}, 106, "", true},
+		{"past the end", []string{"abc", "de"}, 107, "", false},
+		{"full", []string{"abcdefgh"}, 101, "abcdefgh", true},
+		{"wrapped", []string{"abcdef", "ghij"}, 103, "cdefghij", true},
+		{"wrapped middle", []string{"abcdef", "ghij"}, 108, "hij", true},
+		{"dropped", []string{"abcdef", "ghij"}, 102, "", false},
+		{"longer than the backlog", []string{"abcdefghijklmnopq"}, 110, "jklmnopq", true},
+		{"dropped by a long write", []string{"ab", "cdefghijklmnopq"}, 109, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplBacklog(8, 100)
+			for _, p := range tt.writes {
+				b.write([]byte(p))
+			}
+
+			got, ok := b.readFrom(tt.from)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplBacklogResize(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int64
+		first int64
+		want  string
+	}{
+		{"grow", 16, 103, "cdefghij"},
+		{"same", 8, 103, "cdefghij"},
+		{"shrink", 4, 107, "ghij"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplBacklog(8, 100)
+			b.write([]byte("abcdef"))
+			b.write([]byte("ghij"))
+
+			resized := b.resize(tt.size)
+			if resized.firstOffset() != tt.first || resized.end != b.end {
+				t.Fatalf("got offsets %d to %d, want %d to %d", resized.firstOffset(), resized.end, tt.first, b.end)
+			}
+			got, _ := resized.readFrom(tt.first)
+			if string(got) != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+
+			// Later writes go on from the same offset
+			resized.write([]byte("k"))
+			if got, _ := resized.readFrom(110); string(got) != "jk" {
+				t.Fatalf("got %q after a write, want %q", got, "jk")
+			}
+		})
+	}
+}
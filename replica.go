@@ -0,0 +1,618 @@
+/*
+This file contains the replica side of replication. REPLICAOF makes the server a
+replica of another one: a goroutine connects to the master, authenticates with
+masterauth if it's set and sends PSYNC with the replication ID and offset it
+has. If the master continues from there, only the commands missing are sent.
+Otherwise the snapshot the master replies with, with its length or between two
+EOF marks, is read in full while the old dataset is still served, then replaces
+it. The write commands that follow are applied one at a time, as the AOF is
+replayed, so they get persisted, and sent on as received to the replicas of this
+server, which count the same offsets. When the link breaks the replica connects
+again and continues where it left off. Other clients may only read, unless
+replica-read-only is turned off. REPLICAOF NO ONE stops the link and makes the
+server a master, keeping the dataset and starting a new replication ID.
+
+The master may be a genuine Redis server too, which makes this one mirror its
+dataset while clients move over. Its snapshot is in the same RDB format, and the
+commands it replicates, like SET with PXAT or PEXPIREAT, are ones this server
+runs. Keys of data types this server doesn't have, and the commands for them,
+are skipped and logged. For a detailed description of replication, refer to the
+Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/replication/
+https://redis.io/docs/latest/commands/replicaof/
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of the link to the master, as reported by ROLE
+const (
+	linkStateConnect    = "connect"    // Waiting to connect
+	linkStateConnecting = "connecting" // Connecting and handshaking
+	linkStateSync       = "sync"       // Receiving the snapshot
+	linkStateConnected  = "connected"  // Applying the stream of commands
+)
+
+// replTimeout bounds connecting to the master and waiting for data from it
+// until the snapshot is received.
+const replTimeout = 60 * time.Second
+
+// replRetryInterval is how long the replica waits before connecting again.
+const replRetryInterval = time.Second
+
+// replAckInterval is how often the replica acknowledges the offset it processed.
+const replAckInterval = time.Second
+
+// masterLink is the connection of this server to its master when it's a replica.
+type masterLink struct {
+	host string
+	port int
+
+	mu      sync.Mutex
+	state   string
+	conn    net.Conn // nil while not connected
+	stopped chan struct{}
+
+	writeMu sync.Mutex   // Serializes the acknowledgements sent to the master
+	lastIO  atomic.Int64 // Unix time of the last data from the master
+
+	// failoverResult is told how the first PSYNC went when the link was made
+	// by a failover, which asks the master to take over. nil otherwise.
+	failoverResult   chan error
+	failoverReported bool
+
+	// client applies the commands of the master, and keeps the database they
+	// select across a partial resynchronization. It's nil until the first one.
+	client *Client
+}
+
+// timeoutConn is a connection whose reads fail when no data arrives within
+// timeout, so a master that stopped responding is noticed. Zero waits forever.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+// replicaOf is the master of this server, nil when it's a master itself.
+var replicaOf *masterLink
+
+// newMasterLink creates the link to the master at host and port, which starts
+// replicating once run is called.
+func newMasterLink(host string, port int) *masterLink {
+	return &masterLink{host: host, port: port, state: linkStateConnect, stopped: make(chan struct{})}
+}
+
+// linkState returns the state of the link.
+func (l *masterLink) linkState() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
+
+// setState changes the state of the link.
+func (l *masterLink) setState(state string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.state = state
+}
+
+// addr returns the address of the master.
+func (l *masterLink) addr() string {
+	return net.JoinHostPort(l.host, strconv.Itoa(l.port))
+}
+
+// stop closes the link for good.
+func (l *masterLink) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(l.stopped)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// isStopped reports whether stop was called.
+func (l *masterLink) isStopped() bool {
+	select {
+	case <-l.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// run replicates from the master until the link is stopped, connecting again
+// whenever the connection is lost.
+func (l *masterLink) run() {
+	for !l.isStopped() {
+		err := l.replicate()
+		l.reportFailover(err)
+		if l.isStopped() {
+			return
+		}
+		fmt.Printf("Error condition on socket for SYNC with MASTER %s: %s\n", l.addr(), err)
+		l.setState(linkStateConnect)
+
+		select {
+		case <-l.stopped:
+		case <-time.After(replRetryInterval):
+		}
+	}
+}
+
+// replicate connects to the master, loads its snapshot and applies the commands
+// that follow until the connection breaks.
+func (l *masterLink) replicate() error {
+	fmt.Printf("Connecting to MASTER %s\n", l.addr())
+	l.setState(linkStateConnecting)
+	conn, err := net.DialTimeout("tcp", l.addr(), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// A stop in the meantime must be able to close the connection
+	l.mu.Lock()
+	if l.isStopped() {
+		l.mu.Unlock()
+		return nil
+	}
+	l.conn = conn
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+	}()
+
+	fmt.Println("MASTER <-> REPLICA sync started")
+	tc := &timeoutConn{Conn: conn, timeout: replTimeout}
+	resp := NewResp(tc)
+
+	execMu.RLock()
+	user, pass, port := config.masteruser, config.masterauth, config.port
+	execMu.RUnlock()
+	if pass != "" {
+		args := []string{"AUTH", pass}
+		if user != "" {
+			args = []string{"AUTH", user, pass}
+		}
+		if _, err := masterCall(conn, resp.reader, args...); err != nil {
+			return fmt.Errorf("unable to AUTH to MASTER: %w", err)
+		}
+	}
+	if _, err := masterCall(conn, resp.reader, "PING"); err != nil {
+		return fmt.Errorf("master replied to PING: %w", err)
+	}
+
+	// Masters that don't know REPLCONF replicate without it
+	if _, err := masterCall(conn, resp.reader, "REPLCONF", "listening-port", strconv.Itoa(port)); err != nil {
+		fmt.Printf("(Non critical) Master does not understand REPLCONF listening-port: %s\n", err)
+	}
+	if _, err := masterCall(conn, resp.reader, "REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		fmt.Printf("(Non critical) Master does not understand REPLCONF capa: %s\n", err)
+	}
+
+	l.setState(linkStateSync)
+	full, id, offset, err := psync(conn, resp.reader, l.failoverResult != nil && !l.failoverReported)
+	l.reportFailover(err)
+	if err != nil {
+		return err
+	}
+
+	if full {
+		data, rest, err := readSyncPayload(resp.reader)
+		if err != nil {
+			return err
+		}
+		if err := loadMasterSnapshot(data, id, offset); err != nil {
+			return err
+		}
+		l.client = newFakeClient(0)
+		l.client.master = true
+
+		// The commands that followed the snapshot may have been read with it
+		if len(rest) > 0 {
+			resp = NewResp(io.MultiReader(bytes.NewReader(rest), resp.reader))
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+	} else {
+		continueReplication(id)
+		if l.client == nil {
+			l.client = newFakeClient(0)
+			l.client.master = true
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+	}
+
+	tc.timeout = 0
+	conn.SetReadDeadline(time.Time{})
+	l.setState(linkStateConnected)
+	l.lastIO.Store(time.Now().Unix())
+
+	done := make(chan struct{})
+	defer close(done)
+	go l.ackLoop(done)
+
+	return l.applyStream(resp)
+}
+
+// reportFailover tells the failover that made the link how the first attempt
+// to synchronize went, if it wasn't told already.
+func (l *masterLink) reportFailover(err error) {
+	if l.failoverResult != nil && !l.failoverReported {
+		l.failoverResult <- err
+		l.failoverReported = true
+	}
+}
+
+// ackLoop acknowledges the offset processed to the master right away and then
+// periodically, until done is closed.
+func (l *masterLink) ackLoop(done chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+
+	for {
+		l.sendAck()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAck acknowledges the offset processed so far to the master with REPLCONF
+// ACK. A write that fails is noticed when reading from the master.
+func (l *masterLink) sendAck() {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	ack := commandValue("REPLCONF", "ACK", strconv.FormatInt(masterReplOffset.Load(), 10))
+	l.writeMu.Lock()
+	conn.Write(ack.Marshal())
+	l.writeMu.Unlock()
+}
+
+// lastIOSecondsAgo returns how many seconds ago data came from the master, -1
+// if the link isn't up.
+func (l *masterLink) lastIOSecondsAgo() int {
+	if l.linkState() != linkStateConnected {
+		return -1
+	}
+	return int(time.Now().Unix() - l.lastIO.Load())
+}
+
+// psync asks the master to continue the history of this server from its
+// offset, and with failover to become a master first. It reports whether the
+// master starts over with a snapshot instead, and the replication ID and offset
+// the master goes on with. Masters that don't know PSYNC are asked with SYNC
+// for a snapshot, with an unknown history.
+func psync(conn net.Conn, rd *bufio.Reader, failover bool) (full bool, id string, offset int64, err error) {
+	execMu.RLock()
+	id, offset = replID, masterReplOffset.Load()+1
+	execMu.RUnlock()
+
+	args := []string{"PSYNC", id, strconv.FormatInt(offset, 10)}
+	if failover {
+		args = append(args, "FAILOVER")
+	}
+	reply, err := masterCall(conn, rd, args...)
+	if err != nil {
+		// Errors other than these mean PSYNC isn't supported
+		if strings.HasPrefix(err.Error(), "NOMASTERLINK") || strings.HasPrefix(err.Error(), "LOADING") {
+			return false, "", 0, fmt.Errorf("master is currently unable to PSYNC but should be in the future: %w", err)
+		}
+		if _, err := conn.Write(commandValue("SYNC").Marshal()); err != nil {
+			return false, "", 0, err
+		}
+		return true, randomHex(replIDLen), 0, nil
+	}
+
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return false, "", 0, fmt.Errorf("bad FULLRESYNC reply '%s'", reply)
+		}
+		fmt.Printf("Full resync from master: %s:%d\n", fields[1], offset)
+		return true, fields[1], offset, nil
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		// Older masters don't tell their ID, which is then the one asked for
+		if len(fields) == 2 {
+			id = fields[1]
+		}
+		return false, id, 0, nil
+	default:
+		return false, "", 0, fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+}
+
+// masterCall sends a command to the master during the handshake and returns
+// its status reply, or the error it replied with.
+func masterCall(conn net.Conn, rd *bufio.Reader, args ...string) (string, error) {
+	if _, err := conn.Write(commandValue(args...).Marshal()); err != nil {
+		return "", err
+	}
+	line := ""
+	for line == "" {
+		// Empty lines keep the connection alive until the reply
+		l, err := rd.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(l, "\r\n")
+	}
+
+	switch {
+	case strings.HasPrefix(line, "+"):
+		return line[1:], nil
+	case strings.HasPrefix(line, "-"):
+		return "", errors.New(line[1:])
+	default:
+		return "", fmt.Errorf("unexpected reply '%s'", line)
+	}
+}
+
+// readOnlyCheck checks whether c may run the command in argv while this server
+// is a replica, returning the READONLY error to reply with if it's a write and
+// replica-read-only is set. Fake clients, like the ones applying the stream of
+// the master or replaying the AOF, have no user and may write anyway. The
+// caller must hold execMu.
+func readOnlyCheck(c *Client, cmd *Command, argv []Value) *Value {
+	if replicaOf == nil || !config.replicaReadOnly || c.user == nil || !cmd.isWrite(argv[1:]) {
+		return nil
+	}
+	return &Value{typ: ValueTypSimpleError, str: "READONLY You can't write against a read only replica."}
+}
+
+// commandValue returns the command made of args as sent by clients.
+func commandValue(args ...string) Value {
+	value := Value{typ: ValueTypArray}
+	for _, arg := range args {
+		value.array = append(value.array, bulkValue(arg))
+	}
+	return value
+}
+
+// readSyncPayload reads the snapshot the master replies to SYNC with, a bulk
+// string without the final CRLF, or a payload of unknown length between two EOF
+// marks. The master may send newlines to keep the connection alive while it
+// prepares the snapshot. Anything read past the final mark is returned as rest.
+func readSyncPayload(rd *bufio.Reader) (data []byte, rest []byte, err error) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case line[0] == '-':
+			return nil, nil, errors.New(line[1:])
+
+		case strings.HasPrefix(line, "$EOF:") && len(line) == 5+rdbEOFMarkLen:
+			fmt.Println("MASTER <-> REPLICA sync: receiving streamed RDB from master")
+			mark := []byte(line[5:])
+			chunk := make([]byte, 64*1024)
+			for {
+				n, err := rd.Read(chunk)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				// Only the new bytes and the ones before that may be part of
+				// the mark need to be searched
+				from := max(0, len(data)-len(mark)+1)
+				data = append(data, chunk[:n]...)
+				if i := bytes.Index(data[from:], mark); i >= 0 {
+					i += from
+					return data[:i], data[i+len(mark):], nil
+				}
+			}
+
+		case line[0] == '$':
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < 0 {
+				return nil, nil, fmt.Errorf("bad protocol from MASTER, the first byte is not '$' (we received '%s')", line)
+			}
+			fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master\n", n)
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(rd, payload); err != nil {
+				return nil, nil, err
+			}
+			return payload, nil, nil
+
+		default:
+			return nil, nil, fmt.Errorf("bad protocol from MASTER, the first byte is not '$' (we received '%s')", line)
+		}
+	}
+}
+
+// loadMasterSnapshot replaces the dataset with the snapshot of the master, which
+// goes on with the history id from offset. The replicas of this server have to
+// synchronize again, and the AOF is rewritten so it holds the new dataset.
+func loadMasterSnapshot(data []byte, id string, offset int64) error {
+	execMu.Lock()
+	defer execMu.Unlock()
+
+	fmt.Println("MASTER <-> REPLICA sync: Flushing old data")
+	for _, db := range databases {
+		emptyDB(db)
+	}
+	flushLibraries()
+	disconnectReplicas()
+
+	fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory")
+	if _, err := loadRdbData(data); err != nil {
+		return fmt.Errorf("failed trying to load the MASTER synchronization DB from socket: %w", err)
+	}
+
+	// The history of this server is now the one of the master
+	replID = id
+	replID2 = strings.Repeat("0", replIDLen)
+	secondReplOffset = -1
+	masterReplOffset.Store(offset)
+	resetReplBacklog()
+
+	if serverAof != nil {
+		if err := serverAof.rewriteBackground(); err != nil {
+			fmt.Println("Error rewriting the AOF after the synchronization:", err)
+		}
+	}
+	return nil
+}
+
+// continueReplication goes on with the history id of the master after a partial
+// resynchronization. If the master has a new one, this server has it from now
+// on, and its replicas reconnect to learn it.
+func continueReplication(id string) {
+	execMu.Lock()
+	defer execMu.Unlock()
+
+	if id != replID {
+		replID2 = replID
+		secondReplOffset = masterReplOffset.Load() + 1
+		replID = id
+		fmt.Printf("Master replication ID changed to %s\n", id)
+		disconnectReplicas()
+	}
+
+	replMu.Lock()
+	exists := replBacklogBuf != nil
+	replMu.Unlock()
+	if !exists {
+		resetReplBacklog()
+	}
+}
+
+// applyStream applies the commands the master sends until the connection
+// breaks, and sends them on to the replicas. The client of the link runs them,
+// so it keeps track of the database selected.
+func (l *masterLink) applyStream(resp *Resp) error {
+	for {
+		value, err := resp.Read()
+		if err != nil {
+			return err
+		}
+		l.lastIO.Store(time.Now().Unix())
+		if value.typ != ValueTypArray || len(value.array) == 0 {
+			continue
+		}
+
+		if cmd, ok := Commands[strings.ToUpper(value.array[0].bulk)]; ok {
+			// Commands that would block, like in the AOF, must run as if
+			// there was no data to wait for. The offset counts the command
+			// before it runs, so REPLCONF GETACK acknowledges itself too.
+			execMu.Lock()
+			propagateFromMaster(value.Marshal())
+			noBlocking.Store(true)
+			execute(l.client, cmd, value)
+			noBlocking.Store(false)
+			execMu.Unlock()
+		} else {
+			fmt.Println("Invalid command from MASTER:", value.array[0].bulk)
+			execMu.Lock()
+			propagateFromMaster(value.Marshal())
+			execMu.Unlock()
+		}
+	}
+}
+
+// startReplication starts replicating from the master set in the configuration,
+// once the dataset is loaded.
+func startReplication() {
+	execMu.RLock()
+	defer execMu.RUnlock()
+
+	if replicaOf != nil {
+		go replicaOf.run()
+	}
+}
+
+// replicaofCommand handles the REPLICAOF and SLAVEOF commands.
+func replicaofCommand(c *Client, args []Value) Value {
+	if config.clusterEnabled {
+		return Value{typ: ValueTypSimpleError, str: "ERR REPLICAOF not allowed in cluster mode."}
+	}
+
+	host, portArg := args[0].bulk, args[1].bulk
+	if strings.EqualFold(host, "no") && strings.EqualFold(portArg, "one") {
+		if replicaOf != nil {
+			unsetMaster()
+			fmt.Printf("MASTER MODE enabled (user request from '%s')\n", clientAddr(c))
+		}
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port < 0 || port > 65535 {
+		return Value{typ: ValueTypSimpleError, str: "ERR Invalid master port"}
+	}
+	if currentFailover != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR REPLICAOF not allowed while failing over."}
+	}
+	if replicaOf != nil && replicaOf.host == host && replicaOf.port == port {
+		return Value{typ: ValueTypSimpleString, str: "OK Already connected to specified master"}
+	}
+
+	if replicaOf != nil {
+		replicaOf.stop()
+	}
+	disconnectReplicas()
+	replicaOf = newMasterLink(host, port)
+	go replicaOf.run()
+
+	fmt.Printf("REPLICAOF %s enabled (user request from '%s')\n", replicaOf.addr(), clientAddr(c))
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// unsetMaster stops replicating and makes this server a master, which goes on
+// with the history of its old master under a new replication ID. The caller
+// must hold execMu for writing.
+func unsetMaster() {
+	replicaOf.stop()
+	replicaOf = nil
+	shiftReplID()
+	expireHiddenKeys()
+}
+
+// clientAddr returns the address of the client, for the log.
+func clientAddr(c *Client) string {
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.RemoteAddr().String()
+}
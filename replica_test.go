@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPsync(t *testing.T) {
+	defer func(id string, offset int64) {
+		replID = id
+		masterReplOffset.Store(offset)
+	}(replID, masterReplOffset.Load())
+
+	// This server asks to continue its history from offset 43
+	id := strings.Repeat("a", replIDLen)
+	other := strings.Repeat("b", replIDLen)
+	tests := []struct {
+		name       string
+		reply      string
+		full       bool
+		wantID     string // Empty for a new random ID
+		wantOffset int64
+		sent       string // Sent after PSYNC, if anything
+	}{
+		{"full resync", "+FULLRESYNC " + other + " 1000\r\n", true, other, 1000, ""},
+		{"continue", "+CONTINUE " + other + "\r\n", false, other, 0, ""},
+		{"continue without id", "+CONTINUE\r\n", false, id, 0, ""},
+		{"after newlines", "\n\r\n+CONTINUE " + other + "\r\n", false, other, 0, ""},
+		{"psync unknown", "-ERR unknown command 'PSYNC'\r\n", true, "", 0, "*1\r\n$4\r\nSYNC\r\n"},
+		{"not a status", ":1\r\n", true, "", 0, "*1\r\n$4\r\nSYNC\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replID = id
+			masterReplOffset.Store(42)
+
+			conn, peer := net.Pipe()
+			sent := make(chan string)
+			go func() {
+				p, _ := io.ReadAll(peer)
+				sent <- string(p)
+			}()
+
+			full, gotID, offset, err := psync(conn, bufio.NewReader(strings.NewReader(tt.reply)), false)
+			conn.Close()
+			if err != nil {
+				t.Fatalf("psync: %v", err)
+			}
+			if full != tt.full || offset != tt.wantOffset {
+				t.Fatalf("got full %v from offset %d, want full %v from offset %d", full, offset, tt.full, tt.wantOffset)
+			}
+			if tt.wantID != "" && gotID != tt.wantID || tt.wantID == "" && (len(gotID) != replIDLen || gotID == id) {
+				t.Fatalf("got ID %q, want %q", gotID, tt.wantID)
+			}
+			want := string(commandValue("PSYNC", id, "43").Marshal()) + tt.sent
+			if got := <-sent; got != want {
+				t.Fatalf("sent %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPsyncInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"no master link", "-NOMASTERLINK Can't SYNC while not connected with my master\r\n", "master is currently unable to PSYNC"},
+		{"loading", "-LOADING Redis is loading the dataset in memory\r\n", "master is currently unable to PSYNC"},
+		{"bad offset", "+FULLRESYNC id x\r\n", "bad FULLRESYNC reply"},
+		{"unknown status", "+OK\r\n", "unexpected reply to PSYNC from master"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			go io.Copy(io.Discard, peer)
+			defer conn.Close()
+
+			_, _, _, err := psync(conn, bufio.NewReader(strings.NewReader(tt.reply)), false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSyncPayload(t *testing.T) {
+	mark := strings.Repeat("m", rdbEOFMarkLen)
+	tests := []struct {
+		name     string
+		data     string
+		want     string
+		wantRest string // Read after the payload
+	}{
+		{"bulk", "$5\r\nREDIS", "REDIS", ""},
+		{"empty bulk", "$0\r\n", "", ""},
+		{"after newlines", "\n\n\r\n$5\r\nREDIS", "REDIS", ""},
+		{"eof mark", "$EOF:" + mark + "\r\nREDIS" + mark, "REDIS", ""},
+		{"eof mark then stream", "$EOF:" + mark + "\r\nREDIS" + mark + "*1\r\n$4\r\nPING\r\n", "REDIS", "*1\r\n$4\r\nPING\r\n"},
+		{"eof mark in a long payload", "$EOF:" + mark + "\r\n" + strings.Repeat("mx", 100) + mark, strings.Repeat("mx", 100), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reads of 7 bytes split the mark across reads
+			rd := bufio.NewReaderSize(chunkReader{strings.NewReader(tt.data), 7}, 16)
+			data, rest, err := readSyncPayload(rd)
+			if err != nil {
+				t.Fatalf("readSyncPayload: %v", err)
+			}
+
+			// What follows is partly in rest, partly still in the reader
+			unread, _ := io.ReadAll(rd)
+			rest = append(rest, unread...)
+			if string(data) != tt.want || string(rest) != tt.wantRest {
+				t.Fatalf("got %q then %q, want %q then %q", data, rest, tt.want, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestReadSyncPayloadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"error", "-ERR snapshot failed\r\n", "ERR snapshot failed"},
+		{"not a bulk", "+OK\r\n", "bad protocol from MASTER"},
+		{"negative length", "$-1\r\n", "bad protocol from MASTER"},
+		{"short mark", "$EOF:abc\r\nREDIS", "bad protocol from MASTER"},
+		{"truncated bulk", "$10\r\nREDIS", "unexpected EOF"},
+		{"no final mark", "$EOF:" + strings.Repeat("m", rdbEOFMarkLen) + "\r\nREDIS", "EOF"},
+		{"nothing", "", "EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readSyncPayload(bufio.NewReader(strings.NewReader(tt.data)))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	defer func(link *masterLink, readOnly bool) {
+		replicaOf = link
+		config.replicaReadOnly = readOnly
+	}(replicaOf, config.replicaReadOnly)
+
+	readOnly := "-READONLY You can't write against a read only replica.\r\n"
+	tests := []struct {
+		name     string
+		readOnly bool
+		steps    []step
+	}{
+		{"reads", true, []step{
+			{0, []string{"GET", "a"}, "$-1\r\n"},
+			{0, []string{"SORT_RO", "l"}, "*0\r\n"},
+			{0, []string{"FUNCTION", "LIST"}, "*0\r\n"},
+		}},
+		{"writes", true, []step{
+			{0, []string{"SET", "a", "1"}, readOnly},
+			{0, []string{"DEL", "a"}, readOnly},
+			{0, []string{"SORT", "l"}, readOnly},
+			{0, []string{"SORT", "l", "STORE", "dst"}, readOnly},
+			{0, []string{"FUNCTION", "FLUSH"}, readOnly},
+			{0, []string{"GET", "a"}, "$-1\r\n"},
+		}},
+		{"write in a transaction", true, []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"GET", "a"}, "+QUEUED\r\n"},
+			{0, []string{"SET", "a", "1"}, readOnly},
+			{0, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		}},
+		{"writable", false, []step{
+			{0, []string{"SET", "a", "1"}, "+OK\r\n"},
+			{0, []string{"GET", "a"}, "$1\r\n1\r\n"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			replicaOf = newMasterLink("127.0.0.1", 6379)
+			config.replicaReadOnly = tt.readOnly
+			defer func() { replicaOf = nil }()
+
+			runAll(t, tt.steps, c)
+		})
+	}
+}
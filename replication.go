@@ -0,0 +1,838 @@
+/*
+This file contains the master side of replication. A replica connects like any
+client and asks with PSYNC for the stream of write commands from where it left
+off, naming the replication ID of the history it has. If this server shares the
+history and its backlog still holds the stream from there, it only sends what's
+missing. Otherwise it replies FULLRESYNC with its ID and offset, followed by a
+snapshot of the dataset in the RDB format, as it does for the older SYNC. From
+then on every write command that runs is sent to the replica, preceded by a
+SELECT when the database changes, so it applies the same changes. The snapshot
+is taken when the command runs but written in the background, either to a file
+that is then sent with its length, or with repl-diskless-sync straight to the
+replica between two EOF marks. The commands are queued for each replica
+meanwhile, and once the snapshot is sent a goroutine of the replica sends them,
+so neither the transfer nor a slow replica hold up the clients. The replication
+offset counts the bytes of this stream, and each client remembers the offset of
+its last write. Before synchronizing, a replica tells with REPLCONF the port it
+listens on and what it's capable of, like receiving snapshots between EOF marks.
+Afterwards it acknowledges the offset it processed with REPLCONF ACK every
+second, or right away when asked with REPLCONF GETACK on the stream, which lets
+WAIT block a client until enough replicas have its writes. INFO and ROLE report
+the offsets of the replicas and how long ago they acknowledged them. With
+min-replicas-to-write set, writes are refused unless that many replicas
+acknowledged within min-replicas-max-lag seconds, which bounds the writes lost
+when the master is cut off from its replicas. The replica side of the link is in replica.go. For a
+detailed description of replication, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/replication/
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// masterReplOffset is the replication offset of this server, the number of
+// bytes of write commands propagated so far.
+var masterReplOffset atomic.Int64
+
+// replID identifies the history of the dataset the replication offset counts
+// in. When a replica becomes a master it starts a new history, and replID2
+// keeps the ID of the one it shared with its master up to secondReplOffset, so
+// the other replicas can continue from it. They're guarded by execMu.
+var replID = randomHex(replIDLen)
+var replID2 = strings.Repeat("0", replIDLen)
+var secondReplOffset int64 = -1
+
+// replIDLen is the length of a replication ID.
+const replIDLen = 40
+
+// States of a replica, as reported by INFO
+const (
+	replicaStateWaitBgsave = "wait_bgsave" // The snapshot is being written
+	replicaStateSendBulk   = "send_bulk"   // The snapshot is being sent
+	replicaStateOnline     = "online"      // The stream of commands is being sent
+)
+
+// replKeepaliveInterval is how often a newline is sent to a replica waiting for
+// its snapshot, so it knows the master is alive.
+const replKeepaliveInterval = time.Second
+
+// rdbEOFMarkLen is the length of the random mark that delimits a snapshot sent
+// without knowing its length in advance.
+const rdbEOFMarkLen = 40
+
+// replica is a replica connected to this server.
+type replica struct {
+	client        *Client
+	listeningPort int       // Port the replica accepts clients on
+	ackOffset     int64     // Replication offset the replica last acknowledged
+	ackTime       time.Time // When the replica last acknowledged
+
+	mu      sync.Mutex
+	state   string
+	pending []byte        // Replication stream not sent yet, held back until online
+	wake    chan struct{} // Signalled when pending grows or the replica is dropped
+	dropped bool
+}
+
+// replicas maps the ID of the client of every connected replica to its state.
+// ackWaiters holds the wakeup channels of the clients waiting in WAIT, which
+// are signalled when a replica acknowledges an offset.
+var replicas = map[int64]*replica{}
+var ackWaiters = map[chan struct{}]struct{}{}
+var replicasMu = sync.Mutex{}
+
+// replSelectedDB is the database selected by the last SELECT sent to the
+// replicas, -1 if a replica may not have seen it. replMu keeps the stream in
+// the same order for every replica and the backlog, and the offset in step
+// with it.
+var replSelectedDB = -1
+var replMu = sync.Mutex{}
+
+// propagate sends a write command that ran against database db to the replicas
+// and counts it in the replication offset. It returns the offset right after it.
+func propagate(db int, value Value) int64 {
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	p := []byte{}
+	if db != replSelectedDB {
+		p = append(p, aofSelect(db)...)
+		replSelectedDB = db
+	}
+	mirrorFeed(db, value)
+	return feedReplicationStream(value.MarshalTo(p))
+}
+
+// propagateInstead makes commands persisted and replicated in place of the
+// command c is running, for commands whose effect depends on what they picked
+// when they ran, such as the ID XADD generated. No commands means the command
+// changed nothing worth propagating.
+func (c *Client) propagateInstead(commands ...Value) {
+	c.propagated = append([]Value{}, commands...)
+}
+
+// unchanged records that the command c is running changed nothing, so it's
+// neither persisted nor replicated, and the keys it names aren't signalled as
+// modified.
+func (c *Client) unchanged() {
+	c.propagateInstead()
+}
+
+// propagateFromMaster sends on the stream of the master, as received, so the
+// replicas of this server see the same offsets. The caller must hold execMu
+// for writing.
+func propagateFromMaster(p []byte) {
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	// The stream may select a database the SELECTs of this server don't know of
+	replSelectedDB = -1
+	mirrorFeedRaw(p)
+	feedReplicationStream(p)
+}
+
+// feedReplicationStream appends p to the stream of the replicas and to the
+// backlog, and returns the replication offset right after it. The caller must
+// hold replMu.
+func feedReplicationStream(p []byte) int64 {
+	if replBacklogBuf != nil {
+		replBacklogBuf.write(p)
+	}
+
+	replicasMu.Lock()
+	for _, r := range replicas {
+		r.feed(p)
+	}
+	replicasMu.Unlock()
+
+	return masterReplOffset.Add(int64(len(p)))
+}
+
+// resetReplBacklog replaces the backlog with an empty one that starts after the
+// current offset.
+func resetReplBacklog() {
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	replBacklogBuf = newReplBacklog(config.replBacklogSize, masterReplOffset.Load())
+}
+
+// shiftReplID starts a new history when this server stops replicating from its
+// master, remembering the one it shared with it. The caller must hold execMu
+// for writing.
+func shiftReplID() {
+	replID2 = replID
+	secondReplOffset = masterReplOffset.Load() + 1
+	replID = randomHex(replIDLen)
+	fmt.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s\n",
+		replID2, secondReplOffset, replID)
+}
+
+// feed queues p to be sent to the replica.
+func (r *replica) feed(p []byte) {
+	r.mu.Lock()
+	r.pending = append(r.pending, p...)
+	size := len(r.pending)
+	r.mu.Unlock()
+
+	// A replica that can't keep up is disconnected, and has to resync
+	c := r.client
+	if config.clientOutputLimits["replica"].reached(int64(size), &c.obufSoftLimitSince) &&
+		c.obufLimitReached.CompareAndSwap(false, true) {
+		fmt.Printf("Replica %s closed for overcoming of output buffer limits.\n", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replicaState returns the state of the replica.
+func (r *replica) replicaState() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state
+}
+
+// setState changes the state of the replica, waking up sendLoop.
+func (r *replica) setState(state string) {
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendLoop writes the queued stream to the replica once it's online, until it's
+// dropped. A write that fails closes the connection, which drops the replica.
+func (r *replica) sendLoop() {
+	for range r.wake {
+		r.mu.Lock()
+		if r.dropped {
+			r.mu.Unlock()
+			return
+		}
+		if r.state != replicaStateOnline {
+			r.mu.Unlock()
+			continue
+		}
+		pending := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+
+		if _, err := r.client.conn.Write(pending); err != nil {
+			r.client.conn.Close()
+			return
+		}
+	}
+}
+
+// dropReplica forgets the replica of the client with the given ID, if it is one.
+func dropReplica(id int64) {
+	replicasMu.Lock()
+	r, ok := replicas[id]
+	delete(replicas, id)
+	replicasMu.Unlock()
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	r.dropped = true
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	fmt.Printf("Connection with replica %s lost.\n", r.client.conn.RemoteAddr())
+}
+
+// disconnectReplicas closes the connections of every replica, so they
+// synchronize again with what this server becomes.
+func disconnectReplicas() {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	for _, r := range replicas {
+		r.client.conn.Close()
+	}
+}
+
+// syncCommand handles the SYNC command, with which a replica asks for the
+// dataset and the write commands that follow. It takes the place of the reply
+// and turns the connection into a replica, which gets no more replies.
+func syncCommand(c *Client, args []Value) Value {
+	if reply, ok := checkSyncAllowed(c); !ok {
+		return reply
+	}
+
+	fmt.Printf("Replica %s asks for synchronization\n", c.conn.RemoteAddr())
+	startFullSync(c, nil)
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// psyncCommand handles the PSYNC command, with which a replica asks for the
+// stream from an offset of the history with the given replication ID, which is
+// sent right away if the backlog holds it. Otherwise the replica gets a full
+// synchronization, like with SYNC.
+func psyncCommand(c *Client, args []Value) Value {
+	// The master of a replica failing over to it asks it to take over first
+	if len(args) > 2 && strings.EqualFold(args[2].bulk, "failover") {
+		if args[0].bulk != replID {
+			return Value{typ: ValueTypSimpleError, str: "ERR PSYNC FAILOVER replid must match my replid."}
+		}
+		if replicaOf != nil {
+			unsetMaster()
+			fmt.Printf("PSYNC FAILOVER request accepted from %s, becoming master.\n", c.conn.RemoteAddr())
+		}
+	}
+
+	if reply, ok := checkSyncAllowed(c); !ok {
+		return reply
+	}
+
+	id := args[0].bulk
+	offset, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+
+	fmt.Printf("Replica %s asks for synchronization\n", c.conn.RemoteAddr())
+	if tryPartialResync(c, id, offset) {
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+
+	// The snapshot is taken now, so the stream continues from this offset
+	fmt.Printf("Full resync requested by replica %s\n", c.conn.RemoteAddr())
+	startFullSync(c, []byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", replID, masterReplOffset.Load())))
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// isReplica reports whether the client with the given ID is a replica.
+func isReplica(id int64) bool {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	_, ok := replicas[id]
+	return ok
+}
+
+// checkSyncAllowed reports whether c may start replicating, with the reply to
+// send it if not.
+func checkSyncAllowed(c *Client) (Value, bool) {
+	if isReplica(c.id) {
+		return Value{typ: ValueTypSimpleString, str: "OK"}, false
+	}
+
+	// A replica that isn't in sync with its own master has nothing to send
+	if replicaOf != nil && replicaOf.linkState() != linkStateConnected {
+		return Value{typ: ValueTypSimpleError, str: "NOMASTERLINK Can't SYNC while not connected with my master"}, false
+	}
+	return Value{}, true
+}
+
+// tryPartialResync makes c a replica that continues from offset, if it has the
+// same history as this server up to there and the backlog holds the stream from
+// there. The caller must hold execMu for writing.
+func tryPartialResync(c *Client, id string, offset int64) bool {
+	if id != replID && (id != replID2 || offset > secondReplOffset) {
+		if id != "?" {
+			fmt.Printf("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')\n",
+				id, replID, replID2)
+		}
+		return false
+	}
+
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	if replBacklogBuf == nil {
+		return false
+	}
+	backlog, ok := replBacklogBuf.readFrom(offset)
+	if !ok {
+		fmt.Printf("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).\n",
+			c.conn.RemoteAddr(), offset)
+		return false
+	}
+
+	// The replica learns the current ID in case it asked for the previous one
+	r := newReplica(c, replicaStateOnline)
+	if c.hasReplCapa("psync2") {
+		r.feed([]byte("+CONTINUE " + replID + "\r\n"))
+	} else {
+		r.feed([]byte("+CONTINUE\r\n"))
+	}
+	r.feed(backlog)
+	replicasMu.Lock()
+	replicas[c.id] = r
+	replicasMu.Unlock()
+
+	c.replyMode = ReplyModeOff
+	go r.sendLoop()
+
+	fmt.Printf("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.\n",
+		c.conn.RemoteAddr(), len(backlog), offset)
+	return true
+}
+
+// startFullSync makes c a replica and sends it a snapshot of the dataset,
+// preceded by header. The caller must hold execMu for writing.
+func startFullSync(c *Client, header []byte) {
+	// The stream starts right where the snapshot ends, since nothing runs
+	// while it's taken
+	snap := takeSnapshot()
+	r := newReplica(c, replicaStateWaitBgsave)
+
+	replMu.Lock()
+	if replBacklogBuf == nil {
+		replBacklogBuf = newReplBacklog(config.replBacklogSize, masterReplOffset.Load())
+	}
+	replSelectedDB = -1
+	replicasMu.Lock()
+	replicas[c.id] = r
+	replicasMu.Unlock()
+	replMu.Unlock()
+
+	c.replyMode = ReplyModeOff
+	go r.sendLoop()
+	go r.fullSync(snap, header, config.replDisklessSync && c.hasReplCapa("eof"))
+}
+
+// newReplica creates the state of the replica on the connection of c, with the
+// settings it sent with REPLCONF.
+func newReplica(c *Client, state string) *replica {
+	// The stream is written straight to the connection, after the replies
+	// still buffered
+	c.writer.Flush()
+
+	// The stream may be sent in fewer, larger packets, at the cost of the
+	// replica lagging further behind
+	if tcpConn, ok := c.conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(!config.replDisableTCPNodelay)
+	}
+
+	return &replica{
+		client:        c,
+		listeningPort: c.replListeningPort,
+		ackTime:       time.Now(),
+		state:         state,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// hasReplCapa reports whether the replica on the connection of c announced the
+// capability capa with REPLCONF.
+func (c *Client) hasReplCapa(capa string) bool {
+	return slices.Contains(c.replCapa, capa)
+}
+
+// fullSync sends header and snap to the replica, after which the commands
+// queued meanwhile are sent. The connection is closed if that fails.
+func (r *replica) fullSync(snap *rdbSnapshot, header []byte, diskless bool) {
+	_, err := r.client.conn.Write(header)
+	if err == nil && diskless {
+		fmt.Printf("Starting BGSAVE for SYNC with target: replicas sockets\n")
+		err = r.sendSnapshotDiskless(snap)
+	} else if err == nil {
+		fmt.Printf("Starting BGSAVE for SYNC with target: disk\n")
+		err = r.sendSnapshotFile(snap)
+	}
+	if err != nil {
+		fmt.Printf("Error sending the snapshot to replica %s: %s\n", r.client.conn.RemoteAddr(), err)
+		r.client.conn.Close()
+		return
+	}
+
+	r.setState(replicaStateOnline)
+	fmt.Printf("Synchronization with replica %s succeeded\n", r.client.conn.RemoteAddr())
+}
+
+// sendSnapshotFile writes snap to a temporary file, sending newlines to the
+// replica meanwhile, and then sends the file preceded by its length.
+func (r *replica) sendSnapshotFile(snap *rdbSnapshot) error {
+	f, err := os.CreateTemp(".", fmt.Sprintf("temp-repl-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	done := make(chan struct{})
+	keepalive := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(replKeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				keepalive <- nil
+				return
+			case <-ticker.C:
+				if _, err := r.client.conn.Write([]byte("\n")); err != nil {
+					keepalive <- err
+					return
+				}
+			}
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	err = snap.write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	close(done)
+	if kaErr := <-keepalive; err == nil {
+		err = kaErr
+	}
+	if err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r.setState(replicaStateSendBulk)
+	if _, err := r.client.conn.Write([]byte("$" + strconv.FormatInt(size, 10) + "\r\n")); err != nil {
+		return err
+	}
+	_, err = io.Copy(r.client.conn, f)
+	return err
+}
+
+// sendSnapshotDiskless writes snap straight to the replica. Its length isn't
+// known in advance, so it's preceded and followed by a random mark instead.
+func (r *replica) sendSnapshotDiskless(snap *rdbSnapshot) error {
+	mark := randomHex(rdbEOFMarkLen)
+	r.setState(replicaStateSendBulk)
+
+	w := bufio.NewWriter(r.client.conn)
+	w.WriteString("$EOF:" + mark + "\r\n")
+	if err := snap.write(w); err != nil {
+		return err
+	}
+	w.WriteString(mark)
+	return w.Flush()
+}
+
+// randomHex returns a random string of n hexadecimal characters.
+func randomHex(n int) string {
+	b := make([]byte, (n+1)/2)
+	if _, err := rand.Read(b); err != nil {
+		panic("reading random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)[:n]
+}
+
+// replconfCommand handles the REPLCONF command.
+func replconfCommand(c *Client, args []Value) Value {
+	if len(args)%2 != 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i].bulk) {
+		case "listening-port":
+			port, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil || port < 0 || port > 65535 {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			c.replListeningPort = port
+		case "capa":
+			c.replCapa = append(c.replCapa, strings.ToLower(args[i+1].bulk))
+		case "ack":
+			// Acknowledgements are never replied to, they're part of the stream
+			if offset, err := strconv.ParseInt(args[i+1].bulk, 10, 64); err == nil {
+				replicaAck(c.id, offset)
+			}
+			return Value{typ: ValueTypNoReply}
+		case "getack":
+			// Only the master may ask, on the replication stream
+			if c.master && replicaOf != nil {
+				replicaOf.sendAck()
+			}
+			return Value{typ: ValueTypNoReply}
+		default:
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", args[i].bulk)}
+		}
+	}
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// goodReplicas returns the number of online replicas that acknowledged within
+// min-replicas-max-lag seconds.
+func goodReplicas() int {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	n := 0
+	for _, r := range replicas {
+		lag := int(time.Since(r.ackTime).Seconds())
+		if r.replicaState() == replicaStateOnline && lag <= config.minReplicasMaxLag {
+			n++
+		}
+	}
+	return n
+}
+
+// minReplicasCheck checks whether c may run the command in argv, returning the
+// NOREPLICAS error to reply with if it's a write and this master has fewer good
+// replicas than min-replicas-to-write. Fake clients, like the one replaying the
+// AOF, have no user and may write anyway. The caller must hold execMu.
+func minReplicasCheck(c *Client, cmd *Command, argv []Value) *Value {
+	if replicaOf != nil || config.minReplicasToWrite == 0 || config.minReplicasMaxLag == 0 ||
+		c.user == nil || !cmd.isWrite(argv[1:]) {
+		return nil
+	}
+	if goodReplicas() >= config.minReplicasToWrite {
+		return nil
+	}
+	return &Value{typ: ValueTypSimpleError, str: "NOREPLICAS Not enough good replicas to write."}
+}
+
+// requestAcks asks the replicas with REPLCONF GETACK on the replication stream
+// to acknowledge their offset right away.
+func requestAcks() {
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	feedReplicationStream(commandValue("REPLCONF", "GETACK", "*").Marshal())
+}
+
+// replicaAck records that the replica of the given client processed everything
+// up to offset, waking up the clients waiting for acknowledgements.
+func replicaAck(id int64, offset int64) {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	r, ok := replicas[id]
+	if !ok {
+		return
+	}
+	r.ackTime = time.Now()
+	if offset <= r.ackOffset {
+		return
+	}
+	r.ackOffset = offset
+
+	for ch := range ackWaiters {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicasAcked returns the number of replicas that acknowledged offset.
+func replicasAcked(offset int64) int {
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	n := 0
+	for _, r := range replicas {
+		if r.ackOffset >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// waitCommand handles the WAIT command.
+func waitCommand(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'wait' command"}
+	}
+
+	numReplicas, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	timeout, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR timeout is not an integer or out of range"}
+	}
+	if timeout < 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR timeout is negative"}
+	}
+
+	// Inside a transaction nobody else can run, so the count can't change
+	acked := replicasAcked(c.woff)
+	if acked >= numReplicas || noBlocking.Load() {
+		return Value{typ: ValueTypInteger, num: acked}
+	}
+
+	ch := make(chan struct{}, 1)
+	replicasMu.Lock()
+	ackWaiters[ch] = struct{}{}
+	replicasMu.Unlock()
+	defer func() {
+		replicasMu.Lock()
+		delete(ackWaiters, ch)
+		replicasMu.Unlock()
+	}()
+
+	// The replicas acknowledge once a second unless asked to do it now
+	requestAcks()
+
+	// A zero timeout waits forever
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		if acked = replicasAcked(c.woff); acked >= numReplicas {
+			break
+		}
+
+		// Let other commands run while waiting
+		execMu.RUnlock()
+		select {
+		case <-ch:
+			execMu.RLock()
+			continue
+		case <-expired:
+			execMu.RLock()
+		}
+		break
+	}
+
+	return Value{typ: ValueTypInteger, num: replicasAcked(c.woff)}
+}
+
+// roleCommand handles the ROLE command.
+func roleCommand(c *Client, args []Value) Value {
+	if replicaOf != nil {
+		return Value{typ: ValueTypArray, array: []Value{
+			bulkValue("slave"),
+			bulkValue(replicaOf.host),
+			{typ: ValueTypInteger, num: replicaOf.port},
+			bulkValue(replicaOf.linkState()),
+			{typ: ValueTypInteger, num: int(masterReplOffset.Load())},
+		}}
+	}
+
+	replicasMu.Lock()
+	ids := make([]int64, 0, len(replicas))
+	for id := range replicas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	connected := make([]Value, 0, len(ids))
+	for _, id := range ids {
+		r := replicas[id]
+		host, _, _ := net.SplitHostPort(r.client.conn.RemoteAddr().String())
+		connected = append(connected, Value{typ: ValueTypArray, array: []Value{
+			bulkValue(host),
+			bulkValue(strconv.Itoa(r.listeningPort)),
+			bulkValue(strconv.FormatInt(r.ackOffset, 10)),
+		}})
+	}
+	replicasMu.Unlock()
+
+	return Value{typ: ValueTypArray, array: []Value{
+		bulkValue("master"),
+		{typ: ValueTypInteger, num: int(masterReplOffset.Load())},
+		{typ: ValueTypArray, array: connected},
+	}}
+}
+
+// replicationInfo returns the lines of the replication section.
+func replicationInfo() []string {
+	lines := []string{}
+	if replicaOf == nil {
+		lines = append(lines, "role:master")
+	} else {
+		state := replicaOf.linkState()
+		status := "down"
+		if state == linkStateConnected {
+			status = "up"
+		}
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+replicaOf.host,
+			"master_port:"+strconv.Itoa(replicaOf.port),
+			"master_link_status:"+status,
+			"master_last_io_seconds_ago:"+strconv.Itoa(replicaOf.lastIOSecondsAgo()),
+			"master_sync_in_progress:"+strconv.Itoa(boolToInt(state == linkStateSync)),
+			"slave_repl_offset:"+strconv.FormatInt(masterReplOffset.Load(), 10),
+		)
+	}
+
+	good := goodReplicas()
+	replicasMu.Lock()
+	ids := make([]int64, 0, len(replicas))
+	for id := range replicas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	lines = append(lines, "connected_slaves:"+strconv.Itoa(len(ids)))
+	if config.minReplicasToWrite > 0 && config.minReplicasMaxLag > 0 {
+		lines = append(lines, "min_slaves_good_slaves:"+strconv.Itoa(good))
+	}
+	for i, id := range ids {
+		r := replicas[id]
+		host, _, _ := net.SplitHostPort(r.client.conn.RemoteAddr().String())
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, host, r.listeningPort, r.replicaState(), r.ackOffset, int(time.Since(r.ackTime).Seconds())))
+	}
+	replicasMu.Unlock()
+	lines = append(lines, mirrorInfo()...)
+
+	replMu.Lock()
+	defer replMu.Unlock()
+
+	lines = append(lines,
+		"master_failover_state:"+failoverState(),
+		"master_replid:"+replID,
+		"master_replid2:"+replID2,
+		"master_repl_offset:"+strconv.FormatInt(masterReplOffset.Load(), 10),
+		"second_repl_offset:"+strconv.FormatInt(secondReplOffset, 10),
+	)
+	if replBacklogBuf == nil {
+		return append(lines,
+			"repl_backlog_active:0",
+			"repl_backlog_size:"+strconv.FormatInt(config.replBacklogSize, 10),
+			"repl_backlog_first_byte_offset:0",
+			"repl_backlog_histlen:0",
+		)
+	}
+	return append(lines,
+		"repl_backlog_active:1",
+		"repl_backlog_size:"+strconv.Itoa(len(replBacklogBuf.buf)),
+		"repl_backlog_first_byte_offset:"+strconv.FormatInt(replBacklogBuf.firstOffset(), 10),
+		"repl_backlog_histlen:"+strconv.Itoa(replBacklogBuf.histlen),
+	)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTryPartialResync(t *testing.T) {
+	defer func(id, id2 string, second int64, offset int64, backlog *replBacklog) {
+		replID, replID2, secondReplOffset = id, id2, second
+		masterReplOffset.Store(offset)
+		replBacklogBuf = backlog
+	}(replID, replID2, secondReplOffset, masterReplOffset.Load(), replBacklogBuf)
+	resetDatabases()
+
+	// The backlog holds the stream from offset 103 to 110, and this server
+	// shared the history of its previous ID up to offset 106
+	id := strings.Repeat("a", replIDLen)
+	id2 := strings.Repeat("b", replIDLen)
+	tests := []struct {
+		name    string
+		id      string
+		offset  int64
+		capa    []string
+		backlog bool
+		want    string // Sent to the replica, empty if it gets a full resync
+	}{
+		{"current id", id, 105, []string{"psync2"}, true, "+CONTINUE " + id + "\r\nefghij"},
+		{"without psync2", id, 105, nil, true, "+CONTINUE\r\nefghij"},
+		{"up to date", id, 111, []string{"psync2"}, true, "+CONTINUE " + id + "\r\n"},
+		{"previous id", id2, 106, []string{"psync2"}, true, "+CONTINUE " + id + "\r\nfghij"},
+		{"previous id after it changed", id2, 107, []string{"psync2"}, true, ""},
+		{"unknown id", strings.Repeat("c", replIDLen), 105, []string{"psync2"}, true, ""},
+		{"no history", "?", -1, []string{"psync2"}, true, ""},
+		{"dropped from the backlog", id, 102, []string{"psync2"}, true, ""},
+		{"ahead of the master", id, 112, []string{"psync2"}, true, ""},
+		{"no backlog", id, 105, []string{"psync2"}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replID, replID2, secondReplOffset = id, id2, 106
+			masterReplOffset.Store(110)
+			replBacklogBuf = nil
+			if tt.backlog {
+				replBacklogBuf = newReplBacklog(8, 100)
+				replBacklogBuf.write([]byte("abcdefghij"))
+			}
+
+			server, peer := net.Pipe()
+			c := newClient(server)
+			defer peer.Close()
+			defer c.close()
+			c.replCapa = tt.capa
+
+			ok := tryPartialResync(c, tt.id, tt.offset)
+			if ok != (tt.want != "") {
+				t.Fatalf("got partial resync %v, want %v", ok, tt.want != "")
+			}
+			if !ok {
+				if isReplica(c.id) {
+					t.Fatal("the client became a replica")
+				}
+				return
+			}
+
+			got := make([]byte, len(tt.want))
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatalf("reading the stream: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFullSync(t *testing.T) {
+	defer func(diskless bool, backlog *replBacklog) {
+		config.replDisklessSync = diskless
+		replBacklogBuf = backlog
+	}(config.replDisklessSync, replBacklogBuf)
+
+	tests := []struct {
+		name     string
+		diskless bool
+		capa     []string
+	}{
+		{"disk", false, []string{"eof", "psync2"}},
+		{"diskless", true, []string{"eof", "psync2"}},
+		{"diskless without eof", true, []string{"psync2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.replDisklessSync = tt.diskless
+			w := newTestClient(t)
+			run(w, "SET", "a", "1")
+
+			server, peer := net.Pipe()
+			c := newClient(server)
+			defer peer.Close()
+			defer c.close()
+			c.replCapa = tt.capa
+
+			offset := masterReplOffset.Load()
+			if got := run(c, "PSYNC", "?", "-1"); got != "+OK\r\n" {
+				t.Fatalf("PSYNC: got %q", got)
+			}
+			// Written while the snapshot is sent, so it's sent after it
+			run(w, "SET", "b", "2")
+
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			rd := bufio.NewReader(peer)
+			header, err := rd.ReadString('\n')
+			if want := "+FULLRESYNC " + replID + " " + strconv.FormatInt(offset, 10) + "\r\n"; err != nil || header != want {
+				t.Fatalf("got header %q, %v, want %q", header, err, want)
+			}
+
+			data, rest, err := readSyncPayload(rd)
+			if err != nil {
+				t.Fatalf("readSyncPayload: %v", err)
+			}
+			keys := map[string]string{}
+			_, err = parseRdb(data, rdbHandler{key: func(db int, key string, obj Object, expire time.Time) error {
+				keys[key] = obj.str
+				return nil
+			}})
+			if err != nil || len(keys) != 1 || keys["a"] != "1" {
+				t.Fatalf("got snapshot of %v, %v, want a=1 only", keys, err)
+			}
+
+			want := string(aofSelect(0)) + string(commandValue("SET", "b", "2").Marshal())
+			stream := make([]byte, len(want))
+			n := copy(stream, rest)
+			if _, err := io.ReadFull(rd, stream[n:]); err != nil {
+				t.Fatalf("reading the stream: %v", err)
+			}
+			if string(stream) != want {
+				t.Fatalf("got stream %q, want %q", stream, want)
+			}
+		})
+	}
+}
+
+func TestReplconf(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"settings", []step{
+			{0, []string{"REPLCONF", "listening-port", "6380"}, "+OK\r\n"},
+			{0, []string{"REPLCONF", "capa", "eof", "capa", "PSYNC2"}, "+OK\r\n"},
+		}},
+		{"odd arguments", []step{
+			{0, []string{"REPLCONF", "listening-port"}, "-ERR syntax error\r\n"},
+		}},
+		{"bad port", []step{
+			{0, []string{"REPLCONF", "listening-port", "x"}, "-ERR value is not an integer or out of range\r\n"},
+			{0, []string{"REPLCONF", "listening-port", "65536"}, "-ERR value is not an integer or out of range\r\n"},
+		}},
+		{"unknown option", []step{
+			{0, []string{"REPLCONF", "speed", "fast"}, "-ERR Unrecognized REPLCONF option: speed\r\n"},
+		}},
+		{"ack", []step{
+			{0, []string{"REPLCONF", "ACK", "100"}, ""},
+			{0, []string{"REPLCONF", "ACK", "x"}, ""},
+		}},
+		{"getack from a client", []step{
+			{0, []string{"REPLCONF", "GETACK", "*"}, ""},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runAll(t, tt.steps, newTestClient(t))
+		})
+	}
+}
+
+func TestReplicaAck(t *testing.T) {
+	c := newTestClient(t)
+	run(c, "REPLCONF", "listening-port", "6380")
+	r := newReplica(c, replicaStateOnline)
+	r.ackTime = time.Now().Add(-5 * time.Second)
+	replicasMu.Lock()
+	replicas[c.id] = r
+	replicasMu.Unlock()
+
+	tests := []struct {
+		name  string
+		ack   string
+		want  int64
+		acked int // Replicas that acknowledged offset 100
+	}{
+		{"first", "100", 100, 1},
+		{"behind", "50", 100, 1},
+		{"ahead", "150", 150, 1},
+		{"not a number", "x", 150, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(c, "REPLCONF", "ACK", tt.ack)
+			if got := replicasAcked(100); got != tt.acked {
+				t.Fatalf("got %d replicas acknowledging, want %d", got, tt.acked)
+			}
+
+			// Any acknowledgement shows the replica is alive
+			want := fmt.Sprintf("port=6380,state=online,offset=%d,lag=0", tt.want)
+			if info := strings.Join(replicationInfo(), "\n"); !strings.Contains(info, want) {
+				t.Fatalf("got %q, want %q in it", info, want)
+			}
+		})
+	}
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	defer func(toWrite, maxLag int) {
+		config.minReplicasToWrite, config.minReplicasMaxLag = toWrite, maxLag
+	}(config.minReplicasToWrite, config.minReplicasMaxLag)
+
+	type fakeReplica struct {
+		state string
+		lag   time.Duration
+	}
+	tests := []struct {
+		name     string
+		replicas []fakeReplica
+		toWrite  int
+		maxLag   int
+		enough   bool
+	}{
+		{"disabled", nil, 0, 10, true},
+		{"no max lag", nil, 1, 0, true},
+		{"enough", []fakeReplica{{replicaStateOnline, 0}, {replicaStateOnline, 2 * time.Second}}, 2, 10, true},
+		{"none", nil, 1, 10, false},
+		{"lagging", []fakeReplica{{replicaStateOnline, 0}, {replicaStateOnline, 20 * time.Second}}, 2, 10, false},
+		{"syncing", []fakeReplica{{replicaStateOnline, 0}, {replicaStateWaitBgsave, 0}}, 2, 10, false},
+	}
+
+	written := []step{
+		{0, []string{"SET", "a", "1"}, "+OK\r\n"},
+		{0, []string{"GET", "a"}, "$1\r\n1\r\n"},
+		{0, []string{"MULTI"}, "+OK\r\n"},
+		{0, []string{"SET", "a", "2"}, "+QUEUED\r\n"},
+		{0, []string{"EXEC"}, "*1\r\n+OK\r\n"},
+	}
+	refused := []step{
+		{0, []string{"SET", "a", "1"}, "-NOREPLICAS Not enough good replicas to write.\r\n"},
+		{0, []string{"GET", "a"}, "$-1\r\n"},
+		{0, []string{"MULTI"}, "+OK\r\n"},
+		{0, []string{"SET", "a", "2"}, "-NOREPLICAS Not enough good replicas to write.\r\n"},
+		{0, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			for _, fake := range tt.replicas {
+				rc := connectTestClient(t)
+				r := newReplica(rc, fake.state)
+				r.ackTime = time.Now().Add(-fake.lag)
+				replicasMu.Lock()
+				replicas[rc.id] = r
+				replicasMu.Unlock()
+			}
+			config.minReplicasToWrite, config.minReplicasMaxLag = tt.toWrite, tt.maxLag
+
+			if tt.enough {
+				runAll(t, written, c)
+			} else {
+				runAll(t, refused, c)
+			}
+		})
+	}
+}
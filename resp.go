@@ -1,9 +1,10 @@
 /*
 This is a partial implementation of the Redis Serialization Protocol (RESP) for
-educational purposes. RESP is used by Redis and supports different data types 
-including Simple Strings, Errors, Integers, Bulk Strings, and Arrays. For a 
-detailed description of the protocol and its data types, refer to the following 
-documentation:
+educational purposes. RESP is used by Redis and supports different data types
+including Simple Strings, Errors, Integers, Bulk Strings, and Arrays, and since
+RESP3 also Maps, Sets, Doubles, Booleans, Big Numbers, Verbatim Strings and Push
+messages. For a detailed description of the protocol and its data types, refer to
+the following documentation:
 
 https://redis.io/docs/latest/develop/reference/protocol-spec/#resp-protocol-description
 */
@@ -12,9 +13,15 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 // First byte of each RESP data type
@@ -24,6 +31,16 @@ const (
 	FB_INTEGER       = ':'
 	FB_BULK_STRING   = '$'
 	FB_ARRAY         = '*'
+
+	// RESP3 types
+	FB_NULL            = '_'
+	FB_DOUBLE          = ','
+	FB_BOOLEAN         = '#'
+	FB_BIG_NUMBER      = '('
+	FB_VERBATIM_STRING = '='
+	FB_MAP             = '%'
+	FB_SET             = '~'
+	FB_PUSH            = '>'
 )
 
 // ValueTyp represents the type of RESP value
@@ -36,20 +53,63 @@ const (
 	ValueTypBulkString   ValueTyp = "BULK_STRING"
 	ValueTypArray        ValueTyp = "ARRAY"
 	ValueTypNull         ValueTyp = "NULL"
+	ValueTypNullArray    ValueTyp = "NULL_ARRAY"
+	ValueTypNoReply      ValueTyp = "NO_REPLY" // Nothing is written, the reply was sent some other way
+
+	// RESP3 types. Over RESP2 they are written as the closest RESP2 type, so
+	// handlers can use them whatever protocol the connection speaks.
+	ValueTypMap            ValueTyp = "MAP"             // array holds alternating keys and values
+	ValueTypSet            ValueTyp = "SET"             // array holds the members
+	ValueTypDouble         ValueTyp = "DOUBLE"          // double holds the number
+	ValueTypBoolean        ValueTyp = "BOOLEAN"         // num is 1 for true and 0 for false
+	ValueTypBigNumber      ValueTyp = "BIG_NUMBER"      // str holds the digits
+	ValueTypVerbatimString ValueTyp = "VERBATIM_STRING" // str holds the format, such as txt, and bulk the text
+	ValueTypPush           ValueTyp = "PUSH"            // array holds the elements of an out of band message
 )
 
 // Value holds the parsed RESP data
 type Value struct {
-	typ   ValueTyp
-	str   string
-	num   int
-	bulk  string
-	array []Value
+	typ    ValueTyp
+	str    string
+	num    int
+	bulk   string
+	array  []Value
+	double float64
 }
 
+// Limits on the requests of clients, which CONFIG SET may change while
+// connections are reading them, so they're atomic
+var (
+	protoMaxBulkLen      atomic.Int64 // Longest bulk string
+	protoMaxMultibulkLen atomic.Int64 // Most elements of an array
+	protoMaxNesting      atomic.Int64 // Most arrays nested in each other, the command included
+)
+
+const (
+	// protoMaxLineLength is the longest type and length line of a request.
+	protoMaxLineLength = 64 * 1024
+
+	// The most bytes of a bulk string and elements of an array allocated
+	// before their contents arrive, so announcing large ones costs nothing.
+	protoMaxPreallocBytes    = 1024 * 1024
+	protoMaxPreallocElements = 1024
+)
+
+// errProtocol is wrapped by the errors of requests breaking the protocol or its
+// limits, which are answered before closing the connection.
+var errProtocol = errors.New("Protocol error")
+
+var (
+	errInvalidBulkLength      = fmt.Errorf("%w: invalid bulk length", errProtocol)
+	errInvalidMultibulkLength = fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	errLineTooLong            = fmt.Errorf("%w: too big inline request", errProtocol)
+	errNestingTooDeep         = fmt.Errorf("%w: expected '$', got '*'", errProtocol)
+)
+
 // Resp represents a RESP parser
 type Resp struct {
-	reader *bufio.Reader
+	reader  *bufio.Reader
+	limited bool // Whether the limits on the requests of clients apply
 }
 
 // NewResp creates a new Resp parser
@@ -57,6 +117,18 @@ func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
+// NewClientResp creates a parser for the requests of a client, which must keep
+// within the proto-max limits
+func NewClientResp(rd io.Reader) *Resp {
+	return &Resp{reader: bufio.NewReader(rd), limited: true}
+}
+
+// Buffered returns the number of bytes received but not read yet, which is
+// zero once every command of a pipeline has been read
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
 // readLine reads a line ending with \r\n
 func (r *Resp) readLine() (line []byte, n int, err error) {
 	for {
@@ -66,9 +138,12 @@ func (r *Resp) readLine() (line []byte, n int, err error) {
 		}
 		n++
 		line = append(line, b)
-		if len(line) >= 2 && line[len(line)-2] == '\r' {
+		if len(line) >= 2 && line[len(line)-2] == '\r' && b == '\n' {
 			break
 		}
+		if r.limited && len(line) > protoMaxLineLength {
+			return nil, 0, errLineTooLong
+		}
 	}
 	return line[:len(line)-2], n, nil
 }
@@ -89,6 +164,11 @@ func (r *Resp) readInteger() (x int, n int, err error) {
 
 // Read reads a RESP value
 func (r *Resp) Read() (Value, error) {
+	return r.read(1)
+}
+
+// read reads a RESP value at the given depth of nesting in arrays
+func (r *Resp) read(depth int) (Value, error) {
 	_type, err := r.reader.ReadByte()
 	if err != nil {
 		return Value{}, err
@@ -96,7 +176,10 @@ func (r *Resp) Read() (Value, error) {
 
 	switch _type {
 	case FB_ARRAY:
-		return r.readArray()
+		if r.limited && int64(depth) > protoMaxNesting.Load() {
+			return Value{}, errNestingTooDeep
+		}
+		return r.readArray(depth)
 	case FB_BULK_STRING:
 		return r.readBulkString()
 	default:
@@ -106,19 +189,25 @@ func (r *Resp) Read() (Value, error) {
 }
 
 // readArray reads an array from the RESP data
-func (r *Resp) readArray() (Value, error) {
+func (r *Resp) readArray(depth int) (Value, error) {
 	v := Value{typ: ValueTypArray}
 
-	// read the length of the array
+	// read the length of the array, a negative one standing for an empty request
 	length, _, err := r.readInteger()
+	if errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+		return v, errInvalidMultibulkLength
+	}
 	if err != nil {
 		return v, err
 	}
+	if r.limited && int64(length) > protoMaxMultibulkLen.Load() {
+		return v, errInvalidMultibulkLength
+	}
 
 	// parse and read each value in the array
-	v.array = make([]Value, 0, length)
+	v.array = make([]Value, 0, min(max(length, 0), protoMaxPreallocElements))
 	for i := 0; i < length; i++ {
-		val, err := r.Read()
+		val, err := r.read(depth + 1)
 		if err != nil {
 			return v, err
 		}
@@ -128,88 +217,432 @@ func (r *Resp) readArray() (Value, error) {
 	return v, nil
 }
 
-// readBulkString reads a bulk string from the RESP data
+// readBulkString reads a bulk string from the RESP data. The length is read
+// in full, however many reads of the connection it takes, so the value may hold
+// any bytes, \r\n included.
 func (r *Resp) readBulkString() (Value, error) {
 	v := Value{typ: ValueTypBulkString}
 
 	length, _, err := r.readInteger()
+	if errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+		return v, errInvalidBulkLength
+	}
 	if err != nil {
 		return v, err
 	}
+	v.bulk, err = r.readBulkData(length)
+	return v, err
+}
 
-	bulk := make([]byte, length)
-	_, err = r.reader.Read(bulk)
-	if err != nil {
-		return v, err
+// readBulkData reads the length bytes of a bulk string and the CRLF (\r\n)
+// that follows them. Unlike the other limits, protoMaxBulkLen applies to every
+// reader, the AOF, the master and the replies of other servers included, so a
+// corrupt length can't overflow length+2 or run the reader out of memory.
+func (r *Resp) readBulkData(length int) (string, error) {
+	if length < 0 || length > math.MaxInt-2 || int64(length) > protoMaxBulkLen.Load() {
+		return "", errInvalidBulkLength
 	}
-	v.bulk = string(bulk)
 
-	// Read the trailing CRLF (\r\n)
-	_, _, err = r.readLine()
+	// A long value is allocated as it arrives, doubling the part read so far
+	bulk := make([]byte, min(length+2, protoMaxPreallocBytes))
+	if _, err := io.ReadFull(r.reader, bulk); err != nil {
+		return "", err
+	}
+	for len(bulk) < length+2 {
+		n := len(bulk)
+		bulk = slices.Grow(bulk, min(length+2-n, n))[:n+min(length+2-n, n)]
+		if _, err := io.ReadFull(r.reader, bulk[n:]); err != nil {
+			return "", err
+		}
+	}
+	if bulk[length] != '\r' || bulk[length+1] != '\n' {
+		return "", errInvalidBulkLength
+	}
+	return string(bulk[:length]), nil
+}
 
-	return v, err
+// ReadReply reads a RESP2 reply sent by a server, of any type, for the
+// connections this server makes to other servers
+func (r *Resp) ReadReply() (Value, error) {
+	_type, err := r.reader.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch _type {
+	case FB_SIMPLE_STRING, FB_SIMPLE_ERROR:
+		line, _, err := r.readLine()
+		if _type == FB_SIMPLE_ERROR {
+			return Value{typ: ValueTypSimpleError, str: string(line)}, err
+		}
+		return Value{typ: ValueTypSimpleString, str: string(line)}, err
+	case FB_INTEGER:
+		num, _, err := r.readInteger()
+		return Value{typ: ValueTypInteger, num: num}, err
+	case FB_BULK_STRING:
+		length, _, err := r.readInteger()
+		if err != nil || length < 0 {
+			return Value{typ: ValueTypNull}, err
+		}
+		bulk, err := r.readBulkData(length)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: ValueTypBulkString, bulk: bulk}, nil
+	case FB_ARRAY:
+		length, _, err := r.readInteger()
+		if err != nil || length < 0 {
+			return Value{typ: ValueTypNullArray}, err
+		}
+		// The elements are allocated as they arrive past the first few, so a
+		// corrupt length can't run the reader out of memory either
+		v := Value{typ: ValueTypArray, array: make([]Value, 0, min(length, protoMaxPreallocElements))}
+		for i := 0; i < length; i++ {
+			val, err := r.ReadReply()
+			if err != nil {
+				return v, err
+			}
+			v.array = append(v.array, val)
+		}
+		return v, nil
+	default:
+		return Value{}, fmt.Errorf("unknown reply type '%s'", string(_type))
+	}
 }
 
-// Marshal marshals the RESP value to bytes
+// Marshal marshals the RESP value to bytes in RESP2
 func (v Value) Marshal() []byte {
+	return v.appendTo(nil, false)
+}
+
+// MarshalResp3 marshals the RESP value to bytes in RESP3
+func (v Value) MarshalResp3() []byte {
+	return v.appendTo(nil, true)
+}
+
+// MarshalTo appends the RESP value in RESP2 to b and returns the extended
+// slice, so a buffer can be reused for many values
+func (v Value) MarshalTo(b []byte) []byte {
+	return v.appendTo(b, false)
+}
+
+// MarshalResp3To appends the RESP value in RESP3 to b and returns the extended
+// slice
+func (v Value) MarshalResp3To(b []byte) []byte {
+	return v.appendTo(b, true)
+}
+
+// appendTo appends the RESP value to b, using the RESP3 types if resp3 is set
+func (v Value) appendTo(b []byte, resp3 bool) []byte {
 	switch v.typ {
 	case ValueTypArray:
-		return v.marshalArray()
+		return v.appendAggregate(b, FB_ARRAY, len(v.array), resp3)
 	case ValueTypBulkString:
-		return v.marshalBulkString()
+		return appendBulkString(b, v.bulk)
 	case ValueTypSimpleString:
-		return v.marshalSimpleString()
+		return appendLine(b, FB_SIMPLE_STRING, v.str)
+	case ValueTypInteger:
+		return appendInteger(b, FB_INTEGER, v.num)
 	case ValueTypNull:
-		return v.marshalNull()
+		if resp3 {
+			return append(b, "_\r\n"...)
+		}
+		return append(b, "$-1\r\n"...)
+	case ValueTypNullArray:
+		if resp3 {
+			return append(b, "_\r\n"...)
+		}
+		return append(b, "*-1\r\n"...)
 	case ValueTypSimpleError:
-		return v.marshalError()
+		return appendLine(b, FB_SIMPLE_ERROR, v.str)
+	case ValueTypMap:
+		if resp3 {
+			return v.appendAggregate(b, FB_MAP, len(v.array)/2, resp3)
+		}
+		return v.appendAggregate(b, FB_ARRAY, len(v.array), resp3)
+	case ValueTypSet:
+		if resp3 {
+			return v.appendAggregate(b, FB_SET, len(v.array), resp3)
+		}
+		return v.appendAggregate(b, FB_ARRAY, len(v.array), resp3)
+	case ValueTypPush:
+		if resp3 {
+			return v.appendAggregate(b, FB_PUSH, len(v.array), resp3)
+		}
+		return v.appendAggregate(b, FB_ARRAY, len(v.array), resp3)
+	case ValueTypDouble:
+		if resp3 {
+			return appendLine(b, FB_DOUBLE, formatDouble(v.double))
+		}
+		return appendBulkString(b, formatDouble(v.double))
+	case ValueTypBoolean:
+		if resp3 {
+			if v.num != 0 {
+				return append(b, "#t\r\n"...)
+			}
+			return append(b, "#f\r\n"...)
+		}
+		return appendInteger(b, FB_INTEGER, v.num)
+	case ValueTypBigNumber:
+		if resp3 {
+			return appendLine(b, FB_BIG_NUMBER, v.str)
+		}
+		return appendBulkString(b, v.str)
+	case ValueTypVerbatimString:
+		if resp3 {
+			b = appendInteger(b, FB_VERBATIM_STRING, len(v.str)+1+len(v.bulk))
+			b = append(append(append(b, v.str...), ':'), v.bulk...)
+			return append(b, '\r', '\n')
+		}
+		return appendBulkString(b, v.bulk)
 	default:
-		return []byte{}
+		return b
 	}
 }
 
-// marshalSimpleString marshals a simple string value
-func (v Value) marshalSimpleString() []byte {
-	return append([]byte{FB_SIMPLE_STRING}, append([]byte(v.str), '\r', '\n')...)
+// appendLine appends a line starting with firstByte, such as a simple string
+func appendLine(b []byte, firstByte byte, s string) []byte {
+	b = append(append(b, firstByte), s...)
+	return append(b, '\r', '\n')
+}
+
+// appendInteger appends a line holding n after firstByte, such as an integer or
+// the header of a bulk string or an aggregate
+func appendInteger(b []byte, firstByte byte, n int) []byte {
+	b = strconv.AppendInt(append(b, firstByte), int64(n), 10)
+	return append(b, '\r', '\n')
 }
 
-// marshalBulkString marshals a bulk string value
-func (v Value) marshalBulkString() []byte {
-	return append(append(append([]byte{FB_BULK_STRING}, strconv.Itoa(len(v.bulk))...), '\r', '\n'), append([]byte(v.bulk), '\r', '\n')...)
+// appendBulkString appends s as a bulk string
+func appendBulkString(b []byte, s string) []byte {
+	b = append(appendInteger(b, FB_BULK_STRING, len(s)), s...)
+	return append(b, '\r', '\n')
 }
 
-// marshalArray marshals an array value
-func (v Value) marshalArray() []byte {
-	bytes := append([]byte{FB_ARRAY}, strconv.Itoa(len(v.array))...)
-	bytes = append(bytes, '\r', '\n')
+// appendAggregate appends an array, map, set or push value, whose header starts
+// with firstByte and counts n elements
+func (v Value) appendAggregate(b []byte, firstByte byte, n int, resp3 bool) []byte {
+	b = appendInteger(b, firstByte, n)
 	for _, val := range v.array {
-		bytes = append(bytes, val.Marshal()...)
+		b = val.appendTo(b, resp3)
 	}
-	return bytes
+	return b
 }
 
-// marshalError marshals an error value
-func (v Value) marshalError() []byte {
-	return append([]byte{FB_SIMPLE_ERROR}, append([]byte(v.str), '\r', '\n')...)
+// marshalBuffers holds the scratch buffers values are marshaled into before
+// they're written, so writing a value doesn't allocate. Buffers grown past
+// maxPooledMarshalBuffer by a large value aren't kept.
+var marshalBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+const maxPooledMarshalBuffer = 64 * 1024
+
+// writeValue writes v to w in RESP2, or in RESP3 if resp3 is set, marshaling
+// it into a pooled buffer.
+func writeValue(w io.Writer, v Value, resp3 bool) error {
+	buf := marshalBuffers.Get().(*[]byte)
+	*buf = v.appendTo((*buf)[:0], resp3)
+	_, err := w.Write(*buf)
+	if cap(*buf) <= maxPooledMarshalBuffer {
+		marshalBuffers.Put(buf)
+	}
+	return err
 }
 
-// marshalNull marshals a null value
-func (v Value) marshalNull() []byte {
-	return []byte("$-1\r\n")
+// formatDouble formats a double the way Redis does, with inf, -inf and nan
+// for the special values
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
 }
 
-// Writer represents a RESP writer
+// Writer represents a RESP writer. It's safe for concurrent use, so messages
+// from other clients can be pushed while the connection is replying. Values are
+// buffered in chunks and written with a single vectored write where the
+// connection allows it, so the replies to a pipeline of commands go out in a
+// few system calls. Values buffered while another goroutine is writing are
+// written by it as soon as it's done, so a burst of messages pushed by many
+// publishers is coalesced too.
 type Writer struct {
-	writer io.Writer
+	writer   io.Writer
+	mu       sync.Mutex
+	written  sync.Cond   // Broadcast when a goroutine is done writing
+	chunks   []*[]byte   // Values not written yet, in buffers from marshalBuffers
+	buffered int         // Bytes in chunks
+	inflight int         // Bytes in writing
+	flushing bool        // Set while a goroutine writes the chunks out
+	draining bool        // Set while a goroutine is due to flush queued values
+	writing  []*[]byte   // The chunks being written, reused between writes
+	iov      net.Buffers // The contents of writing, reused between writes
+	err      error       // The error of a failed write, returned ever after
+	protocol int         // RESP version the values are written in
+}
+
+// writerChunkSize is the size past which a Writer buffers values in a new
+// chunk, and writerMaxBuffered how much it buffers before writing them out
+// without waiting for a Flush.
+const writerChunkSize = 16 * 1024
+const writerMaxBuffered = 64 * 1024
+
+// buffersWriter is implemented by writers that write many buffers at once, like
+// a connection writing them with writev.
+type buffersWriter interface {
+	WriteBuffers(bufs *net.Buffers) (int64, error)
 }
 
 // NewWriter creates a new Writer
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	writer := &Writer{writer: w, protocol: ProtocolResp2}
+	writer.written.L = &writer.mu
+	return writer
 }
 
-// Write writes a RESP value to the writer
+// SetProtocol sets the RESP version the following values are written in
+func (w *Writer) SetProtocol(protocol int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.protocol = protocol
+}
+
+// Protocol returns the RESP version values are written in
+func (w *Writer) Protocol() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.protocol
+}
+
+// Write writes a RESP value to the writer right away, along with the values
+// buffered before it
 func (w *Writer) Write(v Value) error {
-	_, err := w.writer.Write(v.Marshal())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buffer(v)
+	return w.flush()
+}
+
+// Buffer writes a RESP value to the buffer of the writer, which is written on
+// the next Flush, or once enough is buffered
+func (w *Writer) Buffer(v Value) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buffer(v)
+	if w.buffered >= writerMaxBuffered {
+		return w.flush()
+	}
+	return w.err
+}
+
+// Queue buffers a RESP value to be written by another goroutine, so the caller
+// doesn't wait for the connection, and returns the size of the output not
+// written yet, this value included.
+func (w *Writer) Queue(v Value) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buffer(v)
+	if !w.flushing && !w.draining {
+		w.draining = true
+		go w.drain()
+	}
+	return w.buffered + w.inflight
+}
+
+// drain writes the values queued, unless a goroutine flushing meanwhile wrote
+// them already.
+func (w *Writer) drain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.draining = false
+	w.flush()
+}
+
+// Flush writes the buffered values
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flush()
+}
+
+// buffer marshals v after the values buffered before it, in the RESP version of
+// the writer. Small values share a chunk, so they're written from contiguous
+// memory. Nothing is buffered once a write failed. The caller must hold w.mu.
+func (w *Writer) buffer(v Value) {
+	if w.err != nil {
+		return
+	}
+	n := len(w.chunks)
+	if n == 0 || len(*w.chunks[n-1]) >= writerChunkSize {
+		buf := marshalBuffers.Get().(*[]byte)
+		*buf = (*buf)[:0]
+		w.chunks = append(w.chunks, buf)
+		n++
+	}
+	buf := w.chunks[n-1]
+	size := len(*buf)
+	*buf = v.appendTo(*buf, w.protocol == ProtocolResp3)
+	w.buffered += len(*buf) - size
+}
+
+// flush writes the buffered values out, and those buffered by other goroutines
+// meanwhile. If another goroutine is already writing, it waits for it to write
+// them instead. The caller must hold w.mu, which is released while writing.
+func (w *Writer) flush() error {
+	if w.flushing {
+		for w.flushing {
+			w.written.Wait()
+		}
+		return w.err
+	}
+
+	w.flushing = true
+	for len(w.chunks) > 0 && w.err == nil {
+		w.writing, w.chunks = w.chunks, w.writing[:0]
+		w.inflight, w.buffered = w.buffered, 0
+		w.mu.Unlock()
+		err := w.writeChunks()
+		w.mu.Lock()
+
+		w.err = err
+		w.inflight = 0
+		for i, buf := range w.writing {
+			if cap(*buf) <= maxPooledMarshalBuffer {
+				marshalBuffers.Put(buf)
+			}
+			w.writing[i] = nil
+		}
+	}
+	w.flushing = false
+	w.written.Broadcast()
+	return w.err
+}
+
+// writeChunks writes the chunks in w.writing, with a single vectored write if
+// the underlying writer supports it. Only the goroutine flushing may call it.
+func (w *Writer) writeChunks() error {
+	w.iov = w.iov[:0]
+	for _, buf := range w.writing {
+		w.iov = append(w.iov, *buf)
+	}
+
+	// Writing consumes the slice it's given
+	iov := w.iov
+	var err error
+	if bw, ok := w.writer.(buffersWriter); ok {
+		_, err = bw.WriteBuffers(&iov)
+	} else {
+		_, err = iov.WriteTo(w.writer)
+	}
 	return err
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// requestValue builds the request a client sends for args.
+func requestValue(args ...string) Value {
+	v := Value{typ: ValueTypArray}
+	for _, arg := range args {
+		v.array = append(v.array, Value{typ: ValueTypBulkString, bulk: arg})
+	}
+	return v
+}
+
+// chunkReader returns the data of r in reads of at most n bytes, like a
+// connection the data trickles in on.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	return c.r.Read(p[:min(len(p), c.n)])
+}
+
+func TestReadBulkString(t *testing.T) {
+	payloads := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"short", "value"},
+		{"crlf", "line 1\r\nline 2\r\n"},
+		{"crlf only", "\r\n"},
+		{"nul bytes", "\x00a\x00\x00b\x00"},
+		{"binary", "\x00\r\n\xff\xfe$3\r\n*1\r\n"},
+		{"multi-MB", strings.Repeat("0123456789", 3<<20/10)},
+		{"multi-MB crlf", strings.Repeat("ab\r\n\x00", 1<<20)},
+	}
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"whole", func(r io.Reader) io.Reader { return r }},
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+		{"7 bytes", func(r io.Reader) io.Reader { return chunkReader{r, 7} }},
+		{"4k", func(r io.Reader) io.Reader { return chunkReader{r, 4096} }},
+	}
+
+	for _, p := range payloads {
+		for _, rd := range readers {
+			t.Run(p.name+"/"+rd.name, func(t *testing.T) {
+				request := requestValue("SET", "key", p.data).Marshal()
+				r := NewClientResp(rd.wrap(bytes.NewReader(request)))
+
+				v, err := r.Read()
+				if err != nil {
+					t.Fatalf("Read: %v", err)
+				}
+				if v.typ != ValueTypArray || len(v.array) != 3 {
+					t.Fatalf("got %s of %d elements, want an array of 3", v.typ, len(v.array))
+				}
+				if got := v.array[2].bulk; got != p.data {
+					t.Fatalf("got a bulk string of %d bytes, want %d", len(got), len(p.data))
+				}
+				if _, err := r.Read(); err != io.EOF {
+					t.Fatalf("Read after the request: got %v, want EOF", err)
+				}
+			})
+		}
+	}
+}
+
+func TestReadBulkStringInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    error
+	}{
+		{"negative length", "*1\r\n$-2\r\n", errInvalidBulkLength},
+		{"not a number", "*1\r\n$abc\r\n", errInvalidBulkLength},
+		{"over proto-max-bulk-len", "*1\r\n$" + strconv.FormatInt(protoMaxBulkLen.Load()+1, 10) + "\r\n", errInvalidBulkLength},
+		{"max int", "*1\r\n$9223372036854775807\r\n", errInvalidBulkLength},
+		{"max int - 2", "*1\r\n$9223372036854775805\r\n", errInvalidBulkLength},
+		{"out of range", "*1\r\n$99999999999999999999\r\n", errInvalidBulkLength},
+		{"no crlf after the data", "*1\r\n$3\r\nabcde\r\n", errInvalidBulkLength},
+		{"truncated", "*1\r\n$10\r\nabc", io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every reader is bounded, the AOF and the master stream included
+			for _, r := range []*Resp{NewClientResp(strings.NewReader(tt.request)), NewResp(strings.NewReader(tt.request))} {
+				if _, err := r.Read(); !errors.Is(err, tt.want) {
+					t.Fatalf("limited %v: got %v, want %v", r.limited, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPipelineRoundTrip(t *testing.T) {
+	const commands = 10000
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < commands; i++ {
+		value := strconv.Itoa(i) + "\r\n\x00" + strings.Repeat("v", i%100)
+		if err := w.Buffer(requestValue("SET", "key:"+strconv.Itoa(i), value)); err != nil {
+			t.Fatalf("Buffer: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	r := NewClientResp(chunkReader{&buf, 1500})
+	for i := 0; i < commands; i++ {
+		v, err := r.Read()
+		if err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+		want := requestValue("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i)+"\r\n\x00"+strings.Repeat("v", i%100))
+		if len(v.array) != len(want.array) {
+			t.Fatalf("command %d: got %d arguments, want %d", i, len(v.array), len(want.array))
+		}
+		for j := range want.array {
+			if v.array[j].bulk != want.array[j].bulk {
+				t.Fatalf("command %d: argument %d is %q, want %q", i, j, v.array[j].bulk, want.array[j].bulk)
+			}
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("Read after the pipeline: got %v, want EOF", err)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	big := strings.Repeat("0123456789", 3<<20/10)
+	tests := []struct {
+		name  string
+		reply string
+		want  Value
+	}{
+		{"simple string", "+OK\r\n", Value{typ: ValueTypSimpleString, str: "OK"}},
+		{"error", "-ERR no\r\n", Value{typ: ValueTypSimpleError, str: "ERR no"}},
+		{"integer", ":-12\r\n", Value{typ: ValueTypInteger, num: -12}},
+		{"null", "$-1\r\n", Value{typ: ValueTypNull}},
+		{"bulk string", "$8\r\na\r\nb\x00\r\nc\r\n", bulkValue("a\r\nb\x00\r\nc")},
+		{"multi-MB bulk string", "$" + strconv.Itoa(len(big)) + "\r\n" + big + "\r\n", bulkValue(big)},
+		{"null array", "*-1\r\n", Value{typ: ValueTypNullArray}},
+		{"array", "*2\r\n$1\r\na\r\n:1\r\n", Value{typ: ValueTypArray, array: []Value{bulkValue("a"), {typ: ValueTypInteger, num: 1}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResp(chunkReader{strings.NewReader(tt.reply), 4096})
+			v, err := r.ReadReply()
+			if err != nil {
+				t.Fatalf("ReadReply: %v", err)
+			}
+			if string(v.Marshal()) != string(tt.want.Marshal()) {
+				t.Fatalf("got %.40q, want %.40q", v.Marshal(), tt.want.Marshal())
+			}
+		})
+	}
+}
+
+func TestReadReplyInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  error
+	}{
+		{"over proto-max-bulk-len", "$" + strconv.FormatInt(protoMaxBulkLen.Load()+1, 10) + "\r\n", errInvalidBulkLength},
+		{"max int", "$9223372036854775807\r\n", errInvalidBulkLength},
+		{"no crlf after the data", "$3\r\nabcde\r\n", errInvalidBulkLength},
+		{"truncated bulk string", "$100000000\r\nabc", io.ErrUnexpectedEOF},
+		{"truncated array", "*2147483647\r\n:1\r\n", io.EOF},
+		{"bad element", "*2\r\n:1\r\n$9223372036854775807\r\n", errInvalidBulkLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResp(strings.NewReader(tt.reply))
+			if _, err := r.ReadReply(); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
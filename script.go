@@ -0,0 +1,478 @@
+/*
+This file contains Lua scripting with EVAL, EVALSHA and SCRIPT. Scripts run in an
+embedded Lua interpreter and call back into the server with redis.call and
+redis.pcall, which dispatch through the command table like a client would. A
+script runs with every other command stopped, so it's atomic, and one that runs for
+too long can be stopped with SCRIPT KILL, see script_busy.go. Replies are converted
+between RESP and Lua following the same rules as Redis, so existing scripts work
+unchanged. For a detailed description of scripting, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/develop/interact/programmability/eval-intro/
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scripts caches the bodies of scripts by their SHA1 digest.
+var scripts = map[string]string{}
+var scriptsMu = sync.RWMutex{}
+
+// scriptSha returns the SHA1 digest that identifies a script.
+func scriptSha(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheScript adds a script to the cache and returns its digest.
+func cacheScript(body string) string {
+	sha := scriptSha(body)
+
+	scriptsMu.Lock()
+	scripts[sha] = body
+	scriptsMu.Unlock()
+
+	return sha
+}
+
+// newScriptState creates a Lua interpreter with the libraries scripts may use
+// and the redis module. Read-only scripts can't call commands that write.
+func newScriptState(c *Client, readOnly bool) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// Scripts must not be able to reach the file system
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":         func(L *lua.LState) int { return scriptCall(c, L, true, readOnly) },
+		"pcall":        func(L *lua.LState) int { return scriptCall(c, L, false, readOnly) },
+		"error_reply":  scriptErrorReply,
+		"status_reply": scriptStatusReply,
+		"sha1hex":      scriptSha1hex,
+		"log":          scriptLog,
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+
+	return L
+}
+
+// scriptCall implements redis.call and redis.pcall. Errors are raised with
+// redis.call and returned as an error table with redis.pcall.
+func scriptCall(c *Client, L *lua.LState, raise, readOnly bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+
+	argv := make([]Value, 0, n)
+	for i := 1; i <= n; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			argv = append(argv, Value{typ: ValueTypBulkString, bulk: string(arg)})
+		case lua.LNumber:
+			argv = append(argv, Value{typ: ValueTypBulkString, bulk: formatLuaNumber(arg)})
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	result := scriptDispatch(c, argv, readOnly)
+
+	if result.typ == ValueTypSimpleError && raise {
+		L.Error(respToLua(L, result), 1)
+	}
+
+	L.Push(respToLua(L, result))
+	return 1
+}
+
+// scriptDispatch runs a command on behalf of a script.
+func scriptDispatch(c *Client, argv []Value, readOnly bool) Value {
+	cmd, ok := Commands[strings.ToUpper(argv[0].bulk)]
+	if !ok {
+		return Value{typ: ValueTypSimpleError, str: "ERR Unknown Redis command called from script"}
+	}
+	if !cmd.checkArity(len(argv)) {
+		return Value{typ: ValueTypSimpleError, str: "ERR Wrong number of args calling Redis command from script"}
+	}
+	if cmd.hasFlag("noscript") {
+		return Value{typ: ValueTypSimpleError, str: "ERR This Redis command is not allowed from script"}
+	}
+	if readOnly && cmd.hasFlag("write") {
+		return Value{typ: ValueTypSimpleError, str: "ERR Write commands are not allowed from read-only scripts."}
+	}
+	if cmd.isWrite(argv[1:]) {
+		noteScriptWrite()
+	}
+
+	return execute(c, cmd, Value{typ: ValueTypArray, array: argv})
+}
+
+// formatLuaNumber formats a number the way Redis passes it to commands,
+// without a fractional part when it's an integer.
+func formatLuaNumber(n lua.LNumber) string {
+	f := float64(n)
+	if f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// scriptErrorReply implements redis.error_reply.
+func scriptErrorReply(L *lua.LState) int {
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(L.CheckString(1)))
+	L.Push(t)
+	return 1
+}
+
+// scriptStatusReply implements redis.status_reply.
+func scriptStatusReply(L *lua.LState) int {
+	t := L.NewTable()
+	t.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(t)
+	return 1
+}
+
+// scriptSha1hex implements redis.sha1hex.
+func scriptSha1hex(L *lua.LState) int {
+	L.Push(lua.LString(scriptSha(L.CheckString(1))))
+	return 1
+}
+
+// scriptLog implements redis.log by printing to the server output.
+func scriptLog(L *lua.LState) int {
+	L.CheckInt(1)
+
+	parts := []string{}
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+	}
+
+	fmt.Println("Script:", strings.Join(parts, " "))
+	return 0
+}
+
+// respToLua converts a command reply to a Lua value. Scripts speak RESP2, so the
+// RESP3 types are converted like their RESP2 counterparts.
+func respToLua(L *lua.LState, v Value) lua.LValue {
+	switch v.typ {
+	case ValueTypSimpleString:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v.str))
+		return t
+	case ValueTypSimpleError:
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(v.str))
+		return t
+	case ValueTypInteger:
+		return lua.LNumber(v.num)
+	case ValueTypBoolean:
+		return lua.LNumber(v.num)
+	case ValueTypBulkString, ValueTypVerbatimString:
+		return lua.LString(v.bulk)
+	case ValueTypBigNumber:
+		return lua.LString(v.str)
+	case ValueTypDouble:
+		return lua.LString(formatDouble(v.double))
+	case ValueTypArray, ValueTypMap, ValueTypSet, ValueTypPush:
+		t := L.NewTable()
+		for _, elem := range v.array {
+			t.Append(respToLua(L, elem))
+		}
+		return t
+	default:
+		// Nulls become false, since nil can't be stored in a table
+		return lua.LFalse
+	}
+}
+
+// luaToResp converts a value returned by a script to a reply.
+func luaToResp(lv lua.LValue) Value {
+	switch lv := lv.(type) {
+	case lua.LString:
+		return Value{typ: ValueTypBulkString, bulk: string(lv)}
+	case lua.LNumber:
+		// Numbers are truncated to integers, like Redis does
+		return Value{typ: ValueTypInteger, num: int(lv)}
+	case lua.LBool:
+		if lv {
+			return Value{typ: ValueTypInteger, num: 1}
+		}
+		return Value{typ: ValueTypNull}
+	case *lua.LTable:
+		if err, ok := lv.RawGetString("err").(lua.LString); ok {
+			return Value{typ: ValueTypSimpleError, str: string(err)}
+		}
+		if status, ok := lv.RawGetString("ok").(lua.LString); ok {
+			return Value{typ: ValueTypSimpleString, str: string(status)}
+		}
+
+		// Arrays stop at the first nil
+		values := []Value{}
+		for i := 1; ; i++ {
+			elem := lv.RawGetInt(i)
+			if elem == lua.LNil {
+				break
+			}
+			values = append(values, luaToResp(elem))
+		}
+		return Value{typ: ValueTypArray, array: values}
+	default:
+		return Value{typ: ValueTypNull}
+	}
+}
+
+// scriptErrorValue converts an error raised by a script into a reply. Errors
+// raised by redis.call keep the reply of the failed command.
+func scriptErrorValue(name string, err error) Value {
+	v := scriptError(name, err)
+
+	// Lua error messages can span lines, which a simple error can't
+	v.str = strings.Join(strings.Fields(v.str), " ")
+	return v
+}
+
+// scriptError builds the reply for scriptErrorValue.
+func scriptError(name string, err error) Value {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		if t, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := t.RawGetString("err").(lua.LString); ok {
+				return Value{typ: ValueTypSimpleError, str: string(msg)}
+			}
+		}
+		if apiErr.Type == lua.ApiErrorSyntax {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Error compiling script (new function): %s", apiErr.Object.String())}
+		}
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Error running script (call to %s): %s", name, apiErr.Object.String())}
+	}
+	return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+}
+
+// runScript runs a script with the given keys and arguments. The script gets a
+// client of its own, so a SELECT in the script doesn't change the caller's
+// database, acting as the caller's user.
+func runScript(c *Client, sha, body string, keys, argv []Value) Value {
+	sc := newFakeClient(c.dbIndex)
+	sc.user = c.user
+	L := newScriptState(sc, false)
+	defer L.Close()
+
+	// WAIT after the script waits for the writes it made, and so does its reply
+	// with appendfsync always
+	defer func() {
+		c.woff = max(c.woff, sc.woff)
+		c.aofOff.Store(max(c.aofOff.Load(), sc.aofOff.Load()))
+	}()
+
+	fn, err := L.Load(strings.NewReader(body), "@user_script")
+	if err != nil {
+		return scriptErrorValue("f_"+sha, err)
+	}
+
+	L.SetGlobal("KEYS", luaStrings(L, keys))
+	L.SetGlobal("ARGV", luaStrings(L, argv))
+
+	// Blocking commands can't wait inside a script, nothing else can run
+	noBlocking.Store(true)
+	defer noBlocking.Store(false)
+
+	// Other clients are answered with BUSY once it runs for too long, and SCRIPT
+	// KILL can stop it then
+	running := startScript(L, "f_"+sha, false)
+	defer running.finish()
+
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		if running.killed.Load() {
+			return killedScriptError(running)
+		}
+		return scriptErrorValue("f_"+sha, err)
+	}
+
+	return luaToResp(L.Get(-1))
+}
+
+// luaStrings converts arguments to a Lua array of strings.
+func luaStrings(L *lua.LState, args []Value) *lua.LTable {
+	t := L.NewTable()
+	for _, arg := range args {
+		t.Append(lua.LString(arg.bulk))
+	}
+	return t
+}
+
+// parseNumKeys splits the arguments following the script into keys and
+// arguments according to numkeys.
+func parseNumKeys(args []Value) ([]Value, []Value, *Value) {
+	numKeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return nil, nil, &Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	if numKeys < 0 {
+		return nil, nil, &Value{typ: ValueTypSimpleError, str: "ERR Number of keys can't be negative"}
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, &Value{typ: ValueTypSimpleError, str: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// eval handles the EVAL command.
+func eval(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'eval' command"}
+	}
+
+	keys, argv, errValue := parseNumKeys(args[1:])
+	if errValue != nil {
+		return *errValue
+	}
+
+	body := args[0].bulk
+	return runScript(c, cacheScript(body), body, keys, argv)
+}
+
+// evalsha handles the EVALSHA command.
+func evalsha(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'evalsha' command"}
+	}
+
+	keys, argv, errValue := parseNumKeys(args[1:])
+	if errValue != nil {
+		return *errValue
+	}
+
+	sha := strings.ToLower(args[0].bulk)
+
+	scriptsMu.RLock()
+	body, ok := scripts[sha]
+	scriptsMu.RUnlock()
+
+	if !ok {
+		return Value{typ: ValueTypSimpleError, str: "NOSCRIPT No matching script. Please use EVAL."}
+	}
+
+	return runScript(c, sha, body, keys, argv)
+}
+
+// script handles the SCRIPT command.
+func script(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'script' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "LOAD":
+		if len(args) != 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'script|load' command"}
+		}
+
+		// Compile the script so syntax errors are reported when it's loaded
+		body := args[1].bulk
+		L := lua.NewState(lua.Options{SkipOpenLibs: true})
+		defer L.Close()
+		if _, err := L.Load(strings.NewReader(body), "@user_script"); err != nil {
+			return scriptErrorValue("", err)
+		}
+
+		return bulkValue(cacheScript(body))
+
+	case "EXISTS":
+		if len(args) < 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'script|exists' command"}
+		}
+
+		scriptsMu.RLock()
+		defer scriptsMu.RUnlock()
+
+		values := make([]Value, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			exists := 0
+			if _, ok := scripts[strings.ToLower(arg.bulk)]; ok {
+				exists = 1
+			}
+			values = append(values, Value{typ: ValueTypInteger, num: exists})
+		}
+		return Value{typ: ValueTypArray, array: values}
+
+	case "FLUSH":
+		// ASYNC and SYNC are accepted, the cache is always dropped right away
+		if len(args) > 2 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'script|flush' command"}
+		}
+		if len(args) == 2 {
+			mode := strings.ToUpper(args[1].bulk)
+			if mode != "ASYNC" && mode != "SYNC" {
+				return Value{typ: ValueTypSimpleError, str: "ERR SCRIPT FLUSH only support SYNC|ASYNC option"}
+			}
+		}
+
+		scriptsMu.Lock()
+		scripts = map[string]string{}
+		scriptsMu.Unlock()
+
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+
+	case "KILL":
+		if len(args) != 1 {
+			return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'script|kill' command"}
+		}
+		return killScript(false)
+
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0].bulk)}
+	}
+}
+
+// evalKeys returns the key positions of EVAL, EVALSHA and FCALL, which are
+// given by the numkeys argument.
+func evalKeys(argv []Value) []int {
+	if len(argv) < 3 {
+		return nil
+	}
+
+	numKeys, err := strconv.Atoi(argv[2].bulk)
+	if err != nil || numKeys < 0 || numKeys > len(argv)-3 {
+		return nil
+	}
+
+	positions := []int{}
+	for i := 3; i < 3+numKeys; i++ {
+		positions = append(positions, i)
+	}
+	return positions
+}
@@ -0,0 +1,195 @@
+/*
+This file contains the handling of scripts that run for long. A script, or a
+function, runs with execMu held for writing, so every other command waits for
+it. Once it has run for longer than busy-reply-threshold (lua-time-limit before
+Redis 7) the other clients stop waiting and are answered with a BUSY error
+instead, and SCRIPT KILL, or FUNCTION KILL for a function, can stop it as long as
+it didn't write anything yet, since stopping it then would leave its writes
+half done. SHUTDOWN NOSAVE still works, without waiting for the script. For a
+detailed description of the command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/script-kill/
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runningScript is the script or function being run.
+type runningScript struct {
+	name      string
+	function  bool
+	threshold int // busy-reply-threshold when it started, in milliseconds
+	cancel    context.CancelFunc
+	timer     *time.Timer
+
+	busy   atomic.Bool // Set once it ran past busy-reply-threshold
+	wrote  atomic.Bool // Set once it called a write command
+	killed atomic.Bool // Set by SCRIPT KILL or FUNCTION KILL
+}
+
+// currentScript is the script being run, nil if there's none. scriptBusyCh is
+// closed, and replaced, whenever a script runs past busy-reply-threshold, to
+// wake up the clients waiting for execMu.
+var currentScript atomic.Pointer[runningScript]
+var scriptBusyCh = make(chan struct{})
+var scriptBusyMu = sync.Mutex{}
+
+// startScript notes that the script or function called name starts running in
+// L, which stops at the next instruction once the script is killed. The caller
+// must hold execMu for writing, and call finish once the script returns.
+func startScript(L *lua.LState, name string, function bool) *runningScript {
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+
+	script := &runningScript{name: name, function: function, threshold: config.busyReplyThreshold, cancel: cancel}
+	if script.threshold > 0 {
+		script.timer = time.AfterFunc(time.Duration(script.threshold)*time.Millisecond, script.becomeBusy)
+	}
+	currentScript.Store(script)
+	return script
+}
+
+// finish notes that the script returned.
+func (script *runningScript) finish() {
+	if script.timer != nil {
+		script.timer.Stop()
+	}
+	script.cancel()
+	currentScript.CompareAndSwap(script, nil)
+}
+
+// becomeBusy makes the clients waiting for the script get a BUSY error.
+func (script *runningScript) becomeBusy() {
+	command := "SCRIPT KILL"
+	if script.function {
+		command = "FUNCTION KILL"
+	}
+	fmt.Printf("Slow script detected: still in execution after %d milliseconds. "+
+		"You can try killing the script using the %s command. Script name is: %s.\n",
+		script.threshold, command, script.name)
+
+	script.busy.Store(true)
+
+	scriptBusyMu.Lock()
+	close(scriptBusyCh)
+	scriptBusyCh = make(chan struct{})
+	scriptBusyMu.Unlock()
+}
+
+// busyScript returns the script that ran past busy-reply-threshold, or nil.
+func busyScript() *runningScript {
+	script := currentScript.Load()
+	if script == nil || !script.busy.Load() {
+		return nil
+	}
+	return script
+}
+
+// noteScriptWrite notes that the script being run called a write command, so
+// it can't be killed anymore.
+func noteScriptWrite() {
+	if script := currentScript.Load(); script != nil {
+		script.wrote.Store(true)
+	}
+}
+
+// busyError returns the error the clients get while script is busy.
+func busyError(script *runningScript) Value {
+	if script.function {
+		return Value{typ: ValueTypSimpleError, str: "BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE."}
+	}
+	return Value{typ: ValueTypSimpleError, str: "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."}
+}
+
+// lockExec takes execMu, for writing if exclusive, and returns the function
+// that releases it. If a script runs past busy-reply-threshold meanwhile, it
+// gives up and returns the script instead.
+func lockExec(exclusive bool) (func(), *runningScript) {
+	lock, unlock := execMu.RLock, execMu.RUnlock
+	tryLock := execMu.TryRLock
+	if exclusive {
+		lock, unlock, tryLock = execMu.Lock, execMu.Unlock, execMu.TryLock
+	}
+
+	// Only a command waiting for the lock can be waiting for a script
+	if tryLock() {
+		return unlock, nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+
+	for {
+		scriptBusyMu.Lock()
+		busyCh := scriptBusyCh
+		scriptBusyMu.Unlock()
+
+		if script := busyScript(); script != nil {
+			// The lock is released as soon as it's taken
+			go func() {
+				<-locked
+				unlock()
+			}()
+			return nil, script
+		}
+
+		select {
+		case <-locked:
+			return unlock, nil
+		case <-busyCh:
+		}
+	}
+}
+
+// runsWhileBusy reports whether a command runs while a script is busy rather
+// than waiting for it: SCRIPT KILL and FUNCTION KILL, which stop it, and
+// SHUTDOWN NOSAVE, which doesn't need the dataset.
+func runsWhileBusy(cmd *Command, args []Value) bool {
+	switch cmd.name {
+	case "script", "function":
+		return len(args) == 1 && strings.EqualFold(args[0].bulk, "KILL")
+	case "shutdown":
+		return len(args) == 1 && strings.EqualFold(args[0].bulk, "NOSAVE")
+	}
+	return false
+}
+
+// killScript handles SCRIPT KILL, or FUNCTION KILL if function is set.
+func killScript(function bool) Value {
+	script := busyScript()
+	if script == nil {
+		return Value{typ: ValueTypSimpleError, str: "NOTBUSY No scripts in execution right now."}
+	}
+	if script.function != function {
+		return busyError(script)
+	}
+	if script.wrote.Load() {
+		return Value{typ: ValueTypSimpleError, str: "UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."}
+	}
+
+	script.killed.Store(true)
+	script.cancel()
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// killedScriptError returns the error a killed script or function replies with.
+func killedScriptError(script *runningScript) Value {
+	if script.function {
+		return Value{typ: ValueTypSimpleError, str: "ERR Script killed by user with FUNCTION KILL..."}
+	}
+	return Value{typ: ValueTypSimpleError, str: "ERR Script killed by user with SCRIPT KILL..."}
+}
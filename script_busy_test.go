@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunsWhileBusy(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{"script kill", []string{"SCRIPT", "KILL"}, true},
+		{"lower case", []string{"script", "kill"}, true},
+		{"function kill", []string{"FUNCTION", "KILL"}, true},
+		{"shutdown nosave", []string{"SHUTDOWN", "NOSAVE"}, true},
+		{"shutdown", []string{"SHUTDOWN"}, false},
+		{"shutdown save", []string{"SHUTDOWN", "SAVE"}, false},
+		{"script flush", []string{"SCRIPT", "FLUSH"}, false},
+		{"function list", []string{"FUNCTION", "LIST"}, false},
+		{"other command", []string{"GET", "KILL"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := requestValue(tt.args...)
+			cmd := Commands[strings.ToUpper(tt.args[0])]
+			if got := runsWhileBusy(cmd, value.array[1:]); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBusyScript(t *testing.T) {
+	defer func(threshold int) { config.busyReplyThreshold = threshold }(config.busyReplyThreshold)
+	config.busyReplyThreshold = 20
+
+	busyScriptErr := "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n"
+	busyFunctionErr := "-BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE.\r\n"
+	unkillable := "-UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+		"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n"
+	library := "#!lua name=spinlib\nredis.register_function('spin', function() while true do end end)"
+
+	// Client 0 runs the script, which spins until it's killed, and the others
+	// send the steps once it's busy
+	tests := []struct {
+		name   string
+		setup  []step // Sent before the script runs
+		script []string
+		steps  []step
+		want   string // Reply to the script, once killed
+		after  []step // Sent once the script replied
+	}{
+		{"script kill", nil, []string{"EVAL", "while true do end", "0"}, []step{
+			{1, []string{"PING"}, busyScriptErr},
+			{1, []string{"GET", "a"}, busyScriptErr},
+			{1, []string{"FUNCTION", "KILL"}, busyScriptErr},
+			{1, []string{"SCRIPT", "KILL"}, "+OK\r\n"},
+		}, "-ERR Script killed by user with SCRIPT KILL...\r\n", []step{
+			{1, []string{"PING"}, "+PONG\r\n"},
+		}},
+		{"function kill", []step{{0, []string{"FUNCTION", "LOAD", library}, "$7\r\nspinlib\r\n"}}, []string{"FCALL", "spin", "0"}, []step{
+			{1, []string{"PING"}, busyFunctionErr},
+			{1, []string{"SCRIPT", "KILL"}, busyFunctionErr},
+			{1, []string{"FUNCTION", "KILL"}, "+OK\r\n"},
+		}, "-ERR Script killed by user with FUNCTION KILL...\r\n", nil},
+		{"transaction", []step{{1, []string{"MULTI"}, "+OK\r\n"}}, []string{"EVAL", "while true do end", "0"}, []step{
+			{1, []string{"SET", "a", "1"}, busyScriptErr},
+			{2, []string{"SCRIPT", "KILL"}, "+OK\r\n"},
+		}, "-ERR Script killed by user with SCRIPT KILL...\r\n", []step{
+			{1, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+			{1, []string{"GET", "a"}, "$-1\r\n"},
+		}},
+		{"after a write", nil, []string{"EVAL", "redis.call('SET', 'a', '1') while true do end", "0"}, []step{
+			{1, []string{"SCRIPT", "KILL"}, unkillable},
+			{1, []string{"GET", "a"}, busyScriptErr},
+		}, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := []*Client{newTestClient(t), connectTestClient(t), connectTestClient(t)}
+			runAll(t, tt.setup, clients...)
+
+			replied := make(chan string, 1)
+			done := make(chan struct{})
+			go func() {
+				replied <- run(clients[0], tt.script...)
+				close(done)
+			}()
+			t.Cleanup(func() {
+				// A script that can't be killed, or wasn't, is stopped the
+				// hard way
+				if script := currentScript.Load(); script != nil {
+					script.cancel()
+				}
+				<-done
+			})
+			for deadline := time.Now().Add(5 * time.Second); busyScript() == nil; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the script didn't become busy")
+				}
+			}
+
+			runAll(t, tt.steps, clients...)
+			if tt.want == "" {
+				return
+			}
+			if got := <-replied; got != tt.want {
+				t.Fatalf("got %q for the script, want %q", got, tt.want)
+			}
+			runAll(t, tt.after, clients...)
+		})
+	}
+}
+
+func TestScriptKillNotBusy(t *testing.T) {
+	c := newTestClient(t)
+	runAll(t, []step{
+		{0, []string{"SCRIPT", "KILL"}, "-NOTBUSY No scripts in execution right now.\r\n"},
+		{0, []string{"FUNCTION", "KILL"}, "-NOTBUSY No scripts in execution right now.\r\n"},
+	}, c)
+}
@@ -0,0 +1,1385 @@
+/*
+This file contains sentinel mode, started with --sentinel. A sentinel keeps no
+dataset: it monitors the masters named with sentinel monitor in its
+configuration file, along with their replicas, which it discovers from the INFO
+of the master, and the other sentinels monitoring them, which announce
+themselves on the __sentinel__:hello channel of every instance. An instance that
+doesn't answer PING for down-after-milliseconds is subjectively down (SDOWN) for
+this sentinel, and a master is objectively down (ODOWN) once a quorum of
+sentinels agree it's down, which starts a failover (see sentinel_failover.go).
+The state learned is kept in the configuration file, so a restarted sentinel
+carries on where it stopped. For a detailed description of sentinel, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/sentinel/
+*/
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timing of the sentinel, as in Redis
+const (
+	sentinelDefaultPort            = 26379
+	sentinelHelloChannel           = "__sentinel__:hello"
+	sentinelTickInterval           = 100 * time.Millisecond
+	sentinelPingPeriod             = time.Second
+	sentinelInfoPeriod             = 10 * time.Second
+	sentinelHelloPeriod            = 2 * time.Second
+	sentinelAskPeriod              = time.Second
+	sentinelCallTimeout            = 5 * time.Second
+	sentinelDefaultDownAfter       = 30 * time.Second
+	sentinelDefaultFailoverTimeout = 3 * time.Minute
+)
+
+// Kinds of instances a sentinel knows about, named as in its events
+const (
+	sentinelKindMaster   = "master"
+	sentinelKindReplica  = "slave"
+	sentinelKindSentinel = "sentinel"
+)
+
+// sentinelMode is set when the server runs as a sentinel.
+var sentinelMode bool
+
+// The state of the sentinel, guarded by sentinelMu. The current epoch orders
+// the failovers of every sentinel, each taking a new one.
+var sentinelMu = sync.Mutex{}
+var sentinelMasters = map[string]*sentinelInstance{}
+var sentinelMyID string
+var sentinelCurrentEpoch int64
+
+// sentinelCommandNames lists the commands of the command table a sentinel
+// keeps, the others need a dataset.
+var sentinelCommandNames = []string{
+	"ping", "auth", "hello", "client", "command", "info", "acl", "shutdown", "quit", "reset",
+	"subscribe", "unsubscribe", "psubscribe", "punsubscribe",
+}
+
+// sentinelCommandTable lists the commands only a sentinel has, or that it runs
+// differently.
+var sentinelCommandTable = []Command{
+	{name: "sentinel", handler: sentinelCommand, arity: -2, flags: []string{"admin", "loading", "stale"}, group: "sentinel", since: "2.8.4", summary: "A container for Redis Sentinel commands."},
+	{name: "publish", handler: sentinelPublishCommand, arity: 3, flags: []string{"pubsub", "loading", "stale", "fast"}, group: "pubsub", since: "2.0.0", summary: "Posts a message to a channel."},
+	{name: "role", handler: sentinelRoleCommand, arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}, group: "server", since: "2.8.12", summary: "Returns the replication role."},
+}
+
+// sentinelInstance is a master, replica or sentinel known to this sentinel.
+// It's guarded by sentinelMu.
+type sentinelInstance struct {
+	kind   string
+	name   string // Master name, or address of replicas and sentinels
+	ip     string
+	port   int
+	runID  string
+	master *sentinelInstance // Master monitored, for replicas and sentinels
+	link   *instanceLink
+
+	pingPending, infoPending, helloPending, askPending     bool
+	lastPingSent, lastInfoSent, lastHelloSent, lastAskSent time.Time
+
+	lastOkPing time.Time // Last valid reply to PING
+	sdownSince time.Time // Zero when not subjectively down
+
+	// Reported by INFO
+	infoTime     time.Time
+	role         string
+	roleChanged  time.Time
+	masterHost   string
+	masterPort   int
+	masterLinkUp bool
+	replOffset   int64
+	lastReconf   time.Time // Last REPLICAOF sent to fix its configuration
+
+	// Masters only
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	authPass        string
+	replicas        map[string]*sentinelInstance // By address
+	sentinels       map[string]*sentinelInstance // By run ID
+	odownSince      time.Time
+	configEpoch     int64
+	leader          string // Sentinel this one voted for, or that the sentinel voted for
+	leaderEpoch     int64
+	failover        *sentinelFailover
+	failoverStart   time.Time
+
+	// Replicas only, while a failover reconfigures them
+	reconfSent time.Time
+	reconfDone bool
+
+	// Sentinels only
+	lastHello     time.Time
+	masterDown    bool // Whether it replied that the master is down
+	downReplyTime time.Time
+}
+
+// newSentinelInstance creates an instance of kind at ip:port.
+func newSentinelInstance(kind string, name string, ip string, port int, master *sentinelInstance) *sentinelInstance {
+	inst := &sentinelInstance{
+		kind:       kind,
+		name:       name,
+		ip:         ip,
+		port:       port,
+		master:     master,
+		link:       newInstanceLink(ip, port),
+		lastOkPing: time.Now(),
+	}
+	if kind == sentinelKindMaster {
+		inst.master = inst
+		inst.downAfter = sentinelDefaultDownAfter
+		inst.failoverTimeout = sentinelDefaultFailoverTimeout
+		inst.replicas = map[string]*sentinelInstance{}
+		inst.sentinels = map[string]*sentinelInstance{}
+	}
+	return inst
+}
+
+// addr returns the address of the instance.
+func (inst *sentinelInstance) addr() string {
+	return net.JoinHostPort(inst.ip, strconv.Itoa(inst.port))
+}
+
+// describe returns the instance as events name it.
+func (inst *sentinelInstance) describe() string {
+	s := fmt.Sprintf("%s %s %s %d", inst.kind, inst.name, inst.ip, inst.port)
+	if inst.kind != sentinelKindMaster {
+		s += fmt.Sprintf(" @ %s %s %d", inst.master.name, inst.master.ip, inst.master.port)
+	}
+	return s
+}
+
+// sdown reports whether the instance is subjectively down.
+func (inst *sentinelInstance) sdown() bool {
+	return !inst.sdownSince.IsZero()
+}
+
+// odown reports whether the master is objectively down.
+func (inst *sentinelInstance) odown() bool {
+	return !inst.odownSince.IsZero()
+}
+
+// password returns the password to authenticate to the instance with.
+func (inst *sentinelInstance) password() string {
+	if inst.kind == sentinelKindSentinel {
+		return ""
+	}
+	return inst.master.authPass
+}
+
+// resetLink replaces the links to the instance, dropping the replies still
+// pending on the old ones.
+func (inst *sentinelInstance) resetLink() {
+	inst.link.close()
+	inst.link = newInstanceLink(inst.ip, inst.port)
+	inst.pingPending, inst.infoPending, inst.helloPending, inst.askPending = false, false, false, false
+}
+
+// send runs args on the instance in the background and calls done with the
+// reply, holding sentinelMu, unless the link was replaced meanwhile.
+func (inst *sentinelInstance) send(done func(reply Value, err error), args ...string) {
+	link, pass := inst.link, inst.password()
+	go func() {
+		reply, err := link.call(pass, args...)
+		if err == nil && reply.typ == ValueTypSimpleError {
+			err = errors.New(reply.str)
+		}
+
+		sentinelMu.Lock()
+		defer sentinelMu.Unlock()
+		if inst.link != link || link.isClosed() {
+			return
+		}
+		if done != nil {
+			done(reply, err)
+		}
+	}()
+}
+
+// instanceLink holds the connections to an instance: one for commands, and one
+// subscribed to the hello channel for masters and replicas.
+type instanceLink struct {
+	addr   string
+	callMu sync.Mutex // Serializes the calls, guards resp
+	resp   *Resp
+	up     atomic.Bool // Whether the command connection works
+
+	mu     sync.Mutex // Guards the fields below
+	conn   net.Conn
+	sub    net.Conn
+	closed bool
+	done   chan struct{}
+
+	subscribed bool // Guarded by sentinelMu
+}
+
+// newInstanceLink creates a link to ip:port, which connects on first use.
+func newInstanceLink(ip string, port int) *instanceLink {
+	return &instanceLink{addr: net.JoinHostPort(ip, strconv.Itoa(port)), done: make(chan struct{})}
+}
+
+// call sends args to the instance and returns its reply, connecting and
+// authenticating with pass first if needed.
+func (l *instanceLink) call(pass string, args ...string) (Value, error) {
+	l.callMu.Lock()
+	defer l.callMu.Unlock()
+
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		c, err := l.dial(pass)
+		if err != nil {
+			l.up.Store(false)
+			return Value{}, err
+		}
+		conn, l.resp = c, NewResp(c)
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return Value{}, net.ErrClosed
+		}
+		l.conn = conn
+		l.mu.Unlock()
+	}
+
+	conn.SetDeadline(time.Now().Add(sentinelCallTimeout))
+	_, err := conn.Write(commandValue(args...).Marshal())
+	var reply Value
+	if err == nil {
+		reply, err = l.resp.ReadReply()
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+		conn.Close()
+		l.up.Store(false)
+		return Value{}, err
+	}
+	l.up.Store(true)
+	return reply, nil
+}
+
+// dial connects to the instance, authenticating with pass if it's set.
+func (l *instanceLink) dial(pass string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", l.addr, sentinelCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if pass == "" {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(sentinelCallTimeout))
+	_, err = conn.Write(commandValue("AUTH", pass).Marshal())
+	var reply Value
+	if err == nil {
+		reply, err = NewResp(conn).ReadReply()
+	}
+	if err == nil && reply.typ == ValueTypSimpleError {
+		err = errors.New(reply.str)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// localIP returns the address this server has on the command connection, which
+// the other sentinels are told to reach it at, connecting if needed.
+func (l *instanceLink) localIP(pass string) (string, error) {
+	if _, err := l.call(pass, "PING"); err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return "", net.ErrClosed
+	}
+	ip, _, err := net.SplitHostPort(l.conn.LocalAddr().String())
+	return ip, err
+}
+
+// close closes the connections of the link, which can't be used anymore.
+func (l *instanceLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.done)
+	for _, conn := range []net.Conn{l.conn, l.sub} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// isClosed reports whether the link was closed.
+func (l *instanceLink) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.closed
+}
+
+// subscribeHello reads the hello messages of the instance until the link is
+// closed, reconnecting when the connection drops.
+func (l *instanceLink) subscribeHello(pass string) {
+	for !l.isClosed() {
+		err := l.readHellos(pass)
+		if err == nil || l.isClosed() {
+			return
+		}
+
+		select {
+		case <-l.done:
+		case <-time.After(sentinelPingPeriod):
+		}
+	}
+}
+
+// readHellos subscribes to the hello channel of the instance and processes the
+// messages until the connection fails.
+func (l *instanceLink) readHellos(pass string) error {
+	conn, err := l.dial(pass)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.sub = conn
+	l.mu.Unlock()
+
+	conn.SetDeadline(time.Now().Add(sentinelCallTimeout))
+	if _, err := conn.Write(commandValue("SUBSCRIBE", sentinelHelloChannel).Marshal()); err != nil {
+		return err
+	}
+
+	resp := NewResp(conn)
+	for {
+		// Sentinels publish hellos every few seconds, a silent connection may
+		// be stuck
+		conn.SetDeadline(time.Now().Add(3 * sentinelHelloPeriod))
+		msg, err := resp.ReadReply()
+		if err != nil {
+			return err
+		}
+		if msg.typ != ValueTypArray || len(msg.array) != 3 || msg.array[0].bulk != "message" {
+			continue
+		}
+
+		sentinelMu.Lock()
+		sentinelProcessHello(msg.array[2].bulk)
+		sentinelMu.Unlock()
+	}
+}
+
+// initSentinel sets the server up to run as a sentinel, once the configuration
+// is loaded.
+func initSentinel() error {
+	if configFile == "" {
+		return errors.New("Sentinel needs a config file to save its state")
+	}
+	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("Sentinel config file %s is not writable: %s", configFile, err)
+	}
+	f.Close()
+
+	// A sentinel keeps no dataset
+	configParamsByName["save"].set("")
+	configParamsByName["appendonly"].set("no")
+
+	for name, cmd := range Commands {
+		if !slices.Contains(sentinelCommandNames, cmd.name) {
+			delete(Commands, name)
+		}
+	}
+	for name, cmd := range originalCommands {
+		if !slices.Contains(sentinelCommandNames, cmd.name) {
+			delete(originalCommands, name)
+		}
+	}
+	for i := range sentinelCommandTable {
+		sentinelCommandTable[i].stats = &commandStats{}
+		Commands[strings.ToUpper(sentinelCommandTable[i].name)] = &sentinelCommandTable[i]
+		originalCommands[strings.ToUpper(sentinelCommandTable[i].name)] = &sentinelCommandTable[i]
+	}
+
+	infoSections = []infoSection{
+		{name: "server", defaultSection: true, lines: serverInfo},
+		{name: "clients", defaultSection: true, lines: clientsInfo},
+		{name: "sentinel", defaultSection: true, lines: sentinelInfo},
+	}
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	if sentinelMyID == "" {
+		sentinelMyID = randomHex(40)
+	}
+	fmt.Println("Sentinel ID is", sentinelMyID)
+	for _, m := range sentinelMasters {
+		sentinelEvent("+monitor", m, "quorum %d", m.quorum)
+	}
+	sentinelFlushConfig()
+
+	return nil
+}
+
+// sentinelTimer runs the periodic work of the sentinel.
+func sentinelTimer() {
+	ticker := time.NewTicker(sentinelTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sentinelMu.Lock()
+		for _, m := range sentinelMasters {
+			sentinelHandleMaster(m)
+		}
+		sentinelMu.Unlock()
+	}
+}
+
+// sentinelHandleMaster checks on a master and the instances around it. The
+// caller must hold sentinelMu.
+func sentinelHandleMaster(m *sentinelInstance) {
+	m.handle()
+	for _, r := range m.replicas {
+		r.handle()
+	}
+	for _, s := range m.sentinels {
+		s.handle()
+	}
+
+	m.checkObjectivelyDown()
+	if m.failover == nil && m.odown() && time.Since(m.failoverStart) >= 2*m.failoverTimeout {
+		m.startFailover(false)
+	}
+	if m.failover != nil {
+		m.failoverStep()
+	}
+	m.askMasterState()
+}
+
+// handle sends the periodic commands of the instance and checks whether it's
+// subjectively down.
+func (inst *sentinelInstance) handle() {
+	now := time.Now()
+	m := inst.master
+
+	if inst.kind != sentinelKindSentinel && !inst.link.subscribed {
+		inst.link.subscribed = true
+		go inst.link.subscribeHello(inst.password())
+	}
+
+	// Replicas are watched closely while their master is failing over
+	infoPeriod := sentinelInfoPeriod
+	if inst.kind == sentinelKindReplica && (m.odown() || m.failover != nil) {
+		infoPeriod = time.Second
+	}
+	if inst.kind != sentinelKindSentinel && !inst.infoPending && now.Sub(inst.lastInfoSent) >= infoPeriod {
+		inst.infoPending, inst.lastInfoSent = true, now
+		inst.send(func(reply Value, err error) {
+			inst.infoPending = false
+			if err == nil {
+				inst.refreshInfo(reply.bulk)
+			}
+		}, "INFO")
+	}
+
+	if !inst.pingPending && now.Sub(inst.lastPingSent) >= min(sentinelPingPeriod, m.downAfter) {
+		inst.pingPending, inst.lastPingSent = true, now
+		inst.send(func(reply Value, err error) {
+			inst.pingPending = false
+			// A busy instance still counts as up
+			if err == nil && reply.str == "PONG" ||
+				err != nil && (strings.HasPrefix(err.Error(), "LOADING") || strings.HasPrefix(err.Error(), "MASTERDOWN")) {
+				inst.lastOkPing = time.Now()
+			}
+		}, "PING")
+	}
+
+	if !inst.helloPending && now.Sub(inst.lastHelloSent) >= sentinelHelloPeriod {
+		inst.sendHello()
+	}
+
+	inst.checkSubjectivelyDown()
+}
+
+// sendHello announces this sentinel and its configuration of the master on the
+// hello channel of the instance.
+func (inst *sentinelInstance) sendHello() {
+	m := inst.master
+	inst.helloPending, inst.lastHelloSent = true, time.Now()
+	ip, port := m.currentAddress()
+	payload := fmt.Sprintf("%d,%s,%d,%s,%s,%d,%d",
+		config.port, sentinelMyID, sentinelCurrentEpoch, m.name, ip, port, m.configEpoch)
+
+	link, pass := inst.link, inst.password()
+	go func() {
+		ip, err := link.localIP(pass)
+		if err == nil {
+			_, err = link.call(pass, "PUBLISH", sentinelHelloChannel, ip+","+payload)
+		}
+
+		sentinelMu.Lock()
+		defer sentinelMu.Unlock()
+		if inst.link == link {
+			inst.helloPending = false
+		}
+	}()
+}
+
+// checkSubjectivelyDown marks the instance down when it didn't answer PING for
+// down-after-milliseconds, and up again once it does.
+func (inst *sentinelInstance) checkSubjectivelyDown() {
+	if time.Since(inst.lastOkPing) > inst.master.downAfter {
+		if !inst.sdown() {
+			inst.sdownSince = time.Now()
+			sentinelEvent("+sdown", inst, "")
+		}
+	} else if inst.sdown() {
+		inst.sdownSince = time.Time{}
+		sentinelEvent("-sdown", inst, "")
+	}
+}
+
+// checkObjectivelyDown marks the master down when a quorum of sentinels agree
+// it's subjectively down.
+func (m *sentinelInstance) checkObjectivelyDown() {
+	votes := 0
+	if m.sdown() {
+		votes = 1
+		for _, s := range m.sentinels {
+			if s.masterDown {
+				votes++
+			}
+		}
+	}
+
+	if votes >= m.quorum && m.sdown() {
+		if !m.odown() {
+			m.odownSince = time.Now()
+			sentinelEvent("+odown", m, "#quorum %d/%d", votes, m.quorum)
+		}
+	} else if m.odown() {
+		m.odownSince = time.Time{}
+		sentinelEvent("-odown", m, "")
+	}
+}
+
+// askMasterState asks the other sentinels whether they see the master down,
+// while this one does. During a failover the question also asks for their vote
+// to lead it.
+func (m *sentinelInstance) askMasterState() {
+	if !m.sdown() {
+		return
+	}
+
+	now := time.Now()
+	for _, s := range m.sentinels {
+		// Old answers don't count anymore
+		if now.Sub(s.downReplyTime) > 5*sentinelAskPeriod {
+			s.masterDown = false
+			s.leader = ""
+		}
+		if s.askPending || now.Sub(s.lastAskSent) < sentinelAskPeriod {
+			continue
+		}
+
+		runID := "*"
+		if m.failover != nil {
+			runID = sentinelMyID
+		}
+		s.askPending, s.lastAskSent = true, now
+		s.send(func(reply Value, err error) {
+			s.askPending = false
+			if err != nil || reply.typ != ValueTypArray || len(reply.array) != 3 {
+				return
+			}
+			s.downReplyTime = time.Now()
+			s.masterDown = reply.array[0].num == 1
+			if leader := reply.array[1].bulk; leader != "*" {
+				s.leader, s.leaderEpoch = leader, int64(reply.array[2].num)
+			}
+		}, "SENTINEL", "is-master-down-by-addr", m.ip, strconv.Itoa(m.port),
+			strconv.FormatInt(sentinelCurrentEpoch, 10), runID)
+	}
+}
+
+// refreshInfo updates the instance with its INFO reply, discovering the
+// replicas of masters and fixing the replicas that follow the wrong master.
+func (inst *sentinelInstance) refreshInfo(info string) {
+	now := time.Now()
+	m := inst.master
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields[name] = value
+		}
+	}
+
+	inst.infoTime = now
+	if id := fields["run_id"]; id != "" {
+		inst.runID = id
+	}
+	if role := fields["role"]; role != inst.role {
+		if inst.role != "" {
+			sentinelEvent("-role-change", inst, "new reported role is %s", role)
+		}
+		inst.role, inst.roleChanged = role, now
+	}
+
+	if inst.role == "master" && inst.kind == sentinelKindMaster {
+		for i := 0; ; i++ {
+			replica, ok := fields["slave"+strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			attrs := map[string]string{}
+			for _, attr := range strings.Split(replica, ",") {
+				if name, value, ok := strings.Cut(attr, "="); ok {
+					attrs[name] = value
+				}
+			}
+			port, err := strconv.Atoi(attrs["port"])
+			if err != nil || attrs["ip"] == "" {
+				continue
+			}
+			if m.addReplica(attrs["ip"], port) != nil {
+				sentinelFlushConfig()
+			}
+		}
+	}
+
+	if inst.role == "slave" {
+		inst.masterHost = fields["master_host"]
+		inst.masterPort, _ = strconv.Atoi(fields["master_port"])
+		inst.masterLinkUp = fields["master_link_status"] == "up"
+		inst.replOffset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	}
+
+	if inst.kind != sentinelKindReplica {
+		return
+	}
+	f := m.failover
+
+	// The replica chosen by the failover took over
+	if f != nil && f.state == sentinelFailoverWaitPromotion && f.promoted == inst && inst.role == "master" {
+		m.promoted()
+		return
+	}
+
+	// A replica the failover reconfigured follows the new master
+	if f != nil && f.state == sentinelFailoverReconfSlaves && !inst.reconfSent.IsZero() && !inst.reconfDone &&
+		inst.role == "slave" && inst.masterHost == f.promoted.ip && inst.masterPort == f.promoted.port && inst.masterLinkUp {
+		inst.reconfDone = true
+		sentinelEvent("+slave-reconf-done", inst, "")
+		return
+	}
+
+	// Once things settled, replicas that act as a master, like an old master
+	// that came back, or follow another master are made to follow this one
+	wait := 4 * sentinelHelloPeriod
+	if f != nil || m.sdown() || now.Sub(inst.roleChanged) < wait || now.Sub(inst.lastReconf) < wait {
+		return
+	}
+	switch {
+	case inst.role == "master":
+		sentinelEvent("+convert-to-slave", inst, "")
+	case inst.role == "slave" && (inst.masterHost != m.ip || inst.masterPort != m.port):
+		sentinelEvent("+fix-slave-config", inst, "")
+	default:
+		return
+	}
+	inst.lastReconf = now
+	inst.send(nil, "REPLICAOF", m.ip, strconv.Itoa(m.port))
+}
+
+// addReplica adds the replica at ip:port to the master, returning it, or nil
+// if it was already known.
+func (m *sentinelInstance) addReplica(ip string, port int) *sentinelInstance {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if _, ok := m.replicas[addr]; ok || (ip == m.ip && port == m.port) {
+		return nil
+	}
+
+	r := newSentinelInstance(sentinelKindReplica, addr, ip, port, m)
+	m.replicas[addr] = r
+	sentinelEvent("+slave", r, "")
+	return r
+}
+
+// addSentinel adds the sentinel with runID at ip:port to the master, replacing
+// any other known at the same address, which restarted with a new ID.
+func (m *sentinelInstance) addSentinel(runID string, ip string, port int) *sentinelInstance {
+	for id, s := range m.sentinels {
+		if s.ip == ip && s.port == port && id != runID {
+			sentinelEvent("-dup-sentinel", s, "#duplicate of %s:%d or %s", ip, port, runID)
+			s.link.close()
+			delete(m.sentinels, id)
+		}
+	}
+
+	s := newSentinelInstance(sentinelKindSentinel, net.JoinHostPort(ip, strconv.Itoa(port)), ip, port, m)
+	s.runID = runID
+	m.sentinels[runID] = s
+	sentinelEvent("+sentinel", s, "")
+	return s
+}
+
+// sentinelProcessHello handles a hello message of another sentinel, learning
+// about it and about a newer configuration of the master it announces. The
+// caller must hold sentinelMu.
+func sentinelProcessHello(payload string) {
+	parts := strings.Split(payload, ",")
+	if len(parts) != 8 {
+		return
+	}
+	port, err1 := strconv.Atoi(parts[1])
+	epoch, err2 := strconv.ParseInt(parts[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(parts[6])
+	configEpoch, err4 := strconv.ParseInt(parts[7], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return
+	}
+	ip, runID, masterIP := parts[0], parts[2], parts[5]
+
+	m := sentinelMasters[parts[4]]
+	if m == nil || runID == sentinelMyID {
+		return
+	}
+
+	s := m.sentinels[runID]
+	if s == nil {
+		s = m.addSentinel(runID, ip, port)
+		sentinelFlushConfig()
+	} else if s.ip != ip || s.port != port {
+		sentinelEvent("+sentinel-address-switch", s, "ip %s port %d for %s", ip, port, runID)
+		s.ip, s.port, s.name = ip, port, net.JoinHostPort(ip, strconv.Itoa(port))
+		s.resetLink()
+		sentinelFlushConfig()
+	}
+	s.lastHello = time.Now()
+
+	if epoch > sentinelCurrentEpoch {
+		sentinelCurrentEpoch = epoch
+		sentinelEvent("+new-epoch", nil, "%d", epoch)
+		sentinelFlushConfig()
+	}
+
+	// A failover elsewhere moved the master
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if masterIP != m.ip || masterPort != m.port {
+			sentinelEvent("+config-update-from", s, "")
+			m.switchMaster(masterIP, masterPort)
+		}
+		sentinelFlushConfig()
+	}
+}
+
+// sentinelEvent logs an event about inst and publishes it to the clients
+// subscribed to the channel named after its type. The caller must hold
+// sentinelMu.
+func sentinelEvent(typ string, inst *sentinelInstance, format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	if inst != nil {
+		msg = strings.TrimSuffix(inst.describe()+" "+msg, " ")
+	}
+
+	fmt.Println(typ, msg)
+	publish(nil, []Value{bulkValue(typ), bulkValue(msg)})
+}
+
+// sentinelFlushConfig saves the state of the sentinel to its configuration
+// file. The caller must hold sentinelMu.
+func sentinelFlushConfig() {
+	if err := rewriteConfig(configFile); err != nil {
+		fmt.Println("Error saving the sentinel state:", err)
+	}
+}
+
+// sentinelConfigLines returns the sentinel directives that save its state. The
+// caller must hold sentinelMu.
+func sentinelConfigLines() []string {
+	lines := []string{"sentinel myid " + sentinelMyID}
+
+	names := make([]string, 0, len(sentinelMasters))
+	for name := range sentinelMasters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := sentinelMasters[name]
+		lines = append(lines, fmt.Sprintf("sentinel monitor %s %s %d %d", name, m.ip, m.port, m.quorum))
+		if m.downAfter != sentinelDefaultDownAfter {
+			lines = append(lines, fmt.Sprintf("sentinel down-after-milliseconds %s %d", name, m.downAfter.Milliseconds()))
+		}
+		if m.failoverTimeout != sentinelDefaultFailoverTimeout {
+			lines = append(lines, fmt.Sprintf("sentinel failover-timeout %s %d", name, m.failoverTimeout.Milliseconds()))
+		}
+		if m.authPass != "" {
+			lines = append(lines, fmt.Sprintf("sentinel auth-pass %s %s", name, strconv.Quote(m.authPass)))
+		}
+		lines = append(lines,
+			fmt.Sprintf("sentinel config-epoch %s %d", name, m.configEpoch),
+			fmt.Sprintf("sentinel leader-epoch %s %d", name, m.leaderEpoch))
+
+		addrs := make([]string, 0, len(m.replicas))
+		for addr := range m.replicas {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			r := m.replicas[addr]
+			lines = append(lines, fmt.Sprintf("sentinel known-replica %s %s %d", name, r.ip, r.port))
+		}
+
+		ids := make([]string, 0, len(m.sentinels))
+		for id := range m.sentinels {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := m.sentinels[id]
+			lines = append(lines, fmt.Sprintf("sentinel known-sentinel %s %s %d %s", name, s.ip, s.port, id))
+		}
+	}
+
+	return append(lines, fmt.Sprintf("sentinel current-epoch %d", sentinelCurrentEpoch))
+}
+
+// sentinelConfigDirective applies a sentinel directive of the configuration
+// file, without the leading sentinel.
+func sentinelConfigDirective(args []string) error {
+	if len(args) == 0 {
+		return errors.New("wrong number of arguments")
+	}
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	option := strings.ToLower(args[0])
+	nargs := map[string]int{
+		"monitor": 5, "down-after-milliseconds": 3, "failover-timeout": 3, "auth-pass": 3,
+		"myid": 2, "current-epoch": 2, "config-epoch": 3, "leader-epoch": 3,
+		"known-replica": 4, "known-slave": 4, "known-sentinel": 5,
+	}
+	n, ok := nargs[option]
+	if !ok {
+		return fmt.Errorf("unknown sentinel option '%s'", args[0])
+	}
+	if len(args) != n {
+		return fmt.Errorf("wrong number of arguments for 'sentinel %s'", args[0])
+	}
+
+	switch option {
+	case "monitor":
+		port, err := strconv.Atoi(args[3])
+		quorum, err2 := strconv.Atoi(args[4])
+		switch {
+		case sentinelMasters[args[1]] != nil:
+			return errors.New("Duplicated master name.")
+		case net.ParseIP(args[2]) == nil:
+			return errors.New("Invalid IP address for the master.")
+		case err != nil || port <= 0 || port > 65535:
+			return errors.New("Invalid port for the master.")
+		case err2 != nil || quorum <= 0:
+			return errors.New("Quorum must be 1 or greater.")
+		}
+		m := newSentinelInstance(sentinelKindMaster, args[1], args[2], port, nil)
+		m.quorum = quorum
+		sentinelMasters[args[1]] = m
+		return nil
+	case "myid":
+		if len(args[1]) != 40 {
+			return errors.New("Malformed Sentinel id in myid option.")
+		}
+		sentinelMyID = args[1]
+		return nil
+	case "current-epoch":
+		epoch, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New("Invalid current epoch.")
+		}
+		sentinelCurrentEpoch = max(sentinelCurrentEpoch, epoch)
+		return nil
+	}
+
+	m := sentinelMasters[args[1]]
+	if m == nil {
+		return errors.New("No such master with specified name.")
+	}
+	switch option {
+	case "down-after-milliseconds", "failover-timeout":
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("Invalid %s.", option)
+		}
+		if option == "down-after-milliseconds" {
+			m.downAfter = time.Duration(ms) * time.Millisecond
+		} else {
+			m.failoverTimeout = time.Duration(ms) * time.Millisecond
+		}
+	case "auth-pass":
+		m.authPass = args[2]
+	case "config-epoch", "leader-epoch":
+		epoch, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid %s.", option)
+		}
+		if option == "config-epoch" {
+			m.configEpoch = epoch
+		} else {
+			m.leaderEpoch = epoch
+		}
+		sentinelCurrentEpoch = max(sentinelCurrentEpoch, epoch)
+	case "known-replica", "known-slave":
+		port, err := strconv.Atoi(args[3])
+		if err != nil || net.ParseIP(args[2]) == nil {
+			return errors.New("Wrong hostname or port for replica.")
+		}
+		m.addReplica(args[2], port)
+	case "known-sentinel":
+		port, err := strconv.Atoi(args[3])
+		if err != nil || net.ParseIP(args[2]) == nil {
+			return errors.New("Wrong hostname or port for sentinel.")
+		}
+		m.addSentinel(args[4], args[2], port)
+	}
+	return nil
+}
+
+// sentinelCommand handles the SENTINEL command.
+func sentinelCommand(c *Client, args []Value) Value {
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	sub := strings.ToUpper(args[0].bulk)
+	nargs := map[string]int{
+		"MASTERS": 1, "MASTER": 2, "REPLICAS": 2, "SLAVES": 2, "SENTINELS": 2, "GET-MASTER-ADDR-BY-NAME": 2,
+		"IS-MASTER-DOWN-BY-ADDR": 5, "RESET": 2, "FAILOVER": 2, "MONITOR": 5, "REMOVE": 2, "MYID": 1,
+		"CKQUORUM": 2, "FLUSHCONFIG": 1,
+	}
+	n, ok := nargs[sub]
+	if !ok && sub != "SET" {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", args[0].bulk)}
+	}
+	if ok && len(args) != n || sub == "SET" && (len(args) < 4 || len(args)%2 != 0) {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", strings.ToLower(sub))}
+	}
+
+	switch sub {
+	case "MASTERS":
+		names := make([]string, 0, len(sentinelMasters))
+		for name := range sentinelMasters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		masters := make([]Value, 0, len(names))
+		for _, name := range names {
+			masters = append(masters, sentinelMasters[name].infoValue())
+		}
+		return Value{typ: ValueTypArray, array: masters}
+	case "MYID":
+		return bulkValue(sentinelMyID)
+	case "FLUSHCONFIG":
+		sentinelFlushConfig()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	case "IS-MASTER-DOWN-BY-ADDR":
+		return sentinelIsMasterDownByAddr(args[1:])
+	case "RESET":
+		reset := 0
+		for _, m := range sentinelMasters {
+			if stringMatch(args[1].bulk, m.name) {
+				m.reset(false)
+				sentinelEvent("+reset-master", m, "")
+				reset++
+			}
+		}
+		sentinelFlushConfig()
+		return Value{typ: ValueTypInteger, num: reset}
+	case "MONITOR":
+		if err := sentinelMonitor(args[1:]); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR " + err.Error()}
+		}
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	}
+
+	m := sentinelMasters[args[1].bulk]
+	if m == nil {
+		if sub == "GET-MASTER-ADDR-BY-NAME" {
+			return Value{typ: ValueTypNullArray}
+		}
+		return Value{typ: ValueTypSimpleError, str: "ERR No such master with that name"}
+	}
+
+	switch sub {
+	case "MASTER":
+		return m.infoValue()
+	case "REPLICAS", "SLAVES":
+		return sentinelInstancesValue(m.replicas)
+	case "SENTINELS":
+		return sentinelInstancesValue(m.sentinels)
+	case "GET-MASTER-ADDR-BY-NAME":
+		ip, port := m.currentAddress()
+		return Value{typ: ValueTypArray, array: []Value{bulkValue(ip), bulkValue(strconv.Itoa(port))}}
+	case "FAILOVER":
+		if m.failover != nil {
+			return Value{typ: ValueTypSimpleError, str: "INPROG Failover already in progress"}
+		}
+		if m.selectReplica() == nil {
+			return Value{typ: ValueTypSimpleError, str: "NOGOODSLAVE No suitable replica to promote"}
+		}
+		m.startFailover(true)
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	case "REMOVE":
+		m.reset(false)
+		m.link.close()
+		delete(sentinelMasters, m.name)
+		sentinelEvent("-monitor", m, "")
+		sentinelFlushConfig()
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+	case "CKQUORUM":
+		usable := 1
+		for _, s := range m.sentinels {
+			if !s.sdown() {
+				usable++
+			}
+		}
+		voters := len(m.sentinels) + 1
+		if usable < m.quorum {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable)}
+		}
+		if usable < voters/2+1 {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable)}
+		}
+		return Value{typ: ValueTypSimpleString, str: fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable)}
+	default: // SET
+		return m.set(args[2:])
+	}
+}
+
+// sentinelMonitor starts monitoring the master in args: its name, address
+// and quorum. The caller must hold sentinelMu.
+func sentinelMonitor(args []Value) error {
+	name, ip := args[0].bulk, args[1].bulk
+	port, err := strconv.Atoi(args[2].bulk)
+	quorum, err2 := strconv.Atoi(args[3].bulk)
+	switch {
+	case sentinelMasters[name] != nil:
+		return errors.New("Duplicated master name")
+	case net.ParseIP(ip) == nil:
+		return errors.New("Invalid IP address or hostname specified")
+	case err != nil || port <= 0 || port > 65535:
+		return errors.New("Invalid port")
+	case err2 != nil || quorum <= 0:
+		return errors.New("Quorum must be 1 or greater.")
+	}
+
+	m := newSentinelInstance(sentinelKindMaster, name, ip, port, nil)
+	m.quorum = quorum
+	sentinelMasters[name] = m
+	sentinelEvent("+monitor", m, "quorum %d", quorum)
+	sentinelFlushConfig()
+	return nil
+}
+
+// set handles SENTINEL SET, changing the options of the master in pairs.
+func (m *sentinelInstance) set(pairs []Value) Value {
+	for i := 0; i < len(pairs); i += 2 {
+		option, value := strings.ToLower(pairs[i].bulk), pairs[i+1].bulk
+		invalid := Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Invalid argument '%s' for SENTINEL SET '%s'", value, option)}
+
+		switch option {
+		case "down-after-milliseconds", "failover-timeout":
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms <= 0 {
+				return invalid
+			}
+			if option == "down-after-milliseconds" {
+				m.downAfter = time.Duration(ms) * time.Millisecond
+			} else {
+				m.failoverTimeout = time.Duration(ms) * time.Millisecond
+			}
+		case "quorum":
+			quorum, err := strconv.Atoi(value)
+			if err != nil || quorum <= 0 {
+				return invalid
+			}
+			m.quorum = quorum
+		case "auth-pass":
+			// The links authenticate again with the new password
+			m.authPass = value
+			m.resetLink()
+			for _, r := range m.replicas {
+				r.resetLink()
+			}
+		default:
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unknown option or number of arguments for SENTINEL SET '%s'", pairs[i].bulk)}
+		}
+		sentinelEvent("+set", m, "%s %s", option, value)
+	}
+
+	sentinelFlushConfig()
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// sentinelIsMasterDownByAddr handles SENTINEL IS-MASTER-DOWN-BY-ADDR, which
+// other sentinels send to learn whether this one sees the master at the
+// address down and, with their run ID, to ask for its vote.
+func sentinelIsMasterDownByAddr(args []Value) Value {
+	port, err := strconv.Atoi(args[1].bulk)
+	epoch, err2 := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil || err2 != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	runID := args[3].bulk
+
+	var m *sentinelInstance
+	for _, master := range sentinelMasters {
+		if master.ip == args[0].bulk && master.port == port {
+			m = master
+		}
+	}
+
+	down, leader, leaderEpoch := 0, "", int64(0)
+	if m != nil {
+		if m.sdown() {
+			down = 1
+		}
+		if runID != "*" {
+			leader, leaderEpoch = m.voteLeader(epoch, runID)
+		}
+	}
+	if leader == "" {
+		leader = "*"
+	}
+
+	return Value{typ: ValueTypArray, array: []Value{
+		{typ: ValueTypInteger, num: down},
+		bulkValue(leader),
+		{typ: ValueTypInteger, num: int(leaderEpoch)},
+	}}
+}
+
+// reset forgets the replicas of the master and, unless keepSentinels is set,
+// the other sentinels, and the state learned about it, as after SENTINEL RESET.
+func (m *sentinelInstance) reset(keepSentinels bool) {
+	for _, r := range m.replicas {
+		r.link.close()
+	}
+	m.replicas = map[string]*sentinelInstance{}
+	if !keepSentinels {
+		for _, s := range m.sentinels {
+			s.link.close()
+		}
+		m.sentinels = map[string]*sentinelInstance{}
+	}
+	for _, s := range m.sentinels {
+		s.masterDown, s.leader = false, ""
+	}
+
+	m.resetLink()
+	m.runID, m.role, m.infoTime = "", "", time.Time{}
+	m.lastOkPing, m.sdownSince, m.odownSince = time.Now(), time.Time{}, time.Time{}
+	m.failover = nil
+}
+
+// sentinelRoleCommand handles the ROLE command of a sentinel, which lists the
+// masters it monitors.
+func sentinelRoleCommand(c *Client, args []Value) Value {
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	names := []string{}
+	for name := range sentinelMasters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	masters := make([]Value, 0, len(names))
+	for _, name := range names {
+		masters = append(masters, bulkValue(name))
+	}
+	return Value{typ: ValueTypArray, array: []Value{bulkValue("sentinel"), {typ: ValueTypArray, array: masters}}}
+}
+
+// sentinelPublishCommand handles the PUBLISH command of a sentinel, which only
+// takes the hello messages other sentinels send it directly.
+func sentinelPublishCommand(c *Client, args []Value) Value {
+	if args[0].bulk != sentinelHelloChannel {
+		return Value{typ: ValueTypSimpleError, str: "ERR Only HELLO messages are accepted by Sentinel instances."}
+	}
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	sentinelProcessHello(args[1].bulk)
+	return Value{typ: ValueTypInteger, num: 1}
+}
+
+// flags returns the flags of the instance as SENTINEL MASTERS reports them.
+func (inst *sentinelInstance) flags() string {
+	flags := []string{inst.kind}
+	if inst.sdown() {
+		flags = append(flags, "s_down")
+	}
+	if inst.kind == sentinelKindMaster && inst.odown() {
+		flags = append(flags, "o_down")
+	}
+	if !inst.link.up.Load() {
+		flags = append(flags, "disconnected")
+	}
+	if inst.kind == sentinelKindMaster && inst.failover != nil {
+		flags = append(flags, "failover_in_progress")
+	}
+	if f := inst.master.failover; inst.kind == sentinelKindReplica && f != nil {
+		if f.promoted == inst {
+			flags = append(flags, "promoted")
+		}
+		if !inst.reconfSent.IsZero() {
+			flags = append(flags, "reconf_sent")
+		}
+		if inst.reconfDone {
+			flags = append(flags, "reconf_done")
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// infoValue returns the state of the instance, as SENTINEL MASTERS, REPLICAS
+// and SENTINELS report it.
+func (inst *sentinelInstance) infoValue() Value {
+	ms := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+	}
+
+	fields := []string{
+		"name", inst.name,
+		"ip", inst.ip,
+		"port", strconv.Itoa(inst.port),
+		"runid", inst.runID,
+		"flags", inst.flags(),
+		"last-ok-ping-reply", ms(inst.lastOkPing),
+		"down-after-milliseconds", strconv.FormatInt(inst.master.downAfter.Milliseconds(), 10),
+	}
+	if inst.sdown() {
+		fields = append(fields, "s-down-time", ms(inst.sdownSince))
+	}
+
+	switch inst.kind {
+	case sentinelKindMaster:
+		if inst.odown() {
+			fields = append(fields, "o-down-time", ms(inst.odownSince))
+		}
+		fields = append(fields,
+			"info-refresh", ms(inst.infoTime),
+			"role-reported", inst.role,
+			"config-epoch", strconv.FormatInt(inst.configEpoch, 10),
+			"num-slaves", strconv.Itoa(len(inst.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(inst.sentinels)),
+			"quorum", strconv.Itoa(inst.quorum),
+			"failover-timeout", strconv.FormatInt(inst.failoverTimeout.Milliseconds(), 10))
+		if inst.failover != nil {
+			fields = append(fields, "failover-state", inst.failover.state)
+		}
+	case sentinelKindReplica:
+		status := "err"
+		if inst.masterLinkUp {
+			status = "ok"
+		}
+		fields = append(fields,
+			"info-refresh", ms(inst.infoTime),
+			"role-reported", inst.role,
+			"master-link-status", status,
+			"master-host", inst.masterHost,
+			"master-port", strconv.Itoa(inst.masterPort),
+			"slave-repl-offset", strconv.FormatInt(inst.replOffset, 10))
+	case sentinelKindSentinel:
+		fields = append(fields,
+			"last-hello-message", ms(inst.lastHello),
+			"voted-leader", cmp.Or(inst.leader, "?"),
+			"voted-leader-epoch", strconv.FormatInt(inst.leaderEpoch, 10))
+	}
+
+	values := make([]Value, 0, len(fields))
+	for _, field := range fields {
+		values = append(values, bulkValue(field))
+	}
+	return Value{typ: ValueTypMap, array: values}
+}
+
+// sentinelInstancesValue returns the state of the instances, ordered by name.
+func sentinelInstancesValue(instances map[string]*sentinelInstance) Value {
+	list := make([]*sentinelInstance, 0, len(instances))
+	for _, inst := range instances {
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	values := make([]Value, 0, len(list))
+	for _, inst := range list {
+		values = append(values, inst.infoValue())
+	}
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// sentinelInfo returns the lines of the sentinel section of INFO.
+func sentinelInfo() []string {
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	names := make([]string, 0, len(sentinelMasters))
+	for name := range sentinelMasters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"sentinel_masters:" + strconv.Itoa(len(names))}
+	for i, name := range names {
+		m := sentinelMasters[name]
+		status := "ok"
+		if m.odown() {
+			status = "odown"
+		} else if m.sdown() {
+			status = "sdown"
+		}
+		lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, name, status, m.addr(), len(m.replicas), len(m.sentinels)+1))
+	}
+	return lines
+}
@@ -0,0 +1,311 @@
+/*
+This file contains the failover of the masters a sentinel monitors. Once a
+master is objectively down, the sentinels that noticed start a failover in a new
+epoch and ask the others for their vote, each voting for the first that asks in
+an epoch. The one that gets the votes of a majority, and at least the quorum,
+leads the failover: it picks the replica with the most data, makes it a master
+with REPLICAOF NO ONE, points the other replicas at it, and announces the new
+configuration, tagged with the epoch, to the other sentinels on the hello
+channel. A failover that isn't done within failover-timeout is aborted, and the
+master isn't failed over again for twice that time. For a detailed description
+of the failover, refer to the Redis documentation:
+
+https://redis.io/docs/latest/operate/oss_and_stack/management/sentinel/#sentinels-and-replicas-auto-discovery
+*/
+
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// States of a failover, as SENTINEL MASTERS reports them
+const (
+	sentinelFailoverWaitStart        = "wait_start" // Waiting to be elected leader
+	sentinelFailoverSelectSlave      = "select_slave"
+	sentinelFailoverSendSlaveofNoOne = "send_slaveof_noone"
+	sentinelFailoverWaitPromotion    = "wait_promotion"
+	sentinelFailoverReconfSlaves     = "reconf_slaves"
+)
+
+const (
+	// sentinelElectionTimeout bounds the wait to be elected leader.
+	sentinelElectionTimeout = 10 * time.Second
+
+	// sentinelReconfTimeout is how long a replica has to follow the new master
+	// before it's told again.
+	sentinelReconfTimeout = 10 * time.Second
+
+	// sentinelMaxDesync is the largest random delay added to the start of a
+	// failover, so the sentinels don't all try again at the same time.
+	sentinelMaxDesync = time.Second
+)
+
+// sentinelFailover is a failover of a master in progress.
+type sentinelFailover struct {
+	state       string
+	stateChange time.Time
+	epoch       int64
+	forced      bool // Started with SENTINEL FAILOVER, without an election
+	promoted    *sentinelInstance
+}
+
+// setState moves the failover to state.
+func (f *sentinelFailover) setState(state string) {
+	f.state, f.stateChange = state, time.Now()
+}
+
+// startFailover starts a failover of the master in a new epoch.
+func (m *sentinelInstance) startFailover(forced bool) {
+	sentinelCurrentEpoch++
+	sentinelEvent("+new-epoch", nil, "%d", sentinelCurrentEpoch)
+	sentinelEvent("+try-failover", m, "")
+
+	m.failover = &sentinelFailover{epoch: sentinelCurrentEpoch, forced: forced}
+	m.failover.setState(sentinelFailoverWaitStart)
+	m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+	for _, r := range m.replicas {
+		r.reconfSent, r.reconfDone = time.Time{}, false
+	}
+	sentinelFlushConfig()
+}
+
+// abortFailover gives up the failover of the master.
+func (m *sentinelInstance) abortFailover() {
+	m.failover = nil
+}
+
+// failoverStep moves the failover of the master on as far as it can go.
+func (m *sentinelInstance) failoverStep() {
+	f := m.failover
+	switch f.state {
+	case sentinelFailoverWaitStart:
+		if m.electedLeader() != sentinelMyID && !f.forced {
+			if time.Since(m.failoverStart) > min(sentinelElectionTimeout, m.failoverTimeout) {
+				sentinelEvent("-failover-abort-not-elected", m, "")
+				m.abortFailover()
+			}
+			return
+		}
+		sentinelEvent("+elected-leader", m, "")
+		sentinelEvent("+failover-state-select-slave", m, "")
+		f.setState(sentinelFailoverSelectSlave)
+		m.failoverStep()
+
+	case sentinelFailoverSelectSlave:
+		r := m.selectReplica()
+		if r == nil {
+			sentinelEvent("-failover-abort-no-good-slave", m, "")
+			m.abortFailover()
+			return
+		}
+		sentinelEvent("+selected-slave", r, "")
+		f.promoted = r
+		f.setState(sentinelFailoverSendSlaveofNoOne)
+		sentinelEvent("+failover-state-send-slaveof-noone", r, "")
+		m.failoverStep()
+
+	case sentinelFailoverSendSlaveofNoOne:
+		if !f.promoted.link.up.Load() {
+			if time.Since(f.stateChange) > m.failoverTimeout {
+				sentinelEvent("-failover-abort-slave-timeout", m, "")
+				m.abortFailover()
+			}
+			return
+		}
+		f.promoted.send(nil, "REPLICAOF", "NO", "ONE")
+		f.setState(sentinelFailoverWaitPromotion)
+		sentinelEvent("+failover-state-wait-promotion", f.promoted, "")
+
+	case sentinelFailoverWaitPromotion:
+		// The INFO of the replica tells when it took over
+		if time.Since(f.stateChange) > m.failoverTimeout {
+			sentinelEvent("-failover-abort-slave-timeout", m, "")
+			m.abortFailover()
+		}
+
+	case sentinelFailoverReconfSlaves:
+		m.reconfReplicas()
+	}
+}
+
+// electedLeader returns the sentinel elected to lead the failover of the
+// master in its epoch, empty while none has the votes of a majority and at
+// least the quorum. This sentinel votes for the leader that has the most votes
+// so far, or for itself.
+func (m *sentinelInstance) electedLeader() string {
+	epoch := m.failover.epoch
+	votes := map[string]int{}
+	for _, s := range m.sentinels {
+		if s.leader != "" && s.leaderEpoch == epoch {
+			votes[s.leader]++
+		}
+	}
+
+	winner := func() (string, int) {
+		leader, most := "", 0
+		for id, n := range votes {
+			if n > most || n == most && id < leader {
+				leader, most = id, n
+			}
+		}
+		return leader, most
+	}
+
+	candidate, _ := winner()
+	if candidate == "" {
+		candidate = sentinelMyID
+	}
+	if vote, voteEpoch := m.voteLeader(epoch, candidate); vote != "" && voteEpoch == epoch {
+		votes[vote]++
+	}
+
+	leader, most := winner()
+	voters := len(m.sentinels) + 1
+	if most < voters/2+1 || most < m.quorum {
+		return ""
+	}
+	return leader
+}
+
+// voteLeader votes for runID to lead the failover of the master in epoch,
+// unless a vote was already given in that epoch, and returns the sentinel
+// voted for and the epoch of the vote.
+func (m *sentinelInstance) voteLeader(epoch int64, runID string) (string, int64) {
+	if epoch > sentinelCurrentEpoch {
+		sentinelCurrentEpoch = epoch
+		sentinelEvent("+new-epoch", nil, "%d", epoch)
+		sentinelFlushConfig()
+	}
+
+	if m.leaderEpoch < epoch && sentinelCurrentEpoch <= epoch {
+		m.leader, m.leaderEpoch = runID, sentinelCurrentEpoch
+		sentinelEvent("+vote-for-leader", nil, "%s %d", runID, m.leaderEpoch)
+		sentinelFlushConfig()
+
+		// Voting for another sentinel gives it time to fail over before this
+		// one tries
+		if runID != sentinelMyID {
+			m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// selectReplica returns the replica to promote: among those that are up and
+// reported recently, the one with the most data, nil if there's none.
+func (m *sentinelInstance) selectReplica() *sentinelInstance {
+	maxInfoAge := 3 * sentinelInfoPeriod
+	if m.sdown() {
+		maxInfoAge = 5 * time.Second
+	}
+
+	candidates := []*sentinelInstance{}
+	for _, r := range m.replicas {
+		if r.sdown() || !r.link.up.Load() || r.role != "slave" ||
+			time.Since(r.lastOkPing) > 5*sentinelPingPeriod || time.Since(r.infoTime) > maxInfoAge {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].replOffset != candidates[j].replOffset {
+			return candidates[i].replOffset > candidates[j].replOffset
+		}
+		return candidates[i].runID < candidates[j].runID
+	})
+	return candidates[0]
+}
+
+// promoted moves the failover on once the chosen replica became a master,
+// which the new configuration epoch tells the other sentinels.
+func (m *sentinelInstance) promoted() {
+	f := m.failover
+	m.configEpoch = f.epoch
+	sentinelEvent("+promoted-slave", f.promoted, "")
+	sentinelEvent("+failover-state-reconf-slaves", m, "")
+	f.setState(sentinelFailoverReconfSlaves)
+	sentinelFlushConfig()
+
+	// Announce the new configuration right away
+	for _, inst := range append(mapValues(m.replicas), mapValues(m.sentinels)...) {
+		inst.lastHelloSent = time.Time{}
+	}
+}
+
+// currentAddress returns the address of the master, which is the promoted
+// replica once a failover made it one.
+func (m *sentinelInstance) currentAddress() (string, int) {
+	if f := m.failover; f != nil && f.state == sentinelFailoverReconfSlaves {
+		return f.promoted.ip, f.promoted.port
+	}
+	return m.ip, m.port
+}
+
+// reconfReplicas points the other replicas at the promoted one, and ends the
+// failover once they follow it or the time is up.
+func (m *sentinelInstance) reconfReplicas() {
+	f := m.failover
+	timedOut := time.Since(f.stateChange) > m.failoverTimeout
+
+	done := true
+	for _, r := range m.replicas {
+		// Replicas that are down are fixed once they're back
+		if r == f.promoted || r.reconfDone || r.sdown() {
+			continue
+		}
+		done = false
+		if timedOut || time.Since(r.reconfSent) < sentinelReconfTimeout {
+			continue
+		}
+		r.reconfSent = time.Now()
+		r.send(nil, "REPLICAOF", f.promoted.ip, strconv.Itoa(f.promoted.port))
+		sentinelEvent("+slave-reconf-sent", r, "")
+	}
+
+	if !done && !timedOut {
+		return
+	}
+	if timedOut {
+		sentinelEvent("-failover-end-for-timeout", m, "")
+	}
+	sentinelEvent("+failover-end", m, "")
+	m.switchMaster(f.promoted.ip, f.promoted.port)
+}
+
+// switchMaster moves the master to ip:port, keeping the other replicas and the
+// old master as its replicas.
+func (m *sentinelInstance) switchMaster(ip string, port int) {
+	sentinelEvent("+switch-master", nil, "%s %s %d %s %d", m.name, m.ip, m.port, ip, port)
+
+	addrs := []string{net.JoinHostPort(m.ip, strconv.Itoa(m.port))}
+	for addr := range m.replicas {
+		addrs = append(addrs, addr)
+	}
+
+	m.ip, m.port = ip, port
+	m.reset(true)
+	for _, addr := range addrs {
+		host, p, _ := net.SplitHostPort(addr)
+		replicaPort, _ := strconv.Atoi(p)
+		m.addReplica(host, replicaPort)
+	}
+	sentinelFlushConfig()
+}
+
+// mapValues returns the values of the map.
+func mapValues[K comparable, V any](m map[K]V) []V {
+	values := make([]V, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,313 @@
+/*
+This file contains the set data type, an unordered collection of unique
+strings. Like Redis, a set holding only integers is stored as an intset: a
+sorted slice of int64, searched with a binary search, which takes a fraction of
+the memory of a Go map. Once a member isn't an integer, or the set has more
+than set-max-intset-entries members, it's converted to a map for good. For a
+detailed description of sets and their encodings, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/develop/data-types/sets/
+*/
+
+package main
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Set holds the members of a set, as an intset or in a map.
+type Set struct {
+	ints []int64             // Sorted members, while they're all integers
+	dict map[string]struct{} // Set once the set outgrew the intset encoding
+	peak int                 // Most members dict held since it was last rebuilt
+}
+
+// newSet creates an empty set.
+func newSet() *Set {
+	return &Set{}
+}
+
+// setFromMembers creates a set holding members, as an intset if they allow it.
+func setFromMembers(members []string) *Set {
+	set := newSet()
+	for _, member := range members {
+		set.Add(member)
+	}
+	return set
+}
+
+// Len returns the number of members.
+func (set *Set) Len() int {
+	if set.dict != nil {
+		return len(set.dict)
+	}
+	return len(set.ints)
+}
+
+// Contains reports whether member is in the set.
+func (set *Set) Contains(member string) bool {
+	if set.dict != nil {
+		_, ok := set.dict[member]
+		return ok
+	}
+	n, ok := canonicalInt(member)
+	if !ok {
+		return false
+	}
+	_, found := slices.BinarySearch(set.ints, n)
+	return found
+}
+
+// Add adds member, reporting whether it's new.
+func (set *Set) Add(member string) bool {
+	if set.dict == nil {
+		n, ok := canonicalInt(member)
+		if ok {
+			i, found := slices.BinarySearch(set.ints, n)
+			if found {
+				return false
+			}
+			if len(set.ints) < config.setMaxIntsetEntries {
+				set.ints = slices.Insert(set.ints, i, n)
+				return true
+			}
+		}
+		set.convert()
+	}
+
+	if _, exists := set.dict[member]; exists {
+		return false
+	}
+	set.dict[member] = struct{}{}
+	return true
+}
+
+// Remove removes member, reporting whether it was in the set.
+func (set *Set) Remove(member string) bool {
+	if set.dict != nil {
+		if _, exists := set.dict[member]; !exists {
+			return false
+		}
+		delete(set.dict, member)
+		return true
+	}
+	n, ok := canonicalInt(member)
+	if !ok {
+		return false
+	}
+	i, found := slices.BinarySearch(set.ints, n)
+	if found {
+		set.ints = slices.Delete(set.ints, i, i+1)
+	}
+	return found
+}
+
+// Range calls fn for every member, until it returns false. An intset is ranged
+// in ascending order.
+func (set *Set) Range(fn func(member string) bool) {
+	if set.dict != nil {
+		for member := range set.dict {
+			if !fn(member) {
+				return
+			}
+		}
+		return
+	}
+	for _, n := range set.ints {
+		if !fn(strconv.FormatInt(n, 10)) {
+			return
+		}
+	}
+}
+
+// Members returns the members of the set in a new slice.
+func (set *Set) Members() []string {
+	members := make([]string, 0, set.Len())
+	set.Range(func(member string) bool {
+		members = append(members, member)
+		return true
+	})
+	return members
+}
+
+// Clone returns a copy of the set.
+func (set *Set) Clone() *Set {
+	if set.dict != nil {
+		return &Set{dict: maps.Clone(set.dict)}
+	}
+	return &Set{ints: slices.Clone(set.ints)}
+}
+
+// encoding returns the name Redis gives to the encoding of the set.
+func (set *Set) encoding() string {
+	if set.dict != nil {
+		return "hashtable"
+	}
+	return "intset"
+}
+
+// convert moves the members of an intset to a map.
+func (set *Set) convert() {
+	set.dict = make(map[string]struct{}, len(set.ints)+1)
+	for _, n := range set.ints {
+		set.dict[strconv.FormatInt(n, 10)] = struct{}{}
+	}
+	set.ints = nil
+}
+
+// sadd handles the SADD command.
+func sadd(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'sadd' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		e = s.add(key, Object{typ: KeyTypSet, set: newSet()})
+	}
+	added := 0
+	for _, arg := range args[1:] {
+		if e.set.Add(arg.bulk) {
+			added++
+		}
+	}
+	e.touch()
+
+	if added == 0 {
+		c.unchanged()
+	}
+
+	return Value{typ: ValueTypInteger, num: added}
+}
+
+// srem handles the SREM command.
+func srem(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'srem' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	removed := 0
+	for _, arg := range args[1:] {
+		if e.set.Remove(arg.bulk) {
+			removed++
+		}
+	}
+	e.touch()
+
+	// Like every aggregate type, a set that's left empty is deleted
+	if e.set.Len() == 0 {
+		s.remove(key, false)
+	}
+	if removed == 0 {
+		c.unchanged()
+	}
+
+	return Value{typ: ValueTypInteger, num: removed}
+}
+
+// sismember handles the SISMEMBER command.
+func sismember(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'sismember' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+
+	if !e.set.Contains(args[1].bulk) {
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	return Value{typ: ValueTypInteger, num: 1}
+}
+
+// smembers handles the SMEMBERS command.
+func smembers(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'smembers' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypSet}
+	}
+	e.touch()
+
+	values := make([]Value, 0, e.set.Len())
+	e.set.Range(func(member string) bool {
+		values = append(values, Value{typ: ValueTypBulkString, bulk: member})
+		return true
+	})
+
+	return Value{typ: ValueTypSet, array: values}
+}
+
+// scard handles the SCARD command.
+func scard(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'scard' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypSet)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+
+	return Value{typ: ValueTypInteger, num: e.set.Len()}
+}
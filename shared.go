@@ -0,0 +1,68 @@
+/*
+This file contains the shared integers. Counters and flags make up much of many
+datasets, and every one of their values would otherwise be a string of its own.
+Like Redis, the strings of the integers from 0 to sharedIntegers-1 are created
+once at startup, and a value equal to one of them is stored as that string, so
+any number of keys and hash fields holding small integers share their memory.
+Redis stops sharing them when an LRU or LFU policy needs the access time of
+each value, which doesn't apply here as the keys hold it. For a detailed
+description of shared integers, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/object-refcount/
+*/
+
+package main
+
+import "strconv"
+
+// sharedIntegers is the number of shared integers, from 0, and
+// sharedIntegerMaxLen the number of digits of the largest.
+const sharedIntegers = 10000
+const sharedIntegerMaxLen = 4
+
+// sharedRefcount is the reference count OBJECT REFCOUNT reports for a shared
+// value, which is never freed.
+const sharedRefcount = 2147483647
+
+// sharedIntegerStrings holds the string of every shared integer.
+var sharedIntegerStrings [sharedIntegers]string
+
+func init() {
+	for i := range sharedIntegerStrings {
+		sharedIntegerStrings[i] = strconv.Itoa(i)
+	}
+}
+
+// sharedInteger returns the shared integer s is the canonical form of, if any:
+// digits only, without leading zeros.
+func sharedInteger(s string) (int, bool) {
+	if len(s) == 0 || len(s) > sharedIntegerMaxLen || len(s) > 1 && s[0] == '0' {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int(s[i]-'0')
+	}
+	return n, n < sharedIntegers
+}
+
+// sharedString returns the shared string equal to s if it's a shared integer,
+// and s otherwise, for values about to be stored.
+func sharedString(s string) string {
+	if n, ok := sharedInteger(s); ok {
+		return sharedIntegerStrings[n]
+	}
+	return s
+}
+
+// valueSize returns the memory used by a string stored as a value, which is
+// only its header when it's a shared integer.
+func valueSize(s string) int {
+	if _, ok := sharedInteger(s); ok {
+		return stringHeaderSize
+	}
+	return stringSize(s)
+}
@@ -0,0 +1,107 @@
+/*
+This file contains the shutdown of the server, started by the SHUTDOWN command or
+by a SIGTERM or SIGINT signal. The server saves a snapshot if save points are
+configured, stops accepting connections, closes the connections of its clients
+and syncs the AOF to disk, so every write that was acknowledged survives, before
+the process exits. For a detailed description of the command, refer to the Redis
+documentation:
+
+https://redis.io/docs/latest/commands/shutdown/
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// shuttingDown is set once the server started shutting down, so the accept loop
+// knows the listener was closed on purpose.
+var shuttingDown atomic.Bool
+
+// shutdownCommand handles the SHUTDOWN command.
+func shutdownCommand(c *Client, args []Value) Value {
+	// A snapshot is saved if there are save points, unless told otherwise
+	save := len(config.save) > 0
+	for _, arg := range args {
+		switch strings.ToUpper(arg.bulk) {
+		case "NOSAVE":
+			save = false
+		case "SAVE":
+			save = true
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	if err := shutdown(save); err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR Errors trying to SHUTDOWN. Check logs."}
+	}
+	return Value{typ: ValueTypNoReply}
+}
+
+// handleShutdownSignals shuts the server down when it receives SIGTERM or SIGINT.
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	// If the snapshot can't be saved the server keeps running, as Redis does
+	for sig := range signals {
+		fmt.Printf("Received %s, scheduling shutdown...\n", sig)
+
+		execMu.Lock()
+		shutdown(len(config.save) > 0)
+		execMu.Unlock()
+	}
+}
+
+// shutdown stops the server and exits the process, first saving a snapshot if
+// save is set. If the snapshot can't be saved the server keeps running and the
+// error is returned. The caller must hold execMu for writing, so no command runs
+// while the server goes down.
+func shutdown(save bool) error {
+	fmt.Println("User requested shutdown...")
+
+	// A dataset that isn't fully loaded would replace the snapshot with part of it
+	if save && loading.Load() {
+		fmt.Println("Not saving the RDB snapshot, the dataset is still loading.")
+		save = false
+	}
+
+	if save {
+		fmt.Println("Saving the final RDB snapshot before exiting.")
+		if err := rdbSave(); err != nil {
+			fmt.Println("Error trying to save the DB, can't exit.")
+			return err
+		}
+	}
+
+	shuttingDown.Store(true)
+
+	for _, l := range serverListeners {
+		l.Close()
+	}
+
+	clientsMu.RLock()
+	for _, client := range clients {
+		client.conn.Close()
+	}
+	clientsMu.RUnlock()
+
+	if serverAof != nil {
+		fmt.Println("Calling fsync() on the AOF file.")
+		if err := serverAof.Close(); err != nil {
+			fmt.Println("Error closing AOF:", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println("Redis is now ready to exit, bye bye...")
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,271 @@
+/*
+This file contains the SORT command, which returns the elements of a collection
+sorted numerically or lexicographically. Elements can be sorted by weights read
+from other keys with BY, and GET can fetch the values of other keys instead of
+the elements themselves. Patterns use "*" as a placeholder for the element and
+"key->field" to read a hash field. The keys patterns refer to aren't checked
+against the ACL, so BY and GET are only allowed to users who may access every
+key. STORE saves the result as a list instead of replying with it, which makes
+SORT a write command, and SORT_RO is the same without STORE, for replicas and
+read-only scripts. For a detailed description of the command, refer to the
+Redis documentation:
+
+https://redis.io/docs/latest/commands/sort/
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortItem is an element being sorted along with the weight it's sorted by.
+type sortItem struct {
+	elem   string
+	weight string
+	score  float64
+}
+
+// sortCommand handles the SORT command.
+func sortCommand(c *Client, args []Value) Value {
+	return sortGeneric(c, "sort", args, true)
+}
+
+// sortRo handles the SORT_RO command.
+func sortRo(c *Client, args []Value) Value {
+	return sortGeneric(c, "sort_ro", args, false)
+}
+
+// sortGeneric implements SORT and SORT_RO, the read-only variant which doesn't
+// take STORE.
+func sortGeneric(c *Client, name string, args []Value, store bool) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+
+	byPattern := ""
+	hasBy := false
+	storeKey := ""
+	hasStore := false
+	getPatterns := []string{}
+	offset, count := 0, -1
+	desc, alpha := false, false
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		remaining := len(args) - i - 1
+
+		switch {
+		case opt == "ASC":
+			desc = false
+		case opt == "DESC":
+			desc = true
+		case opt == "ALPHA":
+			alpha = true
+		case opt == "LIMIT" && remaining >= 2:
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1].bulk)
+			count, err2 = strconv.Atoi(args[i+2].bulk)
+			if err1 != nil || err2 != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			i += 2
+		case opt == "BY" && remaining >= 1:
+			byPattern = args[i+1].bulk
+			hasBy = true
+			// The keys a pattern refers to aren't checked against the ACL, so
+			// only a user who may read every key can use one
+			if strings.Contains(byPattern, "*") && !c.user.hasAllKeys() {
+				return Value{typ: ValueTypSimpleError, str: "NOPERM BY option of SORT denied due to insufficient ACL permissions."}
+			}
+			i++
+		case opt == "GET" && remaining >= 1:
+			if !c.user.hasAllKeys() {
+				return Value{typ: ValueTypSimpleError, str: "NOPERM GET option of SORT denied due to insufficient ACL permissions."}
+			}
+			getPatterns = append(getPatterns, args[i+1].bulk)
+			i++
+		case opt == "STORE" && remaining >= 1 && store:
+			storeKey = args[i+1].bulk
+			hasStore = true
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	// Copy the members so the lookups below don't run under the lock of its shard
+	items := []sortItem{}
+	s := c.db.shard(key)
+	s.mu.RLock()
+	e, ok := s.keys[key]
+	if ok {
+		switch e.typ {
+		case KeyTypList:
+			e.list.Range(0, e.list.Len()-1, func(elem string) bool {
+				items = append(items, sortItem{elem: elem})
+				return true
+			})
+		case KeyTypSet:
+			e.set.Range(func(member string) bool {
+				items = append(items, sortItem{elem: member})
+				return true
+			})
+		case KeyTypZSet:
+			for _, m := range e.zset.Members() {
+				items = append(items, sortItem{elem: m.member})
+			}
+		default:
+			ok = false
+		}
+		e.touch()
+	}
+	s.mu.RUnlock()
+
+	if e != nil && !ok {
+		return wrongTypeError
+	}
+
+	// A BY pattern without "*" can't vary per element, which means don't sort.
+	// The members of a set would then come in the order of its map, so they're
+	// sorted anyway when stored, for the replicas and the AOF to store the
+	// same list.
+	dontSort := hasBy && !strings.Contains(byPattern, "*")
+	if dontSort && hasStore && e != nil && e.typ == KeyTypSet {
+		dontSort, hasBy, alpha = false, false, true
+	}
+
+	if !dontSort {
+		for i := range items {
+			weight := items[i].elem
+			if hasBy {
+				weight, _ = lookupSortPattern(c.db, byPattern, items[i].elem)
+			}
+			items[i].weight = weight
+
+			if !alpha {
+				score, err := strconv.ParseFloat(weight, 64)
+				if err != nil && weight != "" {
+					return Value{typ: ValueTypSimpleError, str: "ERR One or more scores can't be converted into double"}
+				}
+				items[i].score = score
+			}
+		}
+
+		sort.SliceStable(items, func(i, j int) bool {
+			a, b := items[i], items[j]
+			if desc {
+				a, b = b, a
+			}
+			if alpha {
+				return a.weight < b.weight
+			}
+			// Equal scores fall back to comparing the elements so the order is stable
+			if a.score != b.score {
+				return a.score < b.score
+			}
+			return a.elem < b.elem
+		})
+	} else if desc {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	// Apply LIMIT
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+	if count >= 0 && count < len(items) {
+		items = items[:count]
+	}
+
+	values := []Value{}
+	for _, item := range items {
+		if len(getPatterns) == 0 {
+			values = append(values, bulkValue(item.elem))
+			continue
+		}
+
+		for _, pattern := range getPatterns {
+			value, ok := lookupSortPattern(c.db, pattern, item.elem)
+			if !ok {
+				values = append(values, Value{typ: ValueTypNull})
+				continue
+			}
+			values = append(values, bulkValue(value))
+		}
+	}
+
+	if hasStore {
+		return sortStore(c, storeKey, values)
+	}
+	c.unchanged()
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// sortStore stores the result of SORT as a list at key, replacing its value,
+// or deletes key if the result is empty, and replies with its length. The
+// values GET found nothing for are stored as empty strings.
+func sortStore(c *Client, key string, values []Value) Value {
+	if len(values) == 0 {
+		deleteKey(c.db, key)
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	list := newList()
+	for _, value := range values {
+		list.Push(value.bulk, false)
+	}
+	storeObject(c.db, key, Object{typ: KeyTypList, list: list})
+
+	return Value{typ: ValueTypInteger, num: len(values)}
+}
+
+// lookupSortPattern substitutes elem into a BY or GET pattern and returns the
+// value it refers to. "#" refers to the element itself and "key->field" reads a
+// field of the hash stored at key.
+func lookupSortPattern(db *DB, pattern, elem string) (string, bool) {
+	if pattern == "#" {
+		return elem, true
+	}
+
+	star := strings.Index(pattern, "*")
+	if star == -1 {
+		return "", false
+	}
+
+	// Split off the hash field, which must come after the placeholder
+	field := ""
+	if arrow := strings.LastIndex(pattern, "->"); arrow > star && arrow+2 < len(pattern) {
+		field = pattern[arrow+2:]
+		pattern = pattern[:arrow]
+	}
+
+	key := pattern[:star] + elem + pattern[star+1:]
+
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.keys[key]
+	switch {
+	case !ok:
+		return "", false
+	case field == "" && e.typ == KeyTypString:
+		return e.str, true
+	case field != "" && e.typ == KeyTypHash:
+		value, ok := e.hash.Get(field)
+		return value, ok
+	}
+	return "", false
+}
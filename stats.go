@@ -0,0 +1,178 @@
+/*
+This file contains the statistics the server keeps about the commands it runs:
+how often each command was called, how long it took, how often it was rejected
+before running or failed while running, and how many error replies were sent per
+error prefix, along with general counters such as keyspace hits and misses. They
+are reported in the stats, commandstats, errorstats and latencystats sections
+of INFO and cleared with CONFIG RESETSTAT. For a detailed description of the
+sections, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/info/
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats holds the general counters of the server.
+var serverStats struct {
+	keyspaceHits             atomic.Int64
+	keyspaceMisses           atomic.Int64
+	totalCommandsProcessed   atomic.Int64
+	totalConnectionsReceived atomic.Int64
+	totalErrorReplies        atomic.Int64
+	expiredKeys              atomic.Int64
+	expiredTimeCapReached    atomic.Int64 // Expire cycles that ran out of time
+	evictedKeys              atomic.Int64
+	activeDefragHits         atomic.Int64 // Maps rebuilt by compaction
+	activeDefragKeyHits      atomic.Int64 // Keys whose collections were compacted
+	activeDefragReclaimed    atomic.Int64 // Bytes compaction freed, estimated
+}
+
+// commandStats holds the call statistics of a command.
+type commandStats struct {
+	calls         atomic.Int64
+	usec          atomic.Int64
+	rejectedCalls atomic.Int64 // Rejected before running, for example for a wrong arity
+	failedCalls   atomic.Int64 // Ran and replied with an error
+
+	// How long the calls ran, see latency_histogram.go
+	histogram atomic.Pointer[latencyHistogram]
+}
+
+// errorStats maps an error prefix, such as ERR or WRONGTYPE, to the number of
+// error replies sent with it.
+var errorStats = map[string]int64{}
+var errorStatsMu = sync.Mutex{}
+
+// recordCall records that cmd ran for d and replied with result.
+func recordCall(cmd *Command, d time.Duration, result Value) {
+	serverStats.totalCommandsProcessed.Add(1)
+	cmd.stats.calls.Add(1)
+	cmd.stats.usec.Add(d.Microseconds())
+	recordCommandLatency(cmd, d)
+
+	if result.typ == ValueTypSimpleError {
+		cmd.stats.failedCalls.Add(1)
+		recordError(result)
+	}
+}
+
+// recordRejected records that cmd was rejected with reply without running. cmd
+// is nil for unknown commands.
+func recordRejected(cmd *Command, reply Value) Value {
+	if cmd != nil {
+		cmd.stats.rejectedCalls.Add(1)
+	}
+	recordError(reply)
+	return reply
+}
+
+// recordError counts an error reply under its prefix.
+func recordError(reply Value) {
+	serverStats.totalErrorReplies.Add(1)
+	prefix, _, _ := strings.Cut(reply.str, " ")
+
+	errorStatsMu.Lock()
+	errorStats[prefix]++
+	errorStatsMu.Unlock()
+}
+
+// recordKeyspaceLookup counts a read of key as a hit if it exists or a miss if
+// it doesn't.
+func recordKeyspaceLookup(db *DB, key string) {
+	if lookupKeyType(db, key) != KeyTypNone {
+		serverStats.keyspaceHits.Add(1)
+	} else {
+		serverStats.keyspaceMisses.Add(1)
+	}
+}
+
+// resetStats clears every statistic, for CONFIG RESETSTAT.
+func resetStats() {
+	serverStats.keyspaceHits.Store(0)
+	serverStats.keyspaceMisses.Store(0)
+	serverStats.totalCommandsProcessed.Store(0)
+	serverStats.totalConnectionsReceived.Store(0)
+	serverStats.totalErrorReplies.Store(0)
+	serverStats.expiredKeys.Store(0)
+	serverStats.expiredTimeCapReached.Store(0)
+	serverStats.evictedKeys.Store(0)
+	serverStats.activeDefragHits.Store(0)
+	serverStats.activeDefragKeyHits.Store(0)
+	serverStats.activeDefragReclaimed.Store(0)
+
+	for _, cmd := range originalCommands {
+		stats := cmd.stats
+		stats.calls.Store(0)
+		stats.usec.Store(0)
+		stats.rejectedCalls.Store(0)
+		stats.failedCalls.Store(0)
+		stats.histogram.Store(nil)
+	}
+
+	errorStatsMu.Lock()
+	errorStats = map[string]int64{}
+	errorStatsMu.Unlock()
+}
+
+// statsInfo returns the lines of the stats section of INFO.
+func statsInfo() []string {
+	return []string{
+		fmt.Sprintf("total_connections_received:%d", serverStats.totalConnectionsReceived.Load()),
+		fmt.Sprintf("total_commands_processed:%d", serverStats.totalCommandsProcessed.Load()),
+		fmt.Sprintf("expired_keys:%d", serverStats.expiredKeys.Load()),
+		fmt.Sprintf("expired_time_cap_reached_count:%d", serverStats.expiredTimeCapReached.Load()),
+		fmt.Sprintf("evicted_keys:%d", serverStats.evictedKeys.Load()),
+		fmt.Sprintf("active_defrag_hits:%d", serverStats.activeDefragHits.Load()),
+		fmt.Sprintf("active_defrag_key_hits:%d", serverStats.activeDefragKeyHits.Load()),
+		fmt.Sprintf("active_defrag_reclaimed_bytes:%d", serverStats.activeDefragReclaimed.Load()),
+		fmt.Sprintf("keyspace_hits:%d", serverStats.keyspaceHits.Load()),
+		fmt.Sprintf("keyspace_misses:%d", serverStats.keyspaceMisses.Load()),
+		fmt.Sprintf("total_error_replies:%d", serverStats.totalErrorReplies.Load()),
+	}
+}
+
+// commandStatsInfo returns the lines of the commandstats section of INFO, for
+// every command that was called or rejected at least once.
+func commandStatsInfo() []string {
+	lines := []string{}
+	for _, cmd := range originalCommands {
+		calls := cmd.stats.calls.Load()
+		usec := cmd.stats.usec.Load()
+		rejected := cmd.stats.rejectedCalls.Load()
+		failed := cmd.stats.failedCalls.Load()
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			cmd.name, calls, usec, perCall, rejected, failed))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// errorStatsInfo returns the lines of the errorstats section of INFO.
+func errorStatsInfo() []string {
+	errorStatsMu.Lock()
+	defer errorStatsMu.Unlock()
+
+	lines := make([]string, 0, len(errorStats))
+	for prefix, count := range errorStats {
+		lines = append(lines, fmt.Sprintf("errorstat_%s:count=%d", prefix, count))
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,779 @@
+/*
+This file contains the stream data type and the XADD, XLEN, XRANGE, XREVRANGE,
+XREAD, XTRIM and XDEL commands. A stream is an append-only log of entries, each identified by an ID made
+of a millisecond timestamp and a sequence number (ms-seq) and holding a list of
+field-value pairs. IDs are strictly increasing, so entries are kept in a slice
+ordered by ID and looked up with binary search. For a detailed description of the
+stream data type, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/streams/
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamNodeEntries is the number of entries approximate ("~") trimming removes at
+// a time, mirroring how Redis only drops whole radix tree nodes.
+const streamNodeEntries = 100
+
+// StreamID identifies a stream entry.
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+// StreamEntry is a single entry of a stream.
+type StreamEntry struct {
+	id     StreamID
+	fields []string // Alternating field names and values
+}
+
+// Stream holds the entries of a stream, the metadata needed to generate IDs and
+// the consumer groups reading from it.
+type Stream struct {
+	entries      []StreamEntry
+	lastID       StreamID
+	entriesAdded uint64
+	maxDeletedID StreamID
+	groups       map[string]*StreamGroup
+}
+
+var errInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// String formats the ID as ms-seq.
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+// Less reports whether id sorts before other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// parseStreamID parses a complete or incomplete (ms only) stream ID, using
+// defaultSeq as the sequence number when it is omitted.
+func parseStreamID(s string, defaultSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+
+	if !hasSeq {
+		return StreamID{ms: ms, seq: defaultSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+
+	return StreamID{ms: ms, seq: seq}, nil
+}
+
+// parseRangeID parses an XRANGE boundary, which may be "-", "+" or an ID
+// prefixed with "(" to make it exclusive.
+func parseRangeID(s string, isStart bool) (StreamID, error) {
+	switch s {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return StreamID{ms: math.MaxUint64, seq: math.MaxUint64}, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+
+	// Incomplete IDs cover the whole millisecond
+	defaultSeq := uint64(0)
+	if !isStart {
+		defaultSeq = math.MaxUint64
+	}
+
+	id, err := parseStreamID(s, defaultSeq)
+	if err != nil {
+		return id, err
+	}
+
+	if exclusive {
+		var ok bool
+		if isStart {
+			id, ok = id.next()
+		} else {
+			id, ok = id.prev()
+		}
+		if !ok && isStart {
+			return id, errors.New("ERR invalid start ID for the interval")
+		}
+		if !ok {
+			return id, errors.New("ERR invalid end ID for the interval")
+		}
+	}
+
+	return id, nil
+}
+
+// next returns the smallest ID greater than id.
+func (id StreamID) next() (StreamID, bool) {
+	if id.seq < math.MaxUint64 {
+		return StreamID{ms: id.ms, seq: id.seq + 1}, true
+	}
+	if id.ms < math.MaxUint64 {
+		return StreamID{ms: id.ms + 1}, true
+	}
+	return id, false
+}
+
+// prev returns the largest ID smaller than id.
+func (id StreamID) prev() (StreamID, bool) {
+	if id.seq > 0 {
+		return StreamID{ms: id.ms, seq: id.seq - 1}, true
+	}
+	if id.ms > 0 {
+		return StreamID{ms: id.ms - 1, seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// nextID generates the ID for a new entry. spec is "*", "ms-*" or an explicit ID.
+func (s *Stream) nextID(spec string) (StreamID, error) {
+	if spec == "*" {
+		ms := uint64(time.Now().UnixMilli())
+		if ms > s.lastID.ms {
+			return StreamID{ms: ms}, nil
+		}
+		id, ok := s.lastID.next()
+		if !ok {
+			return id, errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+		}
+		return id, nil
+	}
+
+	if msPart, ok := strings.CutSuffix(spec, "-*"); ok {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return StreamID{}, errInvalidStreamID
+		}
+
+		switch {
+		case ms < s.lastID.ms:
+			return StreamID{}, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		case ms == s.lastID.ms:
+			if s.lastID.seq == math.MaxUint64 {
+				return StreamID{}, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+			return StreamID{ms: ms, seq: s.lastID.seq + 1}, nil
+		case ms == 0:
+			return StreamID{ms: 0, seq: 1}, nil
+		default:
+			return StreamID{ms: ms}, nil
+		}
+	}
+
+	id, err := parseStreamID(spec, 0)
+	if err != nil {
+		return id, err
+	}
+	if id == (StreamID{}) {
+		return id, errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if !s.lastID.Less(id) {
+		return id, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	return id, nil
+}
+
+// search returns the index of the first entry with an ID greater than or equal to id.
+func (s *Stream) search(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.Less(id)
+	})
+}
+
+// rangeEntries returns up to count entries between start and end inclusive,
+// newest first when rev is set. A negative count means no limit.
+func (s *Stream) rangeEntries(start, end StreamID, count int, rev bool) []StreamEntry {
+	if end.Less(start) || count == 0 {
+		return nil
+	}
+
+	lo := s.search(start)
+	hi := s.search(end)
+	if hi < len(s.entries) && s.entries[hi].id == end {
+		hi++
+	}
+
+	result := []StreamEntry{}
+	for i := lo; i < hi; i++ {
+		idx := i
+		if rev {
+			idx = hi - 1 - (i - lo)
+		}
+		result = append(result, s.entries[idx])
+		if count > 0 && len(result) == count {
+			break
+		}
+	}
+
+	return result
+}
+
+// streamTrimArgs holds the parsed MAXLEN/MINID trimming options.
+type streamTrimArgs struct {
+	strategy  string // "MAXLEN", "MINID" or empty when not trimming
+	maxLen    int
+	minID     StreamID
+	approx    bool
+	limit     int // Maximum entries to evict, zero means the default
+	limitSeen bool
+}
+
+// parseStreamTrim parses a trimming clause starting at args[i] and returns the
+// index of the first argument after it.
+func parseStreamTrim(args []Value, i int, trim *streamTrimArgs) (int, error) {
+	trim.strategy = strings.ToUpper(args[i].bulk)
+	i++
+
+	if i < len(args) && (args[i].bulk == "~" || args[i].bulk == "=") {
+		trim.approx = args[i].bulk == "~"
+		i++
+	}
+	if i >= len(args) {
+		return i, errors.New("ERR syntax error")
+	}
+
+	if trim.strategy == "MAXLEN" {
+		n, err := strconv.Atoi(args[i].bulk)
+		if err != nil {
+			return i, errors.New("ERR value is not an integer or out of range")
+		}
+		if n < 0 {
+			return i, errors.New("ERR The MAXLEN argument must be >= 0.")
+		}
+		trim.maxLen = n
+	} else {
+		id, err := parseStreamID(args[i].bulk, 0)
+		if err != nil {
+			return i, err
+		}
+		trim.minID = id
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToUpper(args[i].bulk) == "LIMIT" {
+		n, err := strconv.Atoi(args[i+1].bulk)
+		if err != nil || n < 0 {
+			return i, errors.New("ERR The LIMIT argument must be >= 0.")
+		}
+		if !trim.approx {
+			return i, errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		trim.limit = n
+		trim.limitSeen = true
+		i += 2
+	}
+
+	return i, nil
+}
+
+// trim removes the oldest entries according to the trimming options and
+// returns the number of entries removed.
+func (s *Stream) trim(trim streamTrimArgs) int {
+	if trim.strategy == "" {
+		return 0
+	}
+
+	// Count how many leading entries fall outside the threshold
+	n := 0
+	if trim.strategy == "MAXLEN" {
+		if len(s.entries) > trim.maxLen {
+			n = len(s.entries) - trim.maxLen
+		}
+	} else {
+		n = s.search(trim.minID)
+	}
+
+	if trim.approx {
+		// Only whole nodes are evicted, and at most limit entries per call
+		limit := streamNodeEntries * 100
+		if trim.limitSeen {
+			limit = trim.limit
+		}
+		if limit > 0 && n > limit {
+			n = limit
+		}
+		n -= n % streamNodeEntries
+	}
+
+	if n <= 0 {
+		return 0
+	}
+
+	s.entries = append([]StreamEntry(nil), s.entries[n:]...)
+
+	return n
+}
+
+// exactArgs returns the trimming clause that removes from s, as trimmed, what
+// trimming with trim did. An approximate trim stops at a node boundary picked
+// when it ran, so it's replaced by the exact threshold it reached, for the AOF
+// and the replicas to remove the same entries.
+func (trim streamTrimArgs) exactArgs(s *Stream) []string {
+	if !trim.approx {
+		if trim.strategy == "MAXLEN" {
+			return []string{"MAXLEN", "=", strconv.Itoa(trim.maxLen)}
+		}
+		return []string{"MINID", "=", trim.minID.String()}
+	}
+
+	if trim.strategy == "MAXLEN" {
+		return []string{"MAXLEN", "=", strconv.Itoa(len(s.entries))}
+	}
+	minID := StreamID{}
+	if len(s.entries) > 0 {
+		minID = s.entries[0].id
+	}
+	return []string{"MINID", "=", minID.String()}
+}
+
+// streamEntryValue converts an entry into its RESP reply form.
+func streamEntryValue(entry StreamEntry) Value {
+	fields := make([]Value, 0, len(entry.fields))
+	for _, f := range entry.fields {
+		fields = append(fields, Value{typ: ValueTypBulkString, bulk: f})
+	}
+
+	return Value{typ: ValueTypArray, array: []Value{
+		{typ: ValueTypBulkString, bulk: entry.id.String()},
+		{typ: ValueTypArray, array: fields},
+	}}
+}
+
+// streamEntriesValue converts a list of entries into an array reply.
+func streamEntriesValue(entries []StreamEntry) Value {
+	values := make([]Value, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, streamEntryValue(entry))
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// xadd handles the XADD command.
+func xadd(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xadd' command"}
+	}
+
+	key := args[0].bulk
+
+	// Parse the options that precede the ID
+	noMkStream := false
+	trim := streamTrimArgs{}
+	i := 1
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		if opt == "NOMKSTREAM" {
+			noMkStream = true
+			continue
+		}
+		if opt == "MAXLEN" || opt == "MINID" {
+			next, err := parseStreamTrim(args, i, &trim)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: err.Error()}
+			}
+			i = next - 1
+			continue
+		}
+		break
+	}
+
+	if i >= len(args) || (len(args)-i-1) < 2 || (len(args)-i-1)%2 != 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xadd' command"}
+	}
+
+	idSpec := args[i].bulk
+	fields := make([]string, 0, len(args)-i-1)
+	for _, arg := range args[i+1:] {
+		fields = append(fields, arg.bulk)
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	stream := &Stream{}
+	if e != nil {
+		stream = e.stream
+	} else if noMkStream {
+		c.unchanged()
+		return Value{typ: ValueTypNull}
+	}
+
+	id, err := stream.nextID(idSpec)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	stream.entries = append(stream.entries, StreamEntry{id: id, fields: fields})
+	stream.lastID = id
+	stream.entriesAdded++
+	stream.trim(trim)
+
+	if e == nil {
+		e = s.add(key, Object{typ: KeyTypStream, stream: stream})
+	}
+	e.touch()
+
+	// Wake up clients blocked in XREAD on this stream
+	signalKeyReady(c.db, key)
+
+	// The ID is generated from the clock, and an approximate trim depends on
+	// how the entries fall in nodes, so the AOF and the replicas get them as
+	// they turned out
+	argv := []string{"XADD", key}
+	if noMkStream {
+		argv = append(argv, "NOMKSTREAM")
+	}
+	if trim.strategy != "" {
+		argv = append(argv, trim.exactArgs(stream)...)
+	}
+	argv = append(append(argv, id.String()), fields...)
+	c.propagateInstead(commandValue(argv...))
+
+	return Value{typ: ValueTypBulkString, bulk: id.String()}
+}
+
+// xlen handles the XLEN command.
+func xlen(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xlen' command"}
+	}
+
+	key := args[0].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+	stream := e.stream
+
+	return Value{typ: ValueTypInteger, num: len(stream.entries)}
+}
+
+// xrange handles the XRANGE command.
+func xrange(c *Client, args []Value) Value {
+	return streamRange(c.db, args, "xrange", false)
+}
+
+// xrevrange handles the XREVRANGE command.
+func xrevrange(c *Client, args []Value) Value {
+	return streamRange(c.db, args, "xrevrange", true)
+}
+
+// streamRange implements XRANGE and XREVRANGE, which differ only in the order of
+// the boundary arguments and of the reply.
+func streamRange(db *DB, args []Value, name string, rev bool) Value {
+	if len(args) != 3 && len(args) != 5 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+	startArg, endArg := args[1].bulk, args[2].bulk
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, err := parseRangeID(startArg, true)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+	end, err := parseRangeID(endArg, false)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].bulk) != "COUNT" {
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+		if count, err = strconv.Atoi(args[4].bulk); err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		}
+		if count < 0 {
+			count = 0
+		}
+	}
+
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypArray, array: []Value{}}
+	}
+	e.touch()
+	stream := e.stream
+
+	return streamEntriesValue(stream.rangeEntries(start, end, count, rev))
+}
+
+// xread handles the XREAD command.
+func xread(c *Client, args []Value) Value {
+	count := -1
+	var block time.Duration
+	blocking := false
+
+	// Parse the options that precede STREAMS
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		if opt == "STREAMS" {
+			break
+		}
+		if i+1 >= len(args) {
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+
+		n, err := strconv.Atoi(args[i+1].bulk)
+		switch {
+		case opt == "COUNT" && err == nil:
+			count = n
+			if count <= 0 {
+				count = -1
+			}
+		case opt == "BLOCK" && err == nil:
+			if n < 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR timeout is negative"}
+			}
+			block = time.Duration(n) * time.Millisecond
+			blocking = true
+		case err != nil && (opt == "COUNT" || opt == "BLOCK"):
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+		i++
+	}
+
+	if i >= len(args) {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	rest := args[i+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."}
+	}
+
+	keys := make([]string, len(rest)/2)
+	ids := make([]StreamID, len(rest)/2)
+
+	// "$" is resolved once, so only entries added after the call are returned
+	for j := range keys {
+		keys[j] = rest[j].bulk
+	}
+	unlock := c.db.lockKeys(false, keys...)
+	for j := range keys {
+		spec := rest[len(keys)+j].bulk
+
+		e, errValue := c.db.shard(keys[j]).lookup(keys[j], KeyTypStream)
+		if errValue != nil {
+			unlock()
+			return *errValue
+		}
+
+		if spec == "$" {
+			if e != nil {
+				ids[j] = e.stream.lastID
+			}
+			continue
+		}
+
+		id, err := parseStreamID(spec, 0)
+		if err != nil {
+			unlock()
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+		ids[j] = id
+	}
+	unlock()
+
+	var result []Value
+	read := func() bool {
+		defer c.db.lockKeys(false, keys...)()
+
+		result = streamReadAfter(c.db, keys, ids, count)
+		return len(result) > 0
+	}
+
+	if read() {
+		return Value{typ: ValueTypArray, array: result}
+	}
+	if !blocking || !blockUntil(c.db, keys, block, read) {
+		return Value{typ: ValueTypNullArray}
+	}
+
+	return Value{typ: ValueTypArray, array: result}
+}
+
+// streamReadAfter returns, for each stream that has entries newer than the
+// matching ID, a [key, entries] pair. The caller must hold the locks of the
+// shards of keys.
+func streamReadAfter(db *DB, keys []string, ids []StreamID, count int) []Value {
+	result := []Value{}
+	for j, key := range keys {
+		e, _ := db.shard(key).lookup(key, KeyTypStream)
+		if e == nil {
+			continue
+		}
+		e.touch()
+
+		start, ok := ids[j].next()
+		if !ok {
+			continue
+		}
+
+		entries := e.stream.rangeEntries(start, StreamID{ms: math.MaxUint64, seq: math.MaxUint64}, count, false)
+		if len(entries) == 0 {
+			continue
+		}
+
+		result = append(result, Value{typ: ValueTypArray, array: []Value{
+			{typ: ValueTypBulkString, bulk: key},
+			streamEntriesValue(entries),
+		}})
+	}
+
+	return result
+}
+
+// xtrim handles the XTRIM command.
+func xtrim(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xtrim' command"}
+	}
+
+	key := args[0].bulk
+
+	strategy := strings.ToUpper(args[1].bulk)
+	if strategy != "MAXLEN" && strategy != "MINID" {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	trim := streamTrimArgs{}
+	next, err := parseStreamTrim(args, 1, &trim)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+	if next != len(args) {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+	stream := e.stream
+
+	trimmed := stream.trim(trim)
+	switch {
+	case trimmed == 0:
+		c.unchanged()
+	case trim.approx:
+		c.propagateInstead(commandValue(append([]string{"XTRIM", key}, trim.exactArgs(stream)...)...))
+	}
+
+	return Value{typ: ValueTypInteger, num: trimmed}
+}
+
+// xdel handles the XDEL command.
+func xdel(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xdel' command"}
+	}
+
+	key := args[0].bulk
+
+	ids := make([]StreamID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamID(arg.bulk, 0)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+		ids = append(ids, id)
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	e.touch()
+	stream := e.stream
+
+	// Pending entries of consumer groups are left alone, readers see them as deleted
+	deleted := 0
+	for _, id := range ids {
+		i := stream.search(id)
+		if i >= len(stream.entries) || stream.entries[i].id != id {
+			continue
+		}
+
+		stream.entries = append(stream.entries[:i], stream.entries[i+1:]...)
+		if stream.maxDeletedID.Less(id) {
+			stream.maxDeletedID = id
+		}
+		deleted++
+	}
+
+	if deleted == 0 {
+		c.unchanged()
+	}
+	return Value{typ: ValueTypInteger, num: deleted}
+}
@@ -0,0 +1,885 @@
+/*
+This file contains stream consumer groups and the XGROUP, XREADGROUP, XACK,
+XPENDING, XCLAIM and XAUTOCLAIM commands. A consumer group remembers the last ID it
+delivered, so every new entry is handed to exactly one of the consumers reading
+through the group. Delivered entries stay in the group's pending entries list
+(PEL) until they are acknowledged with XACK, and entries that a consumer failed to
+process can be claimed by another consumer, giving at-least-once delivery. For a
+detailed description of consumer groups, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/streams/#consumer-groups
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamPendingEntry tracks a delivered but not yet acknowledged entry.
+type StreamPendingEntry struct {
+	consumer      string
+	deliveryTime  time.Time
+	deliveryCount int
+}
+
+// StreamConsumer is a named consumer of a consumer group.
+type StreamConsumer struct {
+	name       string
+	seenTime   time.Time // Last time the consumer attempted an interaction
+	activeTime time.Time // Last time the consumer read or claimed an entry
+	pending    map[StreamID]struct{}
+	peak       int // Most entries pending held since it was last rebuilt
+}
+
+// StreamGroup holds the state of a consumer group.
+type StreamGroup struct {
+	name        string
+	lastID      StreamID
+	entriesRead int64 // Entries delivered to the group, -1 when unknown
+	pending     map[StreamID]*StreamPendingEntry
+	consumers   map[string]*StreamConsumer
+	peak        int // Most entries pending held since it was last rebuilt
+}
+
+// newStreamGroup creates an empty consumer group.
+func newStreamGroup(name string, lastID StreamID, entriesRead int64) *StreamGroup {
+	return &StreamGroup{
+		name:        name,
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     map[StreamID]*StreamPendingEntry{},
+		consumers:   map[string]*StreamConsumer{},
+	}
+}
+
+// consumer returns the named consumer, creating it if create is set.
+func (g *StreamGroup) consumer(name string, create bool) *StreamConsumer {
+	c, ok := g.consumers[name]
+	if !ok && create {
+		c = &StreamConsumer{name: name, seenTime: time.Now(), pending: map[StreamID]struct{}{}}
+		g.consumers[name] = c
+	}
+	return c
+}
+
+// pendingIDs returns the IDs in the PEL in ascending order.
+func (g *StreamGroup) pendingIDs() []StreamID {
+	ids := make([]StreamID, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	sortStreamIDs(ids)
+	return ids
+}
+
+// deliver records that id was delivered to consumer c.
+func (g *StreamGroup) deliver(c *StreamConsumer, id StreamID, now time.Time) {
+	if pe, ok := g.pending[id]; ok {
+		delete(g.consumers[pe.consumer].pending, id)
+		pe.consumer = c.name
+		pe.deliveryTime = now
+		pe.deliveryCount++
+	} else {
+		g.pending[id] = &StreamPendingEntry{consumer: c.name, deliveryTime: now, deliveryCount: 1}
+	}
+	c.pending[id] = struct{}{}
+}
+
+// ack removes id from the PEL, reporting whether it was pending.
+func (g *StreamGroup) ack(id StreamID) bool {
+	pe, ok := g.pending[id]
+	if !ok {
+		return false
+	}
+	delete(g.consumers[pe.consumer].pending, id)
+	delete(g.pending, id)
+	return true
+}
+
+// sortStreamIDs sorts ids in ascending order.
+func sortStreamIDs(ids []StreamID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+}
+
+// lookup returns the entry with the given ID.
+func (s *Stream) lookup(id StreamID) (StreamEntry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i], true
+	}
+	return StreamEntry{}, false
+}
+
+// noGroupError builds the NOGROUP error for a missing key or group.
+func noGroupError(key, group, suffix string) Value {
+	return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'%s", key, group, suffix)}
+}
+
+// lookupStreamGroup returns the stream and consumer group, if both exist. The
+// caller must hold the lock of the shard of key.
+func lookupStreamGroup(db *DB, key, group string) (*Stream, *StreamGroup) {
+	e, _ := db.shard(key).lookup(key, KeyTypStream)
+	if e == nil {
+		return nil, nil
+	}
+	e.touch()
+	return e.stream, e.stream.groups[group]
+}
+
+// The state of consumer groups changes with the clock of the server running the
+// commands, so instead of the commands as typed, the AOF and the replicas get
+// what the commands did, the way Redis propagates it: every entry delivered or
+// claimed as an XCLAIM forcing its owner, delivery time and count, and the
+// position of the group as an XGROUP SETID.
+
+// streamClaimCommand returns the XCLAIM command making id pending in g, as it
+// is now.
+func streamClaimCommand(key string, g *StreamGroup, id StreamID) Value {
+	pe := g.pending[id]
+	return commandValue("XCLAIM", key, g.name, pe.consumer, "0", id.String(),
+		"TIME", strconv.FormatInt(pe.deliveryTime.UnixMilli(), 10),
+		"RETRYCOUNT", strconv.Itoa(pe.deliveryCount), "FORCE", "JUSTID")
+}
+
+// streamSetIDCommand returns the XGROUP SETID command moving g to its last ID
+// and entries read.
+func streamSetIDCommand(key string, g *StreamGroup) Value {
+	return commandValue("XGROUP", "SETID", key, g.name, g.lastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10))
+}
+
+// streamConsumerCommand returns the command creating the consumer name of g if
+// it doesn't exist yet, which the commands reading or claiming on its behalf
+// do, nil if it exists.
+func streamConsumerCommand(key string, g *StreamGroup, name string) []Value {
+	if g.consumer(name, false) != nil {
+		return nil
+	}
+	return []Value{commandValue("XGROUP", "CREATECONSUMER", key, g.name, name)}
+}
+
+// parseGroupLastID parses the ID given to XGROUP CREATE and SETID, where "$"
+// means the last ID of the stream.
+func parseGroupLastID(stream *Stream, spec string) (StreamID, error) {
+	if spec == "$" {
+		return stream.lastID, nil
+	}
+	return parseStreamID(spec, 0)
+}
+
+// xgroup handles the XGROUP command.
+func xgroup(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xgroup' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+
+	arity := map[string]int{"CREATE": 4, "SETID": 4, "DESTROY": 3, "CREATECONSUMER": 4, "DELCONSUMER": 4}
+	n, ok := arity[sub]
+	if !ok {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", args[0].bulk)}
+	}
+	if len(args) < n || (sub != "CREATE" && sub != "SETID" && len(args) != n) {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xgroup|" + strings.ToLower(sub) + "' command"}
+	}
+
+	key := args[1].bulk
+	group := args[2].bulk
+
+	// CREATE and SETID accept MKSTREAM and ENTRIESREAD after the ID
+	mkStream := false
+	entriesRead := int64(-1)
+	for i := n; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "MKSTREAM" && sub == "CREATE":
+			mkStream = true
+		case opt == "ENTRIESREAD" && i+1 < len(args):
+			v, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil || v < -1 {
+				return Value{typ: ValueTypSimpleError, str: "ERR value for ENTRIESREAD must be positive or -1"}
+			}
+			entriesRead = v
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		if sub != "CREATE" || !mkStream {
+			return Value{typ: ValueTypSimpleError, str: "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."}
+		}
+		e = s.add(key, Object{typ: KeyTypStream, stream: &Stream{}})
+	}
+	e.touch()
+	stream := e.stream
+	if stream.groups == nil {
+		stream.groups = map[string]*StreamGroup{}
+	}
+
+	g := stream.groups[group]
+	if g == nil && sub == "DESTROY" {
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+	if g == nil && sub != "CREATE" {
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)}
+	}
+
+	switch sub {
+	case "CREATE":
+		if g != nil {
+			return Value{typ: ValueTypSimpleError, str: "BUSYGROUP Consumer Group name already exists"}
+		}
+		id, err := parseGroupLastID(stream, args[3].bulk)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+		// Starting from either end of the stream tells us how much was read
+		if entriesRead == -1 && args[3].bulk == "$" {
+			entriesRead = int64(stream.entriesAdded)
+		} else if entriesRead == -1 && id == (StreamID{}) {
+			entriesRead = 0
+		}
+		stream.groups[group] = newStreamGroup(group, id, entriesRead)
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+
+	case "SETID":
+		id, err := parseGroupLastID(stream, args[3].bulk)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+		g.lastID = id
+		g.entriesRead = entriesRead
+		return Value{typ: ValueTypSimpleString, str: "OK"}
+
+	case "DESTROY":
+		delete(stream.groups, group)
+		return Value{typ: ValueTypInteger, num: 1}
+
+	case "CREATECONSUMER":
+		if g.consumer(args[3].bulk, false) != nil {
+			return Value{typ: ValueTypInteger, num: 0}
+		}
+		g.consumer(args[3].bulk, true)
+		return Value{typ: ValueTypInteger, num: 1}
+
+	default: // DELCONSUMER
+		c := g.consumer(args[3].bulk, false)
+		if c == nil {
+			return Value{typ: ValueTypInteger, num: 0}
+		}
+		pending := len(c.pending)
+		for id := range c.pending {
+			delete(g.pending, id)
+		}
+		delete(g.consumers, c.name)
+		return Value{typ: ValueTypInteger, num: pending}
+	}
+}
+
+// xreadgroup handles the XREADGROUP command.
+func xreadgroup(c *Client, args []Value) Value {
+	if len(args) < 6 || strings.ToUpper(args[0].bulk) != "GROUP" {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xreadgroup' command"}
+	}
+
+	group := args[1].bulk
+	consumerName := args[2].bulk
+
+	count := -1
+	var block time.Duration
+	blocking := false
+	noAck := false
+
+	// Parse the options that precede STREAMS
+	i := 3
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		if opt == "STREAMS" {
+			break
+		}
+		if opt == "NOACK" {
+			noAck = true
+			continue
+		}
+		if (opt != "COUNT" && opt != "BLOCK") || i+1 >= len(args) {
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+
+		n, err := strconv.Atoi(args[i+1].bulk)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		}
+		if opt == "COUNT" {
+			count = n
+			if count <= 0 {
+				count = -1
+			}
+		} else {
+			if n < 0 {
+				return Value{typ: ValueTypSimpleError, str: "ERR timeout is negative"}
+			}
+			block = time.Duration(n) * time.Millisecond
+			blocking = true
+		}
+		i++
+	}
+
+	if i >= len(args) {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	rest := args[i+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return Value{typ: ValueTypSimpleError, str: "ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified."}
+	}
+
+	keys := make([]string, len(rest)/2)
+	specs := make([]string, len(rest)/2)
+	newOnly := true
+	for j := range keys {
+		keys[j] = rest[j].bulk
+		specs[j] = rest[len(keys)+j].bulk
+		if specs[j] != ">" {
+			if _, err := parseStreamID(specs[j], 0); err != nil {
+				return Value{typ: ValueTypSimpleError, str: err.Error()}
+			}
+			newOnly = false
+		}
+	}
+
+	var result []Value
+	var errValue *Value
+	var propagated []Value
+	read := func() bool {
+		defer c.db.lockKeys(true, keys...)()
+
+		result, errValue = streamReadGroup(c.db, keys, specs, group, consumerName, count, noAck, &propagated)
+		return errValue != nil || len(result) > 0
+	}
+	defer func() { c.propagateInstead(propagated...) }()
+
+	// Only reads of new entries block, reading history always returns immediately
+	if read() || !newOnly || !blocking {
+		if errValue != nil {
+			return *errValue
+		}
+		if len(result) == 0 && newOnly {
+			return Value{typ: ValueTypNullArray}
+		}
+		return Value{typ: ValueTypArray, array: result}
+	}
+
+	if !blockUntil(c.db, keys, block, read) {
+		return Value{typ: ValueTypNullArray}
+	}
+	if errValue != nil {
+		return *errValue
+	}
+
+	return Value{typ: ValueTypArray, array: result}
+}
+
+// streamReadGroup reads entries on behalf of a consumer. A ">" spec delivers
+// entries the group has never delivered, any other ID replays the consumer's own
+// pending entries after that ID. The commands to propagate for the changes to the
+// groups are appended to propagated. The caller must hold the locks of the
+// shards of keys for writing.
+func streamReadGroup(db *DB, keys, specs []string, group, consumerName string, count int, noAck bool, propagated *[]Value) ([]Value, *Value) {
+	// Validate all groups before changing any state
+	for _, key := range keys {
+		if _, g := lookupStreamGroup(db, key, group); g == nil {
+			errValue := noGroupError(key, group, " in XREADGROUP with GROUP option")
+			return nil, &errValue
+		}
+	}
+
+	now := time.Now()
+	result := []Value{}
+	for j, key := range keys {
+		stream, g := lookupStreamGroup(db, key, group)
+		*propagated = append(*propagated, streamConsumerCommand(key, g, consumerName)...)
+		c := g.consumer(consumerName, true)
+		c.seenTime = now
+
+		var entries Value
+		if specs[j] == ">" {
+			start, ok := g.lastID.next()
+			if !ok {
+				continue
+			}
+
+			found := stream.rangeEntries(start, StreamID{ms: math.MaxUint64, seq: math.MaxUint64}, count, false)
+			if len(found) == 0 {
+				continue
+			}
+
+			for _, entry := range found {
+				if !noAck {
+					g.deliver(c, entry.id, now)
+					*propagated = append(*propagated, streamClaimCommand(key, g, entry.id))
+				}
+			}
+			g.lastID = found[len(found)-1].id
+			if g.entriesRead != -1 {
+				g.entriesRead += int64(len(found))
+			}
+			*propagated = append(*propagated, streamSetIDCommand(key, g))
+			c.activeTime = now
+			entries = streamEntriesValue(found)
+		} else {
+			// History replays are reported even when empty
+			after, _ := parseStreamID(specs[j], 0)
+
+			values := []Value{}
+			for _, id := range sortedConsumerPending(c) {
+				if !after.Less(id) {
+					continue
+				}
+				if count > 0 && len(values) == count {
+					break
+				}
+
+				// Entries deleted from the stream are reported with a nil body
+				entry, ok := stream.lookup(id)
+				if !ok {
+					values = append(values, Value{typ: ValueTypArray, array: []Value{
+						{typ: ValueTypBulkString, bulk: id.String()},
+						{typ: ValueTypNullArray},
+					}})
+					continue
+				}
+				values = append(values, streamEntryValue(entry))
+			}
+			entries = Value{typ: ValueTypArray, array: values}
+		}
+
+		result = append(result, Value{typ: ValueTypArray, array: []Value{
+			{typ: ValueTypBulkString, bulk: key},
+			entries,
+		}})
+	}
+
+	return result, nil
+}
+
+// sortedConsumerPending returns the consumer's pending IDs in ascending order.
+func sortedConsumerPending(c *StreamConsumer) []StreamID {
+	ids := make([]StreamID, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	sortStreamIDs(ids)
+	return ids
+}
+
+// xack handles the XACK command.
+func xack(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xack' command"}
+	}
+
+	key := args[0].bulk
+	group := args[1].bulk
+
+	ids := make([]StreamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(arg.bulk, 0)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: err.Error()}
+		}
+		ids = append(ids, id)
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g := lookupStreamGroup(c.db, key, group)
+	if g == nil {
+		c.unchanged()
+		return Value{typ: ValueTypInteger, num: 0}
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	if acked == 0 {
+		c.unchanged()
+	}
+
+	return Value{typ: ValueTypInteger, num: acked}
+}
+
+// xpending handles the XPENDING command.
+func xpending(c *Client, args []Value) Value {
+	if len(args) != 2 && (len(args) < 5 || len(args) > 8) {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xpending' command"}
+	}
+
+	key := args[0].bulk
+	group := args[1].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, g := lookupStreamGroup(c.db, key, group)
+	if g == nil {
+		return noGroupError(key, group, "")
+	}
+
+	ids := g.pendingIDs()
+
+	// The summary form reports totals per consumer
+	if len(args) == 2 {
+		if len(ids) == 0 {
+			return Value{typ: ValueTypArray, array: []Value{
+				{typ: ValueTypInteger, num: 0},
+				{typ: ValueTypNull},
+				{typ: ValueTypNull},
+				{typ: ValueTypNullArray},
+			}}
+		}
+
+		names := make([]string, 0, len(g.consumers))
+		for name, c := range g.consumers {
+			if len(c.pending) > 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		consumers := make([]Value, 0, len(names))
+		for _, name := range names {
+			consumers = append(consumers, Value{typ: ValueTypArray, array: []Value{
+				{typ: ValueTypBulkString, bulk: name},
+				{typ: ValueTypBulkString, bulk: strconv.Itoa(len(g.consumers[name].pending))},
+			}})
+		}
+
+		return Value{typ: ValueTypArray, array: []Value{
+			{typ: ValueTypInteger, num: len(ids)},
+			{typ: ValueTypBulkString, bulk: ids[0].String()},
+			{typ: ValueTypBulkString, bulk: ids[len(ids)-1].String()},
+			{typ: ValueTypArray, array: consumers},
+		}}
+	}
+
+	// The extended form lists individual entries
+	rest := args[2:]
+	minIdle := time.Duration(0)
+	if strings.ToUpper(rest[0].bulk) == "IDLE" {
+		ms, err := strconv.ParseInt(rest[1].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+		}
+		minIdle = time.Duration(ms) * time.Millisecond
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	start, err := parseRangeID(rest[0].bulk, true)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+	end, err := parseRangeID(rest[1].bulk, false)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+	count, err := strconv.Atoi(rest[2].bulk)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+	}
+	consumerFilter := ""
+	if len(rest) == 4 {
+		consumerFilter = rest[3].bulk
+	}
+
+	now := time.Now()
+	values := []Value{}
+	for _, id := range ids {
+		if len(values) >= count {
+			break
+		}
+		if id.Less(start) || end.Less(id) {
+			continue
+		}
+
+		pe := g.pending[id]
+		idle := now.Sub(pe.deliveryTime)
+		if (consumerFilter != "" && pe.consumer != consumerFilter) || idle < minIdle {
+			continue
+		}
+
+		values = append(values, Value{typ: ValueTypArray, array: []Value{
+			{typ: ValueTypBulkString, bulk: id.String()},
+			{typ: ValueTypBulkString, bulk: pe.consumer},
+			{typ: ValueTypInteger, num: int(idle.Milliseconds())},
+			{typ: ValueTypInteger, num: pe.deliveryCount},
+		}})
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// xclaim handles the XCLAIM command.
+func xclaim(c *Client, args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xclaim' command"}
+	}
+
+	key := args[0].bulk
+	group := args[1].bulk
+	consumerName := args[2].bulk
+
+	minIdleMs, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR Invalid min-idle-time argument for XCLAIM"}
+	}
+	minIdle := time.Duration(minIdleMs) * time.Millisecond
+
+	// IDs come first, the options start at the first argument that is not an ID
+	i := 4
+	ids := []StreamID{}
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i].bulk, 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now()
+	deliveryTime := now
+	retryCount := -1
+	force, justID := false, false
+	var lastID *StreamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justID = true
+		case (opt == "IDLE" || opt == "TIME" || opt == "RETRYCOUNT") && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			switch opt {
+			case "IDLE":
+				deliveryTime = now.Add(-time.Duration(n) * time.Millisecond)
+			case "TIME":
+				deliveryTime = time.UnixMilli(n)
+			default:
+				retryCount = int(n)
+			}
+			i++
+		case opt == "LASTID" && i+1 < len(args):
+			id, err := parseStreamID(args[i+1].bulk, 0)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: err.Error()}
+			}
+			lastID = &id
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i].bulk)}
+		}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, g := lookupStreamGroup(c.db, key, group)
+	if g == nil {
+		return noGroupError(key, group, "")
+	}
+
+	propagated := streamConsumerCommand(key, g, consumerName)
+	if lastID != nil && g.lastID.Less(*lastID) {
+		g.lastID = *lastID
+		propagated = append(propagated, streamSetIDCommand(key, g))
+	}
+	defer func() { c.propagateInstead(propagated...) }()
+
+	claimer := g.consumer(consumerName, true)
+	claimer.seenTime = now
+
+	values := []Value{}
+	for _, id := range ids {
+		entry, exists := stream.lookup(id)
+
+		pe, pending := g.pending[id]
+		if !pending {
+			// FORCE creates the pending entry for IDs that still exist in the stream
+			if !force || !exists {
+				continue
+			}
+			pe = &StreamPendingEntry{consumer: claimer.name, deliveryTime: now}
+			g.pending[id] = pe
+			claimer.pending[id] = struct{}{}
+		}
+
+		// Entries deleted from the stream are dropped from the PEL
+		if !exists {
+			g.ack(id)
+			propagated = append(propagated, commandValue("XACK", key, group, id.String()))
+			continue
+		}
+
+		if minIdle > 0 && now.Sub(pe.deliveryTime) < minIdle {
+			continue
+		}
+
+		delete(g.consumers[pe.consumer].pending, id)
+		pe.consumer = claimer.name
+		pe.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			pe.deliveryCount = retryCount
+		} else if !justID {
+			pe.deliveryCount++
+		}
+		claimer.pending[id] = struct{}{}
+		claimer.activeTime = now
+		propagated = append(propagated, streamClaimCommand(key, g, id))
+
+		if justID {
+			values = append(values, Value{typ: ValueTypBulkString, bulk: id.String()})
+		} else {
+			values = append(values, streamEntryValue(entry))
+		}
+	}
+
+	return Value{typ: ValueTypArray, array: values}
+}
+
+// xautoclaim handles the XAUTOCLAIM command.
+func xautoclaim(c *Client, args []Value) Value {
+	if len(args) < 5 || len(args) > 8 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xautoclaim' command"}
+	}
+
+	key := args[0].bulk
+	group := args[1].bulk
+	consumerName := args[2].bulk
+
+	minIdleMs, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR Invalid min-idle-time argument for XAUTOCLAIM"}
+	}
+	minIdle := time.Duration(minIdleMs) * time.Millisecond
+
+	start, err := parseRangeID(args[4].bulk, true)
+	if err != nil {
+		return Value{typ: ValueTypSimpleError, str: err.Error()}
+	}
+
+	count := 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "JUSTID":
+			justID = true
+		case opt == "COUNT" && i+1 < len(args):
+			count, err = strconv.Atoi(args[i+1].bulk)
+			if err != nil || count < 1 {
+				return Value{typ: ValueTypSimpleError, str: "ERR COUNT must be > 0"}
+			}
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	s := c.db.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, g := lookupStreamGroup(c.db, key, group)
+	if g == nil {
+		return noGroupError(key, group, "")
+	}
+
+	propagated := streamConsumerCommand(key, g, consumerName)
+	defer func() { c.propagateInstead(propagated...) }()
+
+	now := time.Now()
+	claimer := g.consumer(consumerName, true)
+	claimer.seenTime = now
+
+	// Scan the PEL from start, examining at most count entries
+	ids := g.pendingIDs()
+	i := sort.Search(len(ids), func(i int) bool { return !ids[i].Less(start) })
+
+	claimed := []Value{}
+	deleted := []Value{}
+	for scanned := 0; i < len(ids) && scanned < count; i++ {
+		id := ids[i]
+		scanned++
+
+		entry, exists := stream.lookup(id)
+		if !exists {
+			g.ack(id)
+			deleted = append(deleted, Value{typ: ValueTypBulkString, bulk: id.String()})
+			propagated = append(propagated, commandValue("XACK", key, group, id.String()))
+			continue
+		}
+
+		pe := g.pending[id]
+		if minIdle > 0 && now.Sub(pe.deliveryTime) < minIdle {
+			continue
+		}
+
+		delete(g.consumers[pe.consumer].pending, id)
+		pe.consumer = claimer.name
+		pe.deliveryTime = now
+		if !justID {
+			pe.deliveryCount++
+		}
+		claimer.pending[id] = struct{}{}
+		claimer.activeTime = now
+		propagated = append(propagated, streamClaimCommand(key, g, id))
+
+		if justID {
+			claimed = append(claimed, Value{typ: ValueTypBulkString, bulk: id.String()})
+		} else {
+			claimed = append(claimed, streamEntryValue(entry))
+		}
+	}
+
+	// The cursor for the next call, 0-0 once the whole PEL was scanned
+	next := StreamID{}
+	if i < len(ids) {
+		next = ids[i]
+	}
+
+	return Value{typ: ValueTypArray, array: []Value{
+		{typ: ValueTypBulkString, bulk: next.String()},
+		{typ: ValueTypArray, array: claimed},
+		{typ: ValueTypArray, array: deleted},
+	}}
+}
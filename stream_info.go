@@ -0,0 +1,277 @@
+/*
+This file contains the XINFO command, which reports the internal state of streams,
+their consumer groups and the consumers of each group. The replies are maps of
+field names to values, which RESP2 connections get as flat arrays of alternating
+field names and values. For a detailed description of the command, refer to the
+Redis documentation:
+
+https://redis.io/docs/latest/commands/xinfo-stream/
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xinfo handles the XINFO command.
+func xinfo(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xinfo' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch {
+	case sub == "STREAM" && len(args) >= 2:
+	case sub == "GROUPS" && len(args) == 2:
+	case sub == "CONSUMERS" && len(args) == 3:
+	case sub == "STREAM" || sub == "GROUPS" || sub == "CONSUMERS":
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'xinfo|" + strings.ToLower(sub) + "' command"}
+	default:
+		return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("ERR unknown subcommand '%s'. Try XINFO HELP.", args[0].bulk)}
+	}
+
+	key := args[1].bulk
+
+	s := c.db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, errValue := s.lookup(key, KeyTypStream)
+	if errValue != nil {
+		return *errValue
+	}
+	if e == nil {
+		return Value{typ: ValueTypSimpleError, str: "ERR no such key"}
+	}
+	e.touch()
+	stream := e.stream
+
+	switch sub {
+	case "GROUPS":
+		return xinfoGroups(stream)
+	case "CONSUMERS":
+		g := stream.groups[args[2].bulk]
+		if g == nil {
+			return Value{typ: ValueTypSimpleError, str: fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", args[2].bulk, key)}
+		}
+		return xinfoConsumers(g)
+	}
+
+	// STREAM accepts FULL [COUNT n]
+	full := false
+	count := 10
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch {
+		case opt == "FULL":
+			full = true
+		case opt == "COUNT" && full && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			count = n
+			i++
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	return xinfoStream(stream, full, count)
+}
+
+// xinfoStream builds the XINFO STREAM reply.
+func xinfoStream(stream *Stream, full bool, count int) Value {
+	nodes := (len(stream.entries) + streamNodeEntries - 1) / streamNodeEntries
+
+	firstID := StreamID{}
+	if len(stream.entries) > 0 {
+		firstID = stream.entries[0].id
+	}
+
+	fields := []Value{
+		bulkValue("length"), {typ: ValueTypInteger, num: len(stream.entries)},
+		bulkValue("radix-tree-keys"), {typ: ValueTypInteger, num: nodes},
+		bulkValue("radix-tree-nodes"), {typ: ValueTypInteger, num: nodes},
+		bulkValue("last-generated-id"), bulkValue(stream.lastID.String()),
+		bulkValue("max-deleted-entry-id"), bulkValue(stream.maxDeletedID.String()),
+		bulkValue("entries-added"), {typ: ValueTypInteger, num: int(stream.entriesAdded)},
+		bulkValue("recorded-first-entry-id"), bulkValue(firstID.String()),
+	}
+
+	if !full {
+		first, last := Value{typ: ValueTypNull}, Value{typ: ValueTypNull}
+		if len(stream.entries) > 0 {
+			first = streamEntryValue(stream.entries[0])
+			last = streamEntryValue(stream.entries[len(stream.entries)-1])
+		}
+
+		fields = append(fields,
+			bulkValue("groups"), Value{typ: ValueTypInteger, num: len(stream.groups)},
+			bulkValue("first-entry"), first,
+			bulkValue("last-entry"), last,
+		)
+		return Value{typ: ValueTypMap, array: fields}
+	}
+
+	// FULL lists up to count entries (zero means all) and every group in detail
+	entries := stream.entries
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+
+	groups := []Value{}
+	for _, name := range sortedGroupNames(stream) {
+		g := stream.groups[name]
+
+		pel := []Value{}
+		for _, id := range g.pendingIDs() {
+			pe := g.pending[id]
+			pel = append(pel, Value{typ: ValueTypArray, array: []Value{
+				bulkValue(id.String()),
+				bulkValue(pe.consumer),
+				{typ: ValueTypInteger, num: int(pe.deliveryTime.UnixMilli())},
+				{typ: ValueTypInteger, num: pe.deliveryCount},
+			}})
+		}
+
+		consumers := []Value{}
+		for _, c := range sortedConsumers(g) {
+			cpel := []Value{}
+			for _, id := range sortedConsumerPending(c) {
+				pe := g.pending[id]
+				cpel = append(cpel, Value{typ: ValueTypArray, array: []Value{
+					bulkValue(id.String()),
+					{typ: ValueTypInteger, num: int(pe.deliveryTime.UnixMilli())},
+					{typ: ValueTypInteger, num: pe.deliveryCount},
+				}})
+			}
+
+			consumers = append(consumers, Value{typ: ValueTypMap, array: []Value{
+				bulkValue("name"), bulkValue(c.name),
+				bulkValue("seen-time"), {typ: ValueTypInteger, num: int(c.seenTime.UnixMilli())},
+				bulkValue("active-time"), {typ: ValueTypInteger, num: activeTimeMillis(c)},
+				bulkValue("pel-count"), {typ: ValueTypInteger, num: len(c.pending)},
+				bulkValue("pending"), {typ: ValueTypArray, array: cpel},
+			}})
+		}
+
+		groups = append(groups, Value{typ: ValueTypMap, array: []Value{
+			bulkValue("name"), bulkValue(g.name),
+			bulkValue("last-delivered-id"), bulkValue(g.lastID.String()),
+			bulkValue("entries-read"), entriesReadValue(g),
+			bulkValue("lag"), groupLagValue(stream, g),
+			bulkValue("pel-count"), {typ: ValueTypInteger, num: len(g.pending)},
+			bulkValue("pending"), {typ: ValueTypArray, array: pel},
+			bulkValue("consumers"), {typ: ValueTypArray, array: consumers},
+		}})
+	}
+
+	fields = append(fields,
+		bulkValue("entries"), streamEntriesValue(entries),
+		bulkValue("groups"), Value{typ: ValueTypArray, array: groups},
+	)
+
+	return Value{typ: ValueTypMap, array: fields}
+}
+
+// xinfoGroups builds the XINFO GROUPS reply.
+func xinfoGroups(stream *Stream) Value {
+	groups := []Value{}
+	for _, name := range sortedGroupNames(stream) {
+		g := stream.groups[name]
+		groups = append(groups, Value{typ: ValueTypMap, array: []Value{
+			bulkValue("name"), bulkValue(g.name),
+			bulkValue("consumers"), {typ: ValueTypInteger, num: len(g.consumers)},
+			bulkValue("pending"), {typ: ValueTypInteger, num: len(g.pending)},
+			bulkValue("last-delivered-id"), bulkValue(g.lastID.String()),
+			bulkValue("entries-read"), entriesReadValue(g),
+			bulkValue("lag"), groupLagValue(stream, g),
+		}})
+	}
+
+	return Value{typ: ValueTypArray, array: groups}
+}
+
+// xinfoConsumers builds the XINFO CONSUMERS reply.
+func xinfoConsumers(g *StreamGroup) Value {
+	now := time.Now()
+
+	consumers := []Value{}
+	for _, c := range sortedConsumers(g) {
+		inactive := -1
+		if !c.activeTime.IsZero() {
+			inactive = int(now.Sub(c.activeTime).Milliseconds())
+		}
+
+		consumers = append(consumers, Value{typ: ValueTypMap, array: []Value{
+			bulkValue("name"), bulkValue(c.name),
+			bulkValue("pending"), {typ: ValueTypInteger, num: len(c.pending)},
+			bulkValue("idle"), {typ: ValueTypInteger, num: int(now.Sub(c.seenTime).Milliseconds())},
+			bulkValue("inactive"), {typ: ValueTypInteger, num: inactive},
+		}})
+	}
+
+	return Value{typ: ValueTypArray, array: consumers}
+}
+
+// sortedGroupNames returns the names of the stream's consumer groups in order.
+func sortedGroupNames(stream *Stream) []string {
+	names := make([]string, 0, len(stream.groups))
+	for name := range stream.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedConsumers returns the consumers of a group ordered by name.
+func sortedConsumers(g *StreamGroup) []*StreamConsumer {
+	consumers := make([]*StreamConsumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].name < consumers[j].name })
+	return consumers
+}
+
+// activeTimeMillis returns the consumer's last active time, or -1 if it never read.
+func activeTimeMillis(c *StreamConsumer) int {
+	if c.activeTime.IsZero() {
+		return -1
+	}
+	return int(c.activeTime.UnixMilli())
+}
+
+// entriesReadValue returns the group's entries-read counter, nil when unknown.
+func entriesReadValue(g *StreamGroup) Value {
+	if g.entriesRead < 0 {
+		return Value{typ: ValueTypNull}
+	}
+	return Value{typ: ValueTypInteger, num: int(g.entriesRead)}
+}
+
+// groupLagValue returns the number of entries the group has yet to read, or nil
+// when it can't be determined because entries-read is unknown.
+func groupLagValue(stream *Stream, g *StreamGroup) Value {
+	if g.entriesRead < 0 {
+		return Value{typ: ValueTypNull}
+	}
+
+	lag := int64(stream.entriesAdded) - g.entriesRead
+	if lag < 0 {
+		lag = 0
+	}
+
+	return Value{typ: ValueTypInteger, num: int(lag)}
+}
+
+// bulkValue wraps a string in a bulk string value.
+func bulkValue(s string) Value {
+	return Value{typ: ValueTypBulkString, bulk: s}
+}
@@ -0,0 +1,247 @@
+/*
+This file contains server-assisted client side caching. A client that enables
+tracking is told when a key it may have cached changes. In the default mode the
+server remembers the keys each client read, and in broadcasting mode (BCAST) the
+client is told about every key matching one of its prefixes instead. Invalidation
+messages go to the client itself or to the client it redirects them to. A RESP3
+connection gets them as push messages, a RESP2 one over pub/sub, and only if it
+is subscribed to the __redis__:invalidate channel. Like published messages,
+they're queued rather than written by the client making the change. For a
+detailed description of client side caching, refer to the Redis documentation:
+
+https://redis.io/docs/latest/develop/reference/client-side-caching/
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// trackingChannel is the channel invalidation messages are published on.
+const trackingChannel = "__redis__:invalidate"
+
+// trackingKeys maps a key to the IDs of the clients that read it, and
+// trackingPrefixes maps a prefix to the IDs of the broadcasting clients
+// interested in it.
+var trackingKeys = map[string]map[int64]struct{}{}
+var trackingPrefixes = map[string]map[int64]struct{}{}
+var trackingMu = sync.Mutex{}
+
+// enableTracking turns tracking on for the client, replacing previous settings.
+// The settings are changed under trackingMu because other clients read them
+// when they invalidate keys.
+func (c *Client) enableTracking(redirect int64, bcast bool, prefixes []string) {
+	trackingMu.Lock()
+	defer trackingMu.Unlock()
+
+	c.resetTracking()
+	c.tracking = true
+	c.trackingRedirect = redirect
+	c.trackingBcast = bcast
+
+	if !bcast {
+		return
+	}
+
+	// Without a prefix every key is broadcast
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	for _, prefix := range prefixes {
+		if _, ok := trackingPrefixes[prefix]; !ok {
+			trackingPrefixes[prefix] = map[int64]struct{}{}
+		}
+		trackingPrefixes[prefix][c.id] = struct{}{}
+	}
+	c.trackingPrefixes = prefixes
+}
+
+// disableTracking turns tracking off for the client, and removes the keys it
+// read from the table.
+func (c *Client) disableTracking() {
+	trackingMu.Lock()
+	defer trackingMu.Unlock()
+
+	for key := range c.trackedKeys {
+		delete(trackingKeys[key], c.id)
+		if len(trackingKeys[key]) == 0 {
+			delete(trackingKeys, key)
+		}
+	}
+	c.trackedKeys = nil
+	c.resetTracking()
+}
+
+// resetTracking clears the tracking settings of the client. The caller must
+// hold trackingMu.
+func (c *Client) resetTracking() {
+	for _, prefix := range c.trackingPrefixes {
+		delete(trackingPrefixes[prefix], c.id)
+		if len(trackingPrefixes[prefix]) == 0 {
+			delete(trackingPrefixes, prefix)
+		}
+	}
+
+	c.tracking = false
+	c.trackingRedirect = 0
+	c.trackingBcast = false
+	c.trackingPrefixes = nil
+}
+
+// trackKeys remembers that the client reads keys, so it is told when they change.
+// It's called before the keys are read, with their shards locked, so a write
+// that follows the read always finds them tracked.
+func trackKeys(c *Client, keys []string) {
+	unlock := c.db.lockKeys(false, keys...)
+	defer unlock()
+
+	trackingMu.Lock()
+	defer trackingMu.Unlock()
+
+	if c.trackedKeys == nil {
+		c.trackedKeys = map[string]struct{}{}
+	}
+	for _, key := range keys {
+		if _, ok := trackingKeys[key]; !ok {
+			trackingKeys[key] = map[int64]struct{}{}
+		}
+		trackingKeys[key][c.id] = struct{}{}
+		c.trackedKeys[key] = struct{}{}
+	}
+}
+
+// trackingInvalidateKey tells every client tracking key that it changed. Clients
+// in the default mode are only told once, until they read the key again.
+func trackingInvalidateKey(key string) {
+	trackingMu.Lock()
+	ids := trackingKeys[key]
+	delete(trackingKeys, key)
+	for id := range ids {
+		if c := lookupClient(id); c != nil {
+			delete(c.trackedKeys, key)
+		}
+	}
+
+	for prefix, prefixIDs := range trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if ids == nil {
+			ids = map[int64]struct{}{}
+		}
+		for id := range prefixIDs {
+			ids[id] = struct{}{}
+		}
+	}
+
+	targets := []*Client{}
+	for id := range ids {
+		if target := invalidationTarget(id); target != nil {
+			targets = append(targets, target)
+		}
+	}
+	trackingMu.Unlock()
+
+	for _, target := range targets {
+		sendInvalidation(target, key)
+	}
+}
+
+// invalidationTarget returns the client that receives the invalidation messages
+// of the client with the given ID, or nil if there's none. The caller must hold
+// trackingMu.
+func invalidationTarget(id int64) *Client {
+	c := lookupClient(id)
+	if c == nil || !c.tracking {
+		return nil
+	}
+
+	if c.trackingRedirect != 0 {
+		return lookupClient(c.trackingRedirect)
+	}
+	return c
+}
+
+// sendInvalidation queues an invalidation message for key to target, which is
+// disconnected if it doesn't read them, like a pub/sub subscriber.
+func sendInvalidation(target *Client, key string) {
+	// RESP3 connections get the message pushed along with their replies
+	if target.writer.Protocol() == ProtocolResp3 {
+		target.push(Value{typ: ValueTypPush, array: []Value{
+			bulkValue("invalidate"),
+			{typ: ValueTypArray, array: []Value{bulkValue(key)}},
+		}}, "normal")
+		return
+	}
+
+	// Over RESP2 the message is only delivered to a client listening on the channel
+	pubsubMu.RLock()
+	_, subscribed := target.sub.channels[trackingChannel]
+	pubsubMu.RUnlock()
+	if !subscribed {
+		return
+	}
+
+	target.push(Value{typ: ValueTypArray, array: []Value{
+		bulkValue("message"),
+		bulkValue(trackingChannel),
+		{typ: ValueTypArray, array: []Value{bulkValue(key)}},
+	}}, "pubsub")
+}
+
+// clientTracking handles the CLIENT TRACKING subcommand.
+func clientTracking(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: ValueTypSimpleError, str: "ERR wrong number of arguments for 'client|tracking' command"}
+	}
+
+	var redirect int64
+	bcast := false
+	prefixes := []string{}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+			}
+			i++
+			id, err := strconv.ParseInt(args[i].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR value is not an integer or out of range"}
+			}
+			if id != c.id && lookupClient(id) == nil {
+				return Value{typ: ValueTypSimpleError, str: "ERR The client ID you want redirect to does not exist"}
+			}
+			redirect = id
+		case "BCAST":
+			bcast = true
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+			}
+			i++
+			prefixes = append(prefixes, args[i].bulk)
+		default:
+			return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+		}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "ON":
+		if len(prefixes) > 0 && !bcast {
+			return Value{typ: ValueTypSimpleError, str: "ERR PREFIX option requires BCAST mode to be enabled"}
+		}
+		c.enableTracking(redirect, bcast, prefixes)
+	case "OFF":
+		c.disableTracking()
+	default:
+		return Value{typ: ValueTypSimpleError, str: "ERR syntax error"}
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
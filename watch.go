@@ -0,0 +1,81 @@
+/*
+This file contains WATCH, which adds optimistic locking to transactions. A client
+watches keys before MULTI, and EXEC refuses to run the transaction if another
+client modified any of them in the meantime. Every write that changed a key goes
+through signalModifiedKey, which flags the transactions watching that key. For a
+detailed description of the command, refer to the Redis documentation:
+
+https://redis.io/docs/latest/commands/watch/
+*/
+
+package main
+
+// signalModifiedKey flags every transaction watching key so its EXEC fails,
+// and invalidates the key for the clients caching it.
+func signalModifiedKey(db *DB, key string) {
+	db.watchedKeysMu.Lock()
+	for tx := range db.watchedKeys[key] {
+		tx.casDirty.Store(true)
+	}
+	db.watchedKeysMu.Unlock()
+
+	trackingInvalidateKey(key)
+}
+
+// watchedKey is a key watched by a transaction.
+type watchedKey struct {
+	db  *DB
+	key string
+}
+
+// watch handles the WATCH command.
+func (tx *Transaction) watch(db *DB, keys []Value) Value {
+	if tx.active {
+		return Value{typ: ValueTypSimpleError, str: "ERR WATCH inside MULTI is not allowed"}
+	}
+
+	db.watchedKeysMu.Lock()
+	defer db.watchedKeysMu.Unlock()
+
+	for _, arg := range keys {
+		key := arg.bulk
+		if _, ok := db.watchedKeys[key][tx]; ok {
+			continue
+		}
+
+		if _, ok := db.watchedKeys[key]; !ok {
+			db.watchedKeys[key] = map[*Transaction]struct{}{}
+		}
+		db.watchedKeys[key][tx] = struct{}{}
+		tx.watched = append(tx.watched, watchedKey{db: db, key: key})
+	}
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// unwatch stops watching every key and forgets about past modifications.
+func (tx *Transaction) unwatch() Value {
+	for _, w := range tx.watched {
+		w.db.watchedKeysMu.Lock()
+		delete(w.db.watchedKeys[w.key], tx)
+		if len(w.db.watchedKeys[w.key]) == 0 {
+			delete(w.db.watchedKeys, w.key)
+		}
+		w.db.watchedKeysMu.Unlock()
+	}
+
+	tx.watched = nil
+	tx.casDirty.Store(false)
+
+	return Value{typ: ValueTypSimpleString, str: "OK"}
+}
+
+// watchCommand handles the WATCH command.
+func watchCommand(c *Client, args []Value) Value {
+	return c.tx.watch(c.db, args)
+}
+
+// unwatchCommand handles the UNWATCH command.
+func unwatchCommand(c *Client, args []Value) Value {
+	return c.tx.unwatch()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"unmodified", []step{
+			{0, []string{"SET", "a", "1"}, "+OK\r\n"},
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"GET", "a"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n$1\r\n1\r\n"},
+		}},
+		{"modified by another client", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{1, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "w"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*-1\r\n"},
+			{0, []string{"GET", "a"}, "$1\r\nx\r\n"},
+		}},
+		{"modified by the same client", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*-1\r\n"},
+		}},
+		{"unwatch", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{0, []string{"UNWATCH"}, "+OK\r\n"},
+			{1, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "a", "w"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+OK\r\n"},
+		}},
+		{"exec unwatches", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"EXEC"}, "*0\r\n"},
+			{1, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+PONG\r\n"},
+		}},
+		{"discard unwatches", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"DISCARD"}, "+OK\r\n"},
+			{1, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+PONG\r\n"},
+		}},
+		{"delete of a missing key", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{1, []string{"DEL", "a"}, ":0\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+PONG\r\n"},
+		}},
+		{"other database", []step{
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{1, []string{"SELECT", "1"}, "+OK\r\n"},
+			{1, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+PONG\r\n"},
+			{0, []string{"WATCH", "a"}, "+OK\r\n"},
+			{1, []string{"SELECT", "0"}, "+OK\r\n"},
+			{1, []string{"SET", "a", "x"}, "+OK\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*-1\r\n"},
+		}},
+		{"expired", []step{
+			{0, []string{"WATCH", "e"}, "+OK\r\n"},
+			{1, []string{"SET", "e", "1"}, "+OK\r\n"},
+			{1, []string{"PEXPIREAT", "e", "1"}, ":1\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*-1\r\n"},
+		}},
+		{"several keys", []step{
+			{0, []string{"WATCH", "a", "b"}, "+OK\r\n"},
+			{1, []string{"RPUSH", "b", "x"}, ":1\r\n"},
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*-1\r\n"},
+		}},
+		{"inside multi", []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"WATCH", "a"}, "-ERR WATCH inside MULTI is not allowed\r\n"},
+			{0, []string{"PING"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, "*1\r\n+PONG\r\n"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runAll(t, tt.steps, newTestClient(t), connectTestClient(t))
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+This file contains the sorted set data type. A sorted set holds unique members,
+each with a floating point score, and keeps them ordered by score and then by
+member. Members are indexed in a map for score lookups and kept in a slice sorted
+by (score, member) for ordered access, which keeps the implementation simple at the
+cost of linear time inserts. For a detailed description of sorted sets, refer to
+the Redis documentation:
+
+https://redis.io/docs/latest/develop/data-types/sorted-sets/
+*/
+
+package main
+
+import (
+	"sort"
+)
+
+// ZSetMember is a member of a sorted set along with its score.
+type ZSetMember struct {
+	member string
+	score  float64
+}
+
+// SortedSet holds the members of a sorted set.
+type SortedSet struct {
+	dict   map[string]float64
+	sorted []ZSetMember
+}
+
+// newSortedSet creates an empty sorted set.
+func newSortedSet() *SortedSet {
+	return &SortedSet{dict: map[string]float64{}}
+}
+
+// less reports whether a sorts before b.
+func (a ZSetMember) less(b ZSetMember) bool {
+	return a.score < b.score || (a.score == b.score && a.member < b.member)
+}
+
+// Len returns the number of members.
+func (z *SortedSet) Len() int {
+	return len(z.sorted)
+}
+
+// Score returns the score of member.
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Add inserts member or updates its score, reporting whether it was newly added.
+func (z *SortedSet) Add(member string, score float64) bool {
+	old, exists := z.dict[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.removeSorted(ZSetMember{member: member, score: old})
+	}
+
+	z.dict[member] = score
+
+	m := ZSetMember{member: member, score: score}
+	i := sort.Search(len(z.sorted), func(i int) bool { return !z.sorted[i].less(m) })
+	z.sorted = append(z.sorted, ZSetMember{})
+	copy(z.sorted[i+1:], z.sorted[i:])
+	z.sorted[i] = m
+
+	return !exists
+}
+
+// Remove deletes member, reporting whether it was present.
+func (z *SortedSet) Remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+
+	delete(z.dict, member)
+	z.removeSorted(ZSetMember{member: member, score: score})
+
+	return true
+}
+
+// removeSorted removes m from the ordered slice.
+func (z *SortedSet) removeSorted(m ZSetMember) {
+	i := sort.Search(len(z.sorted), func(i int) bool { return !z.sorted[i].less(m) })
+	if i < len(z.sorted) && z.sorted[i] == m {
+		z.sorted = append(z.sorted[:i], z.sorted[i+1:]...)
+	}
+}
+
+// Members returns the members in ascending order. The slice must not be modified.
+func (z *SortedSet) Members() []ZSetMember {
+	return z.sorted
+}